@@ -0,0 +1,116 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/tls"
+    "encoding/hex"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "strings"
+)
+
+// acmeLabel marks targets renewed through ACME. The value is the challenge type, http-01 or dns-01,
+// true means http-01.
+const acmeLabel = "acme"
+
+// acmeClient requests the HTTP-01 challenge paths. Every check goes to another host, so connections aren't kept.
+var acmeClient = &http.Client{
+    Transport: &http.Transport{
+        TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+        DisableKeepAlives: true,
+    },
+}
+
+// acmeChallenge returns the challenge type of a target, empty if it isn't an ACME target
+func acmeChallenge(t target) string {
+    switch t.Labels[acmeLabel] {
+    case "true", "http-01":
+        return "http-01"
+    case "dns-01":
+        return "dns-01"
+    }
+    return ""
+}
+
+// checkACME runs the readiness check of the target's challenge type and exports whether its challenge
+// infrastructure works, so broken renewals show up weeks before the certificate expires
+func (m *certMetrics) checkACME(t target) {
+    challenge := acmeChallenge(t)
+    if challenge == "" {
+        return
+    }
+    host, _, err := net.SplitHostPort(t.Domain)
+    if err != nil {
+        host = t.Domain
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+    defer cancel()
+    if challenge == "dns-01" {
+        err = checkDNS01(ctx, host)
+    } else {
+        err = checkHTTP01(ctx, host)
+    }
+
+    ready := 1.0
+    if err != nil {
+        ready = 0
+        log.Printf("ACME %s renewal of domain %s is likely to fail: %v", challenge, t.Domain, err)
+    }
+    m.acmeRenewalReady.forget(t.Domain)
+    m.acmeRenewalReady.set(t.Domain, ready, challenge)
+}
+
+// checkHTTP01 requests a random token below /.well-known/acme-challenge/ over plain HTTP like the CA does.
+// Any response but a server error counts, a 404 just means there is no pending challenge. Redirects are
+// followed and HTTPS certificates aren't verified, as by Let's Encrypt.
+func checkHTTP01(ctx context.Context, host string) error {
+    token := make([]byte, 16)
+    rand.Read(token)
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+net.JoinHostPort(host, "80")+"/.well-known/acme-challenge/"+hex.EncodeToString(token), nil)
+    if err != nil {
+        return err
+    }
+    resp, err := acmeClient.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 500 {
+        return fmt.Errorf("challenge path returned %s", resp.Status)
+    }
+    return nil
+}
+
+// checkDNS01 checks that the zone the TXT record has to be created in is served. If _acme-challenge is
+// delegated with a CNAME, the zone of the CNAME target must be served instead.
+func checkDNS01(ctx context.Context, host string) error {
+    name := "_acme-challenge." + strings.TrimPrefix(host, "*.")
+    if cname, err := net.DefaultResolver.LookupCNAME(ctx, name); err == nil && strings.TrimSuffix(cname, ".") != name {
+        if err := lookupZoneNS(ctx, cname); err != nil {
+            return fmt.Errorf("challenge delegated to %s: %v", cname, err)
+        }
+        return nil
+    }
+    return lookupZoneNS(ctx, strings.TrimPrefix(host, "*."))
+}
+
+// lookupZoneNS looks up the name servers of the zone name belongs to, walking up the labels
+func lookupZoneNS(ctx context.Context, name string) error {
+    name = strings.TrimSuffix(name, ".")
+    var err error
+    for labels := strings.Split(name, "."); len(labels) >= 2; labels = labels[1:] {
+        var ns []*net.NS
+        ns, err = net.DefaultResolver.LookupNS(ctx, strings.Join(labels, "."))
+        if err == nil && len(ns) > 0 {
+            return nil
+        }
+    }
+    if err == nil {
+        err = fmt.Errorf("no name servers found for %s", name)
+    }
+    return err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// Alert states of a domain, ordered by severity
+const (
+    stateOK       = "ok"
+    stateWarning  = "warning"
+    stateCritical = "critical"
+)
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// alerter evaluates expiry thresholds and fires a webhook whenever a domain changes its alert state
+type alerter struct {
+    url        string
+    format     string
+    routingKey string
+    warn       time.Duration
+    critical   time.Duration
+    client     *http.Client
+
+    mu     sync.Mutex
+    states map[string]string
+}
+
+// newAlerter validates the webhook format and returns an alerter
+func newAlerter(url, format, routingKey string, warnDays, criticalDays int) (*alerter, error) {
+    switch format {
+    case "generic", "slack":
+        if url == "" {
+            return nil, fmt.Errorf("webhook format %s requires a webhook url", format)
+        }
+    case "pagerduty":
+        if routingKey == "" {
+            return nil, fmt.Errorf("webhook format pagerduty requires a routing key")
+        }
+        if url == "" {
+            url = pagerDutyEventsURL
+        }
+    default:
+        return nil, fmt.Errorf("unknown webhook format %q", format)
+    }
+    if criticalDays > warnDays {
+        return nil, fmt.Errorf("critical threshold (%d days) must not exceed warning threshold (%d days)", criticalDays, warnDays)
+    }
+    return &alerter{
+        url:        url,
+        format:     format,
+        routingKey: routingKey,
+        warn:       time.Duration(warnDays) * 24 * time.Hour,
+        critical:   time.Duration(criticalDays) * 24 * time.Hour,
+        client:     &http.Client{Timeout: 10 * time.Second},
+        states:     make(map[string]string),
+    }, nil
+}
+
+// alertEvent is the payload of the generic webhook format
+type alertEvent struct {
+    Domain        string    `json:"domain"`
+    State         string    `json:"state"`
+    PreviousState string    `json:"previous_state"`
+    Expiry        time.Time `json:"expiry"`
+    DaysLeft      int       `json:"days_left"`
+}
+
+// evaluate computes the alert state for a domain and notifies on changes.
+// The first evaluation of a domain only notifies if it is not ok, so restarts don't resend recoveries.
+func (a *alerter) evaluate(domain string, expiry time.Time) {
+    left := expiry.Sub(certClock.Now())
+    state := stateOK
+    if left <= a.critical {
+        state = stateCritical
+    } else if left <= a.warn {
+        state = stateWarning
+    }
+
+    a.mu.Lock()
+    previous, seen := a.states[domain]
+    a.states[domain] = state
+    a.mu.Unlock()
+
+    if state == previous || (!seen && state == stateOK) {
+        return
+    }
+    if !seen {
+        previous = stateOK
+    }
+
+    event := alertEvent{
+        Domain:        domain,
+        State:         state,
+        PreviousState: previous,
+        Expiry:        expiry,
+        DaysLeft:      int(left.Hours() / 24),
+    }
+    if err := a.send(event); err != nil {
+        log.Printf("Error sending %s webhook for domain %s: %v", a.format, domain, err)
+        return
+    }
+    log.Printf("Sent %s webhook for domain %s: %s -> %s", a.format, domain, previous, state)
+}
+
+// send encodes the event in the configured format and posts it to the webhook
+func (a *alerter) send(event alertEvent) error {
+    var payload interface{}
+    switch a.format {
+    case "slack":
+        payload = map[string]string{"text": summary(event)}
+    case "pagerduty":
+        action := "trigger"
+        if event.State == stateOK {
+            action = "resolve"
+        }
+        severity := event.State
+        if severity == stateOK {
+            severity = "info"
+        }
+        payload = map[string]interface{}{
+            "routing_key":  a.routingKey,
+            "event_action": action,
+            "dedup_key":    "ssl-exporter-" + event.Domain,
+            "payload": map[string]interface{}{
+                "summary":        summary(event),
+                "source":         event.Domain,
+                "severity":       severity,
+                "custom_details": event,
+            },
+        }
+    default:
+        payload = event
+    }
+
+    body, err := json.Marshal(payload)
+    if err != nil {
+        return err
+    }
+    resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("unexpected status %s", resp.Status)
+    }
+    return nil
+}
+
+// summary returns a human readable one line description of an event
+func summary(event alertEvent) string {
+    if event.State == stateOK {
+        return fmt.Sprintf("SSL certificate for %s recovered, expires %s", event.Domain, event.Expiry.Format(time.RFC1123))
+    }
+    return fmt.Sprintf("SSL certificate for %s is %s: expires in %d days (%s)", event.Domain, event.State, event.DaysLeft, event.Expiry.Format(time.RFC1123))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+    "crypto/x509"
+    "encoding/asn1"
+    "encoding/hex"
+    "log"
+    "sync"
+)
+
+// Anomalies of served certificates that warrant a security review
+const (
+    // anomalyDuplicateSerial is a certificate sharing issuer and serial number with a different certificate,
+    // which a correctly operating CA never issues
+    anomalyDuplicateSerial = "duplicate_serial"
+    // anomalyPrecertificate is a precertificate served as certificate. Its poison extension makes it unusable
+    // for TLS, so it was leaked from a CT submission or a broken issuance pipeline.
+    anomalyPrecertificate = "precertificate_poison"
+)
+
+// oidCTPoison is the critical extension RFC 6962 marks precertificates with
+var oidCTPoison = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+
+// serialIndex remembers the fingerprints of the certificates seen per issuer and serial number since the
+// exporter started, across all targets
+type serialIndex struct {
+    mu    sync.Mutex
+    certs map[string]map[string]bool
+}
+
+// issuedSerials holds the certificates of every probed chain
+var issuedSerials = &serialIndex{certs: make(map[string]map[string]bool)}
+
+// observe records a certificate and reports whether a different one with the same issuer and serial
+// number was seen. A rekeyed CA may keep its name, so the issuer is identified by its key ID as well.
+func (s *serialIndex) observe(cert *x509.Certificate) bool {
+    key := string(cert.RawIssuer) + "\x00" + hex.EncodeToString(cert.AuthorityKeyId) + "\x00" + cert.SerialNumber.String()
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    fingerprints, ok := s.certs[key]
+    if !ok {
+        fingerprints = make(map[string]bool)
+        s.certs[key] = fingerprints
+    }
+    fingerprints[fingerprint(cert)] = true
+    return len(fingerprints) > 1
+}
+
+// chainAnomalies returns the anomalies found in a served chain. The target serving the first of two certificates
+// with the same serial number is flagged from its next probe on.
+func chainAnomalies(chain []*x509.Certificate) map[string]bool {
+    anomalies := map[string]bool{anomalyDuplicateSerial: false, anomalyPrecertificate: false}
+    for _, cert := range chain {
+        if issuedSerials.observe(cert) {
+            anomalies[anomalyDuplicateSerial] = true
+        }
+    }
+    for _, ext := range chain[0].Extensions {
+        if ext.Id.Equal(oidCTPoison) {
+            anomalies[anomalyPrecertificate] = true
+        }
+    }
+    return anomalies
+}
+
+// recordAnomalies exports the anomalies of the chain served by domain
+func (m *certMetrics) recordAnomalies(domain string, chain []*x509.Certificate) {
+    for anomaly, found := range chainAnomalies(chain) {
+        value := 0.0
+        if found {
+            value = 1
+            log.Printf("Domain %s serves a certificate chain with anomaly %s", domain, anomaly)
+        }
+        m.certAnomaly.set(domain, value, anomaly)
+    }
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/hex"
+    "strconv"
+    "time"
+)
+
+// Trust stores reported by attestations besides trustStoreSystem and trustStoreMozilla
+const (
+    trustStoreCAFile = "ca_file"
+    trustStoreSpiffe = "spiffe"
+)
+
+// trustSource names the trust anchors a chain was verified against and the version of their bundle,
+// so a verification result can be reproduced with the same roots
+type trustSource struct {
+    Store string `json:"trust_store"`
+    // Version is the date of the Mozilla data or a hash of the bundle, empty for the system roots
+    Version string `json:"bundle_version,omitempty"`
+    // Source is where the bundle was loaded from: embedded or a URL for mozilla, the path of a ca_file
+    Source string `json:"bundle_source,omitempty"`
+}
+
+// trustSource returns the trust anchors rootPool returns chains are verified against
+func (m *module) trustSource() trustSource {
+    switch {
+    case m.TLSConfig.TrustStore == trustStoreMozilla:
+        return mozilla.trustSource()
+    case m.TLSConfig.Spiffe.expectedServerID() != "":
+        return trustSource{Store: trustStoreSpiffe}
+    case m.TLSConfig.CAFile != "":
+        return trustSource{Store: trustStoreCAFile, Version: m.rootsVersion, Source: m.TLSConfig.CAFile}
+    }
+    return trustSource{Store: trustStoreSystem}
+}
+
+// trustSource returns the version of the bundle in use
+func (b *trustBundle) trustSource() trustSource {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    return trustSource{Store: b.name, Version: b.version, Source: b.source}
+}
+
+// certsVersion identifies a set of certificates by a hash, shortened like the versions of headerless bundles
+func certsVersion(certs []*x509.Certificate) string {
+    h := sha256.New()
+    for _, cert := range certs {
+        h.Write(cert.Raw)
+    }
+    return hex.EncodeToString(h.Sum(nil)[:6])
+}
+
+// attestation records how the chain of a target was verified: the trust anchors and their version, the
+// checked identity and the time of verification, which differs from the probe time with -simulate-now
+type attestation struct {
+    trustSource
+    ServerName string      `json:"server_name,omitempty"`
+    SPIFFEID   string      `json:"spiffe_id,omitempty"`
+    SkipVerify bool        `json:"skip_verify"`
+    VerifiedAt time.Time   `json:"verified_at"`
+    Verified   bool        `json:"verified"`
+    Error      string      `json:"error,omitempty"`
+    Anchors    []anchorRef `json:"anchors"` // root of every verified chain, in chain_no order
+}
+
+// anchorRef identifies the root a verified chain ends in
+type anchorRef struct {
+    ChainNo int    `json:"chain_no"`
+    Subject string `json:"subject"`
+    SHA256  string `json:"sha256"`
+}
+
+// newAttestation describes the verification of res that yielded chains or err at now
+func newAttestation(res *probeResult, chains [][]*x509.Certificate, err error, now time.Time) *attestation {
+    a := &attestation{
+        trustSource: res.trust,
+        ServerName:  res.serverName,
+        SPIFFEID:    res.spiffeID,
+        SkipVerify:  res.skipVerify,
+        VerifiedAt:  now.UTC(),
+        Verified:    err == nil && !res.skipVerify,
+        Anchors:     []anchorRef{},
+    }
+    // Results without a module, like those of keystores, are verified against the system roots
+    if a.Store == "" && res.roots == nil {
+        a.Store = trustStoreSystem
+    }
+    if err != nil {
+        a.Error = err.Error()
+    }
+    for i, c := range chains {
+        root := c[len(c)-1]
+        a.Anchors = append(a.Anchors, anchorRef{ChainNo: i, Subject: root.Subject.String(), SHA256: fingerprint(root)})
+    }
+    return a
+}
+
+// recordAttestation exports how the chain of a domain was verified
+func (m *certMetrics) recordAttestation(domain string, a *attestation) {
+    m.verificationInfo.forget(domain)
+    m.verificationInfo.set(domain, 1, a.Store, a.Version, a.ServerName, strconv.FormatBool(a.SkipVerify))
+    m.chainAnchor.forget(domain)
+    for _, anchor := range a.Anchors {
+        m.chainAnchor.set(domain, 1, strconv.Itoa(anchor.ChainNo), anchor.SHA256)
+    }
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// availabilityWindow is the window of ssl_probe_success_ratio_1h
+const availabilityWindow = time.Hour
+
+// probeOutcome is the result of one probe
+type probeOutcome struct {
+    time    time.Time
+    success bool
+}
+
+// availability exports the fraction of the last hour each target was up. A probe result counts until
+// the next probe, so the ratio stays meaningful when targets are probed less often than the window.
+type availability struct {
+    desc *prometheus.Desc
+
+    mu       sync.Mutex
+    outcomes map[string][]probeOutcome // oldest first, starting with the last one before the window
+}
+
+// newAvailability returns an empty collector
+func newAvailability() *availability {
+    return &availability{
+        desc: prometheus.NewDesc(
+            "ssl_probe_success_ratio_1h",
+            "Fraction of the last hour the probes of a target succeeded, each result counting until the next probe",
+            []string{"domain"}, nil,
+        ),
+        outcomes: make(map[string][]probeOutcome),
+    }
+}
+
+// record adds the result of a probe of domain
+func (a *availability) record(domain string, success bool, now time.Time) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    outcomes := append(a.outcomes[domain], probeOutcome{time: now, success: success})
+    a.outcomes[domain] = prune(outcomes, now.Add(-availabilityWindow))
+}
+
+// remove drops the results of a domain that is no longer a target
+func (a *availability) remove(domain string) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    delete(a.outcomes, domain)
+}
+
+// prune drops the outcomes that no longer affect the window starting at start
+func prune(outcomes []probeOutcome, start time.Time) []probeOutcome {
+    first := 0
+    for first+1 < len(outcomes) && !outcomes[first+1].time.After(start) {
+        first++
+    }
+    return append(outcomes[:0:0], outcomes[first:]...)
+}
+
+// ratio returns the fraction of the window between start and now covered by successful results.
+// Time before the first result doesn't count.
+func ratio(outcomes []probeOutcome, start, now time.Time) (float64, bool) {
+    var up, total time.Duration
+    for i, o := range outcomes {
+        from := o.time
+        if from.Before(start) {
+            from = start
+        }
+        to := now
+        if i+1 < len(outcomes) {
+            to = outcomes[i+1].time
+        }
+        if !to.After(from) {
+            continue
+        }
+        total += to.Sub(from)
+        if o.success {
+            up += to.Sub(from)
+        }
+    }
+    if total == 0 {
+        return 0, false
+    }
+    return float64(up) / float64(total), true
+}
+
+func (a *availability) Describe(ch chan<- *prometheus.Desc) {
+    ch <- a.desc
+}
+
+func (a *availability) Collect(ch chan<- prometheus.Metric) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    now := time.Now()
+    for domain, outcomes := range a.outcomes {
+        r, ok := ratio(outcomes, now.Add(-availabilityWindow), now)
+        if !ok {
+            continue
+        }
+        ch <- prometheus.MustNewConstMetric(a.desc, prometheus.GaugeValue, r, domain)
+    }
+}
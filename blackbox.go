@@ -0,0 +1,186 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+// blackboxConfig is the part of a blackbox_exporter configuration the importer understands
+type blackboxConfig struct {
+    Modules map[string]blackboxModule `yaml:"modules"`
+}
+
+type blackboxModule struct {
+    Prober  string        `yaml:"prober"`
+    Timeout time.Duration `yaml:"timeout"`
+    HTTP    struct {
+        TLSConfig blackboxTLSConfig `yaml:"tls_config"`
+    } `yaml:"http"`
+    TCP struct {
+        TLS           bool                    `yaml:"tls"`
+        TLSConfig     blackboxTLSConfig       `yaml:"tls_config"`
+        QueryResponse []blackboxQueryResponse `yaml:"query_response"`
+    } `yaml:"tcp"`
+}
+
+type blackboxTLSConfig struct {
+    InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+    CAFile             string `yaml:"ca_file"`
+    MinVersion         string `yaml:"min_version"`
+    MaxVersion         string `yaml:"max_version"`
+    ServerName         string `yaml:"server_name"`
+    CertFile           string `yaml:"cert_file"`
+    KeyFile            string `yaml:"key_file"`
+}
+
+type blackboxQueryResponse struct {
+    Send     string `yaml:"send"`
+    StartTLS bool   `yaml:"starttls"`
+}
+
+// importBlackbox implements the import-blackbox subcommand, converting the TLS capable modules of a
+// blackbox_exporter configuration into modules of the probe configuration, written to stdout.
+// Settings without an equivalent are reported on stderr.
+func importBlackbox(args []string) int {
+    fs := flag.NewFlagSet("import-blackbox", flag.ExitOnError)
+    configPath := fs.String("config", "blackbox.yml", "Path to the blackbox_exporter configuration.")
+    fs.Parse(args)
+
+    data, err := os.ReadFile(*configPath)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to read blackbox config: %v\n", err)
+        return 1
+    }
+    var bb blackboxConfig
+    if err := yaml.Unmarshal(data, &bb); err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to parse blackbox config: %v\n", err)
+        return 1
+    }
+
+    names := make([]string, 0, len(bb.Modules))
+    for name := range bb.Modules {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    modules := make(map[string]map[string]interface{})
+    for _, name := range names {
+        converted, warnings := convertBlackboxModule(bb.Modules[name])
+        for _, w := range warnings {
+            fmt.Fprintf(os.Stderr, "module %s: %s\n", name, w)
+        }
+        if converted == nil {
+            continue
+        }
+        if err := checkConvertedModule(converted); err != nil {
+            fmt.Fprintf(os.Stderr, "module %s: skipped, %v\n", name, err)
+            continue
+        }
+        modules[name] = converted
+    }
+
+    enc := yaml.NewEncoder(os.Stdout)
+    enc.SetIndent(2)
+    if err := enc.Encode(map[string]interface{}{"modules": modules}); err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to write modules: %v\n", err)
+        return 1
+    }
+    return 0
+}
+
+// convertBlackboxModule returns the settings of the equivalent module, nil if there is none, and the
+// settings that were dropped
+func convertBlackboxModule(bm blackboxModule) (map[string]interface{}, []string) {
+    var (
+        converted = make(map[string]interface{})
+        warnings  []string
+        tlsCfg    blackboxTLSConfig
+    )
+    switch bm.Prober {
+    case "http":
+        converted["prober"] = proberHTTPS
+        tlsCfg = bm.HTTP.TLSConfig
+        warnings = append(warnings, "request options and response checks are dropped, the https prober only fetches the certificate")
+    case "tcp":
+        tlsCfg = bm.TCP.TLSConfig
+        startTLS := -1
+        for i, qr := range bm.TCP.QueryResponse {
+            if qr.StartTLS {
+                startTLS = i
+                break
+            }
+        }
+        switch {
+        case startTLS >= 0 && isSMTPStartTLS(bm.TCP.QueryResponse[:startTLS]):
+            converted["prober"] = proberSMTPStartTLS
+        case startTLS >= 0:
+            return nil, []string{"skipped, STARTTLS is only supported for SMTP"}
+        case bm.TCP.TLS:
+            converted["prober"] = proberTCP
+        default:
+            return nil, []string{"skipped, the module doesn't use TLS"}
+        }
+    default:
+        return nil, []string{fmt.Sprintf("skipped, the %s prober doesn't use TLS", bm.Prober)}
+    }
+    if bm.Timeout > 0 {
+        converted["timeout"] = bm.Timeout.String()
+    }
+
+    tls := make(map[string]interface{})
+    if tlsCfg.InsecureSkipVerify {
+        tls["insecure_skip_verify"] = true
+    }
+    if tlsCfg.CAFile != "" {
+        tls["ca_file"] = tlsCfg.CAFile
+    }
+    if tlsCfg.MinVersion != "" {
+        tls["min_version"] = tlsCfg.MinVersion
+    }
+    if tlsCfg.MaxVersion != "" {
+        tls["max_version"] = tlsCfg.MaxVersion
+    }
+    if tlsCfg.CertFile != "" {
+        tls["cert_file"] = tlsCfg.CertFile
+    }
+    if tlsCfg.KeyFile != "" {
+        tls["key_file"] = tlsCfg.KeyFile
+    }
+    if len(tls) > 0 {
+        converted["tls_config"] = tls
+    }
+    if tlsCfg.ServerName != "" {
+        warnings = append(warnings, "tls_config.server_name is dropped, the SNI is the host of the target")
+    }
+    return converted, warnings
+}
+
+// isSMTPStartTLS reports whether the exchange before STARTTLS is the one of SMTP
+func isSMTPStartTLS(exchange []blackboxQueryResponse) bool {
+    for _, qr := range exchange {
+        if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(qr.Send)), "STARTTLS") {
+            return true
+        }
+    }
+    return false
+}
+
+// checkConvertedModule validates converted settings like the probe configuration would. The CA and client
+// certificate files aren't read, they may only exist where the exporter runs.
+func checkConvertedModule(converted map[string]interface{}) error {
+    data, err := yaml.Marshal(converted)
+    if err != nil {
+        return err
+    }
+    var m module
+    if err := yaml.Unmarshal(data, &m); err != nil {
+        return err
+    }
+    m.TLSConfig.CAFile, m.TLSConfig.CertFile, m.TLSConfig.KeyFile = "", "", ""
+    return m.validate()
+}
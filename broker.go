@@ -0,0 +1,242 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "crypto/tls"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "time"
+)
+
+// AMQP 0-9-1 framing and connection class methods, see the protocol specification
+const (
+    amqpProtocolHeader = "AMQP\x00\x00\x09\x01"
+    amqpFrameMethod    = 1
+    amqpFrameEnd       = 0xce
+    amqpMaxFrame       = 1 << 20
+    amqpConnection     = 10
+    amqpStart          = 10
+    amqpStartOk        = 11
+    amqpTune           = 30
+    amqpTuneOk         = 31
+    amqpOpen           = 40
+    amqpOpenOk         = 41
+    amqpClose          = 50
+    amqpCloseOk        = 51
+    amqpReplySuccess   = 200
+    amqpMechanism      = "PLAIN"
+    amqpLocale         = "en_US"
+    amqpDefaultVHost   = "/"
+)
+
+// MQTT 3.1.1 control packets and connect flags
+const (
+    mqttConnect          = 0x10
+    mqttConnAck          = 0x20
+    mqttDisconnect       = 0xe0
+    mqttProtocolLevel    = 4
+    mqttCleanSession     = 0x02
+    mqttPasswordFlag     = 0x40
+    mqttUsernameFlag     = 0x80
+    mqttKeepAliveSeconds = 60
+)
+
+// getAMQPConnState runs the TLS handshake with an AMQP 0-9-1 broker like RabbitMQ and returns its state. With open
+// and credentials the client opens the connection to the default virtual host and closes it again, so the broker
+// doesn't log a client that went away during the handshake.
+func getAMQPConnState(ctx context.Context, conn net.Conn, tlsCfg *tls.Config, open bool, username, password string) (tls.ConnectionState, time.Duration, error) {
+    tlsConn, took, err := handshake(ctx, conn, tlsCfg)
+    if err != nil {
+        return tls.ConnectionState{}, took, err
+    }
+    state := tlsConn.ConnectionState()
+    // Without credentials the broker would log a failed login on every probe, worse than an aborted connection
+    if !open || username == "" {
+        return state, took, nil
+    }
+    if err := amqpOpenClose(tlsConn, username, password); err != nil {
+        log.Printf("Error opening AMQP connection to %s: %v", conn.RemoteAddr(), err)
+    }
+    return state, took, nil
+}
+
+// amqpOpenClose negotiates, opens and closes an AMQP connection
+func amqpOpenClose(conn io.ReadWriter, username, password string) error {
+    r := bufio.NewReader(conn)
+    if _, err := conn.Write([]byte(amqpProtocolHeader)); err != nil {
+        return err
+    }
+    if _, err := amqpExpect(conn, r, amqpStart); err != nil {
+        return err
+    }
+    var startOk []byte
+    startOk = binary.BigEndian.AppendUint32(startOk, 0) // no client properties
+    startOk = appendShortString(startOk, amqpMechanism)
+    startOk = appendLongString(startOk, "\x00"+username+"\x00"+password)
+    startOk = appendShortString(startOk, amqpLocale)
+    if err := amqpSend(conn, amqpStartOk, startOk); err != nil {
+        return err
+    }
+    tune, err := amqpExpect(conn, r, amqpTune)
+    if err != nil {
+        return err
+    }
+    if len(tune) < 8 {
+        return errors.New("malformed connection.tune")
+    }
+    // Accept the broker's channel and frame limits, without heartbeats
+    tuneOk := append(append([]byte(nil), tune[:6]...), 0, 0)
+    if err := amqpSend(conn, amqpTuneOk, tuneOk); err != nil {
+        return err
+    }
+    openArgs := appendShortString(nil, amqpDefaultVHost)
+    openArgs = appendShortString(openArgs, "")
+    openArgs = append(openArgs, 0)
+    if err := amqpSend(conn, amqpOpen, openArgs); err != nil {
+        return err
+    }
+    if _, err := amqpExpect(conn, r, amqpOpenOk); err != nil {
+        return err
+    }
+    closeArgs := binary.BigEndian.AppendUint16(nil, amqpReplySuccess)
+    closeArgs = appendShortString(closeArgs, "")
+    closeArgs = append(closeArgs, 0, 0, 0, 0)
+    if err := amqpSend(conn, amqpClose, closeArgs); err != nil {
+        return err
+    }
+    _, err = amqpExpect(conn, r, amqpCloseOk)
+    return err
+}
+
+// amqpSend sends a method of the connection class on channel 0
+func amqpSend(conn io.Writer, method uint16, args []byte) error {
+    payload := binary.BigEndian.AppendUint16(nil, amqpConnection)
+    payload = binary.BigEndian.AppendUint16(payload, method)
+    payload = append(payload, args...)
+    frame := []byte{amqpFrameMethod, 0, 0}
+    frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+    frame = append(frame, payload...)
+    frame = append(frame, amqpFrameEnd)
+    _, err := conn.Write(frame)
+    return err
+}
+
+// amqpExpect reads the next method frame and returns its arguments if it is the expected connection method.
+// A connection.close of the broker, e.g. for refused credentials, is acknowledged and returned as error.
+func amqpExpect(conn io.Writer, r *bufio.Reader, method uint16) ([]byte, error) {
+    header := make([]byte, 7)
+    if _, err := io.ReadFull(r, header); err != nil {
+        return nil, err
+    }
+    size := binary.BigEndian.Uint32(header[3:])
+    if size < 4 || size > amqpMaxFrame {
+        return nil, fmt.Errorf("invalid frame size %d", size)
+    }
+    payload := make([]byte, size+1)
+    if _, err := io.ReadFull(r, payload); err != nil {
+        return nil, err
+    }
+    if header[0] != amqpFrameMethod || payload[size] != amqpFrameEnd {
+        return nil, errors.New("malformed frame")
+    }
+    class, got := binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:])
+    args := payload[4:size]
+    if class == amqpConnection && got == amqpClose && method != amqpClose {
+        amqpSend(conn, amqpCloseOk, nil)
+        text := ""
+        if len(args) > 2 && len(args) >= 3+int(args[2]) {
+            text = string(args[3 : 3+int(args[2])])
+        }
+        return nil, fmt.Errorf("broker closed the connection: %s", text)
+    }
+    if class != amqpConnection || got != method {
+        return nil, fmt.Errorf("unexpected method %d.%d", class, got)
+    }
+    return args, nil
+}
+
+func appendShortString(b []byte, s string) []byte {
+    return append(append(b, byte(len(s))), s...)
+}
+
+func appendLongString(b []byte, s string) []byte {
+    return append(binary.BigEndian.AppendUint32(b, uint32(len(s))), s...)
+}
+
+// getMQTTConnState runs the TLS handshake with an MQTT broker and returns its state. With connect the client
+// connects with a clean session and disconnects right away, so the broker doesn't log a failed connection.
+func getMQTTConnState(ctx context.Context, conn net.Conn, tlsCfg *tls.Config, connect bool, username, password string) (tls.ConnectionState, time.Duration, error) {
+    tlsConn, took, err := handshake(ctx, conn, tlsCfg)
+    if err != nil {
+        return tls.ConnectionState{}, took, err
+    }
+    state := tlsConn.ConnectionState()
+    if !connect {
+        return state, took, nil
+    }
+    if err := mqttConnectDisconnect(tlsConn, username, password); err != nil {
+        log.Printf("Error connecting to MQTT broker %s: %v", conn.RemoteAddr(), err)
+    }
+    return state, took, nil
+}
+
+// mqttConnectDisconnect sends CONNECT, waits for CONNACK and sends DISCONNECT
+func mqttConnectDisconnect(conn io.ReadWriter, username, password string) error {
+    flags := byte(mqttCleanSession)
+    body := appendMQTTString(nil, "MQTT")
+    body = append(body, mqttProtocolLevel, 0)
+    body = binary.BigEndian.AppendUint16(body, mqttKeepAliveSeconds)
+    // An empty client ID makes the broker assign one
+    body = appendMQTTString(body, "")
+    if username != "" {
+        flags |= mqttUsernameFlag
+        body = appendMQTTString(body, username)
+    }
+    if password != "" {
+        flags |= mqttPasswordFlag
+        body = appendMQTTString(body, password)
+    }
+    body[7] = flags
+
+    packet := append([]byte{mqttConnect}, mqttRemainingLength(len(body))...)
+    if _, err := conn.Write(append(packet, body...)); err != nil {
+        return err
+    }
+    connAck := make([]byte, 4)
+    if _, err := io.ReadFull(conn, connAck); err != nil {
+        return err
+    }
+    if connAck[0] != mqttConnAck {
+        return fmt.Errorf("unexpected packet type %d", connAck[0]>>4)
+    }
+    if connAck[3] != 0 {
+        return fmt.Errorf("connection refused with return code %d", connAck[3])
+    }
+    _, err := conn.Write([]byte{mqttDisconnect, 0})
+    return err
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+    return append(binary.BigEndian.AppendUint16(b, uint16(len(s))), s...)
+}
+
+// mqttRemainingLength encodes the length of a packet's remainder as variable byte integer
+func mqttRemainingLength(n int) []byte {
+    var b []byte
+    for {
+        digit := byte(n % 128)
+        n /= 128
+        if n > 0 {
+            digit |= 0x80
+        }
+        b = append(b, digit)
+        if n == 0 {
+            return b
+        }
+    }
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "io"
+    "net"
+    "strings"
+    "testing"
+)
+
+func TestMQTTRemainingLength(t *testing.T) {
+    for _, tc := range []struct {
+        n    int
+        want []byte
+    }{
+        {0, []byte{0x00}},
+        {127, []byte{0x7f}},
+        {128, []byte{0x80, 0x01}},
+        {16383, []byte{0xff, 0x7f}},
+        {16384, []byte{0x80, 0x80, 0x01}},
+        {2097151, []byte{0xff, 0xff, 0x7f}},
+        {268435455, []byte{0xff, 0xff, 0xff, 0x7f}},
+    } {
+        if got := mqttRemainingLength(tc.n); !bytes.Equal(got, tc.want) {
+            t.Errorf("mqttRemainingLength(%d) = % x, want % x", tc.n, got, tc.want)
+        }
+    }
+}
+
+func TestMQTTConnectDisconnect(t *testing.T) {
+    for _, tc := range []struct {
+        name               string
+        username, password string
+        connAck            []byte
+        wantFlags          byte
+        wantErr            bool
+    }{
+        {"anonymous", "", "", []byte{mqttConnAck, 2, 0, 0}, mqttCleanSession, false},
+        {"credentials", "monitor", "s3cret", []byte{mqttConnAck, 2, 0, 0}, mqttCleanSession | mqttUsernameFlag | mqttPasswordFlag, false},
+        {"refused", "monitor", "wrong", []byte{mqttConnAck, 2, 0, 5}, mqttCleanSession | mqttUsernameFlag | mqttPasswordFlag, true},
+        {"not a CONNACK", "", "", []byte{0x30, 2, 0, 0}, mqttCleanSession, true},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            client, broker := net.Pipe()
+            defer client.Close()
+            type received struct {
+                connect, disconnect []byte
+                err                 error
+            }
+            done := make(chan received, 1)
+            go func() {
+                defer broker.Close()
+                var rcv received
+                header := make([]byte, 2)
+                if _, rcv.err = io.ReadFull(broker, header); rcv.err != nil {
+                    done <- rcv
+                    return
+                }
+                rcv.connect = make([]byte, header[1])
+                if _, rcv.err = io.ReadFull(broker, rcv.connect); rcv.err != nil {
+                    done <- rcv
+                    return
+                }
+                if _, rcv.err = broker.Write(tc.connAck); rcv.err != nil {
+                    done <- rcv
+                    return
+                }
+                rcv.disconnect, _ = io.ReadAll(broker)
+                done <- rcv
+            }()
+
+            err := mqttConnectDisconnect(client, tc.username, tc.password)
+            if (err != nil) != tc.wantErr {
+                t.Fatalf("got error %v, want error: %v", err, tc.wantErr)
+            }
+            client.Close()
+            rcv := <-done
+            if rcv.err != nil {
+                t.Fatalf("broker: %v", rcv.err)
+            }
+            if !bytes.HasPrefix(rcv.connect, []byte{0, 4, 'M', 'Q', 'T', 'T', mqttProtocolLevel}) {
+                t.Errorf("got CONNECT % x, want an MQTT 3.1.1 header", rcv.connect)
+            }
+            if flags := rcv.connect[7]; flags != tc.wantFlags {
+                t.Errorf("got connect flags %#x, want %#x", flags, tc.wantFlags)
+            }
+            if tc.username != "" && !bytes.Contains(rcv.connect, []byte(tc.username)) {
+                t.Errorf("got CONNECT % x, want the username", rcv.connect)
+            }
+            wantDisconnect := []byte{mqttDisconnect, 0}
+            if tc.wantErr {
+                wantDisconnect = nil
+            }
+            if !bytes.Equal(rcv.disconnect, wantDisconnect) {
+                t.Errorf("got % x after the CONNACK, want % x", rcv.disconnect, wantDisconnect)
+            }
+        })
+    }
+}
+
+// amqpFrame encodes a method frame of the connection class
+func amqpFrame(method uint16, args []byte) []byte {
+    var b bytes.Buffer
+    amqpSend(&b, method, args)
+    return b.Bytes()
+}
+
+func TestAMQPExpect(t *testing.T) {
+    closeArgs := binary.BigEndian.AppendUint16(nil, 403)
+    closeArgs = appendShortString(closeArgs, "ACCESS_REFUSED")
+    closeArgs = append(closeArgs, 0, 0, 0, 0)
+    badEnd := amqpFrame(amqpTune, []byte{0, 0})
+    badEnd[len(badEnd)-1] = 0
+    for _, tc := range []struct {
+        name     string
+        frame    []byte
+        method   uint16
+        wantArgs []byte
+        wantErr  string
+        wantSent []byte
+    }{
+        {"expected method", amqpFrame(amqpTune, []byte{0, 1, 0, 2}), amqpTune, []byte{0, 1, 0, 2}, "", nil},
+        {"no arguments", amqpFrame(amqpCloseOk, nil), amqpCloseOk, []byte{}, "", nil},
+        {"unexpected method", amqpFrame(amqpOpenOk, nil), amqpTune, nil, "unexpected method", nil},
+        {"broker close", amqpFrame(amqpClose, closeArgs), amqpOpenOk, nil, "ACCESS_REFUSED", amqpFrame(amqpCloseOk, nil)},
+        {"frame end", badEnd, amqpTune, nil, "malformed frame", nil},
+        {"frame size", []byte{amqpFrameMethod, 0, 0, 0, 0, 0, 2, 0, 0, amqpFrameEnd}, amqpTune, nil, "invalid frame size", nil},
+        {"truncated", amqpFrame(amqpTune, []byte{0, 1, 0, 2})[:9], amqpTune, nil, "EOF", nil},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            var sent bytes.Buffer
+            args, err := amqpExpect(&sent, bufio.NewReader(bytes.NewReader(tc.frame)), tc.method)
+            if tc.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+                    t.Errorf("got error %v, want one containing %q", err, tc.wantErr)
+                }
+            } else if err != nil {
+                t.Errorf("reading frame: %v", err)
+            } else if !bytes.Equal(args, tc.wantArgs) {
+                t.Errorf("got arguments % x, want % x", args, tc.wantArgs)
+            }
+            if !bytes.Equal(sent.Bytes(), tc.wantSent) {
+                t.Errorf("sent % x, want % x", sent.Bytes(), tc.wantSent)
+            }
+        })
+    }
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/hex"
+    "encoding/pem"
+    "fmt"
+    "net/http"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+)
+
+// observedChain is the chain a target served on a successful probe
+type observedChain struct {
+    time        time.Time
+    chain       [][]byte     // DER encoded certificates, leaf first
+    attestation *attestation // how the chain was verified, nil if restored from the state file
+}
+
+// observedChains keeps the last chain of every target for the /api/v1/certs endpoints, so responders can
+// inspect a certificate locally without connecting to the target themselves, along with the chain served
+// before the leaf last changed
+type observedChains struct {
+    mu       sync.Mutex
+    chains   map[string]observedChain
+    previous map[string]observedChain
+}
+
+// newObservedChains returns an empty store
+func newObservedChains() *observedChains {
+    return &observedChains{
+        chains:   make(map[string]observedChain),
+        previous: make(map[string]observedChain),
+    }
+}
+
+// update remembers the chain of a successful probe
+func (o *observedChains) update(domain string, res *probeResult) {
+    chain := make([][]byte, len(res.chain))
+    for i, cert := range res.chain {
+        chain[i] = cert.Raw
+    }
+    o.store(domain, observedChain{time: time.Now(), chain: chain, attestation: res.attestation})
+}
+
+// set remembers a chain observed at the given time, e.g. one restored from the state file
+func (o *observedChains) set(domain string, observed time.Time, chain [][]byte) {
+    o.store(domain, observedChain{time: observed, chain: chain})
+}
+
+// store replaces the current chain of domain, keeping the current one as previous if the leaf changed
+func (o *observedChains) store(domain string, observed observedChain) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    if current, ok := o.chains[domain]; ok && !bytes.Equal(current.chain[0], observed.chain[0]) {
+        o.previous[domain] = current
+    }
+    o.chains[domain] = observed
+}
+
+// current returns the chain last observed for domain
+func (o *observedChains) current(domain string) (observedChain, bool) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    observed, ok := o.chains[domain]
+    return observed, ok
+}
+
+// handler serves /api/v1/certs/{target}/pem, the chain last observed for a target in PEM,
+// /api/v1/certs/{target}/diff, the differences between its leaf and the one served before, and
+// /api/v1/certs/{target}/attestation, the trust anchors and settings the chain was verified with
+func (o *observedChains) handler(targets func() []target) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            w.Header().Set("Allow", "GET")
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        // File targets are paths, so the target is whatever lies between the prefix and the last element
+        path := strings.TrimPrefix(r.URL.Path, "/api/v1/certs/")
+        domain, view, ok := cutLast(path, "/")
+        if !ok || (view != "pem" && view != "diff" && view != "attestation") {
+            http.NotFound(w, r)
+            return
+        }
+        if !hasTarget(targets(), domain) {
+            http.Error(w, "unknown target", http.StatusNotFound)
+            return
+        }
+
+        o.mu.Lock()
+        current, ok := o.chains[domain]
+        previous, rotated := o.previous[domain]
+        o.mu.Unlock()
+        if !ok {
+            http.Error(w, "no certificate observed for target", http.StatusNotFound)
+            return
+        }
+        if view == "attestation" {
+            if current.attestation == nil {
+                http.Error(w, "chain not verified since the exporter started", http.StatusNotFound)
+                return
+            }
+            writeJSON(w, http.StatusOK, struct {
+                Target     string    `json:"target"`
+                ObservedAt time.Time `json:"observed_at"`
+                *attestation
+            }{domain, current.time, current.attestation})
+            return
+        }
+        if view == "diff" {
+            var before *observedChain
+            if rotated {
+                before = &previous
+            }
+            diff, err := newCertDiff(domain, current, before)
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+            }
+            writeJSON(w, http.StatusOK, diff)
+            return
+        }
+        w.Header().Set("Content-Type", "application/x-pem-file")
+        w.Header().Set("Last-Modified", current.time.UTC().Format(http.TimeFormat))
+        for _, der := range current.chain {
+            pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+        }
+    })
+}
+
+// cutLast slices s around the last instance of sep
+func cutLast(s, sep string) (before, after string, found bool) {
+    if i := strings.LastIndex(s, sep); i >= 0 {
+        return s[:i], s[i+len(sep):], true
+    }
+    return s, "", false
+}
+
+// certDiff compares the leaf a target serves with the one it served before its last rotation
+type certDiff struct {
+    Target     string       `json:"target"`
+    Current    *certDetails `json:"current"`
+    ObservedAt time.Time    `json:"observed_at"`
+    // Previous is null until the exporter saw the leaf change
+    Previous           *certDetails `json:"previous"`
+    PreviousObservedAt *time.Time   `json:"previous_observed_at,omitempty"`
+    Changes            []certChange `json:"changes"`
+}
+
+// certChange is an attribute of the leaf that differs between the previous and current certificate.
+// Lists like the SANs report the added and removed elements instead of the old and new value.
+type certChange struct {
+    Field   string   `json:"field"`
+    Old     string   `json:"old,omitempty"`
+    New     string   `json:"new,omitempty"`
+    Added   []string `json:"added,omitempty"`
+    Removed []string `json:"removed,omitempty"`
+}
+
+// newCertDiff compares the leaves of two observed chains. Without a previous chain there are no changes.
+func newCertDiff(domain string, current observedChain, previous *observedChain) (*certDiff, error) {
+    leaf, err := x509.ParseCertificate(current.chain[0])
+    if err != nil {
+        return nil, err
+    }
+    diff := &certDiff{Target: domain, Current: newCertDetails(leaf), ObservedAt: current.time, Changes: []certChange{}}
+    if previous == nil {
+        return diff, nil
+    }
+    old, err := x509.ParseCertificate(previous.chain[0])
+    if err != nil {
+        return nil, err
+    }
+    diff.Previous, diff.PreviousObservedAt = newCertDetails(old), &previous.time
+
+    for _, field := range []struct {
+        name     string
+        old, new string
+    }{
+        {"subject", old.Subject.String(), leaf.Subject.String()},
+        {"issuer", old.Issuer.String(), leaf.Issuer.String()},
+        {"serial_number", diff.Previous.SerialNumber, diff.Current.SerialNumber},
+        {"key", publicKeyDescription(old), publicKeyDescription(leaf)},
+        {"not_before", old.NotBefore.UTC().Format(time.RFC3339), leaf.NotBefore.UTC().Format(time.RFC3339)},
+        {"not_after", old.NotAfter.UTC().Format(time.RFC3339), leaf.NotAfter.UTC().Format(time.RFC3339)},
+        {"signature_algorithm", old.SignatureAlgorithm.String(), leaf.SignatureAlgorithm.String()},
+    } {
+        if field.old != field.new {
+            diff.Changes = append(diff.Changes, certChange{Field: field.name, Old: field.old, New: field.new})
+        }
+    }
+    added, removed := setDifference(certSANs(leaf), certSANs(old)), setDifference(certSANs(old), certSANs(leaf))
+    if len(added) > 0 || len(removed) > 0 {
+        diff.Changes = append(diff.Changes, certChange{Field: "sans", Added: added, Removed: removed})
+    }
+    return diff, nil
+}
+
+// publicKeyDescription names the algorithm and size of a certificate's key along with the SHA-256 hash
+// of its SubjectPublicKeyInfo, which tells a reused key from a new one
+func publicKeyDescription(cert *x509.Certificate) string {
+    sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+    spki := hex.EncodeToString(sum[:])
+    switch key := cert.PublicKey.(type) {
+    case *rsa.PublicKey:
+        return fmt.Sprintf("RSA %d %s", key.N.BitLen(), spki)
+    case *ecdsa.PublicKey:
+        return fmt.Sprintf("ECDSA %s %s", key.Curve.Params().Name, spki)
+    }
+    return fmt.Sprintf("%s %s", cert.PublicKeyAlgorithm, spki)
+}
+
+// setDifference returns the elements of a missing from b
+func setDifference(a, b []string) []string {
+    var missing []string
+    for _, s := range a {
+        if !slices.Contains(b, s) {
+            missing = append(missing, s)
+        }
+    }
+    return missing
+}
+
+// hasTarget reports whether domain is one of the targets
+func hasTarget(targets []target, domain string) bool {
+    for _, t := range targets {
+        if t.Domain == domain {
+            return true
+        }
+    }
+    return false
+}
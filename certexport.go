@@ -0,0 +1,185 @@
+package main
+
+import (
+    "archive/zip"
+    "encoding/csv"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "net/http"
+    "slices"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// inventoryColumns are the columns of the certificate inventory before the target labels
+var inventoryColumns = []string{
+    "target", "module", "subject", "issuer", "serial_number", "dns_names", "not_before", "not_after", "days_left", "fingerprint", "observed_at",
+}
+
+// inventoryDaysLeftColumn is the index of days_left, a number in spreadsheets
+var inventoryDaysLeftColumn = slices.Index(inventoryColumns, "days_left")
+
+// inventoryRows returns the header and a row per target, sorted by target. The leaf is the one served on
+// the last successful probe, its columns are empty for targets that weren't probed successfully yet.
+// Every label of a target gets a column, so owner and team labels end up next to the certificate.
+func (o *observedChains) inventoryRows(targets []target, now time.Time) [][]string {
+    labelSet := make(map[string]bool)
+    for _, t := range targets {
+        for name := range t.Labels {
+            labelSet[name] = true
+        }
+    }
+    labels := make([]string, 0, len(labelSet))
+    for name := range labelSet {
+        labels = append(labels, name)
+    }
+    sort.Strings(labels)
+
+    sorted := append([]target(nil), targets...)
+    sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Domain < sorted[j].Domain })
+    rows := [][]string{append(append([]string(nil), inventoryColumns...), labels...)}
+    for _, t := range sorted {
+        row := make([]string, len(inventoryColumns), len(inventoryColumns)+len(labels))
+        row[0], row[1] = t.Domain, t.Module
+        if observed, ok := o.current(t.Domain); ok {
+            if leaf, _, err := parseCertificate(observed.chain[0]); err == nil {
+                copy(row[2:], []string{
+                    leaf.Subject.String(),
+                    leaf.Issuer.String(),
+                    fmt.Sprintf("%x", leaf.SerialNumber),
+                    strings.Join(leaf.DNSNames, " "),
+                    leaf.NotBefore.UTC().Format(time.RFC3339),
+                    leaf.NotAfter.UTC().Format(time.RFC3339),
+                    strconv.Itoa(int(leaf.NotAfter.Sub(now).Hours() / 24)),
+                    fingerprint(leaf),
+                    observed.time.UTC().Format(time.RFC3339),
+                })
+            }
+        }
+        for _, name := range labels {
+            row = append(row, t.Labels[name])
+        }
+        rows = append(rows, row)
+    }
+    return rows
+}
+
+// inventoryHandler serves /api/v1/certs.csv and /api/v1/certs.xlsx, the leaf of every target with the
+// target labels, for audits in spreadsheets
+func (o *observedChains) inventoryHandler(targets func() []target, xlsx bool) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            w.Header().Set("Allow", "GET")
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        rows := o.inventoryRows(targets(), certClock.Now())
+        name := "certs-" + time.Now().UTC().Format("20060102")
+        if xlsx {
+            w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+            w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.xlsx"`, name))
+            writeXLSX(w, "Certificates", rows, inventoryDaysLeftColumn)
+            return
+        }
+        w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+        w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, name))
+        cw := csv.NewWriter(w)
+        for _, row := range rows {
+            cw.Write(csvSafeRow(row))
+        }
+        cw.Flush()
+    })
+}
+
+// csvSafeRow returns the row with the cells spreadsheets would evaluate as formulas prefixed with a single
+// quote. Subjects, issuers and names come from arbitrary servers, =HYPERLINK(...) as organization must not
+// turn into a formula when the inventory is opened. Numbers like negative days left are kept.
+func csvSafeRow(row []string) []string {
+    safe := make([]string, len(row))
+    for i, cell := range row {
+        safe[i] = cell
+        if cell == "" || !strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+            continue
+        }
+        if _, err := strconv.ParseFloat(cell, 64); err != nil {
+            safe[i] = "'" + cell
+        }
+    }
+    return safe
+}
+
+// Parts of a minimal SpreadsheetML workbook holding one worksheet
+const (
+    xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+    xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+    xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`
+    xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`
+)
+
+// writeXLSX writes the rows as a workbook with one sheet, the first row being the header. Cells are inline
+// strings, except the integers in the numeric columns, so spreadsheets can sort and filter by them.
+func writeXLSX(w io.Writer, sheet string, rows [][]string, numeric ...int) error {
+    z := zip.NewWriter(w)
+    for _, part := range []struct{ name, content string }{
+        {"[Content_Types].xml", xlsxContentTypes},
+        {"_rels/.rels", xlsxRels},
+        {"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+        {"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, xmlEscape(sheet))},
+    } {
+        f, err := z.Create(part.name)
+        if err != nil {
+            return err
+        }
+        if _, err := io.WriteString(f, part.content); err != nil {
+            return err
+        }
+    }
+
+    f, err := z.Create("xl/worksheets/sheet1.xml")
+    if err != nil {
+        return err
+    }
+    var b strings.Builder
+    b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+    b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+    for i, row := range rows {
+        fmt.Fprintf(&b, `<row r="%d">`, i+1)
+        for j, cell := range row {
+            ref := xlsxColumn(j) + strconv.Itoa(i+1)
+            if _, err := strconv.Atoi(cell); err == nil && i > 0 && slices.Contains(numeric, j) {
+                fmt.Fprintf(&b, `<c r="%s"><v>%s</v></c>`, ref, cell)
+                continue
+            }
+            fmt.Fprintf(&b, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, xmlEscape(cell))
+        }
+        b.WriteString(`</row>`)
+    }
+    b.WriteString(`</sheetData></worksheet>`)
+    if _, err := io.WriteString(f, b.String()); err != nil {
+        return err
+    }
+    return z.Close()
+}
+
+// xlsxColumn returns the letters of the zero-based column i, A to Z, then AA and so on
+func xlsxColumn(i int) string {
+    var name []byte
+    for i++; i > 0; i = (i - 1) / 26 {
+        name = append([]byte{byte('A' + (i-1)%26)}, name...)
+    }
+    return string(name)
+}
+
+// xmlEscape escapes s for XML text and attribute values
+func xmlEscape(s string) string {
+    var b strings.Builder
+    xml.EscapeText(&b, []byte(s))
+    return b.String()
+}
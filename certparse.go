@@ -0,0 +1,355 @@
+package main
+
+import (
+    "context"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "math/big"
+    "net"
+    "net/netip"
+    "strings"
+    "time"
+)
+
+// Handshake messages read from the server to get hold of a chain Go's TLS client refuses to parse
+const (
+    handshakeCertificate     = 11
+    handshakeServerHelloDone = 14
+    maxCertificateRecords    = 64
+)
+
+// isCertParseError reports whether a handshake failed because the server's certificates don't parse
+func isCertParseError(err error) bool {
+    return err != nil && strings.Contains(err.Error(), "failed to parse certificate from server")
+}
+
+// parseCertificate parses a DER certificate, falling back to the fields that parse if it is malformed, as
+// served by appliances with broken encoders. partial reports the fallback: the certificate lacks fields,
+// its signature can't be checked, and it fails verification.
+func parseCertificate(der []byte) (cert *x509.Certificate, partial bool, err error) {
+    cert, err = x509.ParseCertificate(der)
+    if err == nil {
+        return cert, false, nil
+    }
+    cert, perr := parsePartialCertificate(der)
+    if perr != nil {
+        return nil, true, fmt.Errorf("%v, partial parse: %v", err, perr)
+    }
+    return cert, true, nil
+}
+
+// parsePartialCertificate parses the TBSCertificate field by field, skipping what doesn't parse. It fails
+// only without a validity period, which every metric of the exporter depends on.
+func parsePartialCertificate(der []byte) (*x509.Certificate, error) {
+    var outer struct {
+        TBS    asn1.RawValue
+        SigAlg asn1.RawValue
+        Sig    asn1.BitString
+    }
+    if _, err := asn1.Unmarshal(der, &outer); err != nil {
+        return nil, err
+    }
+    cert := &x509.Certificate{
+        Raw:                der,
+        RawTBSCertificate:  outer.TBS.FullBytes,
+        Signature:          outer.Sig.RightAlign(),
+        SerialNumber:       new(big.Int),
+        SignatureAlgorithm: x509.UnknownSignatureAlgorithm,
+    }
+
+    var fields []asn1.RawValue
+    for rest := outer.TBS.Bytes; len(rest) > 0; {
+        var field asn1.RawValue
+        var err error
+        if rest, err = asn1.Unmarshal(rest, &field); err != nil {
+            break
+        }
+        fields = append(fields, field)
+    }
+    // The version is optional and explicitly tagged
+    if len(fields) > 0 && fields[0].Class == asn1.ClassContextSpecific && fields[0].Tag == 0 {
+        var version int
+        if _, err := asn1.Unmarshal(fields[0].Bytes, &version); err == nil {
+            cert.Version = version + 1
+        }
+        fields = fields[1:]
+    } else {
+        cert.Version = 1
+    }
+    if len(fields) < 5 {
+        return nil, errors.New("truncated TBSCertificate")
+    }
+    serial, issuer, validity, subject, spki := fields[0], fields[1], fields[3], fields[4], fields[5:]
+
+    if serial.Tag == asn1.TagInteger && len(serial.Bytes) > 0 {
+        // Negative serials, which Go rejects, are read as unsigned
+        cert.SerialNumber.SetBytes(serial.Bytes)
+    }
+    var rdns pkix.RDNSequence
+    if _, err := asn1.Unmarshal(issuer.FullBytes, &rdns); err == nil {
+        cert.Issuer.FillFromRDNSequence(&rdns)
+        cert.RawIssuer = issuer.FullBytes
+    }
+    rdns = nil
+    if _, err := asn1.Unmarshal(subject.FullBytes, &rdns); err == nil {
+        cert.Subject.FillFromRDNSequence(&rdns)
+        cert.RawSubject = subject.FullBytes
+    }
+
+    var times []asn1.RawValue
+    for rest := validity.Bytes; len(rest) > 0 && len(times) < 2; {
+        var t asn1.RawValue
+        var err error
+        if rest, err = asn1.Unmarshal(rest, &t); err != nil {
+            break
+        }
+        times = append(times, t)
+    }
+    if len(times) < 2 {
+        return nil, errors.New("no validity period")
+    }
+    var err error
+    if cert.NotBefore, err = parseLenientTime(times[0]); err != nil {
+        return nil, fmt.Errorf("notBefore: %v", err)
+    }
+    if cert.NotAfter, err = parseLenientTime(times[1]); err != nil {
+        return nil, fmt.Errorf("notAfter: %v", err)
+    }
+
+    if len(spki) > 0 {
+        cert.RawSubjectPublicKeyInfo = spki[0].FullBytes
+        if key, err := x509.ParsePKIXPublicKey(spki[0].FullBytes); err == nil {
+            cert.PublicKey = key
+        }
+    }
+    for _, f := range spki {
+        if f.Class == asn1.ClassContextSpecific && f.Tag == 3 {
+            parsePartialExtensions(cert, f.Bytes)
+        }
+    }
+    return cert, nil
+}
+
+// parseLenientTime parses a UTCTime or GeneralizedTime, accepting the encodings that violate DER as well,
+// like missing seconds or time zone offsets
+func parseLenientTime(v asn1.RawValue) (time.Time, error) {
+    var layouts []string
+    switch v.Tag {
+    case asn1.TagUTCTime:
+        layouts = []string{"060102150405Z0700", "0601021504Z0700", "060102150405", "0601021504"}
+    case asn1.TagGeneralizedTime:
+        layouts = []string{"20060102150405.999999999Z0700", "20060102150405Z0700", "200601021504Z0700", "20060102150405"}
+    default:
+        return time.Time{}, fmt.Errorf("unexpected tag %d", v.Tag)
+    }
+    s := string(v.Bytes)
+    for _, layout := range layouts {
+        t, err := time.Parse(layout, s)
+        if err != nil {
+            continue
+        }
+        // Two digit years of UTCTime are 1950 to 2049
+        if v.Tag == asn1.TagUTCTime && t.Year() >= 2050 {
+            t = t.AddDate(-100, 0, 0)
+        }
+        return t.UTC(), nil
+    }
+    return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// parsePartialExtensions takes over the extensions that parse, basic constraints and the subject alternative names
+func parsePartialExtensions(cert *x509.Certificate, data []byte) {
+    var exts []pkix.Extension
+    if _, err := asn1.Unmarshal(data, &exts); err != nil {
+        return
+    }
+    cert.Extensions = exts
+    for _, ext := range exts {
+        switch {
+        case ext.Id.Equal(oidExtensionBasicConstraints):
+            var bc struct {
+                IsCA bool `asn1:"optional"`
+            }
+            if _, err := asn1.Unmarshal(ext.Value, &bc); err == nil {
+                cert.BasicConstraintsValid, cert.IsCA = true, bc.IsCA
+            }
+        case ext.Id.Equal(oidExtensionSubjectAltName):
+            var names asn1.RawValue
+            if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+                continue
+            }
+            for rest := names.Bytes; len(rest) > 0; {
+                var name asn1.RawValue
+                var err error
+                if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+                    break
+                }
+                switch name.Tag {
+                case 1:
+                    cert.EmailAddresses = append(cert.EmailAddresses, string(name.Bytes))
+                case 2:
+                    cert.DNSNames = append(cert.DNSNames, string(name.Bytes))
+                case 7:
+                    if len(name.Bytes) == net.IPv4len || len(name.Bytes) == net.IPv6len {
+                        cert.IPAddresses = append(cert.IPAddresses, net.IP(name.Bytes))
+                    }
+                }
+            }
+        }
+    }
+}
+
+var (
+    oidExtensionBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+    oidExtensionSubjectAltName   = asn1.ObjectIdentifier{2, 5, 29, 17}
+)
+
+// parseChain parses the chain leaf first, leaving out certificates that don't parse at all besides the leaf.
+// partial reports whether a certificate was malformed.
+func parseChain(ders [][]byte) (chain []*x509.Certificate, partial bool, err error) {
+    for i, der := range ders {
+        cert, p, err := parseCertificate(der)
+        partial = partial || p
+        if err != nil {
+            if i == 0 {
+                return nil, true, err
+            }
+            continue
+        }
+        chain = append(chain, cert)
+    }
+    return chain, partial, nil
+}
+
+// rawChainFetchable reports whether the server speaks TLS right away, so fetchRawChain can get its chain
+func (m *module) rawChainFetchable() bool {
+    if m.script != nil && m.script.before != nil {
+        return false
+    }
+    return m.Prober != proberSMTPStartTLS && m.Prober != proberRDP
+}
+
+// probeMalformed fetches the chain of a server whose certificates Go's TLS client fails to parse, and
+// returns the fields that parse. The handshake is left unfinished, so there is no TLS state.
+func (m *module) probeMalformed(ctx context.Context, dialer *net.Dialer, host, port string, proxy *proxyRule) (*probeResult, error) {
+    ders, addr, err := m.fetchRawChain(ctx, dialer, host, port, proxy)
+    if err != nil {
+        return nil, err
+    }
+    chain, partial, err := parseChain(ders)
+    if err != nil {
+        return nil, err
+    }
+    return &probeResult{
+        chain:      chain,
+        serverName: host,
+        spiffeID:   m.TLSConfig.Spiffe.expectedServerID(),
+        skipVerify: m.TLSConfig.InsecureSkipVerify,
+        roots:      m.rootPool(),
+        trust:      m.trustSource(),
+        parseError: partial,
+        address:    addr,
+    }, nil
+}
+
+// fetchRawChain reads the certificates the server presents in a TLS 1.2 handshake without parsing them,
+// for servers whose chain Go's TLS client rejects. The connection is closed after the Certificate message.
+func (m *module) fetchRawChain(ctx context.Context, dialer *net.Dialer, host, port string, proxy *proxyRule) ([][]byte, netip.Addr, error) {
+    ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+    defer cancel()
+    var (
+        conn net.Conn
+        err  error
+    )
+    if proxy != nil {
+        conn, err = dialProxy(ctx, probeDialing.proxyDialer(dialer), proxy, net.JoinHostPort(host, port))
+    } else {
+        var addrs []netip.Addr
+        if addrs, err = resolveHost(ctx, host); err == nil {
+            conn, err = dialAny(ctx, dialer, addrs, port)
+        }
+    }
+    if err != nil {
+        return nil, netip.Addr{}, err
+    }
+    defer conn.Close()
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+    }
+    var addr netip.Addr
+    if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+        addr = tcpAddr.AddrPort().Addr().Unmap()
+    }
+    if _, err := conn.Write(clientHello(0x0303, host, scanCipherSuites, false)); err != nil {
+        return nil, addr, err
+    }
+
+    var msgs []byte
+    for i := 0; i < maxCertificateRecords; i++ {
+        header := make([]byte, 5)
+        if _, err := io.ReadFull(conn, header); err != nil {
+            return nil, addr, err
+        }
+        payload := make([]byte, binary.BigEndian.Uint16(header[3:]))
+        if _, err := io.ReadFull(conn, payload); err != nil {
+            return nil, addr, err
+        }
+        switch header[0] {
+        case recordAlert:
+            return nil, addr, errHelloRejected
+        case recordHandshake:
+            msgs = append(msgs, payload...)
+        default:
+            return nil, addr, fmt.Errorf("unexpected record type %d", header[0])
+        }
+        for len(msgs) >= 4 {
+            length := int(msgs[1])<<16 | int(msgs[2])<<8 | int(msgs[3])
+            if len(msgs) < 4+length {
+                break
+            }
+            typ, body := msgs[0], msgs[4:4+length]
+            msgs = msgs[4+length:]
+            switch typ {
+            case handshakeCertificate:
+                chain, err := parseCertificateMessage(body)
+                return chain, addr, err
+            case handshakeServerHelloDone:
+                return nil, addr, errors.New("server sent no certificate")
+            }
+        }
+    }
+    return nil, addr, errors.New("no Certificate message")
+}
+
+// parseCertificateMessage splits the body of a TLS 1.2 Certificate message into the DER certificates
+func parseCertificateMessage(body []byte) ([][]byte, error) {
+    malformed := errors.New("malformed Certificate message")
+    if len(body) < 3 {
+        return nil, malformed
+    }
+    length := int(body[0])<<16 | int(body[1])<<8 | int(body[2])
+    if len(body) != 3+length {
+        return nil, malformed
+    }
+    var chain [][]byte
+    for body = body[3:]; len(body) > 0; {
+        if len(body) < 3 {
+            return nil, malformed
+        }
+        n := int(body[0])<<16 | int(body[1])<<8 | int(body[2])
+        if len(body) < 3+n {
+            return nil, malformed
+        }
+        chain = append(chain, body[3:3+n])
+        body = body[3+n:]
+    }
+    if len(chain) == 0 {
+        return nil, errors.New("server sent no certificate")
+    }
+    return chain, nil
+}
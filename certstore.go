@@ -0,0 +1,106 @@
+package main
+
+import (
+    "crypto/x509"
+    "database/sql"
+    "encoding/pem"
+    "fmt"
+    "strings"
+    "time"
+
+    _ "github.com/lib/pq"
+    _ "modernc.org/sqlite"
+)
+
+// certStoreSchema works for SQLite and PostgreSQL. Times are Unix timestamps.
+var certStoreSchema = []string{
+    `CREATE TABLE IF NOT EXISTS certificates (
+        fingerprint TEXT PRIMARY KEY,
+        subject     TEXT NOT NULL,
+        issuer      TEXT NOT NULL,
+        serial      TEXT NOT NULL,
+        not_before  BIGINT NOT NULL,
+        not_after   BIGINT NOT NULL,
+        pem         TEXT NOT NULL,
+        first_seen  BIGINT NOT NULL,
+        last_seen   BIGINT NOT NULL
+    )`,
+    `CREATE TABLE IF NOT EXISTS certificate_targets (
+        fingerprint TEXT NOT NULL REFERENCES certificates (fingerprint),
+        target      TEXT NOT NULL,
+        chain       TEXT NOT NULL,
+        first_seen  BIGINT NOT NULL,
+        last_seen   BIGINT NOT NULL,
+        PRIMARY KEY (fingerprint, target)
+    )`,
+}
+
+// certStore records every certificate the exporter observes in a database, together with
+// the targets serving it, as an inventory and audit trail beyond what metrics can express
+type certStore struct {
+    db *sql.DB
+}
+
+// openCertStore connects to the database given as sqlite:<path> or postgres:// URL and creates the schema
+func openCertStore(dsn string) (*certStore, error) {
+    var driver, source string
+    switch {
+    case strings.HasPrefix(dsn, "sqlite:"):
+        driver, source = "sqlite", strings.TrimPrefix(dsn, "sqlite:")
+    case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+        driver, source = "postgres", dsn
+    default:
+        return nil, fmt.Errorf("unsupported database %q, expected sqlite:<path> or a postgres:// URL", dsn)
+    }
+
+    db, err := sql.Open(driver, source)
+    if err != nil {
+        return nil, err
+    }
+    for _, stmt := range certStoreSchema {
+        if _, err := db.Exec(stmt); err != nil {
+            db.Close()
+            return nil, err
+        }
+    }
+    return &certStore{db: db}, nil
+}
+
+// record stores the certificates of a chain served by domain, updating last_seen of the known ones
+func (s *certStore) record(domain string, chain []*x509.Certificate, now time.Time) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var chainPEM strings.Builder
+    for _, cert := range chain {
+        pem.Encode(&chainPEM, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+    }
+
+    for i, cert := range chain {
+        fp := fingerprint(cert)
+        _, err := tx.Exec(`INSERT INTO certificates (fingerprint, subject, issuer, serial, not_before, not_after, pem, first_seen, last_seen)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+            ON CONFLICT (fingerprint) DO UPDATE SET last_seen = excluded.last_seen`,
+            fp, cert.Subject.String(), cert.Issuer.String(), cert.SerialNumber.Text(16),
+            cert.NotBefore.Unix(), cert.NotAfter.Unix(),
+            string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})), now.Unix())
+        if err != nil {
+            return err
+        }
+        // Targets are linked to the leaf they serve, the chain records the intermediates sent with it
+        if i > 0 {
+            continue
+        }
+        _, err = tx.Exec(`INSERT INTO certificate_targets (fingerprint, target, chain, first_seen, last_seen)
+            VALUES ($1, $2, $3, $4, $4)
+            ON CONFLICT (fingerprint, target) DO UPDATE SET chain = excluded.chain, last_seen = excluded.last_seen`,
+            fp, domain, chainPEM.String(), now.Unix())
+        if err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// chatopsConfig holds the secrets Slack and Microsoft Teams sign the requests of slash commands and
+// outgoing webhooks with. Chat platforms can't send the API credentials, so each endpoint is only served
+// if its secret is set.
+type chatopsConfig struct {
+    SlackSigningSecret string `yaml:"slack_signing_secret"`
+    // TeamsSecret is the base64 encoded security token Teams shows when creating the outgoing webhook
+    TeamsSecret string `yaml:"teams_secret"`
+
+    teamsKey []byte
+}
+
+// slackMaxSkew bounds the age of a Slack request timestamp, so captured requests can't be replayed later
+const slackMaxSkew = 5 * time.Minute
+
+// validate decodes the Teams secret
+func (c *chatopsConfig) validate() error {
+    if c.TeamsSecret == "" {
+        return nil
+    }
+    key, err := base64.StdEncoding.DecodeString(c.TeamsSecret)
+    if err != nil {
+        return fmt.Errorf("teams_secret: %v", err)
+    }
+    c.teamsKey = key
+    return nil
+}
+
+// verifySlack checks the v0 signature of a Slack request over its timestamp and body
+func (c *chatopsConfig) verifySlack(r *http.Request, body []byte, now time.Time) bool {
+    ts := r.Header.Get("X-Slack-Request-Timestamp")
+    sec, err := strconv.ParseInt(ts, 10, 64)
+    if err != nil {
+        return false
+    }
+    if skew := now.Sub(time.Unix(sec, 0)); skew > slackMaxSkew || skew < -slackMaxSkew {
+        return false
+    }
+    mac := hmac.New(sha256.New, []byte(c.SlackSigningSecret))
+    fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+    expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+    return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Slack-Signature")))
+}
+
+// verifyTeams checks the HMAC a Teams outgoing webhook puts in the Authorization header
+func (c *chatopsConfig) verifyTeams(r *http.Request, body []byte) bool {
+    mac := hmac.New(sha256.New, c.teamsKey)
+    mac.Write(body)
+    expected := "HMAC " + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+    return hmac.Equal([]byte(expected), []byte(r.Header.Get("Authorization")))
+}
+
+// teamsMention is the mention of the webhook Teams puts in front of the message text
+var teamsMention = regexp.MustCompile(`<at>.*?</at>`)
+
+// slackHandler serves /api/v1/chatops/slack, the target of a slash command like /cert example.com
+func (e *exporter) slackHandler(c *chatopsConfig, targets func() []target) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            w.Header().Set("Allow", "POST")
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if !c.verifySlack(r, body, time.Now()) {
+            http.Error(w, "invalid signature", http.StatusUnauthorized)
+            return
+        }
+        form, err := url.ParseQuery(string(body))
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        writeJSON(w, http.StatusOK, map[string]string{
+            "response_type": "ephemeral",
+            "text":          e.chatSummary(form.Get("text"), targets(), "*%s*"),
+        })
+    })
+}
+
+// teamsHandler serves /api/v1/chatops/teams, the target of an outgoing webhook mentioned like @cert example.com
+func (e *exporter) teamsHandler(c *chatopsConfig, targets func() []target) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            w.Header().Set("Allow", "POST")
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if !c.verifyTeams(r, body) {
+            http.Error(w, "invalid signature", http.StatusUnauthorized)
+            return
+        }
+        var activity struct {
+            Text string `json:"text"`
+        }
+        if err := json.Unmarshal(body, &activity); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        query := teamsMention.ReplaceAllString(activity.Text, "")
+        writeJSON(w, http.StatusOK, map[string]string{
+            "type": "message",
+            "text": e.chatSummary(query, targets(), "**%s**"),
+        })
+    })
+}
+
+// chatSummary describes the certificates of the targets matching the query, a target or a host name
+// matching the targets on any port, one line per target. bold formats the target in the platform's markup.
+func (e *exporter) chatSummary(query string, targets []target, bold string) string {
+    query = strings.TrimSpace(query)
+    if query == "" {
+        return "Usage: give a domain, like example.com or example.com:8443"
+    }
+    var lines []string
+    for _, t := range targets {
+        if t.Domain != query && hostOf(t.Domain) != query {
+            continue
+        }
+        lines = append(lines, fmt.Sprintf(bold, t.Domain)+" "+e.targetSummary(t.Domain, certClock.Now()))
+    }
+    if len(lines) == 0 {
+        return fmt.Sprintf("%s is not monitored", query)
+    }
+    return strings.Join(lines, "\n")
+}
+
+// targetSummary describes the certificate a target last served and the outcome of its last probe.
+// Days left are counted from now, the time of certClock, the age of probes in wall clock time.
+func (e *exporter) targetSummary(domain string, now time.Time) string {
+    observed, ok := e.chains.current(domain)
+    var summary string
+    if !ok {
+        summary = "has not been probed successfully yet."
+    } else if leaf, err := x509.ParseCertificate(observed.chain[0]); err != nil {
+        summary = fmt.Sprintf("serves an unparsable certificate: %v.", err)
+    } else {
+        days := int(leaf.NotAfter.Sub(now).Hours() / 24)
+        verb := fmt.Sprintf("expires in %d days", days)
+        if !leaf.NotAfter.After(now) {
+            verb = fmt.Sprintf("expired %d days ago", -days)
+        }
+        summary = fmt.Sprintf("%s (%s), issued by %s. Last successful probe %s ago.",
+            verb, leaf.NotAfter.UTC().Format("2006-01-02"), leaf.Issuer, time.Since(observed.time).Round(time.Second))
+    }
+    if e.history != nil {
+        if entry, ok := e.history.last(domain); ok && !entry.Success {
+            summary += fmt.Sprintf(" The last probe %s ago failed: %s.", time.Since(entry.Time).Round(time.Second), entry.Reason)
+        }
+    }
+    return summary
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "crypto"
+    "crypto/tls"
+    "encoding/asn1"
+    "errors"
+    "fmt"
+    "math/big"
+)
+
+// pkcs11Key selects a private key on a PKCS#11 token, e.g. an HSM or smart card
+type pkcs11Key struct {
+    Module     string `yaml:"module"` // path of the PKCS#11 library
+    TokenLabel string `yaml:"token_label"`
+    PIN        string `yaml:"pin"`
+    // KeyLabel and KeyID (hex) select the key, at least one is required
+    KeyLabel string `yaml:"key_label"`
+    KeyID    string `yaml:"key_id"`
+}
+
+// tpmKey selects a persistent signing key of a TPM 2.0
+type tpmKey struct {
+    Device   string `yaml:"device"` // /dev/tpmrm0 if empty
+    Handle   uint32 `yaml:"handle"` // persistent handle like 0x81000001
+    Password string `yaml:"password"`
+}
+
+// defaultTPMDevice is the in-kernel resource manager, which unlike /dev/tpm0 can be shared with other processes
+const defaultTPMDevice = "/dev/tpmrm0"
+
+// clientCertificate loads the client certificate and its key. Keys on a PKCS#11 token or TPM stay there,
+// the handshake asks the device to sign. nil if no client certificate is configured.
+func (c *tlsConfig) clientCertificate() (*tls.Certificate, error) {
+    sources := 0
+    for _, set := range []bool{c.KeyFile != "", c.PKCS11 != nil, c.TPM != nil} {
+        if set {
+            sources++
+        }
+    }
+    switch {
+    case c.CertFile == "" && sources == 0:
+        return nil, nil
+    case c.CertFile == "":
+        return nil, errors.New("cert_file is required with a client key")
+    case sources == 0:
+        return nil, errors.New("cert_file needs key_file, pkcs11 or tpm")
+    case sources > 1:
+        return nil, errors.New("key_file, pkcs11 and tpm are mutually exclusive")
+    }
+
+    if c.KeyFile != "" {
+        cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+        if err != nil {
+            return nil, err
+        }
+        return &cert, nil
+    }
+    chain, err := readCertFile(c.CertFile)
+    if err != nil {
+        return nil, err
+    }
+    var signer crypto.Signer
+    if c.PKCS11 != nil {
+        signer, err = c.PKCS11.signer(chain[0].PublicKey)
+        if err != nil {
+            return nil, fmt.Errorf("pkcs11: %v", err)
+        }
+    } else {
+        signer, err = c.TPM.signer(chain[0].PublicKey)
+        if err != nil {
+            return nil, fmt.Errorf("tpm: %v", err)
+        }
+    }
+    cert := &tls.Certificate{PrivateKey: signer, Leaf: chain[0]}
+    for _, c := range chain {
+        cert.Certificate = append(cert.Certificate, c.Raw)
+    }
+    return cert, nil
+}
+
+// ecdsaSignature encodes the r and s values devices return as the ASN.1 signature TLS expects
+func ecdsaSignature(r, s []byte) ([]byte, error) {
+    return asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(r), new(big.Int).SetBytes(s)})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "fmt"
+    "time"
+)
+
+// clock tells the time certificates are checked against: chain verification, stale intermediates, OCSP
+// staples, renewal policies, certificate ages, expiry alerts and emails. Probe timeouts, durations and the
+// intervals of loops always run on the system clock.
+type clock interface {
+    Now() time.Time
+}
+
+// systemClock is the clock of the host
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// simulatedClock starts at the time set with -simulate-now and runs at the pace of the system clock, so live
+// certificates are checked as they would be at that date, e.g. to see what expires during a change freeze
+type simulatedClock struct {
+    offset time.Duration
+}
+
+func newSimulatedClock(now time.Time) simulatedClock {
+    return simulatedClock{offset: time.Until(now)}
+}
+
+func (c simulatedClock) Now() time.Time { return time.Now().Add(c.offset) }
+
+// certClock is the clock certificates are checked against
+var certClock clock = systemClock{}
+
+// parseSimulatedNow parses the -simulate-now flag, an RFC 3339 time or a date at midnight UTC
+func parseSimulatedNow(s string) (time.Time, error) {
+    if t, err := time.Parse(time.RFC3339, s); err == nil {
+        return t, nil
+    }
+    t, err := time.Parse(time.DateOnly, s)
+    if err != nil {
+        return time.Time{}, fmt.Errorf("expected an RFC 3339 time or a date like 2006-01-02, got %q", s)
+    }
+    return t, nil
+}
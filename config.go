@@ -0,0 +1,441 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/subtle"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/netip"
+    "os"
+    "path"
+    "regexp"
+    "strings"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+// probeConfig is the YAML configuration of the /probe endpoint
+type probeConfig struct {
+    Modules            map[string]*module       `yaml:"modules"`
+    Tenants            map[string]*tenantConfig `yaml:"tenants"`
+    TargetPolicy       targetPolicy             `yaml:"target_policy"`
+    API                apiConfig                `yaml:"api"`
+    MaintenanceWindows []maintenanceWindow      `yaml:"maintenance_windows"`
+    InventoryFiles     []inventoryFile          `yaml:"inventory_files"`
+    ScanResults        []*scanResultFile        `yaml:"scan_results"`
+    Limits             limitsConfig             `yaml:"limits"`
+    ProxyConfigs       []proxyConfigFile        `yaml:"proxy_configs"`
+    Zones              []*zoneSource            `yaml:"zones"`
+    CTDiscovery        ctDiscovery              `yaml:"ct_discovery"`
+    Proxies            []*proxyRule             `yaml:"proxies"`
+    Groups             []*targetGroup           `yaml:"groups"`
+    PrometheusSources  []*promSource            `yaml:"prometheus_sources"`
+    NetworkScans       []*networkScan           `yaml:"network_scans"`
+    Chatops            chatopsConfig            `yaml:"chatops"`
+    Envoy              envoyConfig              `yaml:"envoy"`
+    MailPolicies       mailPolicyConfig         `yaml:"mail_policies"`
+    Enrichment         enrichmentConfig         `yaml:"enrichment"`
+}
+
+// apiConfig holds the credentials of the /api/v1 endpoints. The API is disabled without credentials.
+type apiConfig struct {
+    BearerToken string `yaml:"bearer_token"`
+    Username    string `yaml:"username"`
+    Password    string `yaml:"password"`
+}
+
+// maintenanceWindow snoozes the targets matching one of the patterns between start and end
+type maintenanceWindow struct {
+    Targets []string  `yaml:"targets"`
+    Start   time.Time `yaml:"start"`
+    End     time.Time `yaml:"end"`
+    Comment string    `yaml:"comment"`
+}
+
+// targetPolicy restricts which domains and addresses /probe may connect to, so the exporter
+// can't be used to scan internal networks. Deny rules win over allow rules, empty allow lists allow everything.
+type targetPolicy struct {
+    AllowDomains []string       `yaml:"allow_domains"`
+    DenyDomains  []string       `yaml:"deny_domains"`
+    AllowCIDRs   []netip.Prefix `yaml:"allow_cidrs"`
+    DenyCIDRs    []netip.Prefix `yaml:"deny_cidrs"`
+}
+
+// tenantConfig scopes the targets a tenant may probe. A tenant is identified by its bearer token or basic auth credentials.
+type tenantConfig struct {
+    BearerToken string `yaml:"bearer_token"`
+    Username    string `yaml:"username"`
+    Password    string `yaml:"password"`
+
+    // Targets are shell patterns as understood by path.Match, e.g. "*.team-a.example.com"
+    Targets []string `yaml:"targets"`
+    // Modules the tenant may use, any module if empty
+    Modules []string `yaml:"modules"`
+}
+
+// configRef matches ${VAR} references to environment variables and ${file:/path} references to files
+// in config values
+var configRef = regexp.MustCompile(`\$\{(?:file:([^}]+)|([A-Za-z_][A-Za-z0-9_]*))\}`)
+
+// interpolate replaces ${VAR} references with environment variables and ${file:/path} references with the
+// content of the file, so secrets don't have to live in the config file. Mapping keys are left alone, and
+// so is the content of the references, a secret containing ${...} is used as it is.
+func interpolate(node *yaml.Node) error {
+    if node.Kind == yaml.ScalarNode && node.Tag != "!!binary" {
+        var errs []string
+        value := configRef.ReplaceAllStringFunc(node.Value, func(ref string) string {
+            match := configRef.FindStringSubmatch(ref)
+            if path := match[1]; path != "" {
+                data, err := os.ReadFile(path)
+                if err != nil {
+                    errs = append(errs, err.Error())
+                }
+                return strings.TrimRight(string(data), "\r\n")
+            }
+            v, ok := os.LookupEnv(match[2])
+            if !ok {
+                errs = append(errs, fmt.Sprintf("environment variable %s is not set", match[2]))
+            }
+            return v
+        })
+        if len(errs) > 0 {
+            return fmt.Errorf("line %d: %s", node.Line, strings.Join(errs, ", "))
+        }
+        if value != node.Value {
+            node.Value = value
+            // Unquoted values are resolved again, so ${PORT} can fill in a number
+            if node.Style == 0 {
+                node.Tag = ""
+            }
+        }
+    }
+    for i, child := range node.Content {
+        if node.Kind == yaml.MappingNode && i%2 == 0 {
+            continue
+        }
+        if err := interpolate(child); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// loadProbeConfig reads and validates the YAML configuration. Unknown fields are rejected to catch typos.
+func loadProbeConfig(filePath string) (*probeConfig, error) {
+    raw, err := os.ReadFile(filePath)
+    if err != nil {
+        return nil, err
+    }
+
+    var root yaml.Node
+    if err := yaml.Unmarshal(raw, &root); err != nil {
+        return nil, fmt.Errorf("parsing %s: %v", filePath, err)
+    }
+    if err := interpolate(&root); err != nil {
+        return nil, fmt.Errorf("parsing %s: %v", filePath, err)
+    }
+    data, err := yaml.Marshal(&root)
+    if err != nil {
+        return nil, err
+    }
+
+    cfg := &probeConfig{}
+    dec := yaml.NewDecoder(bytes.NewReader(data))
+    dec.KnownFields(true)
+    if err := dec.Decode(cfg); err != nil && err != io.EOF {
+        return nil, fmt.Errorf("parsing %s: %v", filePath, err)
+    }
+
+    for _, pattern := range append(cfg.TargetPolicy.AllowDomains, cfg.TargetPolicy.DenyDomains...) {
+        if _, err := path.Match(pattern, ""); err != nil {
+            return nil, fmt.Errorf("target_policy: invalid domain pattern %q: %v", pattern, err)
+        }
+    }
+
+    if err := cfg.Limits.validate(); err != nil {
+        return nil, fmt.Errorf("limits: %v", err)
+    }
+
+    if err := cfg.Chatops.validate(); err != nil {
+        return nil, fmt.Errorf("chatops: %v", err)
+    }
+
+    for i, w := range cfg.MaintenanceWindows {
+        if len(w.Targets) == 0 || !w.End.After(w.Start) {
+            return nil, fmt.Errorf("maintenance window %d: targets and an end after the start are required", i)
+        }
+    }
+
+    for i, inv := range cfg.InventoryFiles {
+        if inv.Path == "" || inv.DomainColumn == "" {
+            return nil, fmt.Errorf("inventory file %d: path and domain_column are required", i)
+        }
+    }
+
+    for i, f := range cfg.ScanResults {
+        if f == nil {
+            return nil, fmt.Errorf("scan result %d: empty file", i)
+        }
+        if err := f.validate(); err != nil {
+            return nil, fmt.Errorf("scan result %d: %v", i, err)
+        }
+    }
+
+    for i, pc := range cfg.ProxyConfigs {
+        if pc.Path == "" || (pc.Type != proxyNginx && pc.Type != proxyHAProxy) {
+            return nil, fmt.Errorf("proxy config %d: path and a type of nginx or haproxy are required", i)
+        }
+    }
+
+    for i, z := range cfg.Zones {
+        if z == nil {
+            return nil, fmt.Errorf("zone %d: empty zone", i)
+        }
+        if err := z.validate(); err != nil {
+            return nil, fmt.Errorf("zone %d: %v", i, err)
+        }
+    }
+
+    for i, g := range cfg.Groups {
+        if g == nil {
+            return nil, fmt.Errorf("group %d: empty group", i)
+        }
+        if err := g.validate(); err != nil {
+            return nil, fmt.Errorf("group %d: %v", i, err)
+        }
+    }
+
+    for i, s := range cfg.PrometheusSources {
+        if s == nil {
+            return nil, fmt.Errorf("prometheus source %d: empty source", i)
+        }
+        if err := s.validate(); err != nil {
+            return nil, fmt.Errorf("prometheus source %d: %v", i, err)
+        }
+        if _, err := cfg.module(s.Module); err != nil {
+            return nil, fmt.Errorf("prometheus source %d: %v", i, err)
+        }
+    }
+
+    for i, s := range cfg.NetworkScans {
+        if s == nil {
+            return nil, fmt.Errorf("network scan %d: empty scan", i)
+        }
+        if err := s.validate(); err != nil {
+            return nil, fmt.Errorf("network scan %d: %v", i, err)
+        }
+        if _, err := cfg.module(s.Module); err != nil {
+            return nil, fmt.Errorf("network scan %d: %v", i, err)
+        }
+    }
+
+    for i, r := range cfg.Proxies {
+        if r == nil {
+            return nil, fmt.Errorf("proxy %d: empty rule", i)
+        }
+        if err := r.validate(); err != nil {
+            return nil, fmt.Errorf("proxy %d: %v", i, err)
+        }
+    }
+
+    if err := cfg.CTDiscovery.validate(); err != nil {
+        return nil, fmt.Errorf("ct_discovery: %v", err)
+    }
+    if err := cfg.Envoy.validate(); err != nil {
+        return nil, fmt.Errorf("envoy: %v", err)
+    }
+    if err := cfg.MailPolicies.validate(); err != nil {
+        return nil, fmt.Errorf("mail_policies: %v", err)
+    }
+    if err := cfg.Enrichment.validate(); err != nil {
+        return nil, fmt.Errorf("enrichment: %v", err)
+    }
+
+    for name, m := range cfg.Modules {
+        if m == nil {
+            return nil, fmt.Errorf("module %s: empty module", name)
+        }
+        if err := m.validate(); err != nil {
+            return nil, fmt.Errorf("module %s: %v", name, err)
+        }
+    }
+
+    for name, t := range cfg.Tenants {
+        if t == nil || (t.BearerToken == "" && t.Username == "") {
+            return nil, fmt.Errorf("tenant %s: bearer_token or username is required", name)
+        }
+        for _, m := range t.Modules {
+            if _, err := cfg.module(m); err != nil {
+                return nil, fmt.Errorf("tenant %s: %v", name, err)
+            }
+        }
+        for _, pattern := range t.Targets {
+            if _, err := path.Match(pattern, ""); err != nil {
+                return nil, fmt.Errorf("tenant %s: invalid target pattern %q: %v", name, pattern, err)
+            }
+        }
+    }
+    return cfg, nil
+}
+
+// module returns the configured or builtin module with the given name, the default module if name is empty
+func (c *probeConfig) module(name string) (*module, error) {
+    if name == "" {
+        name = defaultModule
+    }
+    if m, ok := c.Modules[name]; ok {
+        return m, nil
+    }
+    if m, ok := builtinModules[name]; ok {
+        return m, nil
+    }
+    return nil, fmt.Errorf("unknown module %q", name)
+}
+
+// tenantFor returns the tenant whose credentials the request carries, or nil if none match
+func (c *probeConfig) tenantFor(r *http.Request) (string, *tenantConfig) {
+    token := ""
+    if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+        token = strings.TrimPrefix(auth, "Bearer ")
+    }
+    username, password, hasBasic := r.BasicAuth()
+
+    for name, t := range c.Tenants {
+        if token != "" && t.BearerToken != "" && secureEqual(token, t.BearerToken) {
+            return name, t
+        }
+        if hasBasic && t.Username != "" && secureEqual(username, t.Username) && secureEqual(password, t.Password) {
+            return name, t
+        }
+    }
+    return "", nil
+}
+
+// enabled reports whether API credentials are configured
+func (a *apiConfig) enabled() bool {
+    return a.BearerToken != "" || a.Username != ""
+}
+
+// authorized reports whether the request carries the API credentials
+func (a *apiConfig) authorized(r *http.Request) bool {
+    if auth := r.Header.Get("Authorization"); a.BearerToken != "" && strings.HasPrefix(auth, "Bearer ") {
+        return secureEqual(strings.TrimPrefix(auth, "Bearer "), a.BearerToken)
+    }
+    username, password, ok := r.BasicAuth()
+    return ok && a.Username != "" && secureEqual(username, a.Username) && secureEqual(password, a.Password)
+}
+
+// protect wraps an API handler with authentication
+func (a *apiConfig) protect(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !a.enabled() {
+            http.Error(w, "API is disabled, configure api credentials to enable it", http.StatusNotFound)
+            return
+        }
+        if !a.authorized(r) {
+            w.Header().Set("WWW-Authenticate", `Basic realm="ssl_exporter"`)
+            http.Error(w, "unauthorized", http.StatusUnauthorized)
+            return
+        }
+        h.ServeHTTP(w, r)
+    })
+}
+
+// allows reports whether the tenant may probe the domain
+func (t *tenantConfig) allows(domain string) bool {
+    return matchesAny(t.Targets, domain)
+}
+
+// allowsModule reports whether the tenant may use the module
+func (t *tenantConfig) allowsModule(name string) bool {
+    if len(t.Modules) == 0 {
+        return true
+    }
+    if name == "" {
+        name = defaultModule
+    }
+    for _, m := range t.Modules {
+        if m == name {
+            return true
+        }
+    }
+    return false
+}
+
+// matchesAny reports whether the domain matches one of the patterns, ignoring case
+func matchesAny(patterns []string, domain string) bool {
+    domain = strings.ToLower(domain)
+    for _, pattern := range patterns {
+        if ok, _ := path.Match(strings.ToLower(pattern), domain); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// checkDomain returns an error if the domain is denied by the policy
+func (p *targetPolicy) checkDomain(domain string) error {
+    if matchesAny(p.DenyDomains, domain) {
+        return fmt.Errorf("domain %s is denied by target policy", domain)
+    }
+    if len(p.AllowDomains) > 0 && !matchesAny(p.AllowDomains, domain) {
+        return fmt.Errorf("domain %s is not allowed by target policy", domain)
+    }
+    return nil
+}
+
+// checkAddr returns an error if the IP address is denied by the policy
+func (p *targetPolicy) checkAddr(addr netip.Addr) error {
+    addr = addr.Unmap()
+    for _, prefix := range p.DenyCIDRs {
+        if prefix.Contains(addr) {
+            return fmt.Errorf("address %s is denied by target policy", addr)
+        }
+    }
+    if len(p.AllowCIDRs) == 0 {
+        return nil
+    }
+    for _, prefix := range p.AllowCIDRs {
+        if prefix.Contains(addr) {
+            return nil
+        }
+    }
+    return fmt.Errorf("address %s is not allowed by target policy", addr)
+}
+
+// check validates the domain and every address it resolves to
+func (p *targetPolicy) check(ctx context.Context, domain string) error {
+    if err := p.checkDomain(domain); err != nil {
+        return err
+    }
+    if len(p.AllowCIDRs) == 0 && len(p.DenyCIDRs) == 0 {
+        return nil
+    }
+    addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", domain)
+    if err != nil {
+        return err
+    }
+    for _, addr := range addrs {
+        if err := p.checkAddr(addr); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// dialer returns a probe dialer that refuses connections to denied addresses
+func (p *targetPolicy) dialer() *net.Dialer {
+    if len(p.AllowCIDRs) == 0 && len(p.DenyCIDRs) == 0 {
+        return probeDialing.dialer(nil)
+    }
+    return probeDialing.dialer(p.checkAddr)
+}
+
+// secureEqual compares secrets in constant time
+func secureEqual(a, b string) bool {
+    return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestLoadProbeConfigInterpolation(t *testing.T) {
+    dir := t.TempDir()
+    secret := filepath.Join(dir, "password")
+    if err := os.WriteFile(secret, []byte("s3cret ${NOT_EXPANDED}\n"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("SSL_EXPORTER_TEST_TOKEN", "token")
+    config := filepath.Join(dir, "config.yml")
+    if err := os.WriteFile(config, []byte(`
+api:
+  bearer_token: ${SSL_EXPORTER_TEST_TOKEN}
+  username: admin
+  password: ${file:`+secret+`}
+modules:
+  file:local:
+    prober: file
+groups:
+  - name: certs
+    module: file:local
+    targets:
+      - file:///etc/ssl/certs/server.pem
+      - domain: file:/etc/ssl/certs/other.pem
+`), 0o600); err != nil {
+        t.Fatal(err)
+    }
+
+    cfg, err := loadProbeConfig(config)
+    if err != nil {
+        t.Fatalf("loading config: %v", err)
+    }
+    if cfg.API.BearerToken != "token" {
+        t.Errorf("got bearer token %q, want the environment variable", cfg.API.BearerToken)
+    }
+    if cfg.API.Password != "s3cret ${NOT_EXPANDED}" {
+        t.Errorf("got password %q, want the content of the file", cfg.API.Password)
+    }
+    if _, ok := cfg.Modules["file:local"]; !ok {
+        t.Errorf("got modules %v, want the key file:local unchanged", cfg.Modules)
+    }
+    targets := cfg.Groups[0].Targets
+    if targets[0].Domain != "file:///etc/ssl/certs/server.pem" || targets[1].Domain != "file:/etc/ssl/certs/other.pem" {
+        t.Errorf("got targets %s and %s, want them unchanged", targets[0].Domain, targets[1].Domain)
+    }
+    if cfg.Groups[0].Module != "file:local" {
+        t.Errorf("got module %q, want file:local", cfg.Groups[0].Module)
+    }
+}
+
+func TestLoadProbeConfigInterpolationErrors(t *testing.T) {
+    dir := t.TempDir()
+    for name, value := range map[string]string{
+        "missing variable": "${SSL_EXPORTER_TEST_UNSET}",
+        "missing file":     "${file:" + filepath.Join(dir, "missing") + "}",
+    } {
+        t.Run(name, func(t *testing.T) {
+            config := filepath.Join(dir, "config.yml")
+            if err := os.WriteFile(config, []byte("api:\n  bearer_token: "+value+"\n"), 0o600); err != nil {
+                t.Fatal(err)
+            }
+            if _, err := loadProbeConfig(config); err == nil {
+                t.Error("loading succeeded, want an error")
+            }
+        })
+    }
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+    "crypto/x509"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math/big"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// ctDiscovery queries crt.sh for the certificates logged to Certificate Transparency for our domains
+type ctDiscovery struct {
+    Domains  []string      `yaml:"domains"`  // subdomains are included
+    URL      string        `yaml:"url"`      // https://crt.sh by default
+    Interval time.Duration `yaml:"interval"` // 12h by default
+}
+
+// validate fills in defaults
+func (c *ctDiscovery) validate() error {
+    if len(c.Domains) == 0 {
+        return nil
+    }
+    if c.URL == "" {
+        c.URL = "https://crt.sh"
+    }
+    if c.Interval == 0 {
+        c.Interval = 12 * time.Hour
+    }
+    if c.Interval < time.Hour {
+        return fmt.Errorf("interval must be at least 1h, crt.sh rate limits its users")
+    }
+    return nil
+}
+
+// ctEntry is a certificate as returned by the crt.sh JSON API
+type ctEntry struct {
+    ID           int64  `json:"id"`
+    IssuerName   string `json:"issuer_name"`
+    CommonName   string `json:"common_name"`
+    SerialNumber string `json:"serial_number"`
+    NotAfter     string `json:"not_after"`
+}
+
+// ctCertificate is an unexpired certificate logged for one of the domains
+type ctCertificate struct {
+    domain     string
+    id         string
+    serial     string
+    issuer     string
+    commonName string
+    notAfter   time.Time
+}
+
+// ctCertificates exports the certificates found in CT logs and whether a configured target served them.
+// Certificates nobody serves were possibly issued outside the usual pipeline.
+type ctCertificates struct {
+    cfg    ctDiscovery
+    client *http.Client
+
+    mu     sync.Mutex
+    certs  []ctCertificate
+    served map[string]bool // serials of the leaves served by the configured targets
+
+    notAfterDesc *prometheus.Desc
+    servedDesc   *prometheus.Desc
+}
+
+// newCTCertificates returns the collector for the configured discovery
+func newCTCertificates(cfg ctDiscovery) *ctCertificates {
+    labels := []string{"domain", "crtsh_id", "serial", "issuer", "common_name"}
+    return &ctCertificates{
+        cfg:    cfg,
+        client: &http.Client{Timeout: 6 * dialTimeout},
+        served: make(map[string]bool),
+        notAfterDesc: prometheus.NewDesc(
+            "ssl_ct_certificate_not_after",
+            "Expiry date in Unix timestamp of an unexpired certificate logged to Certificate Transparency for a domain",
+            labels, nil,
+        ),
+        servedDesc: prometheus.NewDesc(
+            "ssl_ct_certificate_served",
+            "1 if a configured target served the logged certificate since the exporter started, 0 if none did",
+            labels, nil,
+        ),
+    }
+}
+
+// normalizeSerial returns the hex serial number without leading zeros, as crt.sh pads them
+func normalizeSerial(serial string) string {
+    n, ok := new(big.Int).SetString(serial, 16)
+    if !ok {
+        return strings.ToLower(serial)
+    }
+    return n.Text(16)
+}
+
+// observe records the leaf a configured target served
+func (c *ctCertificates) observe(leaf *x509.Certificate) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.served[leaf.SerialNumber.Text(16)] = true
+}
+
+// query returns the unexpired certificates crt.sh knows for the domain and its subdomains
+func (c *ctCertificates) query(domain string) ([]ctCertificate, error) {
+    seen := make(map[int64]bool)
+    var certs []ctCertificate
+    for _, q := range []string{domain, "%." + domain} {
+        params := url.Values{"q": {q}, "output": {"json"}, "exclude": {"expired"}, "deduplicate": {"Y"}}
+        resp, err := c.client.Get(strings.TrimSuffix(c.cfg.URL, "/") + "/?" + params.Encode())
+        if err != nil {
+            return nil, err
+        }
+        var entries []ctEntry
+        if resp.StatusCode != http.StatusOK {
+            resp.Body.Close()
+            return nil, fmt.Errorf("unexpected status %s", resp.Status)
+        }
+        err = json.NewDecoder(resp.Body).Decode(&entries)
+        resp.Body.Close()
+        if err != nil {
+            return nil, err
+        }
+
+        for _, e := range entries {
+            if seen[e.ID] {
+                continue
+            }
+            seen[e.ID] = true
+            notAfter, err := time.Parse("2006-01-02T15:04:05", e.NotAfter)
+            if err != nil {
+                return nil, fmt.Errorf("certificate %d: %v", e.ID, err)
+            }
+            certs = append(certs, ctCertificate{
+                domain:     domain,
+                id:         strconv.FormatInt(e.ID, 10),
+                serial:     normalizeSerial(e.SerialNumber),
+                issuer:     e.IssuerName,
+                commonName: e.CommonName,
+                notAfter:   notAfter,
+            })
+        }
+    }
+    return certs, nil
+}
+
+// update queries every domain. The certificates of a domain whose query fails are kept from the last run.
+func (c *ctCertificates) update() {
+    var certs []ctCertificate
+    c.mu.Lock()
+    previous := c.certs
+    c.mu.Unlock()
+    for _, domain := range c.cfg.Domains {
+        found, err := c.query(domain)
+        if err != nil {
+            log.Printf("Error querying CT logs for domain %s: %v", domain, err)
+            for _, cert := range previous {
+                if cert.domain == domain {
+                    certs = append(certs, cert)
+                }
+            }
+            continue
+        }
+        log.Printf("Found %d unexpired certificates in CT logs for domain %s", len(found), domain)
+        certs = append(certs, found...)
+    }
+    c.mu.Lock()
+    c.certs = certs
+    c.mu.Unlock()
+}
+
+// run updates the certificates right away and then at the configured interval
+func (c *ctCertificates) run() {
+    for {
+        c.update()
+        time.Sleep(c.cfg.Interval)
+    }
+}
+
+func (c *ctCertificates) Describe(ch chan<- *prometheus.Desc) {
+    ch <- c.notAfterDesc
+    ch <- c.servedDesc
+}
+
+func (c *ctCertificates) Collect(ch chan<- prometheus.Metric) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    now := certClock.Now()
+    for _, cert := range c.certs {
+        // Certificates expiring between two queries are dropped right away
+        if cert.notAfter.Before(now) {
+            continue
+        }
+        labels := []string{cert.domain, cert.id, cert.serial, cert.issuer, cert.commonName}
+        ch <- prometheus.MustNewConstMetric(c.notAfterDesc, prometheus.GaugeValue, float64(cert.notAfter.Unix()), labels...)
+        served := 0.0
+        if c.served[cert.serial] {
+            served = 1
+        }
+        ch <- prometheus.MustNewConstMetric(c.servedDesc, prometheus.GaugeValue, served, labels...)
+    }
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+)
+
+// stringsFlag collects the values of a repeated string flag
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(value string) error {
+    *s = append(*s, value)
+    return nil
+}
+
+// dashboardOptions tailor the generated Grafana dashboard
+type dashboardOptions struct {
+    title  string
+    uid    string
+    labels []string // extra labels offered as dashboard variables, e.g. job or env
+}
+
+// genDashboard implements the gen-dashboard subcommand, writing a Grafana dashboard to stdout
+func genDashboard(args []string) int {
+    fs := flag.NewFlagSet("gen-dashboard", flag.ExitOnError)
+    var (
+        title  = fs.String("title", "SSL certificates", "Title of the dashboard.")
+        uid    = fs.String("uid", "ssl-exporter", "UID of the dashboard.")
+        labels stringsFlag
+    )
+    fs.Var(&labels, "label", "Additional label to filter by with a dashboard variable, e.g. job. Can be repeated.")
+    fs.Parse(args)
+
+    if err := writeDashboard(os.Stdout, dashboardOptions{title: *title, uid: *uid, labels: labels}); err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to write dashboard: %v\n", err)
+        return 1
+    }
+    return 0
+}
+
+// dashboardHandler serves the default dashboard so it can be imported straight from the exporter
+func dashboardHandler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        opts := dashboardOptions{title: "SSL certificates", uid: "ssl-exporter", labels: r.URL.Query()["label"]}
+        w.Header().Set("Content-Type", "application/json")
+        if err := writeDashboard(w, opts); err != nil {
+            log.Printf("Error writing dashboard: %v", err)
+        }
+    })
+}
+
+// writeDashboard renders the dashboard JSON for the exporter's metrics
+func writeDashboard(w io.Writer, opts dashboardOptions) error {
+    datasource := map[string]string{"type": "prometheus", "uid": "${datasource}"}
+
+    // Every panel filters by the domain variable and the extra label variables
+    matchers := []string{`domain=~"$domain"`}
+    variables := []interface{}{
+        map[string]interface{}{
+            "name":  "datasource",
+            "type":  "datasource",
+            "query": "prometheus",
+        },
+    }
+    for _, label := range append([]string{"domain"}, opts.labels...) {
+        if label != "domain" {
+            matchers = append(matchers, fmt.Sprintf(`%s=~"$%s"`, label, label))
+        }
+        variables = append(variables, map[string]interface{}{
+            "name":       label,
+            "type":       "query",
+            "datasource": datasource,
+            "query":      fmt.Sprintf("label_values(%s, %s)", metricCertExpiry, label),
+            "refresh":    2,
+            "multi":      true,
+            "includeAll": true,
+            "allValue":   ".*",
+        })
+    }
+    sel := "{" + strings.Join(matchers, ",") + "}"
+
+    panel := func(id int, title, kind, expr, legend string, x, y, width, height int) map[string]interface{} {
+        return map[string]interface{}{
+            "id":         id,
+            "title":      title,
+            "type":       kind,
+            "datasource": datasource,
+            "gridPos":    map[string]int{"x": x, "y": y, "w": width, "h": height},
+            "targets": []interface{}{
+                map[string]interface{}{"refId": "A", "expr": expr, "legendFormat": legend},
+            },
+        }
+    }
+    daysLeft := fmt.Sprintf("(%s%s - time()) / 86400", metricCertExpiry, sel)
+
+    expiring := panel(1, "Certificates expiring within 30 days", "stat", fmt.Sprintf("count(%s < 30) or vector(0)", daysLeft), "", 0, 0, 6, 4)
+    stale := panel(2, "Domains with stale intermediates", "stat", fmt.Sprintf("count(%s%s == 1) or vector(0)", metricChainExpiredIntermediate, sel), "", 6, 0, 6, 4)
+    table := panel(3, "Days until expiry", "table", fmt.Sprintf("sort(%s)", daysLeft), "{{domain}}", 12, 0, 12, 12)
+    table["targets"].([]interface{})[0].(map[string]interface{})["format"] = "table"
+    table["targets"].([]interface{})[0].(map[string]interface{})["instant"] = true
+    history := panel(4, "Days until expiry over time", "timeseries", daysLeft, "{{domain}}", 0, 4, 12, 8)
+    chains := panel(5, "Days until expiry per verified chain", "timeseries", fmt.Sprintf("(%s%s - time()) / 86400", metricChainExpiry, sel), "{{domain}} chain {{chain_no}}", 0, 12, 24, 8)
+
+    dashboard := map[string]interface{}{
+        "uid":           opts.uid,
+        "title":         opts.title,
+        "tags":          []string{"ssl", "certificates"},
+        "schemaVersion": 39,
+        "time":          map[string]string{"from": "now-7d", "to": "now"},
+        "templating":    map[string]interface{}{"list": variables},
+        "panels":        []interface{}{expiring, stale, table, history, chains},
+    }
+
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    return enc.Encode(dashboard)
+}
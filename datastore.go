@@ -0,0 +1,123 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "crypto/tls"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "strings"
+    "time"
+)
+
+// mongoOpMsg is the opcode of MongoDB's OP_MSG
+const mongoOpMsg = 2013
+
+// mongoHello is an OP_MSG with the hello command drivers start their connections with
+var mongoHello = func() []byte {
+    doc := []byte{0, 0, 0, 0}
+    doc = append(doc, 0x10) // int32
+    doc = append(doc, "hello\x00"...)
+    doc = binary.LittleEndian.AppendUint32(doc, 1)
+    doc = append(doc, 0x02) // string
+    doc = append(doc, "$db\x00"...)
+    doc = binary.LittleEndian.AppendUint32(doc, uint32(len("admin")+1))
+    doc = append(doc, "admin\x00"...)
+    doc = append(doc, 0)
+    binary.LittleEndian.PutUint32(doc, uint32(len(doc)))
+
+    msg := make([]byte, 16, 16+4+1+len(doc))
+    binary.LittleEndian.PutUint32(msg[4:], 1) // requestID
+    binary.LittleEndian.PutUint32(msg[12:], mongoOpMsg)
+    msg = binary.LittleEndian.AppendUint32(msg, 0) // flagBits
+    msg = append(msg, 0)                           // body section
+    msg = append(msg, doc...)
+    binary.LittleEndian.PutUint32(msg, uint32(len(msg)))
+    return msg
+}()
+
+// getMongoDBConnState runs the TLS handshake with a MongoDB server and returns its state. With hello the
+// connection is used like a driver would before it is closed, so mongod doesn't log it as failed.
+func getMongoDBConnState(ctx context.Context, conn net.Conn, tlsCfg *tls.Config, hello bool) (tls.ConnectionState, time.Duration, error) {
+    tlsConn, took, err := handshake(ctx, conn, tlsCfg)
+    if err != nil {
+        return tls.ConnectionState{}, took, err
+    }
+    state := tlsConn.ConnectionState()
+    if !hello {
+        return state, took, nil
+    }
+    if err := mongoExchange(tlsConn); err != nil {
+        log.Printf("Error sending hello to MongoDB server %s: %v", conn.RemoteAddr(), err)
+    }
+    return state, took, nil
+}
+
+// mongoExchange sends the hello command and reads the reply
+func mongoExchange(conn *tls.Conn) error {
+    if _, err := conn.Write(mongoHello); err != nil {
+        return err
+    }
+    header := make([]byte, 16)
+    if _, err := io.ReadFull(conn, header); err != nil {
+        return err
+    }
+    length := int(binary.LittleEndian.Uint32(header))
+    if length < 16 || length > 16<<20 {
+        return fmt.Errorf("invalid message length %d", length)
+    }
+    if opCode := binary.LittleEndian.Uint32(header[12:]); opCode != mongoOpMsg {
+        return fmt.Errorf("unexpected opcode %d", opCode)
+    }
+    _, err := io.CopyN(io.Discard, conn, int64(length-16))
+    return err
+}
+
+// getRedisConnState runs the TLS handshake with a Redis server on its tls-port and returns its state. With quit
+// the client authenticates if a password is set and ends the session with QUIT, so the server sees a clean close.
+func getRedisConnState(ctx context.Context, conn net.Conn, tlsCfg *tls.Config, quit bool, username, password string) (tls.ConnectionState, time.Duration, error) {
+    tlsConn, took, err := handshake(ctx, conn, tlsCfg)
+    if err != nil {
+        return tls.ConnectionState{}, took, err
+    }
+    state := tlsConn.ConnectionState()
+    if !quit {
+        return state, took, nil
+    }
+    r := bufio.NewReader(tlsConn)
+    if password != "" {
+        args := []string{"AUTH", password}
+        if username != "" {
+            args = []string{"AUTH", username, password}
+        }
+        if err := redisCommand(tlsConn, r, args...); err != nil {
+            log.Printf("Error authenticating to Redis server %s: %v", conn.RemoteAddr(), err)
+        }
+    }
+    if err := redisCommand(tlsConn, r, "QUIT"); err != nil {
+        log.Printf("Error closing Redis session with %s: %v", conn.RemoteAddr(), err)
+    }
+    return state, took, nil
+}
+
+// redisCommand sends a command and reads its simple string reply
+func redisCommand(conn *tls.Conn, r *bufio.Reader, args ...string) error {
+    cmd := fmt.Sprintf("*%d\r\n", len(args))
+    for _, arg := range args {
+        cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+    }
+    if _, err := conn.Write([]byte(cmd)); err != nil {
+        return err
+    }
+    reply, err := r.ReadString('\n')
+    if err != nil {
+        return err
+    }
+    if strings.HasPrefix(reply, "-") {
+        return fmt.Errorf("%s", strings.TrimSpace(reply[1:]))
+    }
+    return nil
+}
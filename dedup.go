@@ -0,0 +1,130 @@
+package main
+
+import (
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/hex"
+    "fmt"
+    "sync"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// Layouts of the certificate start and expiry metrics
+const (
+    certMetricsDomain      = "domain"
+    certMetricsFingerprint = "fingerprint"
+    certMetricsBoth        = "both"
+)
+
+// fingerprintIndex exports the leaf certificates of all targets once per certificate, keyed by the SHA-256
+// fingerprint, with the number of targets serving it. Thousands of vhosts sharing a wildcard certificate
+// then cost three series instead of thousands.
+type fingerprintIndex struct {
+    mu     sync.Mutex
+    leaves map[string]*x509.Certificate // leaf last served per domain
+
+    notBeforeDesc *prometheus.Desc
+    notAfterDesc  *prometheus.Desc
+    targetsDesc   *prometheus.Desc
+}
+
+// newFingerprintIndex returns an empty index
+func newFingerprintIndex() *fingerprintIndex {
+    return &fingerprintIndex{
+        leaves: make(map[string]*x509.Certificate),
+        notBeforeDesc: prometheus.NewDesc(
+            metricCertNotBefore,
+            "Start date of a certificate in Unix timestamp",
+            []string{"fingerprint", "subject_cn"}, nil,
+        ),
+        notAfterDesc: prometheus.NewDesc(
+            metricCertNotAfter,
+            "Expiry date of a certificate in Unix timestamp",
+            []string{"fingerprint", "subject_cn"}, nil,
+        ),
+        targetsDesc: prometheus.NewDesc(
+            metricCertTargets,
+            "Number of targets serving a certificate",
+            []string{"fingerprint", "subject_cn"}, nil,
+        ),
+    }
+}
+
+// update records the leaf certificate domain serves
+func (f *fingerprintIndex) update(domain string, leaf *x509.Certificate) {
+    f.mu.Lock()
+    f.leaves[domain] = leaf
+    f.mu.Unlock()
+}
+
+// remove forgets the leaf of domain
+func (f *fingerprintIndex) remove(domain string) {
+    f.mu.Lock()
+    delete(f.leaves, domain)
+    f.mu.Unlock()
+}
+
+// fingerprint returns the hex encoded SHA-256 hash of the certificate
+func fingerprint(cert *x509.Certificate) string {
+    sum := sha256.Sum256(cert.Raw)
+    return hex.EncodeToString(sum[:])
+}
+
+// chainID returns the hex encoded SHA-256 hash of the chain as served, certificates in order. DER encodings
+// are self-delimiting, so their concatenation identifies the chain.
+func chainID(chain []*x509.Certificate) string {
+    h := sha256.New()
+    for _, cert := range chain {
+        h.Write(cert.Raw)
+    }
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// duplicateCerts returns how many certificates of the chain repeat an earlier one
+func duplicateCerts(chain []*x509.Certificate) int {
+    seen := make(map[string]bool, len(chain))
+    duplicates := 0
+    for _, cert := range chain {
+        fp := fingerprint(cert)
+        if seen[fp] {
+            duplicates++
+        }
+        seen[fp] = true
+    }
+    return duplicates
+}
+
+func (f *fingerprintIndex) Describe(ch chan<- *prometheus.Desc) {
+    ch <- f.notBeforeDesc
+    ch <- f.notAfterDesc
+    ch <- f.targetsDesc
+}
+
+func (f *fingerprintIndex) Collect(ch chan<- prometheus.Metric) {
+    f.mu.Lock()
+    certs := make(map[string]*x509.Certificate)
+    targets := make(map[string]int)
+    for _, leaf := range f.leaves {
+        fp := fingerprint(leaf)
+        certs[fp] = leaf
+        targets[fp]++
+    }
+    f.mu.Unlock()
+
+    for fp, cert := range certs {
+        cn := cert.Subject.CommonName
+        ch <- prometheus.MustNewConstMetric(f.notBeforeDesc, prometheus.GaugeValue, float64(cert.NotBefore.Unix()), fp, cn)
+        ch <- prometheus.MustNewConstMetric(f.notAfterDesc, prometheus.GaugeValue, float64(cert.NotAfter.Unix()), fp, cn)
+        ch <- prometheus.MustNewConstMetric(f.targetsDesc, prometheus.GaugeValue, float64(targets[fp]), fp, cn)
+    }
+}
+
+// checkCertMetricsLayout validates the value of the cert-metrics flag
+func checkCertMetricsLayout(layout string) error {
+    switch layout {
+    case certMetricsDomain, certMetricsFingerprint, certMetricsBoth:
+        return nil
+    }
+    return fmt.Errorf("unknown layout %q, expected domain, fingerprint or both", layout)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+    "context"
+    "crypto/x509"
+    "fmt"
+    "log"
+    "strings"
+)
+
+// Target labels naming the copy of the certificate the server should be serving
+const (
+    certFileLabel   = "cert_file"   // path of a PEM file
+    certSecretLabel = "cert_secret" // namespace/name of a Kubernetes TLS secret
+)
+
+// deployedLeaf reads the leaf certificate a target should serve. It returns nil if the target has no source.
+func deployedLeaf(ctx context.Context, t target, kube *kubeClient) (*x509.Certificate, string, error) {
+    if path := t.Labels[certFileLabel]; path != "" {
+        chain, err := readCertFile(path)
+        if err != nil {
+            return nil, path, err
+        }
+        return chain[0], path, nil
+    }
+    if ref := t.Labels[certSecretLabel]; ref != "" {
+        namespace, name, ok := strings.Cut(ref, "/")
+        if !ok {
+            return nil, ref, fmt.Errorf("invalid %s %q, expected namespace/name", certSecretLabel, ref)
+        }
+        if kube == nil {
+            return nil, ref, fmt.Errorf("%s needs Kubernetes mode", certSecretLabel)
+        }
+        chain, err := secretChain(ctx, kube, namespace, name)
+        if err != nil {
+            return nil, ref, err
+        }
+        return chain[0], ref, nil
+    }
+    return nil, "", nil
+}
+
+// checkDeployment compares the served leaf with the deployed one and exports whether they match.
+// A mismatch catches certificates that were renewed but never loaded by the server.
+func (m *certMetrics) checkDeployment(t target, served *x509.Certificate, kube *kubeClient) {
+    ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+    defer cancel()
+    deployed, source, err := deployedLeaf(ctx, t, kube)
+    if err != nil {
+        log.Printf("Error reading deployed certificate of domain %s from %s: %v", t.Domain, source, err)
+        return
+    }
+    if deployed == nil {
+        return
+    }
+
+    synced := 1.0
+    if fingerprint(deployed) != fingerprint(served) {
+        synced = 0
+        log.Printf("Domain %s serves a certificate expiring %v, but %s holds one expiring %v", t.Domain, served.NotAfter, source, deployed.NotAfter)
+    }
+    m.deploymentSynced.forget(t.Domain)
+    m.deploymentSynced.set(t.Domain, synced, source)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+    "context"
+    "net"
+    "net/netip"
+    "syscall"
+    "time"
+)
+
+// defaultFallbackDelay is how long the first address family gets before the other one is tried in parallel,
+// the default of net.Dialer
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// dialTuning tunes the TCP connections of all probes
+type dialTuning struct {
+    keepAlive     time.Duration // interval of keep-alive probes, disabled if negative
+    fastOpen      bool          // send the first bytes with the SYN
+    fallbackDelay time.Duration // head start of the preferred address family, addresses are tried one by one if negative
+}
+
+// probeDialing is the tuning of the probes' connections, set from the command line
+var probeDialing dialTuning
+
+// dialer returns a dialer with the tuning. If check is set, connections to addresses it rejects are refused.
+// Checking at connect time prevents DNS rebinding between a policy check and the probe.
+func (d dialTuning) dialer(check func(netip.Addr) error) *net.Dialer {
+    dialer := &net.Dialer{
+        Timeout:       dialTimeout,
+        KeepAlive:     d.keepAlive,
+        FallbackDelay: d.fallbackDelay,
+    }
+    if !d.fastOpen && check == nil {
+        return dialer
+    }
+    dialer.Control = func(network, address string, c syscall.RawConn) error {
+        if check != nil {
+            addrPort, err := netip.ParseAddrPort(address)
+            if err != nil {
+                return err
+            }
+            if err := check(addrPort.Addr()); err != nil {
+                return err
+            }
+        }
+        if d.fastOpen {
+            return fastOpenControl(network, address, c)
+        }
+        return nil
+    }
+    return dialer
+}
+
+// proxyDialer returns a copy of a probe dialer for connecting to a proxy. The proxy is set by the operator,
+// so the address check of the target policy is left out, the rest of the tuning is kept.
+func (d dialTuning) proxyDialer(dialer *net.Dialer) *net.Dialer {
+    proxy := *dialer
+    proxy.Control = nil
+    if d.fastOpen {
+        proxy.Control = fastOpenControl
+    }
+    return &proxy
+}
+
+// dialAny connects to the first reachable address. Like net.Dialer does for host names, the addresses of the
+// first one's family get a head start of the dialer's FallbackDelay before the other family is raced against
+// them (RFC 8305), so a broken IPv6 path doesn't cost a full timeout per probe.
+func dialAny(ctx context.Context, dialer *net.Dialer, addrs []netip.Addr, port string) (net.Conn, error) {
+    var primaries, fallbacks []netip.Addr
+    for _, addr := range addrs {
+        if addr.Unmap().Is4() == addrs[0].Unmap().Is4() {
+            primaries = append(primaries, addr)
+        } else {
+            fallbacks = append(fallbacks, addr)
+        }
+    }
+    if len(fallbacks) == 0 || dialer.FallbackDelay < 0 {
+        return dialSerial(ctx, dialer, addrs, port)
+    }
+    delay := dialer.FallbackDelay
+    if delay == 0 {
+        delay = defaultFallbackDelay
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    type dialResult struct {
+        conn net.Conn
+        err  error
+    }
+    results := make(chan dialResult, 2)
+    race := func(addrs []netip.Addr) {
+        conn, err := dialSerial(ctx, dialer, addrs, port)
+        results <- dialResult{conn, err}
+    }
+    go race(primaries)
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+
+    pending, fallbackStarted := 1, false
+    var firstErr error
+    for {
+        select {
+        case <-timer.C:
+            if !fallbackStarted {
+                fallbackStarted = true
+                pending++
+                go race(fallbacks)
+            }
+        case r := <-results:
+            pending--
+            if r.err == nil {
+                if pending > 0 {
+                    // The other family may still connect before it sees the cancellation
+                    go func() {
+                        if loser := <-results; loser.conn != nil {
+                            loser.conn.Close()
+                        }
+                    }()
+                }
+                return r.conn, nil
+            }
+            if firstErr == nil {
+                firstErr = r.err
+            }
+            if !fallbackStarted {
+                fallbackStarted = true
+                pending++
+                go race(fallbacks)
+            } else if pending == 0 {
+                return nil, firstErr
+            }
+        }
+    }
+}
+
+// dialSerial connects to the first reachable address, trying them in order
+func dialSerial(ctx context.Context, dialer *net.Dialer, addrs []netip.Addr, port string) (net.Conn, error) {
+    var err error
+    for _, addr := range addrs {
+        var conn net.Conn
+        conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+        if err == nil {
+            return conn, nil
+        }
+    }
+    return nil, err
+}
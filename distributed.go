@@ -0,0 +1,471 @@
+package main
+
+import (
+    "bytes"
+    "crypto/tls"
+    "encoding/json"
+    "fmt"
+    "hash/fnv"
+    "log"
+    "net/http"
+    "net/netip"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// regionLabel is the target label naming the region whose workers should probe the target
+const regionLabel = "region"
+
+// heartbeatInterval is how often workers register with the coordinator and fetch their targets.
+// Workers missing three heartbeats are considered dead and their targets are reassigned.
+const heartbeatInterval = 30 * time.Second
+
+// workerHeartbeat registers a worker with the coordinator
+type workerHeartbeat struct {
+    Name   string `json:"name"`
+    Region string `json:"region,omitempty"`
+}
+
+// workerReport carries the results of a worker's probes
+type workerReport struct {
+    Name    string         `json:"name"`
+    Results []workerResult `json:"results"`
+}
+
+// workerResult is the outcome of a probe a worker reports to the coordinator
+type workerResult struct {
+    Domain string    `json:"domain"`
+    Time   time.Time `json:"time"`
+    Reason string    `json:"reason,omitempty"`
+    Error  string    `json:"error,omitempty"`
+
+    Chain           [][]byte             `json:"chain,omitempty"` // DER encoded certificates, leaf first
+    ServerName      string               `json:"server_name,omitempty"`
+    SkipVerify      bool                 `json:"skip_verify,omitempty"`
+    FallbackSteps   int                  `json:"fallback_steps,omitempty"`
+    MaxVersion      uint16               `json:"max_version,omitempty"`
+    Phases          map[string]float64   `json:"phases,omitempty"` // seconds
+    Address         string               `json:"address,omitempty"`
+    AddressNotAfter map[string]time.Time `json:"address_not_after,omitempty"`
+    OCSPStaple      []byte               `json:"ocsp_staple,omitempty"`
+    Findings        map[string]bool      `json:"findings,omitempty"`
+    CurveID         tls.CurveID          `json:"curve_id,omitempty"`
+    EarlyData       *bool                `json:"early_data,omitempty"`
+    ScriptPass      *bool                `json:"script_pass,omitempty"`
+}
+
+// newWorkerResult describes the result of a probe for the coordinator
+func newWorkerResult(domain string, res *probeResult, err error, now time.Time) workerResult {
+    r := workerResult{Domain: domain, Time: now}
+    if err != nil {
+        r.Reason = classifyProbeError(err)
+        r.Error = err.Error()
+        return r
+    }
+    for _, cert := range res.chain {
+        r.Chain = append(r.Chain, cert.Raw)
+    }
+    r.ServerName = res.serverName
+    r.SkipVerify = res.skipVerify
+    r.FallbackSteps = res.fallbackSteps
+    r.MaxVersion = res.maxVersion
+    r.Findings = res.findings
+    r.EarlyData = res.earlyData
+    r.ScriptPass = res.scriptPass
+    if res.tlsState != nil {
+        r.OCSPStaple = res.tlsState.OCSPResponse
+        r.CurveID = res.tlsState.CurveID
+    }
+    if len(res.phases) > 0 {
+        r.Phases = make(map[string]float64, len(res.phases))
+        for phase, took := range res.phases {
+            r.Phases[phase] = took.Seconds()
+        }
+    }
+    if res.address.IsValid() {
+        r.Address = res.address.String()
+    }
+    if len(res.addressNotAfter) > 0 {
+        r.AddressNotAfter = make(map[string]time.Time, len(res.addressNotAfter))
+        for addr, notAfter := range res.addressNotAfter {
+            r.AddressNotAfter[addr.String()] = notAfter
+        }
+    }
+    return r
+}
+
+// probeResult rebuilds the result of the probe, verified against the trust anchors of the module
+func (r workerResult) probeResult(mod *module) (*probeResult, error) {
+    if r.Error != "" {
+        return nil, &remoteProbeError{reason: r.Reason, msg: r.Error}
+    }
+    if len(r.Chain) == 0 {
+        return nil, fmt.Errorf("worker reported no certificates")
+    }
+    res := &probeResult{
+        serverName:    r.ServerName,
+        spiffeID:      mod.TLSConfig.Spiffe.expectedServerID(),
+        skipVerify:    r.SkipVerify,
+        roots:         mod.rootPool(),
+        trust:         mod.trustSource(),
+        fallbackSteps: r.FallbackSteps,
+        maxVersion:    r.MaxVersion,
+        findings:      r.Findings,
+        earlyData:     r.EarlyData,
+        scriptPass:    r.ScriptPass,
+        pqOffered:     mod.TLSConfig.offersPostQuantum(),
+        phases:        make(map[string]time.Duration, len(r.Phases)),
+    }
+    var err error
+    if res.chain, res.parseError, err = parseChain(r.Chain); err != nil {
+        return nil, fmt.Errorf("parsing certificate reported by worker: %v", err)
+    }
+    // Workers only probe network targets, the state holds what the coordinator's metrics need of the handshake
+    res.tlsState = &tls.ConnectionState{PeerCertificates: res.chain, OCSPResponse: r.OCSPStaple, CurveID: r.CurveID}
+    if len(r.OCSPStaple) > 0 {
+        res.ocspStaple, res.ocspErr = parseStaple(r.OCSPStaple, res.chain)
+    }
+    for phase, seconds := range r.Phases {
+        res.phases[phase] = time.Duration(seconds * float64(time.Second))
+    }
+    res.address, _ = netip.ParseAddr(r.Address)
+    if len(r.AddressNotAfter) > 0 {
+        res.addressNotAfter = make(map[netip.Addr]time.Time, len(r.AddressNotAfter))
+        for addr, notAfter := range r.AddressNotAfter {
+            if a, err := netip.ParseAddr(addr); err == nil {
+                res.addressNotAfter[a] = notAfter
+            }
+        }
+    }
+    return res, nil
+}
+
+// workerState is what the coordinator knows about a worker
+type workerState struct {
+    region   string
+    seen     time.Time
+    assigned int
+}
+
+// coordinator shards the network targets among the registered workers and records the results they report.
+// File and keystore targets are local to the coordinator's host and always probed there.
+type coordinator struct {
+    e       *exporter
+    targets func() []target
+
+    mu      sync.Mutex
+    workers map[string]*workerState
+
+    heartbeatDesc *prometheus.Desc
+    targetsDesc   *prometheus.Desc
+}
+
+// newCoordinator returns a coordinator distributing the targets the function returns
+func newCoordinator(e *exporter, targets func() []target) *coordinator {
+    return &coordinator{
+        e:       e,
+        targets: targets,
+        workers: make(map[string]*workerState),
+        heartbeatDesc: prometheus.NewDesc(
+            "ssl_worker_last_heartbeat_timestamp",
+            "Time of the last heartbeat of a worker registered with this coordinator",
+            []string{"worker", "region"}, nil,
+        ),
+        targetsDesc: prometheus.NewDesc(
+            "ssl_worker_targets",
+            "Number of targets assigned to a worker at its last heartbeat",
+            []string{"worker", "region"}, nil,
+        ),
+    }
+}
+
+// liveWorkers returns the names of the workers whose last heartbeat is recent. It must be called with mu held.
+func (c *coordinator) liveWorkers(now time.Time) []string {
+    var names []string
+    for name, w := range c.workers {
+        if now.Sub(w.seen) < 3*heartbeatInterval {
+            names = append(names, name)
+        }
+    }
+    return names
+}
+
+// active reports whether a worker is alive, so the network targets are left to the workers
+func (c *coordinator) active() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return len(c.liveWorkers(time.Now())) > 0
+}
+
+// distributable reports whether a worker can probe the target
+func (c *coordinator) distributable(t target) bool {
+    if t.Keystore != nil {
+        return false
+    }
+    mod, err := c.e.cfg.module(t.Module)
+    return err == nil && mod.Prober != proberFile
+}
+
+// local returns the targets the coordinator probes itself
+func (c *coordinator) local(targets []target) []target {
+    if !c.active() {
+        return targets
+    }
+    var local []target
+    for _, t := range targets {
+        if !c.distributable(t) {
+            local = append(local, t)
+        }
+    }
+    return local
+}
+
+// owner picks the worker of a target by rendezvous hashing, so only the targets of a worker that
+// joins or leaves move. Workers of the target's region are preferred. It must be called with mu held.
+func (c *coordinator) owner(t target, live []string) string {
+    candidates := live
+    if region := t.Labels[regionLabel]; region != "" {
+        var inRegion []string
+        for _, name := range live {
+            if c.workers[name].region == region {
+                inRegion = append(inRegion, name)
+            }
+        }
+        if len(inRegion) > 0 {
+            candidates = inRegion
+        }
+    }
+    var (
+        best     string
+        bestHash uint64
+    )
+    for _, name := range candidates {
+        h := fnv.New64a()
+        h.Write([]byte(name + "\x00" + t.Domain))
+        if sum := h.Sum64(); best == "" || sum > bestHash {
+            best, bestHash = name, sum
+        }
+    }
+    return best
+}
+
+// heartbeat records the heartbeat of a worker and returns the targets assigned to it
+func (c *coordinator) heartbeat(hb workerHeartbeat, now time.Time) []target {
+    targets := c.targets()
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    w, ok := c.workers[hb.Name]
+    if !ok {
+        log.Printf("Worker %s registered from region %q", hb.Name, hb.Region)
+        w = &workerState{}
+        c.workers[hb.Name] = w
+    }
+    w.region, w.seen = hb.Region, now
+
+    live := c.liveWorkers(now)
+    var assigned []target
+    for _, t := range targets {
+        if c.distributable(t) && c.owner(t, live) == hb.Name {
+            assigned = append(assigned, t)
+        }
+    }
+    w.assigned = len(assigned)
+    return assigned
+}
+
+// heartbeatHandler serves POST /api/v1/workers/heartbeat, which returns the targets of the worker
+func (c *coordinator) heartbeatHandler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            w.Header().Set("Allow", "POST")
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        var hb workerHeartbeat
+        if err := json.NewDecoder(r.Body).Decode(&hb); err != nil || hb.Name == "" {
+            http.Error(w, "invalid heartbeat, a name is required", http.StatusBadRequest)
+            return
+        }
+        specs := []targetSpec{}
+        for _, t := range c.heartbeat(hb, time.Now()) {
+            specs = append(specs, newTargetSpec(t))
+        }
+        writeJSON(w, http.StatusOK, specs)
+    })
+}
+
+// owns reports whether the worker currently owns the target. Until its next heartbeat a worker
+// may still probe targets that moved to a new worker.
+func (c *coordinator) owns(name string, t target) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.owner(t, c.liveWorkers(time.Now())) == name
+}
+
+// resultsHandler serves POST /api/v1/workers/results, which records the results a worker reports
+// like the ones of local probes
+func (c *coordinator) resultsHandler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            w.Header().Set("Allow", "POST")
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        var report workerReport
+        if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<20)).Decode(&report); err != nil {
+            http.Error(w, "invalid results: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        targets := make(map[string]target)
+        for _, t := range c.targets() {
+            targets[t.Domain] = t
+        }
+        for _, result := range report.Results {
+            t, ok := targets[result.Domain]
+            // Targets removed from the configuration or moved to another worker since the worker's last heartbeat
+            if !ok || !c.owns(report.Name, t) {
+                continue
+            }
+            mod, err := c.e.cfg.module(t.Module)
+            if err != nil {
+                continue
+            }
+            res, probeErr := result.probeResult(mod)
+            c.e.mu.Lock()
+            if c.e.schedule != nil {
+                c.e.schedule.probed(t.Domain, result.Time)
+            }
+            c.e.handleResult(t, mod, res, probeErr)
+            c.e.mu.Unlock()
+        }
+        c.e.saveState()
+        w.WriteHeader(http.StatusNoContent)
+    })
+}
+
+func (c *coordinator) Describe(ch chan<- *prometheus.Desc) {
+    ch <- c.heartbeatDesc
+    ch <- c.targetsDesc
+}
+
+func (c *coordinator) Collect(ch chan<- prometheus.Metric) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for name, w := range c.workers {
+        ch <- prometheus.MustNewConstMetric(c.heartbeatDesc, prometheus.GaugeValue, float64(w.seen.Unix()), name, w.region)
+        ch <- prometheus.MustNewConstMetric(c.targetsDesc, prometheus.GaugeValue, float64(w.assigned), name, w.region)
+    }
+}
+
+// worker probes the targets a coordinator assigns and reports the results back
+type worker struct {
+    url    string
+    token  string
+    name   string
+    region string
+    client *http.Client
+    wake   func() // called when the assigned targets changed
+
+    mu      sync.Mutex
+    targets []target
+}
+
+// newWorker returns a worker of the coordinator at url
+func newWorker(url, token, name, region string, wake func()) *worker {
+    return &worker{
+        url:    strings.TrimSuffix(url, "/"),
+        token:  token,
+        name:   name,
+        region: region,
+        client: &http.Client{Timeout: 6 * dialTimeout},
+        wake:   wake,
+    }
+}
+
+// post sends v as JSON to an API endpoint of the coordinator and decodes the response into out unless it is nil
+func (w *worker) post(path string, v, out interface{}) error {
+    body, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequest(http.MethodPost, w.url+path, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if w.token != "" {
+        req.Header.Set("Authorization", "Bearer "+w.token)
+    }
+    resp, err := w.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        return fmt.Errorf("unexpected status %s", resp.Status)
+    }
+    if out == nil {
+        return nil
+    }
+    return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// heartbeat registers with the coordinator and takes over the assigned targets. The series of targets
+// moved to other workers are dropped.
+func (w *worker) heartbeat() error {
+    var specs []targetSpec
+    if err := w.post("/api/v1/workers/heartbeat", workerHeartbeat{Name: w.name, Region: w.region}, &specs); err != nil {
+        return err
+    }
+    targets := make([]target, 0, len(specs))
+    assigned := make(map[string]bool, len(specs))
+    for _, s := range specs {
+        targets = append(targets, s.target())
+        assigned[s.Domain] = true
+    }
+
+    w.mu.Lock()
+    previous := w.targets
+    w.targets = targets
+    w.mu.Unlock()
+
+    changed := len(previous) != len(targets)
+    for _, t := range previous {
+        if !assigned[t.Domain] {
+            metrics.remove(t.Domain)
+            changed = true
+        }
+    }
+    if changed {
+        log.Printf("Coordinator assigned %d targets", len(targets))
+        w.wake()
+    }
+    return nil
+}
+
+// run sends a heartbeat at every interval. The last assignment is kept while the coordinator is unreachable.
+func (w *worker) run() {
+    for {
+        time.Sleep(heartbeatInterval)
+        if err := w.heartbeat(); err != nil {
+            log.Printf("Error sending heartbeat to coordinator %s: %v", w.url, err)
+        }
+    }
+}
+
+// current returns the assigned targets
+func (w *worker) current() []target {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    return w.targets
+}
+
+// report sends probe results to the coordinator
+func (w *worker) report(results []workerResult) {
+    if err := w.post("/api/v1/workers/results", workerReport{Name: w.name, Results: results}, nil); err != nil {
+        log.Printf("Error reporting %d results to coordinator %s: %v", len(results), w.url, err)
+    }
+}
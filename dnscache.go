@@ -0,0 +1,139 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultDNSNegativeTTL is how long a failed lookup is cached after the first failure
+const defaultDNSNegativeTTL = time.Minute
+
+// maxDNSNegativeTTL caps the back-off of hosts that keep failing to resolve
+const maxDNSNegativeTTL = time.Hour
+
+// Kinds of failed lookups, the kind label of ssl_probe_dns_failures_total
+const (
+    dnsFailureNotFound  = "not_found"
+    dnsFailureTimeout   = "timeout"
+    dnsFailureTemporary = "temporary"
+    dnsFailureOther     = "other"
+)
+
+var dnsFailures = prometheus.NewCounterVec(
+    prometheus.CounterOpts{
+        Name: "ssl_probe_dns_failures_total",
+        Help: "Number of lookups of probe targets that failed, by kind. Lookups answered from the negative cache are not counted.",
+    },
+    []string{"kind"},
+)
+
+func init() {
+    prometheus.MustRegister(dnsFailures)
+}
+
+// dnsFailure is a cached failed lookup
+type dnsFailure struct {
+    err      *net.DNSError
+    until    time.Time
+    failures int // consecutive failed lookups
+}
+
+// dnsNegativeCache remembers hosts that failed to resolve, so decommissioned domains left in the
+// configuration don't hit the resolvers on every probe. A host is looked up again after the TTL,
+// which doubles with every consecutive failure up to maxDNSNegativeTTL. A successful lookup resets it.
+type dnsNegativeCache struct {
+    ttl time.Duration // after the first failure, caching is disabled if not positive
+
+    mu    sync.Mutex
+    hosts map[string]*dnsFailure
+}
+
+// negativeDNS is the negative cache of the lookups of the targets' probes, its TTL is set from the command
+// line. Probes of /probe don't use it, as their callers pick the timeout and could fill it with failed
+// lookups of the targets' hosts.
+var negativeDNS = &dnsNegativeCache{ttl: defaultDNSNegativeTTL, hosts: make(map[string]*dnsFailure)}
+
+// negativeDNSKey is the context key of the negative cache a probe uses
+type negativeDNSKey struct{}
+
+// withNegativeDNS returns a context whose probes consult and fill the cache
+func withNegativeDNS(ctx context.Context, c *dnsNegativeCache) context.Context {
+    return context.WithValue(ctx, negativeDNSKey{}, c)
+}
+
+// negativeDNSFrom returns the negative cache of the probe, nil if it doesn't use one
+func negativeDNSFrom(ctx context.Context) *dnsNegativeCache {
+    c, _ := ctx.Value(negativeDNSKey{}).(*dnsNegativeCache)
+    return c
+}
+
+// cached returns the error of the last lookup of host if it failed and hasn't expired yet
+func (c *dnsNegativeCache) cached(host string, now time.Time) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if f, ok := c.hosts[host]; ok && now.Before(f.until) {
+        return fmt.Errorf("%w (cached until %s)", f.err, f.until.Format(time.RFC3339))
+    }
+    return nil
+}
+
+// observe records the outcome of a lookup of host. Only DNS errors are cached, not those of cancelled probes.
+func (c *dnsNegativeCache) observe(host string, err error, now time.Time) {
+    var dnsErr *net.DNSError
+    if err != nil && !errors.As(err, &dnsErr) {
+        return
+    }
+    if err != nil {
+        dnsFailures.WithLabelValues(dnsFailureKind(dnsErr)).Inc()
+    }
+    if c.ttl <= 0 {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if err == nil {
+        delete(c.hosts, host)
+        return
+    }
+    f, ok := c.hosts[host]
+    if !ok {
+        // Hosts that are no longer probed would stay forever, entries expired for long are dropped
+        for h, other := range c.hosts {
+            if now.Sub(other.until) > maxDNSNegativeTTL {
+                delete(c.hosts, h)
+            }
+        }
+        f = &dnsFailure{}
+        c.hosts[host] = f
+    }
+    f.failures++
+    ttl := c.ttl << min(f.failures-1, 16)
+    if ttl > maxDNSNegativeTTL || ttl <= 0 {
+        ttl = maxDNSNegativeTTL
+    }
+    f.err, f.until = dnsErr, now.Add(ttl)
+    if f.failures == 1 {
+        log.Printf("Lookup of %s failed, not resolving it again for %s: %v", host, ttl, err)
+    }
+}
+
+// dnsFailureKind classifies a failed lookup
+func dnsFailureKind(err *net.DNSError) string {
+    switch {
+    case err.IsNotFound:
+        return dnsFailureNotFound
+    case err.IsTimeout:
+        return dnsFailureTimeout
+    case err.IsTemporary:
+        return dnsFailureTemporary
+    }
+    return dnsFailureOther
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+    "context"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestResolveHostNegativeCache(t *testing.T) {
+    const host = "poisoned.invalid"
+    c := &dnsNegativeCache{ttl: time.Hour, hosts: make(map[string]*dnsFailure)}
+    c.observe(host, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}, time.Now())
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if _, err := resolveHost(withNegativeDNS(ctx, c), host); err == nil || !strings.Contains(err.Error(), "cached until") {
+        t.Errorf("got error %v with the cache, want the cached one", err)
+    }
+    // Probes without the cache, like those of /probe, neither consult nor fill it
+    if _, err := resolveHost(ctx, host); err != nil && strings.Contains(err.Error(), "cached until") {
+        t.Errorf("got the cached error %v without the cache", err)
+    }
+    resolveHost(ctx, "other.invalid")
+    if _, ok := c.hosts["other.invalid"]; ok {
+        t.Error("a lookup without the cache filled it")
+    }
+}
+
+func TestNegativeCacheBackOff(t *testing.T) {
+    c := &dnsNegativeCache{ttl: time.Minute, hosts: make(map[string]*dnsFailure)}
+    now := time.Now()
+    nxdomain := &net.DNSError{Err: "no such host", Name: "gone.example.com", IsNotFound: true}
+    for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+        c.observe("gone.example.com", nxdomain, now)
+        if got := c.hosts["gone.example.com"].until.Sub(now); got != want {
+            t.Errorf("failure %d: got a TTL of %s, want %s", i+1, got, want)
+        }
+    }
+    if err := c.cached("gone.example.com", now.Add(3*time.Minute)); err == nil {
+        t.Error("got no cached error before the TTL passed")
+    }
+    c.observe("gone.example.com", nil, now)
+    if err := c.cached("gone.example.com", now); err != nil {
+        t.Errorf("got cached error %v after a successful lookup", err)
+    }
+}
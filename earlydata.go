@@ -0,0 +1,219 @@
+package main
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/hkdf"
+    "crypto/sha256"
+    "crypto/sha512"
+    "crypto/tls"
+    "encoding/binary"
+    "encoding/hex"
+    "hash"
+    "net"
+    "strings"
+    "time"
+
+    "golang.org/x/crypto/chacha20poly1305"
+)
+
+// earlyDataWait bounds the wait for the session tickets of a TLS 1.3 server after the handshake. Servers send
+// them right after the client's Finished, so only servers without tickets cost the full wait.
+const earlyDataWait = time.Second
+
+// TLS 1.3 constants of the session ticket decryption
+const (
+    recordApplicationData     = 23
+    handshakeNewSessionTicket = 4
+    extEarlyData              = 42
+)
+
+// earlyDataCheck finds out whether a TLS 1.3 server offers 0-RTT. Go's TLS client ignores the early_data
+// extension of session tickets outside of QUIC, so the connection is recorded and the tickets are decrypted
+// with the server's traffic secret taken from the key log.
+type earlyDataCheck struct {
+    net.Conn
+    received bytes.Buffer
+    keys     serverSecretLog
+}
+
+// serverSecretLog keeps the server's application traffic secret of the key log
+type serverSecretLog struct {
+    secret []byte
+}
+
+// newEarlyDataCheck records conn and adds the key log to the config of its handshake
+func newEarlyDataCheck(conn net.Conn, tlsCfg *tls.Config) (*earlyDataCheck, *tls.Config) {
+    c := &earlyDataCheck{Conn: conn}
+    tlsCfg = tlsCfg.Clone()
+    tlsCfg.KeyLogWriter = &c.keys
+    return c, tlsCfg
+}
+
+// Read records what the server sent
+func (c *earlyDataCheck) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p)
+    c.received.Write(p[:n])
+    return n, err
+}
+
+func (l *serverSecretLog) Write(line []byte) (int, error) {
+    fields := strings.Fields(string(line))
+    if len(fields) == 3 && fields[0] == "SERVER_TRAFFIC_SECRET_0" {
+        l.secret, _ = hex.DecodeString(fields[2])
+    }
+    return len(line), nil
+}
+
+// offered reports whether a session ticket of the server allows early data, reading from the connection until one
+// arrived or earlyDataWait passed. Handshakes below TLS 1.3 never offer it.
+func (c *earlyDataCheck) offered(state tls.ConnectionState) bool {
+    if state.Version != tls.VersionTLS13 || c.keys.secret == nil {
+        return false
+    }
+    deadline := time.Now().Add(earlyDataWait)
+    c.Conn.SetReadDeadline(deadline)
+    buf := make([]byte, 4096)
+    for {
+        offered, ticket := ticketsOfferEarlyData(c.received.Bytes(), state.CipherSuite, c.keys.secret)
+        if ticket || time.Now().After(deadline) {
+            return offered
+        }
+        if _, err := c.Read(buf); err != nil {
+            offered, _ := ticketsOfferEarlyData(c.received.Bytes(), state.CipherSuite, c.keys.secret)
+            return offered
+        }
+    }
+}
+
+// ticketsOfferEarlyData decrypts the application data records the server sent and reports whether any
+// NewSessionTicket carries the early_data extension, and whether a ticket arrived at all. Records that fail to
+// decrypt precede the traffic secret, they belong to the handshake.
+func ticketsOfferEarlyData(records []byte, suite uint16, secret []byte) (offered, ticket bool) {
+    aead, iv := trafficKeys(suite, secret)
+    if aead == nil {
+        return false, false
+    }
+    var seq uint64
+    for len(records) >= 5 {
+        length := int(binary.BigEndian.Uint16(records[3:]))
+        if len(records) < 5+length {
+            break
+        }
+        header, payload := records[:5], records[5:5+length]
+        records = records[5+length:]
+        if header[0] != recordApplicationData {
+            continue
+        }
+        nonce := make([]byte, len(iv))
+        copy(nonce, iv)
+        for i := 0; i < 8; i++ {
+            nonce[len(nonce)-1-i] ^= byte(seq >> (8 * i))
+        }
+        plain, err := aead.Open(nil, nonce, payload, header)
+        if err != nil {
+            if seq == 0 {
+                continue
+            }
+            break
+        }
+        seq++
+        // The content type follows the content, padded with zeros
+        plain = bytes.TrimRight(plain, "\x00")
+        if len(plain) == 0 || plain[len(plain)-1] != recordHandshake {
+            continue
+        }
+        for msgs := plain[:len(plain)-1]; len(msgs) >= 4; {
+            msgLen := int(msgs[1])<<16 | int(msgs[2])<<8 | int(msgs[3])
+            if len(msgs) < 4+msgLen {
+                break
+            }
+            if msgs[0] == handshakeNewSessionTicket {
+                ticket = true
+                offered = offered || ticketHasEarlyData(msgs[4:4+msgLen])
+            }
+            msgs = msgs[4+msgLen:]
+        }
+    }
+    return offered, ticket
+}
+
+// ticketHasEarlyData reports whether the extensions of a NewSessionTicket message include early_data
+func ticketHasEarlyData(msg []byte) bool {
+    // ticket_lifetime and ticket_age_add
+    if len(msg) < 9 {
+        return false
+    }
+    msg = msg[8:]
+    nonceLen := int(msg[0])
+    if len(msg) < 1+nonceLen+2 {
+        return false
+    }
+    msg = msg[1+nonceLen:]
+    ticketLen := int(binary.BigEndian.Uint16(msg))
+    if len(msg) < 2+ticketLen+2 {
+        return false
+    }
+    exts := msg[2+ticketLen+2:]
+    for len(exts) >= 4 {
+        typ, length := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+        if typ == extEarlyData {
+            return true
+        }
+        if len(exts) < 4+length {
+            return false
+        }
+        exts = exts[4+length:]
+    }
+    return false
+}
+
+// trafficKeys derives the record protection of a TLS 1.3 traffic secret (RFC 8446, section 7.3)
+func trafficKeys(suite uint16, secret []byte) (cipher.AEAD, []byte) {
+    var (
+        h      func() hash.Hash
+        keyLen int
+    )
+    switch suite {
+    case tls.TLS_AES_128_GCM_SHA256:
+        h, keyLen = sha256.New, 16
+    case tls.TLS_AES_256_GCM_SHA384:
+        h, keyLen = sha512.New384, 32
+    case tls.TLS_CHACHA20_POLY1305_SHA256:
+        h, keyLen = sha256.New, chacha20poly1305.KeySize
+    default:
+        return nil, nil
+    }
+    key, err := expandLabel(h, secret, "key", keyLen)
+    if err != nil {
+        return nil, nil
+    }
+    iv, err := expandLabel(h, secret, "iv", 12)
+    if err != nil {
+        return nil, nil
+    }
+    var aead cipher.AEAD
+    if suite == tls.TLS_CHACHA20_POLY1305_SHA256 {
+        aead, err = chacha20poly1305.New(key)
+    } else {
+        var block cipher.Block
+        if block, err = aes.NewCipher(key); err == nil {
+            aead, err = cipher.NewGCM(block)
+        }
+    }
+    if err != nil {
+        return nil, nil
+    }
+    return aead, iv
+}
+
+// expandLabel is HKDF-Expand-Label with an empty context
+func expandLabel(h func() hash.Hash, secret []byte, label string, length int) ([]byte, error) {
+    label = "tls13 " + label
+    info := binary.BigEndian.AppendUint16(nil, uint16(length))
+    info = append(info, byte(len(label)))
+    info = append(info, label...)
+    info = append(info, 0)
+    return hkdf.Expand(h, secret, string(info), length)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// enrichmentConfig configures the lookup of target labels in an external system like a CMDB. For each
+// target the URL is requested with the target and module query parameters, the response is a JSON object
+// of strings, e.g. {"owner": "payments", "cost_center": "4711"}. A 404 means the system knows no labels.
+type enrichmentConfig struct {
+    URL         string        `yaml:"url"`
+    BearerToken string        `yaml:"bearer_token"`
+    Labels      []string      `yaml:"labels"` // keys of the response taken over as target labels
+    TTL         time.Duration `yaml:"ttl"`    // how long labels are cached, 1h by default
+    // Concurrency bounds the lookups in flight, 4 by default
+    Concurrency int `yaml:"concurrency"`
+}
+
+// validate checks the configuration and fills in defaults
+func (c *enrichmentConfig) validate() error {
+    if c.URL == "" {
+        return nil
+    }
+    if _, err := url.Parse(c.URL); err != nil {
+        return err
+    }
+    if len(c.Labels) == 0 {
+        return fmt.Errorf("labels are required")
+    }
+    for _, name := range c.Labels {
+        if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") || name == "domain" {
+            return fmt.Errorf("invalid label name %q", name)
+        }
+    }
+    if c.TTL == 0 {
+        c.TTL = time.Hour
+    }
+    if c.TTL < time.Minute {
+        return fmt.Errorf("ttl must be at least 1m")
+    }
+    if c.Concurrency == 0 {
+        c.Concurrency = 4
+    }
+    if c.Concurrency < 0 {
+        return fmt.Errorf("concurrency must not be negative")
+    }
+    return nil
+}
+
+// enrichment is the cached lookup of a target
+type enrichment struct {
+    labels  map[string]string
+    expires time.Time // when the labels are looked up again
+    used    time.Time // when the target was last enriched, entries unused for two TTLs are dropped
+    pending bool
+}
+
+// enricher adds the labels of the external system to the targets. Lookups run in the background, so a slow
+// or unavailable system never delays probes: targets carry the cached labels, none before the first lookup,
+// and keep the previous ones while the system fails. ssl_target_labels_info exports the labels for joins.
+type enricher struct {
+    cfg     enrichmentConfig
+    client  *http.Client
+    limiter chan struct{}
+    desc    *prometheus.Desc
+
+    mu      sync.Mutex
+    entries map[string]*enrichment
+}
+
+// newEnricher returns an enricher for the configuration
+func newEnricher(cfg enrichmentConfig) *enricher {
+    return &enricher{
+        cfg:     cfg,
+        client:  &http.Client{Timeout: 6 * dialTimeout},
+        limiter: make(chan struct{}, cfg.Concurrency),
+        entries: make(map[string]*enrichment),
+        desc: prometheus.NewDesc(
+            "ssl_target_labels_info",
+            "Labels of the target looked up in the external system configured as enrichment",
+            append([]string{"domain"}, cfg.Labels...), nil,
+        ),
+    }
+}
+
+// enrich returns the targets with the cached labels added. Labels of the target itself win.
+func (e *enricher) enrich(targets []target) []target {
+    now := time.Now()
+    enriched := make([]target, len(targets))
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    for i, t := range targets {
+        enriched[i] = t
+        entry, ok := e.entries[t.Domain]
+        if !ok {
+            entry = &enrichment{}
+            e.entries[t.Domain] = entry
+        }
+        entry.used = now
+        if !entry.pending && !now.Before(entry.expires) {
+            entry.pending = true
+            go e.update(t)
+        }
+        if len(entry.labels) == 0 {
+            continue
+        }
+        enriched[i].Labels = make(map[string]string, len(t.Labels)+len(entry.labels))
+        for k, v := range entry.labels {
+            enriched[i].Labels[k] = v
+        }
+        for k, v := range t.Labels {
+            enriched[i].Labels[k] = v
+        }
+    }
+    for domain, entry := range e.entries {
+        if now.Sub(entry.used) > 2*e.cfg.TTL {
+            delete(e.entries, domain)
+        }
+    }
+    return enriched
+}
+
+// update looks up the labels of a target. Failed lookups are retried after a minute.
+func (e *enricher) update(t target) {
+    e.limiter <- struct{}{}
+    labels, err := e.lookup(t)
+    <-e.limiter
+
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    entry, ok := e.entries[t.Domain]
+    if !ok {
+        return
+    }
+    entry.pending = false
+    if err != nil {
+        log.Printf("Error looking up labels of %s: %v", t.Domain, err)
+        entry.expires = time.Now().Add(time.Minute)
+        return
+    }
+    entry.labels = labels
+    entry.expires = time.Now().Add(e.cfg.TTL)
+}
+
+// lookup requests the labels of a target, nil if the system doesn't know it
+func (e *enricher) lookup(t target) (map[string]string, error) {
+    u, err := url.Parse(e.cfg.URL)
+    if err != nil {
+        return nil, err
+    }
+    query := u.Query()
+    query.Set("target", t.Domain)
+    if t.Module != "" {
+        query.Set("module", t.Module)
+    }
+    u.RawQuery = query.Encode()
+    req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Accept", "application/json")
+    if e.cfg.BearerToken != "" {
+        req.Header.Set("Authorization", "Bearer "+e.cfg.BearerToken)
+    }
+    resp, err := e.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, nil
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("unexpected status %s", resp.Status)
+    }
+    var body map[string]any
+    if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+        return nil, err
+    }
+    labels := make(map[string]string, len(e.cfg.Labels))
+    for _, name := range e.cfg.Labels {
+        switch v := body[name].(type) {
+        case string:
+            if v != "" {
+                labels[name] = v
+            }
+        case float64, bool:
+            labels[name] = fmt.Sprint(v)
+        }
+    }
+    return labels, nil
+}
+
+func (e *enricher) Describe(ch chan<- *prometheus.Desc) {
+    ch <- e.desc
+}
+
+func (e *enricher) Collect(ch chan<- prometheus.Metric) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    for domain, entry := range e.entries {
+        if len(entry.labels) == 0 {
+            continue
+        }
+        values := []string{domain}
+        for _, name := range e.cfg.Labels {
+            values = append(values, entry.labels[name])
+        }
+        ch <- prometheus.MustNewConstMetric(e.desc, prometheus.GaugeValue, 1, values...)
+    }
+}
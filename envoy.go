@@ -0,0 +1,229 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// envoyConfig lists the Envoy sidecars and gateways whose admin /certs endpoint is queried, covering the
+// mesh internal mTLS material that is never served on a probeable listener, like Istio workload certificates
+// delivered over SDS
+type envoyConfig struct {
+    Sidecars []envoySidecar `yaml:"sidecars"`
+    Interval time.Duration  `yaml:"interval"` // 1m by default
+}
+
+// envoySidecar is the admin endpoint of an Envoy, e.g. http://127.0.0.1:15000
+type envoySidecar struct {
+    Name string `yaml:"name"` // value of the sidecar label, the URL if empty
+    URL  string `yaml:"url"`
+}
+
+// validate fills in defaults
+func (c *envoyConfig) validate() error {
+    if c.Interval == 0 {
+        c.Interval = time.Minute
+    }
+    seen := make(map[string]bool)
+    for i := range c.Sidecars {
+        s := &c.Sidecars[i]
+        if s.URL == "" {
+            return fmt.Errorf("sidecar %d: url is required", i)
+        }
+        if s.Name == "" {
+            s.Name = s.URL
+        }
+        if seen[s.Name] {
+            return fmt.Errorf("sidecar %q is configured twice", s.Name)
+        }
+        seen[s.Name] = true
+    }
+    return nil
+}
+
+// envoyCerts is the response of the admin /certs endpoint
+type envoyCerts struct {
+    Certificates []struct {
+        CACert    []envoyCertDetails `json:"ca_cert"`
+        CertChain []envoyCertDetails `json:"cert_chain"`
+    } `json:"certificates"`
+}
+
+type envoyCertDetails struct {
+    Path            string     `json:"path"` // <inline> for certificates delivered over SDS
+    SerialNumber    string     `json:"serial_number"`
+    SubjectAltNames []envoySAN `json:"subject_alt_names"`
+    ValidFrom       time.Time  `json:"valid_from"`
+    ExpirationTime  time.Time  `json:"expiration_time"`
+}
+
+// envoySAN holds one of the SAN types
+type envoySAN struct {
+    DNS string `json:"dns"`
+    URI string `json:"uri"`
+    IP  string `json:"ip_address"`
+}
+
+// Kinds of certificates Envoy reports
+const (
+    envoyKindWorkload = "workload" // the certificate chain Envoy presents
+    envoyKindRoot     = "root"     // a CA certificate Envoy validates peers against
+)
+
+// envoyCert is a certificate an Envoy holds
+type envoyCert struct {
+    sidecar, kind, path, serial, san string
+    notBefore, notAfter              time.Time
+}
+
+// envoySidecars exports the certificates the configured Envoys hold
+type envoySidecars struct {
+    cfg    envoyConfig
+    client *http.Client
+
+    mu    sync.Mutex
+    certs map[string][]envoyCert // by sidecar
+    up    map[string]bool
+
+    notAfterDesc  *prometheus.Desc
+    notBeforeDesc *prometheus.Desc
+    upDesc        *prometheus.Desc
+}
+
+// newEnvoySidecars returns the collector for the configured sidecars
+func newEnvoySidecars(cfg envoyConfig) *envoySidecars {
+    labels := []string{"sidecar", "kind", "path", "serial", "subject_alt_name"}
+    return &envoySidecars{
+        cfg:    cfg,
+        client: &http.Client{Timeout: dialTimeout},
+        certs:  make(map[string][]envoyCert),
+        up:     make(map[string]bool),
+        notAfterDesc: prometheus.NewDesc(
+            "ssl_envoy_cert_not_after",
+            "Expiry date in Unix timestamp of a workload or root certificate an Envoy sidecar holds",
+            labels, nil,
+        ),
+        notBeforeDesc: prometheus.NewDesc(
+            "ssl_envoy_cert_not_before",
+            "Start date in Unix timestamp of a workload or root certificate an Envoy sidecar holds",
+            labels, nil,
+        ),
+        upDesc: prometheus.NewDesc(
+            "ssl_envoy_up",
+            "1 if the last query of the admin /certs endpoint of an Envoy sidecar succeeded, 0 otherwise",
+            []string{"sidecar"}, nil,
+        ),
+    }
+}
+
+// query returns the certificates a sidecar holds
+func (e *envoySidecars) query(s envoySidecar) ([]envoyCert, error) {
+    resp, err := e.client.Get(strings.TrimSuffix(s.URL, "/") + "/certs")
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("unexpected status %s", resp.Status)
+    }
+    var body envoyCerts
+    if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+        return nil, err
+    }
+
+    var certs []envoyCert
+    add := func(kind string, details []envoyCertDetails) {
+        for _, d := range details {
+            certs = append(certs, envoyCert{
+                sidecar:   s.Name,
+                kind:      kind,
+                path:      d.Path,
+                serial:    normalizeSerial(d.SerialNumber),
+                san:       d.firstSAN(),
+                notBefore: d.ValidFrom,
+                notAfter:  d.ExpirationTime,
+            })
+        }
+    }
+    for _, c := range body.Certificates {
+        add(envoyKindWorkload, c.CertChain)
+        add(envoyKindRoot, c.CACert)
+    }
+    return certs, nil
+}
+
+// firstSAN returns the first subject alternative name, the SPIFFE ID of Istio workload certificates
+func (d envoyCertDetails) firstSAN() string {
+    for _, san := range d.SubjectAltNames {
+        for _, name := range []string{san.URI, san.DNS, san.IP} {
+            if name != "" {
+                return name
+            }
+        }
+    }
+    return ""
+}
+
+// update queries every sidecar. The certificates of a sidecar whose query fails are kept from the last run,
+// so an Envoy restart doesn't look like expired certificates.
+func (e *envoySidecars) update() {
+    for _, s := range e.cfg.Sidecars {
+        certs, err := e.query(s)
+        e.mu.Lock()
+        e.up[s.Name] = err == nil
+        if err == nil {
+            e.certs[s.Name] = certs
+        }
+        e.mu.Unlock()
+        if err != nil {
+            log.Printf("Error querying certificates of Envoy sidecar %s: %v", s.Name, err)
+        }
+    }
+}
+
+// run updates the certificates right away and then at the configured interval
+func (e *envoySidecars) run() {
+    for {
+        e.update()
+        time.Sleep(e.cfg.Interval)
+    }
+}
+
+func (e *envoySidecars) Describe(ch chan<- *prometheus.Desc) {
+    ch <- e.notAfterDesc
+    ch <- e.notBeforeDesc
+    ch <- e.upDesc
+}
+
+func (e *envoySidecars) Collect(ch chan<- prometheus.Metric) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    for sidecar, up := range e.up {
+        value := 0.0
+        if up {
+            value = 1
+        }
+        ch <- prometheus.MustNewConstMetric(e.upDesc, prometheus.GaugeValue, value, sidecar)
+    }
+    // Every listener and cluster using a certificate reports it, e.g. the mesh root appears many times
+    seen := make(map[string]bool)
+    for _, certs := range e.certs {
+        for _, c := range certs {
+            labels := []string{c.sidecar, c.kind, c.path, c.serial, c.san}
+            key := strings.Join(labels, "\x00")
+            if seen[key] {
+                continue
+            }
+            seen[key] = true
+            ch <- prometheus.MustNewConstMetric(e.notAfterDesc, prometheus.GaugeValue, float64(c.notAfter.Unix()), labels...)
+            ch <- prometheus.MustNewConstMetric(e.notBeforeDesc, prometheus.GaugeValue, float64(c.notBefore.Unix()), labels...)
+        }
+    }
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// maxExpansion bounds the number of targets a single line of the configuration can expand to
+const maxExpansion = 10000
+
+// expandBraces expands shell style brace expressions in a target: alternatives like {a,b,c}.example.com
+// and ranges like web{01..20}.example.com or {a..f}, which keep the zero padding of their bounds.
+// Expressions can be nested and combined, a string without braces expands to itself.
+func expandBraces(s string) ([]string, error) {
+    start := strings.Index(s, "{")
+    if start < 0 {
+        if strings.Contains(s, "}") {
+            return nil, fmt.Errorf("unbalanced } in %q", s)
+        }
+        return []string{s}, nil
+    }
+    end, err := closingBrace(s, start)
+    if err != nil {
+        return nil, err
+    }
+
+    alternatives, err := braceAlternatives(s[start+1 : end])
+    if err != nil {
+        return nil, fmt.Errorf("%q: %v", s, err)
+    }
+    suffixes, err := expandBraces(s[end+1:])
+    if err != nil {
+        return nil, err
+    }
+    prefix := s[:start]
+    if strings.Contains(prefix, "}") {
+        return nil, fmt.Errorf("unbalanced } in %q", s)
+    }
+
+    var expanded []string
+    for _, alt := range alternatives {
+        inner, err := expandBraces(alt)
+        if err != nil {
+            return nil, err
+        }
+        if len(expanded)+len(inner)*len(suffixes) > maxExpansion {
+            return nil, fmt.Errorf("%q expands to more than %d targets", s, maxExpansion)
+        }
+        for _, in := range inner {
+            for _, suffix := range suffixes {
+                expanded = append(expanded, prefix+in+suffix)
+            }
+        }
+    }
+    return expanded, nil
+}
+
+// closingBrace returns the index of the brace closing the one at start
+func closingBrace(s string, start int) (int, error) {
+    depth := 0
+    for i := start; i < len(s); i++ {
+        switch s[i] {
+        case '{':
+            depth++
+        case '}':
+            depth--
+            if depth == 0 {
+                return i, nil
+            }
+        }
+    }
+    return 0, fmt.Errorf("unbalanced { in %q", s)
+}
+
+// braceAlternatives splits the content of a brace expression at its top level commas,
+// or expands it as a range if it has none
+func braceAlternatives(body string) ([]string, error) {
+    var (
+        alternatives []string
+        depth, last  int
+    )
+    for i := 0; i < len(body); i++ {
+        switch body[i] {
+        case '{':
+            depth++
+        case '}':
+            depth--
+        case ',':
+            if depth == 0 {
+                alternatives = append(alternatives, body[last:i])
+                last = i + 1
+            }
+        }
+    }
+    alternatives = append(alternatives, body[last:])
+    if len(alternatives) > 1 {
+        return alternatives, nil
+    }
+    if from, to, ok := strings.Cut(body, ".."); ok && !strings.ContainsAny(body, "{}") {
+        return braceRange(from, to)
+    }
+    return nil, fmt.Errorf("brace expression {%s} needs a comma or a range", body)
+}
+
+// braceRange expands a numeric range like 01..20 or a letter range like a..f, both inclusive
+// and counting down if from is greater than to
+func braceRange(from, to string) ([]string, error) {
+    lo, errLo := strconv.Atoi(from)
+    hi, errHi := strconv.Atoi(to)
+    if errLo == nil && errHi == nil {
+        width := 0
+        if (len(from) > 1 && strings.TrimPrefix(from, "-")[0] == '0') || (len(to) > 1 && strings.TrimPrefix(to, "-")[0] == '0') {
+            width = max(len(from), len(to))
+        }
+        return rangeValues(lo, hi, func(i int) string { return fmt.Sprintf("%0*d", width, i) })
+    }
+    if len(from) == 1 && len(to) == 1 && isLetter(from[0]) && isLetter(to[0]) {
+        return rangeValues(int(from[0]), int(to[0]), func(i int) string { return string(rune(i)) })
+    }
+    return nil, fmt.Errorf("invalid range %s..%s", from, to)
+}
+
+// rangeValues formats every value from lo to hi
+func rangeValues(lo, hi int, format func(int) string) ([]string, error) {
+    step := 1
+    if lo > hi {
+        step = -1
+    }
+    if (hi-lo)*step >= maxExpansion {
+        return nil, fmt.Errorf("range %d..%d has more than %d values", lo, hi, maxExpansion)
+    }
+    var values []string
+    for i := lo; ; i += step {
+        values = append(values, format(i))
+        if i == hi {
+            break
+        }
+    }
+    return values, nil
+}
+
+// isLetter reports whether c is an ASCII letter
+func isLetter(c byte) bool {
+    return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
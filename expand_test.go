@@ -0,0 +1,50 @@
+package main
+
+import (
+    "slices"
+    "testing"
+)
+
+func TestExpandBraces(t *testing.T) {
+    for _, tc := range []struct {
+        in   string
+        want []string
+    }{
+        {"example.com", []string{"example.com"}},
+        {"{a,b,c}.example.com", []string{"a.example.com", "b.example.com", "c.example.com"}},
+        {"web{1..3}", []string{"web1", "web2", "web3"}},
+        {"web{08..10}", []string{"web08", "web09", "web10"}},
+        {"web{3..1}", []string{"web3", "web2", "web1"}},
+        {"{a..c}", []string{"a", "b", "c"}},
+        {"{-1..1}", []string{"-1", "0", "1"}},
+        {"web{01..02}.{de,fr}.example.com", []string{"web01.de.example.com", "web01.fr.example.com", "web02.de.example.com", "web02.fr.example.com"}},
+        {"{a,b{1..2}}.example.com", []string{"a.example.com", "b1.example.com", "b2.example.com"}},
+        {"{,www.}example.com", []string{"example.com", "www.example.com"}},
+    } {
+        got, err := expandBraces(tc.in)
+        if err != nil {
+            t.Errorf("expandBraces(%q): %v", tc.in, err)
+            continue
+        }
+        if !slices.Equal(got, tc.want) {
+            t.Errorf("expandBraces(%q) = %q, want %q", tc.in, got, tc.want)
+        }
+    }
+}
+
+func TestExpandBracesErrors(t *testing.T) {
+    for _, in := range []string{
+        "web{1..3",
+        "web1..3}",
+        "}{a,b}",
+        "{a}",
+        "{1..a}",
+        "{aa..b}",
+        "{0..10000}",
+        "{0..99}{0..99}{0..9}",
+    } {
+        if got, err := expandBraces(in); err == nil {
+            t.Errorf("expandBraces(%q) = %d targets, want an error", in, len(got))
+        }
+    }
+}
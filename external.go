@@ -0,0 +1,100 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/x509"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os/exec"
+    "plugin"
+    "strings"
+    "time"
+)
+
+// Prober fetches the certificate chain of a target in a protocol the exporter doesn't speak itself.
+// The exec and plugin probers delegate to implementations outside the exporter, so bespoke protocols can
+// be probed without a fork. target is the target of the configuration, with the module's port added if it
+// has none, options are the module's options.
+type Prober interface {
+    Probe(ctx context.Context, target string, options map[string]string) ([]*x509.Certificate, error)
+}
+
+// proberSymbol is the variable a Go plugin exports, its address must implement Prober
+const proberSymbol = "Prober"
+
+// loadPluginProber opens a Go plugin built with go build -buildmode=plugin against the exporter's Go version
+// and dependencies. Plugins can't be unloaded, opening a path again returns the plugin loaded before.
+func loadPluginProber(path string) (Prober, error) {
+    p, err := plugin.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    sym, err := p.Lookup(proberSymbol)
+    if err != nil {
+        return nil, err
+    }
+    prober, ok := sym.(Prober)
+    if !ok {
+        return nil, fmt.Errorf("%s of %s doesn't implement Probe(context.Context, string, map[string]string) ([]*x509.Certificate, error)", proberSymbol, path)
+    }
+    return prober, nil
+}
+
+// execRequest is written to the standard input of an exec prober
+type execRequest struct {
+    Target  string            `json:"target"`
+    Timeout float64           `json:"timeout_seconds"`
+    Options map[string]string `json:"options,omitempty"`
+}
+
+// execResponse is read from the standard output of an exec prober: the PEM encoded chain, leaf first,
+// or the error that kept it from fetching the chain
+type execResponse struct {
+    Chain string `json:"chain"`
+    Error string `json:"error"`
+}
+
+// execProber runs a command for every probe, which answers the JSON request on its standard input
+// with a JSON response on its standard output
+type execProber struct {
+    command []string
+}
+
+func (p execProber) Probe(ctx context.Context, target string, options map[string]string) ([]*x509.Certificate, error) {
+    req := execRequest{Target: target, Options: options}
+    if deadline, ok := ctx.Deadline(); ok {
+        req.Timeout = time.Until(deadline).Seconds()
+    }
+    in, err := json.Marshal(req)
+    if err != nil {
+        return nil, err
+    }
+    var stdout, stderr bytes.Buffer
+    cmd := exec.CommandContext(ctx, p.command[0], p.command[1:]...)
+    cmd.Stdin = bytes.NewReader(in)
+    cmd.Stdout = &stdout
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        if msg := strings.TrimSpace(stderr.String()); msg != "" {
+            return nil, fmt.Errorf("%s: %v: %s", p.command[0], err, msg)
+        }
+        return nil, fmt.Errorf("%s: %v", p.command[0], err)
+    }
+    var resp execResponse
+    if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+        return nil, fmt.Errorf("%s: invalid response: %v", p.command[0], err)
+    }
+    if resp.Error != "" {
+        return nil, errors.New(resp.Error)
+    }
+    chain, err := parseCertPEM([]byte(resp.Chain))
+    if err != nil {
+        return nil, fmt.Errorf("%s: invalid chain: %v", p.command[0], err)
+    }
+    if len(chain) == 0 {
+        return nil, fmt.Errorf("%s: no certificates returned", p.command[0])
+    }
+    return chain, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "net"
+    "os"
+    "syscall"
+)
+
+// Reasons a probe can fail with, exported as the reason label of ssl_probe_failure_reason
+const (
+    reasonDNSError            = "dns_error"
+    reasonConnectionRefused   = "connection_refused"
+    reasonTimeout             = "timeout"
+    reasonTLSAlert            = "tls_alert"
+    reasonCertExpiredRejected = "cert_expired_rejected"
+    reasonProtocolError       = "protocol_error"
+    reasonFileError           = "file_error"
+    reasonUnknown             = "unknown"
+)
+
+// remoteProbeError is the error of a probe another instance ran, classified there
+type remoteProbeError struct {
+    reason string
+    msg    string
+}
+
+func (e *remoteProbeError) Error() string {
+    return e.msg
+}
+
+// isHardFailure reports whether a probe failed in a way that rarely fixes itself: the domain doesn't
+// exist or nothing listens on the port. Workers only report the reason of their failures, so their
+// DNS errors count as the domain not existing.
+func isHardFailure(err error) bool {
+    var dnsErr *net.DNSError
+    if errors.As(err, &dnsErr) {
+        return dnsErr.IsNotFound
+    }
+    switch classifyProbeError(err) {
+    case reasonDNSError, reasonConnectionRefused:
+        return true
+    }
+    return false
+}
+
+// classifyProbeError maps a probe error to a failure reason, so alerts can tell a host that is down from a bad certificate
+func classifyProbeError(err error) string {
+    var (
+        dnsErr     *net.DNSError
+        opErr      *net.OpError
+        netErr     net.Error
+        invalidErr x509.CertificateInvalidError
+        recordErr  tls.RecordHeaderError
+        pathErr    *os.PathError
+        remoteErr  *remoteProbeError
+    )
+    switch {
+    case errors.As(err, &remoteErr):
+        return remoteErr.reason
+    case errors.As(err, &dnsErr):
+        return reasonDNSError
+    case errors.Is(err, syscall.ECONNREFUSED):
+        return reasonConnectionRefused
+    case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+        errors.As(err, &netErr) && netErr.Timeout():
+        return reasonTimeout
+    case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+        return reasonCertExpiredRejected
+    case errors.As(err, &opErr) && opErr.Op == "remote error":
+        // Alerts sent by the server, the expired certificate alert means our certificate was rejected
+        if opErr.Err != nil && opErr.Err.Error() == "tls: expired certificate" {
+            return reasonCertExpiredRejected
+        }
+        return reasonTLSAlert
+    case errors.As(err, &recordErr), errors.Is(err, syscall.ECONNRESET):
+        return reasonProtocolError
+    case errors.As(err, &pathErr):
+        return reasonFileError
+    }
+    return reasonUnknown
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "syscall"
+    "testing"
+    "time"
+)
+
+func TestIsHardFailure(t *testing.T) {
+    for _, tc := range []struct {
+        name string
+        err  error
+        want bool
+    }{
+        {"nxdomain", &net.DNSError{Err: "no such host", Name: "gone.example.com", IsNotFound: true}, true},
+        {"dns timeout", &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, false},
+        {"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+        {"timeout", context.DeadlineExceeded, false},
+        {"worker dns error", &remoteProbeError{reason: reasonDNSError, msg: "lookup gone.example.com: no such host"}, true},
+        {"worker connection refused", &remoteProbeError{reason: reasonConnectionRefused, msg: "connection refused"}, true},
+        {"worker timeout", &remoteProbeError{reason: reasonTimeout, msg: "i/o timeout"}, false},
+    } {
+        if got := isHardFailure(tc.err); got != tc.want {
+            t.Errorf("%s: isHardFailure(%v) = %v, want %v", tc.name, tc.err, got, tc.want)
+        }
+    }
+}
+
+// TestIsHardFailureWorkerResult checks the failures of workers are classified like local ones after the round trip
+func TestIsHardFailureWorkerResult(t *testing.T) {
+    nxdomain := &net.DNSError{Err: "no such host", Name: "gone.example.com", IsNotFound: true}
+    _, err := newWorkerResult("gone.example.com", nil, nxdomain, time.Now()).probeResult(&module{})
+    if !isHardFailure(err) {
+        t.Errorf("got a soft failure for %v reported by a worker, want a hard one", err)
+    }
+}
+
+func TestClassifyProbeError(t *testing.T) {
+    for _, tc := range []struct {
+        name string
+        err  error
+        want string
+    }{
+        {"dns", &connectError{&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}}, reasonDNSError},
+        {"refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, reasonConnectionRefused},
+        {"deadline", fmt.Errorf("handshake: %w", context.DeadlineExceeded), reasonTimeout},
+        {"io timeout", &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, reasonTimeout},
+        {"expired", x509.CertificateInvalidError{Reason: x509.Expired}, reasonCertExpiredRejected},
+        {"expired alert", &net.OpError{Op: "remote error", Err: errors.New("tls: expired certificate")}, reasonCertExpiredRejected},
+        {"alert", &net.OpError{Op: "remote error", Err: errors.New("tls: handshake failure")}, reasonTLSAlert},
+        {"record header", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, reasonProtocolError},
+        {"reset", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, reasonProtocolError},
+        {"file", &os.PathError{Op: "open", Path: "/etc/ssl/missing.pem", Err: os.ErrNotExist}, reasonFileError},
+        {"worker", &remoteProbeError{reason: reasonTLSAlert, msg: "remote error"}, reasonTLSAlert},
+        {"other", errors.New("no certificates"), reasonUnknown},
+    } {
+        if got := classifyProbeError(tc.err); got != tc.want {
+            t.Errorf("%s: classifyProbeError(%v) = %s, want %s", tc.name, tc.err, got, tc.want)
+        }
+    }
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package main
+
+import (
+    "syscall"
+
+    "golang.org/x/sys/unix"
+)
+
+// fastOpenControl sets TCP_FASTOPEN_CONNECT, so the ClientHello rides on the SYN of servers that handed out
+// a Fast Open cookie before
+func fastOpenControl(network, address string, c syscall.RawConn) error {
+    var sockErr error
+    err := c.Control(func(fd uintptr) {
+        sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+    })
+    if err != nil {
+        return err
+    }
+    return sockErr
+}
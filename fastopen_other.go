@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+    "errors"
+    "syscall"
+)
+
+// fastOpenControl fails, TCP_FASTOPEN_CONNECT is only available on Linux
+func fastOpenControl(network, address string, c syscall.RawConn) error {
+    return errors.New("TCP Fast Open is not supported on this platform")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+)
+
+// fileSDGroup is a target group of Prometheus file based service discovery
+type fileSDGroup struct {
+    Targets []string          `json:"targets"`
+    Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// labelNamePattern matches valid Prometheus label names
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// genFileSD implements the gen-file-sd subcommand, writing the targets of the configuration files as
+// file_sd JSON, so Prometheus can scrape /probe for each of them with the same labels. Targets of the
+// API and the discovery sources are only known to a running exporter, which writes all of them with -file-sd-output.
+func genFileSD(args []string) int {
+    fs := flag.NewFlagSet("gen-file-sd", flag.ExitOnError)
+    var (
+        configPath      = fs.String("config", "domains.cfg", "Path to the domains configuration file.")
+        probeConfigPath = fs.String("probe-config", "", "Path to the YAML configuration of probe modules and discovery sources.")
+        output          = fs.String("output", "", "File to write the target groups to, replaced atomically. Stdout if empty.")
+        interval        = fs.Duration("interval", 0, "Rewrite the file at this interval, so changes of the configuration files are picked up. Written once if 0.")
+    )
+    fs.Parse(args)
+
+    cfg := &probeConfig{}
+    if *probeConfigPath != "" {
+        var err error
+        cfg, err = loadProbeConfig(*probeConfigPath)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Failed to load probe config: %v\n", err)
+            return 1
+        }
+    }
+    for {
+        targets, err := loadTargets(*configPath, cfg)
+        if err == nil {
+            err = writeFileSD(targets, *output)
+        }
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Failed to write file_sd targets: %v\n", err)
+            if *interval == 0 {
+                return 1
+            }
+        }
+        if *interval == 0 {
+            return 0
+        }
+        time.Sleep(*interval)
+    }
+}
+
+// writeFileSD writes the groups of the targets to output, stdout if empty
+func writeFileSD(targets []target, output string) error {
+    data, err := fileSDJSON(targets)
+    if err != nil {
+        return err
+    }
+    if output == "" {
+        _, err = os.Stdout.Write(data)
+        return err
+    }
+    if err := writeFileAtomic(output, data); err != nil {
+        return err
+    }
+    log.Printf("Wrote %d targets to %s", len(targets), output)
+    return nil
+}
+
+// fileSDJSON returns the file_sd JSON of the targets
+func fileSDJSON(targets []target) ([]byte, error) {
+    data, err := json.MarshalIndent(fileSDGroups(targets), "", "  ")
+    if err != nil {
+        return nil, err
+    }
+    return append(data, '\n'), nil
+}
+
+// runFileSD writes the targets the function returns, those of all sources, to output at the interval.
+// The file is only replaced when the targets changed, so Prometheus doesn't reload it for nothing.
+func runFileSD(targets func() []target, output string, interval time.Duration) {
+    var written []byte
+    for {
+        current := targets()
+        data, err := fileSDJSON(current)
+        if err == nil && !bytes.Equal(data, written) {
+            if err = writeFileAtomic(output, data); err == nil {
+                written = data
+                log.Printf("Wrote %d targets to %s", len(current), output)
+            }
+        }
+        if err != nil {
+            log.Printf("Error writing file_sd targets to %s: %v", output, err)
+        }
+        time.Sleep(interval)
+    }
+}
+
+// fileSDGroups groups the targets by their labels. The module becomes the __param_module label, which
+// Prometheus passes to /probe as the module parameter. Labels that aren't valid label names are left out.
+func fileSDGroups(targets []target) []fileSDGroup {
+    groups := make(map[string]*fileSDGroup)
+    var keys []string
+    for _, t := range targets {
+        labels := make(map[string]string)
+        for name, value := range t.Labels {
+            if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+                log.Printf("Leaving out label %q of domain %s, it is not a valid label name", name, t.Domain)
+                continue
+            }
+            labels[name] = value
+        }
+        if t.Module != "" {
+            labels["__param_module"] = t.Module
+        }
+
+        names := make([]string, 0, len(labels))
+        for name := range labels {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        var key strings.Builder
+        for _, name := range names {
+            fmt.Fprintf(&key, "%s=%q,", name, labels[name])
+        }
+
+        group, ok := groups[key.String()]
+        if !ok {
+            group = &fileSDGroup{Targets: []string{}, Labels: labels}
+            groups[key.String()] = group
+            keys = append(keys, key.String())
+        }
+        group.Targets = append(group.Targets, t.Domain)
+    }
+
+    sort.Strings(keys)
+    result := make([]fileSDGroup, 0, len(keys))
+    for _, key := range keys {
+        result = append(result, *groups[key])
+    }
+    return result
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "strconv"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+// targetGroup declares targets sharing a port, module, labels and probe interval. Targets inherit
+// the group's settings and may override them.
+type targetGroup struct {
+    Name     string            `yaml:"name"`
+    Port     int               `yaml:"port"` // applied to targets without a port, 443 by default
+    Module   string            `yaml:"module"`
+    Labels   map[string]string `yaml:"labels"`
+    Interval time.Duration     `yaml:"interval"` // probe interval, 6h by default
+    Targets  []groupTarget     `yaml:"targets"`
+}
+
+// groupTarget is a target of a group, either a domain or a mapping overriding the group's settings.
+// Domains may use brace expansion like in the domains file.
+type groupTarget struct {
+    Domain   string            `yaml:"domain"`
+    Module   string            `yaml:"module"`
+    Labels   map[string]string `yaml:"labels"`
+    Interval time.Duration     `yaml:"interval"`
+}
+
+// UnmarshalYAML accepts a plain domain as well as a mapping
+func (t *groupTarget) UnmarshalYAML(node *yaml.Node) error {
+    if node.Kind == yaml.ScalarNode {
+        t.Domain = node.Value
+        return nil
+    }
+    type plain groupTarget
+    return node.Decode((*plain)(t))
+}
+
+// validate checks the group and fills in defaults
+func (g *targetGroup) validate() error {
+    if g.Name == "" {
+        return fmt.Errorf("name is required")
+    }
+    if len(g.Targets) == 0 {
+        return fmt.Errorf("targets are required")
+    }
+    if g.Port == 0 {
+        g.Port = 443
+    }
+    if g.Port < 0 || g.Port > 65535 {
+        return fmt.Errorf("invalid port %d", g.Port)
+    }
+    if g.Interval < 0 {
+        return fmt.Errorf("interval must not be negative")
+    }
+    for i, t := range g.Targets {
+        if t.Domain == "" {
+            return fmt.Errorf("target %d: domain is required", i)
+        }
+        if t.Interval < 0 {
+            return fmt.Errorf("target %s: interval must not be negative", t.Domain)
+        }
+    }
+    return nil
+}
+
+// groupTargets returns the targets of the group with the group's settings applied.
+// The group name is added as the group label unless the labels set one.
+func groupTargets(g targetGroup) ([]target, error) {
+    var targets []target
+    for _, gt := range g.Targets {
+        domains, err := expandBraces(gt.Domain)
+        if err != nil {
+            return nil, fmt.Errorf("target %s: %v", gt.Domain, err)
+        }
+        for _, domain := range domains {
+            // URLs imply their port, they are normalized with the targets of the other sources
+            if _, _, err := net.SplitHostPort(domain); err != nil && g.Port != 443 && !isTargetURL(domain) {
+                domain = net.JoinHostPort(domain, strconv.Itoa(g.Port))
+            }
+            t := target{
+                Domain:   domain,
+                Module:   g.Module,
+                Labels:   map[string]string{"group": g.Name},
+                Interval: g.Interval,
+            }
+            for k, v := range g.Labels {
+                t.Labels[k] = v
+            }
+            for k, v := range gt.Labels {
+                t.Labels[k] = v
+            }
+            if gt.Module != "" {
+                t.Module = gt.Module
+            }
+            if gt.Interval != 0 {
+                t.Interval = gt.Interval
+            }
+            targets = append(targets, t)
+        }
+    }
+    return targets, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+    "context"
+    "net"
+    "net/http"
+    "time"
+
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// adminServer implements the gRPC admin service defined in admin.proto, mirroring the /api/v1 endpoints
+type adminServer struct {
+    UnimplementedAdminServer
+
+    e       *exporter
+    targets func() []target // currently probed
+}
+
+// serveAdmin serves the admin service on ln. Calls need the API credentials in the authorization metadata.
+func serveAdmin(ln net.Listener, e *exporter, targets func() []target) error {
+    server := grpc.NewServer(grpc.UnaryInterceptor(e.cfg.API.authorize))
+    RegisterAdminServer(server, &adminServer{e: e, targets: targets})
+    return server.Serve(ln)
+}
+
+// authorize checks the API credentials of a gRPC call, passed like the Authorization header
+func (a *apiConfig) authorize(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+    if !a.enabled() {
+        return nil, status.Error(codes.FailedPrecondition, "API is disabled, configure api credentials to enable it")
+    }
+    md, _ := metadata.FromIncomingContext(ctx)
+    r := &http.Request{Header: http.Header{"Authorization": md.Get("authorization")}}
+    if !a.authorized(r) {
+        return nil, status.Error(codes.Unauthenticated, "unauthorized")
+    }
+    return handler(ctx, req)
+}
+
+func (s *adminServer) ListTargets(ctx context.Context, req *ListTargetsRequest) (*ListTargetsResponse, error) {
+    resp := &ListTargetsResponse{}
+    for _, t := range s.targets() {
+        resp.Targets = append(resp.Targets, &Target{Domain: t.Domain, Module: t.Module, Labels: t.Labels})
+    }
+    return resp, nil
+}
+
+// Probe probes a configured target. A failed probe is a result, not an error.
+func (s *adminServer) Probe(ctx context.Context, req *ProbeRequest) (*ProbeResult, error) {
+    for _, t := range s.targets() {
+        if t.Domain != req.Domain {
+            continue
+        }
+        res, err := s.e.probeTarget(t)
+        s.e.saveState()
+        if err != nil {
+            return entryResult(t.Domain, failureEntry(err, time.Now())), nil
+        }
+        return entryResult(t.Domain, resultEntry(res, time.Now())), nil
+    }
+    return nil, status.Errorf(codes.NotFound, "unknown target %q", req.Domain)
+}
+
+// GetResults returns the last results recorded in the history. Targets never probed are left out
+// when all are requested.
+func (s *adminServer) GetResults(ctx context.Context, req *GetResultsRequest) (*GetResultsResponse, error) {
+    if s.e.history == nil {
+        return nil, status.Error(codes.FailedPrecondition, "history is disabled, set -history-size")
+    }
+    resp := &GetResultsResponse{}
+    if len(req.Domains) == 0 {
+        for _, t := range s.targets() {
+            if entry, ok := s.e.history.last(t.Domain); ok {
+                resp.Results = append(resp.Results, entryResult(t.Domain, entry))
+            }
+        }
+        return resp, nil
+    }
+    for _, domain := range req.Domains {
+        entry, ok := s.e.history.last(domain)
+        if !ok {
+            return nil, status.Errorf(codes.NotFound, "no result for target %q", domain)
+        }
+        resp.Results = append(resp.Results, entryResult(domain, entry))
+    }
+    return resp, nil
+}
+
+func (s *adminServer) Reload(ctx context.Context, req *ReloadRequest) (*ReloadResponse, error) {
+    targets, err := s.e.reload()
+    if err != nil {
+        return nil, status.Errorf(codes.FailedPrecondition, "reloading targets: %v", err)
+    }
+    return &ReloadResponse{Targets: int32(len(targets))}, nil
+}
+
+// entryResult converts a history entry to its protobuf form
+func entryResult(domain string, entry historyEntry) *ProbeResult {
+    result := &ProbeResult{
+        Domain:            domain,
+        Time:              timestamppb.New(entry.Time),
+        Success:           entry.Success,
+        Reason:            entry.Reason,
+        Error:             entry.Error,
+        Subject:           entry.Subject,
+        Issuer:            entry.Issuer,
+        FingerprintSha256: entry.Fingerprint,
+    }
+    if entry.NotBefore != nil {
+        result.NotBefore = timestamppb.New(*entry.NotBefore)
+    }
+    if entry.NotAfter != nil {
+        result.NotAfter = timestamppb.New(*entry.NotAfter)
+    }
+    return result
+}
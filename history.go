@@ -0,0 +1,114 @@
+package main
+
+import (
+    "net/http"
+    "sync"
+    "time"
+)
+
+// historyEntry is the outcome of one probe of a target
+type historyEntry struct {
+    Time        time.Time  `json:"time"`
+    Success     bool       `json:"success"`
+    Reason      string     `json:"reason,omitempty"`
+    Error       string     `json:"error,omitempty"`
+    NotBefore   *time.Time `json:"not_before,omitempty"`
+    NotAfter    *time.Time `json:"not_after,omitempty"`
+    Subject     string     `json:"subject,omitempty"`
+    Issuer      string     `json:"issuer,omitempty"`
+    Fingerprint string     `json:"fingerprint_sha256,omitempty"`
+}
+
+// history keeps the last probe results of every target in memory, so a changed expiry date or
+// a flapping target can be inspected without querying Prometheus
+type history struct {
+    size int
+
+    mu      sync.Mutex
+    entries map[string][]historyEntry // oldest first
+}
+
+// newHistory returns a history holding size entries per target
+func newHistory(size int) *history {
+    return &history{size: size, entries: make(map[string][]historyEntry)}
+}
+
+// add appends an entry for domain, dropping the oldest one if the target's buffer is full
+func (h *history) add(domain string, entry historyEntry) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    entries := append(h.entries[domain], entry)
+    if len(entries) > h.size {
+        // Copy instead of reslicing, so the dropped entries don't pin the backing array
+        entries = append([]historyEntry(nil), entries[len(entries)-h.size:]...)
+    }
+    h.entries[domain] = entries
+}
+
+// last returns the latest entry of domain
+func (h *history) last(domain string) (historyEntry, bool) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    entries := h.entries[domain]
+    if len(entries) == 0 {
+        return historyEntry{}, false
+    }
+    return entries[len(entries)-1], true
+}
+
+// recordResult adds a successful probe of domain
+func (h *history) recordResult(domain string, res *probeResult) {
+    h.add(domain, resultEntry(res, time.Now()))
+}
+
+// recordFailure adds a failed probe of domain
+func (h *history) recordFailure(domain string, err error) {
+    h.add(domain, failureEntry(err, time.Now()))
+}
+
+// resultEntry describes a successful probe by its leaf certificate
+func resultEntry(res *probeResult, now time.Time) historyEntry {
+    leaf := res.chain[0]
+    return historyEntry{
+        Time:        now,
+        Success:     true,
+        NotBefore:   &leaf.NotBefore,
+        NotAfter:    &leaf.NotAfter,
+        Subject:     leaf.Subject.String(),
+        Issuer:      leaf.Issuer.String(),
+        Fingerprint: fingerprint(leaf),
+    }
+}
+
+// failureEntry describes a failed probe
+func failureEntry(err error, now time.Time) historyEntry {
+    return historyEntry{
+        Time:   now,
+        Reason: classifyProbeError(err),
+        Error:  err.Error(),
+    }
+}
+
+// handler serves /api/v1/history: the entries of the target given as parameter, or of all targets without it
+func (h *history) handler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            w.Header().Set("Allow", "GET")
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        if domain := r.URL.Query().Get("target"); domain != "" {
+            entries, ok := h.entries[domain]
+            if !ok {
+                http.Error(w, "no history for target", http.StatusNotFound)
+                return
+            }
+            writeJSON(w, http.StatusOK, entries)
+            return
+        }
+        writeJSON(w, http.StatusOK, h.entries)
+    })
+}
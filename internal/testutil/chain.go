@@ -0,0 +1,175 @@
+package testutil
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "fmt"
+    "math/big"
+    "net"
+    "time"
+)
+
+// ChainOptions describes the chain GenerateChain issues. The zero value yields a leaf for localhost and
+// 127.0.0.1 valid for 90 days, issued by one intermediate below a root.
+type ChainOptions struct {
+    DNSNames      []string
+    IPAddresses   []net.IP
+    NotBefore     time.Time     // now if zero
+    Lifetime      time.Duration // of the leaf, 90 days if zero, negative for an expired leaf
+    Intermediates int           // between root and leaf, 1 if zero, negative for none
+    // IntermediateLifetime is the validity of the intermediates, 5 years if zero, negative for expired ones
+    IntermediateLifetime time.Duration
+}
+
+// Chain is a generated certificate chain with the keys of its certificates
+type Chain struct {
+    Root          *x509.Certificate
+    Intermediates []*x509.Certificate // leaf's issuer first
+    Leaf          *x509.Certificate
+    LeafKey       crypto.Signer
+}
+
+// GenerateChain issues a fresh chain with ECDSA P-256 keys
+func GenerateChain(opts ChainOptions) (*Chain, error) {
+    if len(opts.DNSNames) == 0 && len(opts.IPAddresses) == 0 {
+        opts.DNSNames = []string{"localhost"}
+        opts.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+    }
+    if opts.NotBefore.IsZero() {
+        opts.NotBefore = time.Now().Add(-time.Minute)
+    }
+    if opts.Lifetime == 0 {
+        opts.Lifetime = 90 * 24 * time.Hour
+    }
+    if opts.Intermediates == 0 {
+        opts.Intermediates = 1
+    }
+    if opts.IntermediateLifetime == 0 {
+        opts.IntermediateLifetime = 5 * 365 * 24 * time.Hour
+    }
+
+    root, rootKey, err := issue(&x509.Certificate{
+        Subject:               pkix.Name{CommonName: "testutil root"},
+        NotBefore:             opts.NotBefore,
+        NotAfter:              opts.NotBefore.Add(10 * 365 * 24 * time.Hour),
+        KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+    }, nil, nil)
+    if err != nil {
+        return nil, err
+    }
+    c := &Chain{Root: root}
+    issuer, issuerKey := root, rootKey
+    for i := 0; i < opts.Intermediates; i++ {
+        cert, key, err := issue(&x509.Certificate{
+            Subject:               pkix.Name{CommonName: fmt.Sprintf("testutil intermediate %d", opts.Intermediates-i)},
+            NotBefore:             validFrom(opts.NotBefore, opts.IntermediateLifetime),
+            NotAfter:              validFrom(opts.NotBefore, opts.IntermediateLifetime).Add(abs(opts.IntermediateLifetime)),
+            KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+            BasicConstraintsValid: true,
+            IsCA:                  true,
+        }, issuer, issuerKey)
+        if err != nil {
+            return nil, err
+        }
+        c.Intermediates = append([]*x509.Certificate{cert}, c.Intermediates...)
+        issuer, issuerKey = cert, key
+    }
+    c.Leaf, c.LeafKey, err = issue(&x509.Certificate{
+        Subject:     pkix.Name{CommonName: firstName(opts)},
+        DNSNames:    opts.DNSNames,
+        IPAddresses: opts.IPAddresses,
+        NotBefore:   validFrom(opts.NotBefore, opts.Lifetime),
+        NotAfter:    validFrom(opts.NotBefore, opts.Lifetime).Add(abs(opts.Lifetime)),
+        KeyUsage:    x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    }, issuer, issuerKey)
+    if err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+// Certificate returns the leaf with its intermediates as served in a handshake
+func (c *Chain) Certificate() tls.Certificate {
+    cert := tls.Certificate{PrivateKey: c.LeafKey, Leaf: c.Leaf, Certificate: [][]byte{c.Leaf.Raw}}
+    for _, inter := range c.Intermediates {
+        cert.Certificate = append(cert.Certificate, inter.Raw)
+    }
+    return cert
+}
+
+// RootPool returns a pool holding the root, for clients that verify the chain
+func (c *Chain) RootPool() *x509.CertPool {
+    pool := x509.NewCertPool()
+    pool.AddCert(c.Root)
+    return pool
+}
+
+// RootPEM returns the PEM encoded root, e.g. for a module's ca_file
+func (c *Chain) RootPEM() []byte {
+    return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Root.Raw})
+}
+
+// ChainPEM returns the PEM encoded leaf and intermediates, e.g. for the file prober
+func (c *Chain) ChainPEM() []byte {
+    var data []byte
+    for _, der := range c.Certificate().Certificate {
+        data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+    }
+    return data
+}
+
+// issue creates a certificate with a new key, self-signed without issuer
+func issue(tmpl, issuer *x509.Certificate, issuerKey crypto.Signer) (*x509.Certificate, crypto.Signer, error) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return nil, nil, err
+    }
+    tmpl.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {
+        return nil, nil, err
+    }
+    if issuer == nil {
+        issuer, issuerKey = tmpl, key
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, key.Public(), issuerKey)
+    if err != nil {
+        return nil, nil, err
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        return nil, nil, err
+    }
+    return cert, key, nil
+}
+
+// validFrom returns the start of a validity period, moved into the past for negative lifetimes
+// so the certificate has expired by notBefore
+func validFrom(notBefore time.Time, lifetime time.Duration) time.Time {
+    if lifetime < 0 {
+        return notBefore.Add(2 * lifetime)
+    }
+    return notBefore
+}
+
+func abs(d time.Duration) time.Duration {
+    if d < 0 {
+        return -d
+    }
+    return d
+}
+
+func firstName(opts ChainOptions) string {
+    if len(opts.DNSNames) > 0 {
+        return opts.DNSNames[0]
+    }
+    return opts.IPAddresses[0].String()
+}
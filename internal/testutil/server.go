@@ -0,0 +1,254 @@
+// Package testutil runs in-process TLS servers for the integration tests of the exporter's probers,
+// serving generated chains directly, behind SMTP STARTTLS or with broken handshakes.
+package testutil
+
+import (
+    "bufio"
+    "crypto/tls"
+    "io"
+    "net"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// Mode is how a Server treats the connections it accepts
+type Mode int
+
+const (
+    // ModeNormal completes the handshake and closes the connection once the client does
+    ModeNormal Mode = iota
+    // ModeReset closes connections right after accepting them, before the client hello is read
+    ModeReset
+    // ModeGarbage answers the client hello with bytes that aren't TLS
+    ModeGarbage
+    // ModeStall reads the client hello and never answers, until the client gives up
+    ModeStall
+    // ModeAlert answers the client hello with a handshake_failure alert, as servers sharing no protocol
+    // version or cipher suite with the client do
+    ModeAlert
+)
+
+// TLS alert record of ModeAlert
+const (
+    recordTypeAlert       = 21
+    alertLevelFatal       = 2
+    alertHandshakeFailure = 40
+)
+
+// STARTTLS protocols a Server can emulate
+const (
+    STARTTLSNone = ""
+    STARTTLSSMTP = "smtp"
+)
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithChain serves the chain instead of a generated one
+func WithChain(c *Chain) Option {
+    return func(s *Server) { s.Chain = c }
+}
+
+// WithMode sets how connections are treated, ModeNormal by default
+func WithMode(m Mode) Option {
+    return func(s *Server) { s.mode = m }
+}
+
+// WithSTARTTLS makes the server speak a plaintext protocol until the client upgrades the connection
+func WithSTARTTLS(protocol string) Option {
+    return func(s *Server) { s.starttls = protocol }
+}
+
+// WithTLSConfig sets the TLS configuration of the server, e.g. to restrict versions. Its certificates
+// are replaced by the chain.
+func WithTLSConfig(cfg *tls.Config) Option {
+    return func(s *Server) { s.tlsConfig = cfg.Clone() }
+}
+
+// Server is a TLS server listening on a loopback port
+type Server struct {
+    Chain *Chain // served to clients
+
+    mode      Mode
+    starttls  string
+    tlsConfig *tls.Config
+    listener  net.Listener
+
+    mu     sync.Mutex
+    conns  map[net.Conn]bool
+    closed bool
+    wg     sync.WaitGroup
+}
+
+// NewServer starts a server and stops it when the test ends. Without WithChain it serves a chain
+// of GenerateChain's defaults, which clients verify with s.Chain.RootPool().
+func NewServer(t testing.TB, opts ...Option) *Server {
+    t.Helper()
+    s := &Server{conns: make(map[net.Conn]bool)}
+    for _, opt := range opts {
+        opt(s)
+    }
+    if s.starttls != STARTTLSNone && s.starttls != STARTTLSSMTP {
+        t.Fatalf("testutil: unsupported STARTTLS protocol %q", s.starttls)
+    }
+    if s.Chain == nil {
+        chain, err := GenerateChain(ChainOptions{})
+        if err != nil {
+            t.Fatalf("testutil: generating chain: %v", err)
+        }
+        s.Chain = chain
+    }
+    if s.tlsConfig == nil {
+        s.tlsConfig = &tls.Config{}
+    }
+    s.tlsConfig.Certificates = []tls.Certificate{s.Chain.Certificate()}
+    s.tlsConfig.GetCertificate = nil
+
+    var err error
+    s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("testutil: listening: %v", err)
+    }
+    s.wg.Add(1)
+    go s.serve()
+    t.Cleanup(s.Close)
+    return s
+}
+
+// Addr returns the host:port the server listens on
+func (s *Server) Addr() string {
+    return s.listener.Addr().String()
+}
+
+// Port returns the port the server listens on
+func (s *Server) Port() int {
+    return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops the server and closes the open connections
+func (s *Server) Close() {
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        return
+    }
+    s.closed = true
+    s.listener.Close()
+    for conn := range s.conns {
+        conn.Close()
+    }
+    s.mu.Unlock()
+    s.wg.Wait()
+}
+
+func (s *Server) serve() {
+    defer s.wg.Done()
+    for {
+        conn, err := s.listener.Accept()
+        if err != nil {
+            return
+        }
+        s.mu.Lock()
+        if s.closed {
+            s.mu.Unlock()
+            conn.Close()
+            return
+        }
+        s.conns[conn] = true
+        s.wg.Add(1)
+        s.mu.Unlock()
+        go func() {
+            defer s.wg.Done()
+            s.handle(conn)
+            conn.Close()
+            s.mu.Lock()
+            delete(s.conns, conn)
+            s.mu.Unlock()
+        }()
+    }
+}
+
+func (s *Server) handle(conn net.Conn) {
+    if s.mode == ModeReset {
+        if tcp, ok := conn.(*net.TCPConn); ok {
+            tcp.SetLinger(0)
+        }
+        return
+    }
+    if s.starttls == STARTTLSSMTP {
+        if _, err := io.WriteString(conn, "220 testutil ESMTP\r\n"); err != nil || !smtpSession(conn, true) {
+            return
+        }
+    }
+    switch s.mode {
+    case ModeGarbage:
+        readRecord(conn)
+        conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"))
+        return
+    case ModeAlert:
+        readRecord(conn)
+        conn.Write([]byte{recordTypeAlert, 3, 3, 0, 2, alertLevelFatal, alertHandshakeFailure})
+        return
+    case ModeStall:
+        readRecord(conn)
+        io.Copy(io.Discard, conn)
+        return
+    }
+    tlsConn := tls.Server(conn, s.tlsConfig)
+    if err := tlsConn.Handshake(); err != nil {
+        return
+    }
+    if s.starttls == STARTTLSSMTP {
+        smtpSession(tlsConn, false)
+        return
+    }
+    io.Copy(io.Discard, tlsConn)
+}
+
+// readRecord reads the first TLS record, the client hello
+func readRecord(conn net.Conn) {
+    header := make([]byte, 5)
+    if _, err := io.ReadFull(conn, header); err != nil {
+        return
+    }
+    io.CopyN(io.Discard, conn, int64(header[3])<<8|int64(header[4]))
+}
+
+// smtpSession plays an SMTP server. Before the upgrade it offers STARTTLS and reports whether the client
+// sent it, after the upgrade it answers until the client quits.
+func smtpSession(conn io.ReadWriter, offerTLS bool) bool {
+    r := bufio.NewReader(conn)
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil {
+            return false
+        }
+        verb, _, _ := strings.Cut(strings.ToUpper(strings.TrimSpace(line)), " ")
+        var reply string
+        switch verb {
+        case "EHLO":
+            reply = "250-testutil\r\n250 PIPELINING\r\n"
+            if offerTLS {
+                reply = "250-testutil\r\n250-PIPELINING\r\n250 STARTTLS\r\n"
+            }
+        case "HELO", "NOOP", "RSET":
+            reply = "250 OK\r\n"
+        case "STARTTLS":
+            if !offerTLS {
+                reply = "503 TLS already active\r\n"
+                break
+            }
+            _, err := io.WriteString(conn, "220 Ready to start TLS\r\n")
+            return err == nil && r.Buffered() == 0
+        case "QUIT":
+            io.WriteString(conn, "221 Bye\r\n")
+            return false
+        default:
+            reply = "502 Command not implemented\r\n"
+        }
+        if _, err := io.WriteString(conn, reply); err != nil {
+            return false
+        }
+    }
+}
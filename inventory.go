@@ -0,0 +1,109 @@
+package main
+
+import (
+    "encoding/csv"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "unicode"
+)
+
+// inventoryFile maps the columns of a CSV or TSV export, e.g. from a CMDB, to targets
+type inventoryFile struct {
+    Path string `yaml:"path"`
+    // Delimiter defaults to a tab for .tsv files and a comma otherwise
+    Delimiter    string            `yaml:"delimiter"`
+    DomainColumn string            `yaml:"domain_column"`
+    ModuleColumn string            `yaml:"module_column"`
+    Labels       map[string]string `yaml:"labels"` // label name -> column
+}
+
+// readInventory reads the targets of an inventory file. The first row must hold the column names.
+func readInventory(inv inventoryFile) ([]target, error) {
+    file, err := os.Open(inv.Path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    r := csv.NewReader(file)
+    r.Comma = ','
+    if strings.EqualFold(filepath.Ext(inv.Path), ".tsv") {
+        r.Comma = '\t'
+    }
+    if inv.Delimiter != "" {
+        delim := []rune(inv.Delimiter)
+        if len(delim) != 1 {
+            return nil, fmt.Errorf("%s: delimiter must be a single character", inv.Path)
+        }
+        r.Comma = delim[0]
+    }
+    r.FieldsPerRecord = -1
+    // Trimming with a whitespace delimiter would swallow empty fields and shift the columns
+    r.TrimLeadingSpace = !unicode.IsSpace(r.Comma)
+
+    header, err := r.Read()
+    if err != nil {
+        return nil, fmt.Errorf("%s: reading header: %v", inv.Path, err)
+    }
+    columns := make(map[string]int, len(header))
+    for i, name := range header {
+        columns[strings.TrimSpace(name)] = i
+    }
+    column := func(name string) (int, error) {
+        i, ok := columns[name]
+        if !ok {
+            return 0, fmt.Errorf("%s: no column %q", inv.Path, name)
+        }
+        return i, nil
+    }
+
+    domainCol, err := column(inv.DomainColumn)
+    if err != nil {
+        return nil, err
+    }
+    moduleCol := -1
+    if inv.ModuleColumn != "" {
+        if moduleCol, err = column(inv.ModuleColumn); err != nil {
+            return nil, err
+        }
+    }
+    labelCols := make(map[string]int, len(inv.Labels))
+    for label, name := range inv.Labels {
+        if labelCols[label], err = column(name); err != nil {
+            return nil, err
+        }
+    }
+
+    var targets []target
+    for {
+        record, err := r.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("%s: %v", inv.Path, err)
+        }
+        field := func(i int) string {
+            if i < 0 || i >= len(record) {
+                return ""
+            }
+            return strings.TrimSpace(record[i])
+        }
+
+        domain := field(domainCol)
+        if domain == "" {
+            continue
+        }
+        t := target{Domain: domain, Module: field(moduleCol), Labels: make(map[string]string)}
+        for label, i := range labelCols {
+            if value := field(i); value != "" {
+                t.Labels[label] = value
+            }
+        }
+        targets = append(targets, t)
+    }
+    return targets, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "maps"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestReadInventory(t *testing.T) {
+    dir := t.TempDir()
+    for _, tc := range []struct {
+        name      string
+        file      string
+        delimiter string
+        content   string
+    }{
+        {"csv", "hosts.csv", "", "host, module, team, env\nweb1.example.com, https, web, prod\n, https, db, prod\ndb1.example.com:5432,postgres,db\n"},
+        {"tsv", "hosts.tsv", "", "host\tmodule\tteam\tenv\nweb1.example.com\thttps\tweb\tprod\n\thttps\tdb\tprod\ndb1.example.com:5432\tpostgres\tdb\t\n"},
+        {"delimiter", "hosts.txt", ";", "host;module;team;env\nweb1.example.com;https;web;prod\n;https;db;prod\ndb1.example.com:5432;postgres;db;\n"},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            path := filepath.Join(dir, tc.file)
+            if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+                t.Fatal(err)
+            }
+            targets, err := readInventory(inventoryFile{
+                Path:         path,
+                Delimiter:    tc.delimiter,
+                DomainColumn: "host",
+                ModuleColumn: "module",
+                Labels:       map[string]string{"team": "team", "environment": "env"},
+            })
+            if err != nil {
+                t.Fatalf("reading inventory: %v", err)
+            }
+            want := []target{
+                {Domain: "web1.example.com", Module: "https", Labels: map[string]string{"team": "web", "environment": "prod"}},
+                {Domain: "db1.example.com:5432", Module: "postgres", Labels: map[string]string{"team": "db"}},
+            }
+            if len(targets) != len(want) {
+                t.Fatalf("got %d targets, want %d", len(targets), len(want))
+            }
+            for i := range want {
+                got := targets[i]
+                if got.Domain != want[i].Domain || got.Module != want[i].Module || !maps.Equal(got.Labels, want[i].Labels) {
+                    t.Errorf("target %d: got %s with module %q and labels %v, want %s with module %q and labels %v",
+                        i, got.Domain, got.Module, got.Labels, want[i].Domain, want[i].Module, want[i].Labels)
+                }
+            }
+        })
+    }
+}
+
+func TestReadInventoryErrors(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "hosts.csv")
+    if err := os.WriteFile(path, []byte("host,module\nweb1.example.com,https\n"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    for name, inv := range map[string]inventoryFile{
+        "missing file":          {Path: filepath.Join(dir, "missing.csv"), DomainColumn: "host"},
+        "missing domain column": {Path: path, DomainColumn: "domain"},
+        "missing module column": {Path: path, DomainColumn: "host", ModuleColumn: "prober"},
+        "missing label column":  {Path: path, DomainColumn: "host", Labels: map[string]string{"team": "team"}},
+        "long delimiter":        {Path: path, Delimiter: ";;", DomainColumn: "host"},
+    } {
+        t.Run(name, func(t *testing.T) {
+            if _, err := readInventory(inv); err == nil {
+                t.Error("reading succeeded, want an error")
+            }
+        })
+    }
+}
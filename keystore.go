@@ -0,0 +1,274 @@
+package main
+
+import (
+    "bytes"
+    "crypto/x509"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "software.sslmate.com/src/go-pkcs12"
+)
+
+// javaKeystore is a keystore a running JVM was started with
+type javaKeystore struct {
+    Path     string
+    Type     string // JKS or PKCS12, detected from the content if empty
+    Password string
+}
+
+// defaultKeystorePassword is what the JDK tools use if no password is given
+const defaultKeystorePassword = "changeit"
+
+// jksMagic starts every JKS keystore
+const jksMagic = 0xfeedfeed
+
+// discoverJavaKeystores scans the command lines of the running processes for the keystore system properties
+func discoverJavaKeystores() ([]javaKeystore, error) {
+    entries, err := os.ReadDir("/proc")
+    if err != nil {
+        return nil, err
+    }
+    var stores []javaKeystore
+    seen := make(map[string]bool)
+    for _, e := range entries {
+        if _, err := strconv.Atoi(e.Name()); err != nil {
+            continue
+        }
+        // Processes of other users or that exited in the meantime can't be read
+        cmdline, err := os.ReadFile(filepath.Join("/proc", e.Name(), "cmdline"))
+        if err != nil {
+            continue
+        }
+        ks := javaKeystore{Password: defaultKeystorePassword}
+        for _, arg := range strings.Split(string(cmdline), "\x00") {
+            key, value, ok := strings.Cut(arg, "=")
+            if !ok {
+                continue
+            }
+            switch key {
+            case "-Djavax.net.ssl.keyStore":
+                ks.Path = value
+            case "-Djavax.net.ssl.keyStoreType":
+                ks.Type = strings.ToUpper(value)
+            case "-Djavax.net.ssl.keyStorePassword":
+                ks.Password = value
+            }
+        }
+        if ks.Path == "" || ks.Path == "NONE" {
+            continue
+        }
+        if !filepath.IsAbs(ks.Path) {
+            cwd, err := os.Readlink(filepath.Join("/proc", e.Name(), "cwd"))
+            if err != nil {
+                continue
+            }
+            ks.Path = filepath.Join(cwd, ks.Path)
+        }
+        if !seen[ks.Path] {
+            seen[ks.Path] = true
+            stores = append(stores, ks)
+        }
+    }
+    return stores, nil
+}
+
+// javaKeystoreTargets keeps a file target for every keystore of the running JVMs. JVMs come and go, so the
+// keystores are discovered anew at the interval, rather than on every scrape as discovery reads the command
+// line of every process.
+type javaKeystoreTargets struct {
+    interval time.Duration
+    changed  func()                 // called when keystores showed up
+    removed  func(domains []string) // called with the keystores of JVMs that exited
+
+    mu      sync.Mutex
+    targets []target
+}
+
+// current returns the keystores of the last discovery
+func (k *javaKeystoreTargets) current() []target {
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    return k.targets
+}
+
+// update discovers the keystores. A failed discovery keeps the previous ones.
+func (k *javaKeystoreTargets) update() {
+    stores, err := discoverJavaKeystores()
+    if err != nil {
+        log.Printf("Error discovering Java keystores: %v", err)
+        return
+    }
+    targets := make([]target, 0, len(stores))
+    for i := range stores {
+        targets = append(targets, target{Domain: stores[i].Path, Module: proberFile, Keystore: &stores[i]})
+    }
+    k.mu.Lock()
+    dropped := droppedDomains(k.targets, targets)
+    added := len(droppedDomains(targets, k.targets)) > 0
+    k.targets = targets
+    k.mu.Unlock()
+    if added || len(dropped) > 0 {
+        log.Printf("Found %d Java keystores", len(targets))
+    }
+    if len(dropped) > 0 && k.removed != nil {
+        k.removed(dropped)
+    }
+    if added && k.changed != nil {
+        k.changed()
+    }
+}
+
+// run discovers the keystores at the interval
+func (k *javaKeystoreTargets) run() {
+    for {
+        time.Sleep(k.interval)
+        k.update()
+    }
+}
+
+// probe reads the certificates of the keystore as a file target
+func (ks javaKeystore) probe() (*probeResult, error) {
+    chain, err := readKeystore(ks.Path, ks.Type, ks.Password)
+    if err != nil {
+        return nil, err
+    }
+    return &probeResult{chain: chain}, nil
+}
+
+// readKeystore returns the certificates of a JKS or PKCS#12 keystore, the first one being the leaf of the key entry
+func readKeystore(filePath, storeType, password string) ([]*x509.Certificate, error) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return nil, err
+    }
+    if storeType == "" && len(data) >= 4 && binary.BigEndian.Uint32(data) == jksMagic {
+        storeType = "JKS"
+    }
+
+    var chain []*x509.Certificate
+    switch storeType {
+    case "JKS":
+        chain, err = parseJKS(data)
+    case "", "PKCS12":
+        chain, err = parsePKCS12(data, password)
+    default:
+        return nil, fmt.Errorf("%s: unsupported keystore type %s", filePath, storeType)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", filePath, err)
+    }
+    if len(chain) == 0 {
+        return nil, fmt.Errorf("no certificates found in %s", filePath)
+    }
+    return chain, nil
+}
+
+// parsePKCS12 decodes the key entry's chain of a PKCS#12 keystore, or the certificates of a trust store
+func parsePKCS12(data []byte, password string) ([]*x509.Certificate, error) {
+    _, leaf, cas, err := pkcs12.DecodeChain(data, password)
+    if err == nil {
+        return append([]*x509.Certificate{leaf}, cas...), nil
+    }
+    certs, trustErr := pkcs12.DecodeTrustStore(data, password)
+    if trustErr != nil {
+        return nil, err
+    }
+    return certs, nil
+}
+
+// parseJKS reads the certificates of a JKS keystore. They are stored unencrypted, so no password is needed;
+// the integrity check at the end of the file is not verified. Chains of key entries come first.
+func parseJKS(data []byte) ([]*x509.Certificate, error) {
+    r := bytes.NewReader(data)
+    var header struct{ Magic, Version, Count uint32 }
+    if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+        return nil, err
+    }
+    if header.Magic != jksMagic || (header.Version != 1 && header.Version != 2) {
+        return nil, fmt.Errorf("not a JKS keystore")
+    }
+
+    var keyChains, trusted []*x509.Certificate
+    for i := uint32(0); i < header.Count; i++ {
+        var tag uint32
+        if err := binary.Read(r, binary.BigEndian, &tag); err != nil {
+            return nil, err
+        }
+        // Alias and creation time
+        if _, err := jksBytes(r, 2); err != nil {
+            return nil, err
+        }
+        if _, err := r.Seek(8, io.SeekCurrent); err != nil {
+            return nil, err
+        }
+
+        switch tag {
+        case 1: // private key with its chain
+            if _, err := jksBytes(r, 4); err != nil {
+                return nil, err
+            }
+            var n uint32
+            if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+                return nil, err
+            }
+            for j := uint32(0); j < n; j++ {
+                cert, err := jksCert(r, header.Version)
+                if err != nil {
+                    return nil, err
+                }
+                keyChains = append(keyChains, cert)
+            }
+        case 2: // trusted certificate
+            cert, err := jksCert(r, header.Version)
+            if err != nil {
+                return nil, err
+            }
+            trusted = append(trusted, cert)
+        default:
+            return nil, fmt.Errorf("unknown JKS entry tag %d", tag)
+        }
+    }
+    return append(keyChains, trusted...), nil
+}
+
+// jksCert reads a certificate of a JKS entry, version 2 prefixes it with its type
+func jksCert(r *bytes.Reader, version uint32) (*x509.Certificate, error) {
+    if version == 2 {
+        if _, err := jksBytes(r, 2); err != nil {
+            return nil, err
+        }
+    }
+    der, err := jksBytes(r, 4)
+    if err != nil {
+        return nil, err
+    }
+    return x509.ParseCertificate(der)
+}
+
+// jksBytes reads a field prefixed with its length of size 2 or 4 bytes
+func jksBytes(r *bytes.Reader, size int) ([]byte, error) {
+    var n uint32
+    if size == 2 {
+        var n16 uint16
+        if err := binary.Read(r, binary.BigEndian, &n16); err != nil {
+            return nil, err
+        }
+        n = uint32(n16)
+    } else if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+        return nil, err
+    }
+    if int64(n) > int64(r.Len()) {
+        return nil, io.ErrUnexpectedEOF
+    }
+    b := make([]byte, n)
+    _, err := io.ReadFull(r, b)
+    return b, err
+}
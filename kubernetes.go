@@ -0,0 +1,294 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into every pod
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient is a minimal client of the Kubernetes API using the pod's service account
+type kubeClient struct {
+    host   string
+    token  string
+    client *http.Client
+}
+
+// newInClusterClient returns a client for the API server of the cluster the exporter runs in
+func newInClusterClient() (*kubeClient, error) {
+    host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+    if host == "" || port == "" {
+        return nil, fmt.Errorf("not running in a cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+    }
+    token, err := os.ReadFile(serviceAccountDir + "/token")
+    if err != nil {
+        return nil, err
+    }
+    ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+    if err != nil {
+        return nil, err
+    }
+    roots := x509.NewCertPool()
+    if !roots.AppendCertsFromPEM(ca) {
+        return nil, fmt.Errorf("no certificates found in %s/ca.crt", serviceAccountDir)
+    }
+    return &kubeClient{
+        host:  "https://" + net.JoinHostPort(host, port),
+        token: strings.TrimSpace(string(token)),
+        client: &http.Client{
+            Timeout:   3 * dialTimeout,
+            Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+        },
+    }, nil
+}
+
+// get decodes the JSON response of a GET request to the API path into v
+func (c *kubeClient) get(ctx context.Context, path string, v interface{}) error {
+    _, err := c.do(ctx, http.MethodGet, path, nil, v)
+    return err
+}
+
+// do sends a request with body encoded as JSON unless it is nil and decodes a successful response into v.
+// The status code is returned along with the error of an unsuccessful response.
+func (c *kubeClient) do(ctx context.Context, method, path string, body, v interface{}) (int, error) {
+    var reqBody io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return 0, err
+        }
+        reqBody = bytes.NewReader(data)
+    }
+    req, err := http.NewRequestWithContext(ctx, method, c.host+path, reqBody)
+    if err != nil {
+        return 0, err
+    }
+    req.Header.Set("Authorization", "Bearer "+c.token)
+    req.Header.Set("Accept", "application/json")
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    resp, err := c.client.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        return resp.StatusCode, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+    }
+    if v == nil {
+        return resp.StatusCode, nil
+    }
+    return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// kubeMeta is the object metadata the exporter needs
+type kubeMeta struct {
+    Name            string            `json:"name"`
+    Namespace       string            `json:"namespace"`
+    Annotations     map[string]string `json:"annotations"`
+    OwnerReferences []struct {
+        Kind string `json:"kind"`
+        Name string `json:"name"`
+    } `json:"ownerReferences"`
+}
+
+// kubeCondition is a status condition of a cert-manager resource
+type kubeCondition struct {
+    Type    string `json:"type"`
+    Status  string `json:"status"`
+    Reason  string `json:"reason"`
+    Message string `json:"message"`
+}
+
+// condition returns the condition of the given type, nil if it isn't set
+func condition(conditions []kubeCondition, typ string) *kubeCondition {
+    for i := range conditions {
+        if conditions[i].Type == typ {
+            return &conditions[i]
+        }
+    }
+    return nil
+}
+
+// cmCertificate is a cert-manager Certificate
+type cmCertificate struct {
+    Metadata kubeMeta `json:"metadata"`
+    Spec     struct {
+        SecretName string `json:"secretName"`
+    } `json:"spec"`
+    Status struct {
+        Conditions  []kubeCondition `json:"conditions"`
+        NotAfter    *time.Time      `json:"notAfter"`
+        RenewalTime *time.Time      `json:"renewalTime"`
+    } `json:"status"`
+}
+
+// cmCertificateRequest is a cert-manager CertificateRequest
+type cmCertificateRequest struct {
+    Metadata kubeMeta `json:"metadata"`
+    Status   struct {
+        Conditions []kubeCondition `json:"conditions"`
+    } `json:"status"`
+}
+
+// certManagerMetrics exports the status of cert-manager Certificates next to the expiry of the
+// certificate actually stored in their secret, so issuance failures can be correlated with served certificates
+type certManagerMetrics struct {
+    ready         *prometheus.GaugeVec
+    notAfter      *prometheus.GaugeVec
+    renewalTime   *prometheus.GaugeVec
+    secretExpiry  *prometheus.GaugeVec
+    requestFailed *prometheus.GaugeVec
+}
+
+// newCertManagerMetrics creates the cert-manager metrics and registers them with reg
+func newCertManagerMetrics(reg prometheus.Registerer) *certManagerMetrics {
+    labels := []string{"namespace", "certificate"}
+    m := &certManagerMetrics{
+        ready: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+            Name: "ssl_certmanager_certificate_ready",
+            Help: "1 if the Ready condition of a cert-manager Certificate is true",
+        }, labels),
+        notAfter: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+            Name: "ssl_certmanager_certificate_not_after",
+            Help: "Expiry date in Unix timestamp as reported in the status of a cert-manager Certificate",
+        }, labels),
+        renewalTime: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+            Name: "ssl_certmanager_certificate_renewal_time",
+            Help: "Time in Unix timestamp cert-manager will renew a Certificate at",
+        }, labels),
+        secretExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+            Name: "ssl_certmanager_secret_expiry",
+            Help: "Expiry date in Unix timestamp of the certificate stored in the secret of a cert-manager Certificate",
+        }, labels),
+        requestFailed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+            Name: "ssl_certmanager_request_failed",
+            Help: "1 if a CertificateRequest of a cert-manager Certificate failed or was denied",
+        }, labels),
+    }
+    reg.MustRegister(m.ready, m.notAfter, m.renewalTime, m.secretExpiry, m.requestFailed)
+    return m
+}
+
+// update lists the Certificates and CertificateRequests of the namespace, all namespaces if empty,
+// and replaces the exported series
+func (m *certManagerMetrics) update(ctx context.Context, c *kubeClient, namespace string) error {
+    prefix := "/apis/cert-manager.io/v1"
+    if namespace != "" {
+        prefix += "/namespaces/" + namespace
+    }
+    var certs struct {
+        Items []cmCertificate `json:"items"`
+    }
+    if err := c.get(ctx, prefix+"/certificates", &certs); err != nil {
+        return err
+    }
+    var requests struct {
+        Items []cmCertificateRequest `json:"items"`
+    }
+    if err := c.get(ctx, prefix+"/certificaterequests", &requests); err != nil {
+        return err
+    }
+
+    // Requests are owned by the Certificate they were created for. Only the request of the latest
+    // revision counts, older failures are history once a renewal succeeded.
+    failed := make(map[[2]string]bool)
+    revisions := make(map[[2]string]int)
+    for _, req := range requests.Items {
+        revision, _ := strconv.Atoi(req.Metadata.Annotations["cert-manager.io/certificate-revision"])
+        for _, owner := range req.Metadata.OwnerReferences {
+            key := [2]string{req.Metadata.Namespace, owner.Name}
+            if owner.Kind != "Certificate" || revision < revisions[key] {
+                continue
+            }
+            revisions[key] = revision
+            ready := condition(req.Status.Conditions, "Ready")
+            denied := condition(req.Status.Conditions, "Denied")
+            failed[key] = (ready != nil && ready.Status == "False" && ready.Reason == "Failed") || (denied != nil && denied.Status == "True")
+        }
+    }
+
+    for _, vec := range []*prometheus.GaugeVec{m.ready, m.notAfter, m.renewalTime, m.secretExpiry, m.requestFailed} {
+        vec.Reset()
+    }
+    for _, cert := range certs.Items {
+        ns, name := cert.Metadata.Namespace, cert.Metadata.Name
+        ready := 0.0
+        if cond := condition(cert.Status.Conditions, "Ready"); cond != nil && cond.Status == "True" {
+            ready = 1
+        }
+        m.ready.WithLabelValues(ns, name).Set(ready)
+        if cert.Status.NotAfter != nil {
+            m.notAfter.WithLabelValues(ns, name).Set(float64(cert.Status.NotAfter.Unix()))
+        }
+        if cert.Status.RenewalTime != nil {
+            m.renewalTime.WithLabelValues(ns, name).Set(float64(cert.Status.RenewalTime.Unix()))
+        }
+        requestFailed := 0.0
+        if failed[[2]string{ns, name}] {
+            requestFailed = 1
+        }
+        m.requestFailed.WithLabelValues(ns, name).Set(requestFailed)
+
+        expiry, err := secretExpiry(ctx, c, ns, cert.Spec.SecretName)
+        if err != nil {
+            log.Printf("Error reading secret of certificate %s/%s: %v", ns, name, err)
+            continue
+        }
+        m.secretExpiry.WithLabelValues(ns, name).Set(float64(expiry.Unix()))
+    }
+    return nil
+}
+
+// secretExpiry returns the expiry date of the leaf certificate in the tls.crt key of a secret
+func secretExpiry(ctx context.Context, c *kubeClient, namespace, name string) (time.Time, error) {
+    chain, err := secretChain(ctx, c, namespace, name)
+    if err != nil {
+        return time.Time{}, err
+    }
+    return chain[0].NotAfter, nil
+}
+
+// secretChain returns the certificates in the tls.crt key of a secret
+func secretChain(ctx context.Context, c *kubeClient, namespace, name string) ([]*x509.Certificate, error) {
+    var secret struct {
+        Data map[string]string `json:"data"`
+    }
+    if err := c.get(ctx, "/api/v1/namespaces/"+namespace+"/secrets/"+name, &secret); err != nil {
+        return nil, err
+    }
+    data, err := base64.StdEncoding.DecodeString(secret.Data["tls.crt"])
+    if err != nil {
+        return nil, err
+    }
+    return parseCertPEM(data)
+}
+
+// run updates the cert-manager metrics right away and then at the given interval
+func (m *certManagerMetrics) run(c *kubeClient, namespace string, interval time.Duration) {
+    for {
+        ctx, cancel := context.WithTimeout(context.Background(), interval)
+        if err := m.update(ctx, c, namespace); err != nil {
+            log.Printf("Error reading cert-manager certificates: %v", err)
+        }
+        cancel()
+        time.Sleep(interval)
+    }
+}
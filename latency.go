@@ -0,0 +1,35 @@
+package main
+
+import (
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// phaseTotal is the latency phase covering the whole probe
+const phaseTotal = "total"
+
+// newProbeLatency returns the histogram of probe latencies by phase. It is a native histogram, so the
+// resolution doesn't depend on hand-picked buckets. Scrapers without native histogram support only see
+// the count and sum unless classic buckets are added as well.
+func newProbeLatency(classic bool) *prometheus.HistogramVec {
+    opts := prometheus.HistogramOpts{
+        Name:                            "ssl_probe_latency_seconds",
+        Help:                            "Latency of the probes of the configured targets by phase: dns, connect, tls, ocsp and total",
+        NativeHistogramBucketFactor:     1.1,
+        NativeHistogramMaxBucketNumber:  160,
+        NativeHistogramMinResetDuration: time.Hour,
+    }
+    if classic {
+        opts.Buckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+    }
+    return prometheus.NewHistogramVec(opts, []string{"phase"})
+}
+
+// observeLatency adds the phases of a probe and its total duration to the histogram
+func observeLatency(h *prometheus.HistogramVec, res *probeResult, total time.Duration) {
+    for phase, took := range res.phases {
+        h.WithLabelValues(phase).Observe(took.Seconds())
+    }
+    h.WithLabelValues(phaseTotal).Observe(total.Seconds())
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// leaseDuration is how long a lease is valid without renewal. The leader renews it every third of it,
+// so a standby takes over within leaseDuration after the leader stops.
+const leaseDuration = 15 * time.Second
+
+// microTime is the format of the timestamps of Leases
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// kubeLease is a coordination.k8s.io/v1 Lease
+type kubeLease struct {
+    APIVersion string `json:"apiVersion"`
+    Kind       string `json:"kind"`
+    Metadata   struct {
+        Name            string `json:"name"`
+        Namespace       string `json:"namespace"`
+        ResourceVersion string `json:"resourceVersion,omitempty"`
+    } `json:"metadata"`
+    Spec struct {
+        HolderIdentity       string `json:"holderIdentity,omitempty"`
+        LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+        AcquireTime          string `json:"acquireTime,omitempty"`
+        RenewTime            string `json:"renewTime,omitempty"`
+        LeaseTransitions     int    `json:"leaseTransitions"`
+    } `json:"spec"`
+}
+
+// expired reports whether the holder failed to renew the lease in time
+func (l *kubeLease) expired(now time.Time) bool {
+    renewed, err := time.Parse(microTime, l.Spec.RenewTime)
+    if err != nil {
+        return true
+    }
+    return now.After(renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// leaderElector elects one of several replicas with a Lease, so only the leader probes while
+// the standbys serve the results they restored or probed while they led
+type leaderElector struct {
+    kube      *kubeClient
+    namespace string
+    name      string
+    identity  string
+    wake      func() // called when the replica becomes the leader
+
+    mu      sync.Mutex
+    leading bool
+
+    leaderGauge prometheus.Gauge
+}
+
+// newLeaderElector returns an elector for the Lease in namespace, the pod's namespace if empty
+func newLeaderElector(kube *kubeClient, namespace, name, identity string, wake func()) (*leaderElector, error) {
+    if namespace == "" {
+        data, err := os.ReadFile(serviceAccountDir + "/namespace")
+        if err != nil {
+            return nil, fmt.Errorf("determining namespace: %v", err)
+        }
+        namespace = strings.TrimSpace(string(data))
+    }
+    return &leaderElector{
+        kube:      kube,
+        namespace: namespace,
+        name:      name,
+        identity:  identity,
+        wake:      wake,
+        leaderGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+            Name: "ssl_exporter_leader",
+            Help: "1 if this replica holds the leader election lease and probes the targets",
+        }),
+    }, nil
+}
+
+// isLeader reports whether this replica holds the lease
+func (l *leaderElector) isLeader() bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.leading
+}
+
+// tryAcquire creates, renews or takes over the lease. It returns whether this replica holds it.
+// Updates carry the resource version, so of two replicas racing for an expired lease only one wins.
+func (l *leaderElector) tryAcquire(ctx context.Context, now time.Time) (bool, error) {
+    path := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", l.namespace)
+    var lease kubeLease
+    status, err := l.kube.do(ctx, http.MethodGet, path+"/"+l.name, nil, &lease)
+    if status == http.StatusNotFound {
+        lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+        lease.Metadata.Name, lease.Metadata.Namespace = l.name, l.namespace
+        lease.Spec.HolderIdentity = l.identity
+        lease.Spec.LeaseDurationSeconds = int(leaseDuration / time.Second)
+        lease.Spec.AcquireTime = now.UTC().Format(microTime)
+        lease.Spec.RenewTime = lease.Spec.AcquireTime
+        status, err = l.kube.do(ctx, http.MethodPost, path, &lease, nil)
+        if status == http.StatusConflict {
+            return false, nil
+        }
+        return err == nil, err
+    }
+    if err != nil {
+        return false, err
+    }
+
+    if lease.Spec.HolderIdentity != l.identity {
+        if !lease.expired(now) {
+            return false, nil
+        }
+        lease.Spec.HolderIdentity = l.identity
+        lease.Spec.AcquireTime = now.UTC().Format(microTime)
+        lease.Spec.LeaseTransitions++
+    }
+    lease.Spec.LeaseDurationSeconds = int(leaseDuration / time.Second)
+    lease.Spec.RenewTime = now.UTC().Format(microTime)
+    status, err = l.kube.do(ctx, http.MethodPut, path+"/"+l.name, &lease, nil)
+    if status == http.StatusConflict {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+// run takes part in the election until the process exits. A leader that can't renew the lease
+// steps down before it expires, so two replicas never probe at the same time for long.
+func (l *leaderElector) run() {
+    lastRenewal := time.Time{}
+    for {
+        ctx, cancel := context.WithTimeout(context.Background(), leaseDuration/3)
+        now := time.Now()
+        leading, err := l.tryAcquire(ctx, now)
+        cancel()
+        if err != nil {
+            log.Printf("Error updating leader election lease %s/%s: %v", l.namespace, l.name, err)
+            // Keep leading until the lease would expire for the others
+            leading = l.isLeader() && now.Sub(lastRenewal) < leaseDuration*2/3
+        } else if leading {
+            lastRenewal = now
+        }
+
+        l.mu.Lock()
+        changed := leading != l.leading
+        l.leading = leading
+        l.mu.Unlock()
+        if changed {
+            if leading {
+                log.Printf("Became leader of lease %s/%s", l.namespace, l.name)
+                l.leaderGauge.Set(1)
+                l.wake()
+            } else {
+                log.Printf("Lost lease %s/%s, standing by", l.namespace, l.name)
+                l.leaderGauge.Set(0)
+            }
+        }
+        time.Sleep(leaseDuration / 3)
+    }
+}
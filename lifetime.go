@@ -0,0 +1,70 @@
+package main
+
+import (
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// certAges exports the age of the leaf certificate of each domain, computed at collection time
+// so it doesn't lag behind between probes
+type certAges struct {
+    domainLabel bool
+    desc        *prometheus.Desc
+
+    mu        sync.Mutex
+    notBefore map[string]time.Time
+}
+
+// newCertAges returns an empty collector, labeled with the domain if domainLabel is set
+func newCertAges(domainLabel bool) *certAges {
+    var labels []string
+    if domainLabel {
+        labels = []string{"domain"}
+    }
+    return &certAges{
+        domainLabel: domainLabel,
+        desc: prometheus.NewDesc(
+            metricCertAge,
+            "Seconds since the start date of the leaf certificate",
+            labels, nil,
+        ),
+        notBefore: make(map[string]time.Time),
+    }
+}
+
+// set records the start date of the leaf domain serves
+func (a *certAges) set(domain string, notBefore time.Time) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if !a.domainLabel {
+        // Without the label only one series can exist
+        clear(a.notBefore)
+    }
+    a.notBefore[domain] = notBefore
+}
+
+// remove drops the series of domain
+func (a *certAges) remove(domain string) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    delete(a.notBefore, domain)
+}
+
+func (a *certAges) Describe(ch chan<- *prometheus.Desc) {
+    ch <- a.desc
+}
+
+func (a *certAges) Collect(ch chan<- prometheus.Metric) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    now := certClock.Now()
+    for domain, notBefore := range a.notBefore {
+        var labels []string
+        if a.domainLabel {
+            labels = []string{domain}
+        }
+        ch <- prometheus.MustNewConstMetric(a.desc, prometheus.GaugeValue, now.Sub(notBefore).Seconds(), labels...)
+    }
+}
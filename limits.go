@@ -0,0 +1,57 @@
+package main
+
+import (
+    "fmt"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// limitsConfig bounds the number of series the exporter creates, so a misconfigured inventory or
+// an unusual certificate can't flood Prometheus with labels. Zero means unlimited, except for
+// max_sans where SANs are only exported if it is set.
+type limitsConfig struct {
+    MaxTargets int `yaml:"max_targets"` // configured targets, the ones beyond are not probed
+    MaxSANs    int `yaml:"max_sans"`    // ssl_cert_san series per target
+    MaxChains  int `yaml:"max_chains"`  // ssl_chain_expiry series per target
+}
+
+// Reasons series are dropped for, the reason label of ssl_exporter_series_dropped_total
+const (
+    droppedTargets = "targets"
+    droppedSANs    = "sans"
+    droppedChains  = "chains"
+)
+
+// seriesDropped counts what the limits cut off, shared by the configured targets and /probe
+var seriesDropped = prometheus.NewCounterVec(
+    prometheus.CounterOpts{
+        Name: "ssl_exporter_series_dropped_total",
+        Help: "Number of targets and series dropped because a configured limit was reached",
+    },
+    []string{"reason"},
+)
+
+func init() {
+    prometheus.MustRegister(seriesDropped)
+    for _, reason := range []string{droppedTargets, droppedSANs, droppedChains} {
+        seriesDropped.WithLabelValues(reason)
+    }
+}
+
+// validate rejects negative limits
+func (l *limitsConfig) validate() error {
+    if l.MaxTargets < 0 || l.MaxSANs < 0 || l.MaxChains < 0 {
+        return fmt.Errorf("limits must not be negative")
+    }
+    return nil
+}
+
+// limit returns the first max items of n, counting the rest as dropped with the domain as exemplar.
+// Zero max means unlimited.
+func limit(n, max int, reason, domain string) int {
+    if max == 0 || n <= max {
+        return n
+    }
+    addWithDomainExemplar(seriesDropped.WithLabelValues(reason), float64(n-max), domain)
+    return max
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "os/exec"
+    "os/signal"
+    "strconv"
+    "syscall"
+    "time"
+)
+
+// listenFDEnv passes the listener to the new process during an upgrade, the socket is inherited as file descriptor 3
+const listenFDEnv = "SSL_EXPORTER_LISTEN_FD"
+
+// grpcListenFDEnv passes the listener of the gRPC admin service along, inherited as file descriptor 4
+const grpcListenFDEnv = "SSL_EXPORTER_GRPC_LISTEN_FD"
+
+// shutdownTimeout bounds how long in-flight scrapes may take to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// listen returns the HTTP listener. A socket inherited from systemd socket activation or from
+// the previous process during an upgrade is preferred over binding a new one.
+func listen(addr string, reusePort bool) (net.Listener, error) {
+    if ln, err := inheritedListener(); ln != nil || err != nil {
+        return ln, err
+    }
+
+    lc := net.ListenConfig{}
+    if reusePort {
+        lc.Control = reusePortControl
+    }
+    return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// inheritedListener returns the listener passed as file descriptor 3, or nil if there is none
+func inheritedListener() (net.Listener, error) {
+    inherited := os.Getenv(listenFDEnv) != ""
+    // systemd sets LISTEN_PID to the pid of the process the sockets are meant for
+    if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err == nil && pid == os.Getpid() {
+        if n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS")); n >= 1 {
+            inherited = true
+        }
+    }
+    if !inherited {
+        return nil, nil
+    }
+    os.Unsetenv(listenFDEnv)
+    os.Unsetenv("LISTEN_PID")
+    os.Unsetenv("LISTEN_FDS")
+    return fileListener(3, "listener")
+}
+
+// listenGRPC returns the listener of the gRPC admin service, the one inherited from the previous
+// process during an upgrade if there is one
+func listenGRPC(addr string) (net.Listener, error) {
+    if os.Getenv(grpcListenFDEnv) != "" {
+        os.Unsetenv(grpcListenFDEnv)
+        return fileListener(4, "gRPC listener")
+    }
+    return net.Listen("tcp", addr)
+}
+
+// fileListener returns the listener of the inherited file descriptor fd
+func fileListener(fd uintptr, name string) (net.Listener, error) {
+    f := os.NewFile(fd, name)
+    defer f.Close()
+    ln, err := net.FileListener(f)
+    if err != nil {
+        return nil, fmt.Errorf("using inherited %s: %v", name, err)
+    }
+    log.Printf("Using inherited %s on %s", name, ln.Addr())
+    return ln, nil
+}
+
+// serve serves HTTP on ln until a termination or upgrade signal arrives. On an upgrade signal the
+// current binary is started again with the listener and the one of the gRPC admin service if it is
+// set, so no connection is refused during the deploy. In both cases in-flight requests finish before
+// the process exits.
+func serve(srv *http.Server, ln, grpcLn net.Listener) error {
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, upgradeSignals...)...)
+
+    errs := make(chan error, 1)
+    go func() { errs <- srv.Serve(ln) }()
+
+    select {
+    case err := <-errs:
+        return err
+    case sig := <-signals:
+        if sig != os.Interrupt && sig != syscall.SIGTERM {
+            if err := upgrade(ln, grpcLn); err != nil {
+                log.Printf("Upgrade failed, continuing to serve: %v", err)
+                signal.Stop(signals)
+                return serve(srv, ln, grpcLn)
+            }
+        }
+        log.Printf("Received %s, shutting down", sig)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+    defer cancel()
+    return srv.Shutdown(ctx)
+}
+
+// upgrade starts the current executable with the listener as file descriptor 3 and the gRPC listener,
+// if not nil, as file descriptor 4
+func upgrade(ln, grpcLn net.Listener) error {
+    f, err := listenerFile(ln)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    files, env := []*os.File{f}, []string{listenFDEnv + "=3"}
+    if grpcLn != nil {
+        grpcFile, err := listenerFile(grpcLn)
+        if err != nil {
+            return err
+        }
+        defer grpcFile.Close()
+        files, env = append(files, grpcFile), append(env, grpcListenFDEnv+"=4")
+    }
+
+    executable, err := os.Executable()
+    if err != nil {
+        return err
+    }
+    cmd := exec.Command(executable, os.Args[1:]...)
+    cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+    cmd.ExtraFiles = files
+    cmd.Env = append(os.Environ(), env...)
+    if err := cmd.Start(); err != nil {
+        return err
+    }
+    log.Printf("Started upgraded process %d", cmd.Process.Pid)
+    return nil
+}
+
+// listenerFile returns a duplicate of the socket of a TCP listener, to be passed to a new process
+func listenerFile(ln net.Listener) (*os.File, error) {
+    tcpLn, ok := ln.(*net.TCPListener)
+    if !ok {
+        return nil, fmt.Errorf("listener of type %T can't be passed on", ln)
+    }
+    return tcpLn.File()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "log"
+    "net"
+    "net/smtp"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// mailNotifier emails the owners of certificates that are about to expire.
+// Recipients are taken from a target label, so every team only hears about its own certificates.
+type mailNotifier struct {
+    addr      string
+    from      string
+    auth      smtp.Auth
+    labelKey  string
+    defaultTo []string
+    within    time.Duration
+    digest    time.Duration
+
+    mu       sync.Mutex
+    notified map[string]time.Time            // domain -> expiry an immediate email was sent for
+    pending  map[string]map[string]time.Time // recipient -> domain -> expiry for the next digest
+}
+
+// newMailNotifier returns a mailNotifier and, in digest mode, starts sending digests in the background
+func newMailNotifier(addr, from, username, password, labelKey, defaultTo string, days int, digest time.Duration) (*mailNotifier, error) {
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        return nil, fmt.Errorf("invalid smtp server %q: %v", addr, err)
+    }
+    if digest < 0 {
+        return nil, fmt.Errorf("digest interval must not be negative")
+    }
+
+    m := &mailNotifier{
+        addr:      addr,
+        from:      from,
+        labelKey:  labelKey,
+        defaultTo: splitRecipients(defaultTo),
+        within:    time.Duration(days) * 24 * time.Hour,
+        digest:    digest,
+        notified:  make(map[string]time.Time),
+        pending:   make(map[string]map[string]time.Time),
+    }
+    if username != "" {
+        m.auth = smtp.PlainAuth("", username, password, host)
+    }
+    if digest > 0 {
+        go func() {
+            for range time.Tick(digest) {
+                m.flush()
+            }
+        }()
+    }
+    return m, nil
+}
+
+// splitRecipients splits a comma separated address list
+func splitRecipients(list string) []string {
+    var recipients []string
+    for _, r := range strings.Split(list, ",") {
+        if r = strings.TrimSpace(r); r != "" {
+            recipients = append(recipients, r)
+        }
+    }
+    return recipients
+}
+
+// check records a certificate for notification if it expires within the configured window.
+// Without digest mode every certificate is emailed once per expiry date.
+func (m *mailNotifier) check(t target, expiry time.Time) {
+    recipients := splitRecipients(t.Labels[m.labelKey])
+    if len(recipients) == 0 {
+        recipients = m.defaultTo
+    }
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if expiry.Sub(certClock.Now()) > m.within || len(recipients) == 0 {
+        delete(m.notified, t.Domain)
+        return
+    }
+
+    if m.digest > 0 {
+        for _, r := range recipients {
+            if m.pending[r] == nil {
+                m.pending[r] = make(map[string]time.Time)
+            }
+            m.pending[r][t.Domain] = expiry
+        }
+        return
+    }
+
+    if notified, ok := m.notified[t.Domain]; ok && notified.Equal(expiry) {
+        return
+    }
+    subject := fmt.Sprintf("SSL certificate for %s expires in %d days", t.Domain, int(expiry.Sub(certClock.Now()).Hours()/24))
+    if err := m.send(recipients, subject, expiryLines(map[string]time.Time{t.Domain: expiry})); err != nil {
+        log.Printf("Error sending expiry email for domain %s: %v", t.Domain, err)
+        return
+    }
+    m.notified[t.Domain] = expiry
+}
+
+// flush sends one digest to every recipient with pending certificates
+func (m *mailNotifier) flush() {
+    m.mu.Lock()
+    pending := m.pending
+    m.pending = make(map[string]map[string]time.Time)
+    m.mu.Unlock()
+
+    for recipient, domains := range pending {
+        subject := fmt.Sprintf("%d SSL certificates expire within %d days", len(domains), int(m.within.Hours()/24))
+        if err := m.send([]string{recipient}, subject, expiryLines(domains)); err != nil {
+            log.Printf("Error sending expiry digest to %s: %v", recipient, err)
+        }
+    }
+}
+
+// expiryLines renders one line per domain, soonest expiry first
+func expiryLines(domains map[string]time.Time) string {
+    names := make([]string, 0, len(domains))
+    for domain := range domains {
+        names = append(names, domain)
+    }
+    sort.Slice(names, func(i, j int) bool { return domains[names[i]].Before(domains[names[j]]) })
+
+    var b strings.Builder
+    for _, domain := range names {
+        expiry := domains[domain]
+        fmt.Fprintf(&b, "%s expires %s (%d days)\r\n", domain, expiry.Format(time.RFC1123), int(expiry.Sub(certClock.Now()).Hours()/24))
+    }
+    return b.String()
+}
+
+// send delivers a plain text email
+func (m *mailNotifier) send(to []string, subject, body string) error {
+    var msg bytes.Buffer
+    fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+    fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+    fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+    fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+    msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+    msg.WriteString(body)
+    return smtp.SendMail(m.addr, m.auth, m.from, to, msg.Bytes())
+}
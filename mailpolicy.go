@@ -0,0 +1,432 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/miekg/dns"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// mailPolicyConfig lists the mail domains whose transport security policies are checked against the certificates
+// their MX hosts serve: the MTA-STS policy (RFC 8461) and the DANE TLSA records (RFC 7672) of each MX
+type mailPolicyConfig struct {
+    Domains []string `yaml:"domains"`
+    // Resolver is the host[:port] of the DNS server, the first one of /etc/resolv.conf if empty. DANE needs a
+    // validating resolver, records it didn't authenticate with DNSSEC are reported as such.
+    Resolver string        `yaml:"resolver"`
+    Port     int           `yaml:"port"`     // SMTP port of the MX hosts, 25 by default
+    Interval time.Duration `yaml:"interval"` // 1h by default
+}
+
+// validate fills in defaults
+func (c *mailPolicyConfig) validate() error {
+    if c.Interval == 0 {
+        c.Interval = time.Hour
+    }
+    if c.Port == 0 {
+        c.Port = 25
+    }
+    if len(c.Domains) == 0 {
+        return nil
+    }
+    if c.Resolver == "" {
+        conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+        if err != nil {
+            return fmt.Errorf("resolver is required: %v", err)
+        }
+        if len(conf.Servers) == 0 {
+            return fmt.Errorf("resolver is required, /etc/resolv.conf lists no servers")
+        }
+        c.Resolver = net.JoinHostPort(conf.Servers[0], conf.Port)
+    }
+    if _, _, err := net.SplitHostPort(c.Resolver); err != nil {
+        c.Resolver = net.JoinHostPort(c.Resolver, "53")
+    }
+    return nil
+}
+
+// MTA-STS modes, and the pseudo modes of domains without a usable policy
+const (
+    stsModeEnforce = "enforce"
+    stsModeTesting = "testing"
+    stsModeNone    = "none"
+    stsModeAbsent  = "absent"  // no _mta-sts TXT record
+    stsModeInvalid = "invalid" // the TXT record announces a policy that can't be fetched or parsed
+)
+
+// stsPolicy is an MTA-STS policy
+type stsPolicy struct {
+    mode   string
+    mx     []string // patterns, *.example.com matches a single label
+    maxAge time.Duration
+}
+
+// mailDomainState is the outcome of the last check of a mail domain
+type mailDomainState struct {
+    up     bool // DNS lookups succeeded
+    mode   string
+    maxAge time.Duration
+    mx     []mxState
+}
+
+// mxState is the outcome of the checks of an MX host
+type mxState struct {
+    host      string
+    compliant bool // serves a certificate the MTA-STS policy accepts
+    tlsa      bool // has TLSA records
+    tlsaMatch bool // one of them matches the served chain
+    dnssec    bool // the TLSA records were authenticated by the resolver
+}
+
+// mailPolicies checks and exports the transport security policies of the configured mail domains
+type mailPolicies struct {
+    cfg    mailPolicyConfig
+    dns    *dns.Client
+    client *http.Client
+
+    mu      sync.Mutex
+    domains map[string]mailDomainState
+
+    upDesc        *prometheus.Desc
+    modeDesc      *prometheus.Desc
+    maxAgeDesc    *prometheus.Desc
+    compliantDesc *prometheus.Desc
+    tlsaDesc      *prometheus.Desc
+}
+
+// newMailPolicies returns the collector for the configured mail domains
+func newMailPolicies(cfg mailPolicyConfig) *mailPolicies {
+    return &mailPolicies{
+        cfg: cfg,
+        dns: &dns.Client{Timeout: dialTimeout},
+        client: &http.Client{
+            Timeout: dialTimeout,
+            // RFC 8461 forbids following redirects of the policy
+            CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+        },
+        domains: make(map[string]mailDomainState),
+        upDesc: prometheus.NewDesc(
+            "ssl_mail_policy_up",
+            "1 if the DNS lookups of the last check of a mail domain's transport security policies succeeded",
+            []string{"mail_domain"}, nil,
+        ),
+        modeDesc: prometheus.NewDesc(
+            "ssl_mta_sts_mode_info",
+            "MTA-STS mode of a mail domain: enforce, testing, none, absent without policy or invalid if it can't be fetched, the value is always 1",
+            []string{"mail_domain", "mode"}, nil,
+        ),
+        maxAgeDesc: prometheus.NewDesc(
+            "ssl_mta_sts_max_age_seconds",
+            "Time senders cache the MTA-STS policy of a mail domain",
+            []string{"mail_domain"}, nil,
+        ),
+        compliantDesc: prometheus.NewDesc(
+            metricMTASTSMXCompliant,
+            "1 if the MX host matches the MTA-STS policy and serves a certificate valid for its name over STARTTLS",
+            []string{"mail_domain", "mx"}, nil,
+        ),
+        tlsaDesc: prometheus.NewDesc(
+            metricDANETLSAMatch,
+            "1 if a TLSA record of the MX host matches the certificate chain it serves, absent without TLSA records",
+            []string{"mail_domain", "mx", "dnssec"}, nil,
+        ),
+    }
+}
+
+// query looks up the records of a name and whether the resolver authenticated them. A missing name has no records.
+func (p *mailPolicies) query(name string, qtype uint16) ([]dns.RR, bool, error) {
+    msg := new(dns.Msg)
+    msg.SetQuestion(dns.Fqdn(name), qtype)
+    msg.SetEdns0(4096, true)
+    resp, _, err := p.dns.Exchange(msg, p.cfg.Resolver)
+    if err == nil && resp.Truncated {
+        tcp := *p.dns
+        tcp.Net = "tcp"
+        resp, _, err = tcp.Exchange(msg, p.cfg.Resolver)
+    }
+    if err != nil {
+        return nil, false, err
+    }
+    switch resp.Rcode {
+    case dns.RcodeSuccess:
+        return resp.Answer, resp.AuthenticatedData, nil
+    case dns.RcodeNameError:
+        return nil, resp.AuthenticatedData, nil
+    }
+    return nil, false, fmt.Errorf("looking up %s: %s", name, dns.RcodeToString[resp.Rcode])
+}
+
+// stsPolicy returns the MTA-STS mode of a domain and its policy if it has one
+func (p *mailPolicies) stsPolicy(domain string) (string, *stsPolicy, error) {
+    records, _, err := p.query("_mta-sts."+domain, dns.TypeTXT)
+    if err != nil {
+        return "", nil, err
+    }
+    announced := false
+    for _, rr := range records {
+        if txt, ok := rr.(*dns.TXT); ok && strings.HasPrefix(strings.Join(txt.Txt, ""), "v=STSv1") {
+            announced = true
+        }
+    }
+    if !announced {
+        return stsModeAbsent, nil, nil
+    }
+    resp, err := p.client.Get("https://mta-sts." + domain + "/.well-known/mta-sts.txt")
+    if err != nil {
+        log.Printf("Error fetching MTA-STS policy of %s: %v", domain, err)
+        return stsModeInvalid, nil, nil
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+    if err == nil && resp.StatusCode != http.StatusOK {
+        err = fmt.Errorf("unexpected status %s", resp.Status)
+    }
+    var policy *stsPolicy
+    if err == nil {
+        policy, err = parseSTSPolicy(string(body))
+    }
+    if err != nil {
+        log.Printf("Error fetching MTA-STS policy of %s: %v", domain, err)
+        return stsModeInvalid, nil, nil
+    }
+    return policy.mode, policy, nil
+}
+
+// parseSTSPolicy parses the key: value lines of an MTA-STS policy
+func parseSTSPolicy(body string) (*stsPolicy, error) {
+    policy := &stsPolicy{}
+    version := ""
+    for _, line := range strings.Split(body, "\n") {
+        key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+        if !ok {
+            continue
+        }
+        value = strings.TrimSpace(value)
+        switch strings.TrimSpace(key) {
+        case "version":
+            version = value
+        case "mode":
+            policy.mode = value
+        case "mx":
+            policy.mx = append(policy.mx, strings.ToLower(value))
+        case "max_age":
+            seconds, err := strconv.Atoi(value)
+            if err != nil {
+                return nil, fmt.Errorf("invalid max_age %q", value)
+            }
+            policy.maxAge = time.Duration(seconds) * time.Second
+        }
+    }
+    if version != "STSv1" {
+        return nil, fmt.Errorf("unsupported version %q", version)
+    }
+    switch policy.mode {
+    case stsModeEnforce, stsModeTesting, stsModeNone:
+    default:
+        return nil, fmt.Errorf("invalid mode %q", policy.mode)
+    }
+    return policy, nil
+}
+
+// matches reports whether the policy allows the MX host
+func (s *stsPolicy) matches(host string) bool {
+    host = strings.ToLower(strings.TrimSuffix(host, "."))
+    for _, pattern := range s.mx {
+        if wildcard, ok := strings.CutPrefix(pattern, "*."); ok {
+            if _, parent, ok := strings.Cut(host, "."); ok && parent == wildcard {
+                return true
+            }
+        } else if host == pattern {
+            return true
+        }
+    }
+    return false
+}
+
+// serverChain returns the chain an MX host serves over STARTTLS
+func (p *mailPolicies) serverChain(host string) ([]*x509.Certificate, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+    defer cancel()
+    conn, err := probeDialing.dialer(nil).DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(p.cfg.Port)))
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(dialTimeout))
+    state, _, err := getSMTPConnState(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+    if err != nil {
+        return nil, err
+    }
+    if len(state.PeerCertificates) == 0 {
+        return nil, errors.New("no certificates presented")
+    }
+    return state.PeerCertificates, nil
+}
+
+// checkMX checks the chain an MX host serves against the MTA-STS policy, if any, and its TLSA records
+func (p *mailPolicies) checkMX(host string, policy *stsPolicy) (mxState, error) {
+    state := mxState{host: host}
+    records, authenticated, err := p.query("_"+strconv.Itoa(p.cfg.Port)+"._tcp."+host, dns.TypeTLSA)
+    if err != nil {
+        return state, err
+    }
+    var tlsa []*dns.TLSA
+    for _, rr := range records {
+        if r, ok := rr.(*dns.TLSA); ok {
+            tlsa = append(tlsa, r)
+        }
+    }
+    state.tlsa, state.dnssec = len(tlsa) > 0, authenticated
+
+    chain, err := p.serverChain(host)
+    if err != nil {
+        // Neither the policy nor the TLSA records are satisfied
+        log.Printf("Error fetching the certificate of MX %s: %v", host, err)
+        return state, nil
+    }
+    if policy != nil {
+        _, verifyErr := verifiedChains(host, chain, nil)
+        state.compliant = policy.matches(host) && verifyErr == nil
+    }
+    for _, r := range tlsa {
+        if tlsaMatches(r, chain) {
+            state.tlsaMatch = true
+        }
+    }
+    return state, nil
+}
+
+// tlsaMatches reports whether a TLSA record matches the chain. DANE-EE and PKIX-EE records match the leaf,
+// DANE-TA and PKIX-TA records any certificate of the chain.
+func tlsaMatches(r *dns.TLSA, chain []*x509.Certificate) bool {
+    certs := chain
+    if r.Usage == 1 || r.Usage == 3 {
+        certs = chain[:1]
+    }
+    for _, cert := range certs {
+        if r.Verify(cert) == nil {
+            return true
+        }
+    }
+    return false
+}
+
+// check looks up the policies of a mail domain and checks each of its MX hosts
+func (p *mailPolicies) check(domain string) (mailDomainState, error) {
+    state := mailDomainState{}
+    mode, policy, err := p.stsPolicy(domain)
+    if err != nil {
+        return state, err
+    }
+    state.mode = mode
+    if policy != nil {
+        state.maxAge = policy.maxAge
+    }
+    records, _, err := p.query(domain, dns.TypeMX)
+    if err != nil {
+        return state, err
+    }
+    // A host listed twice with different preferences is checked once, its series would be duplicated otherwise
+    checked := make(map[string]bool, len(records))
+    for _, rr := range records {
+        mx, ok := rr.(*dns.MX)
+        if !ok {
+            continue
+        }
+        host := strings.ToLower(strings.TrimSuffix(mx.Mx, "."))
+        if checked[host] {
+            continue
+        }
+        checked[host] = true
+        mxState, err := p.checkMX(host, policy)
+        if err != nil {
+            return state, err
+        }
+        state.mx = append(state.mx, mxState)
+    }
+    state.up = true
+    return state, nil
+}
+
+// update checks every domain. The results of a domain whose DNS lookups fail are kept from the last run.
+func (p *mailPolicies) update() {
+    for _, domain := range p.cfg.Domains {
+        state, err := p.check(domain)
+        if err != nil {
+            log.Printf("Error checking transport security policies of mail domain %s: %v", domain, err)
+        }
+        p.mu.Lock()
+        if err == nil {
+            p.domains[domain] = state
+        } else {
+            previous := p.domains[domain]
+            previous.up = false
+            p.domains[domain] = previous
+        }
+        p.mu.Unlock()
+    }
+}
+
+// run updates the policies right away and then at the configured interval
+func (p *mailPolicies) run() {
+    for {
+        p.update()
+        time.Sleep(p.cfg.Interval)
+    }
+}
+
+func (p *mailPolicies) Describe(ch chan<- *prometheus.Desc) {
+    ch <- p.upDesc
+    ch <- p.modeDesc
+    ch <- p.maxAgeDesc
+    ch <- p.compliantDesc
+    ch <- p.tlsaDesc
+}
+
+func (p *mailPolicies) Collect(ch chan<- prometheus.Metric) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    for domain, state := range p.domains {
+        up := 0.0
+        if state.up {
+            up = 1
+        }
+        ch <- prometheus.MustNewConstMetric(p.upDesc, prometheus.GaugeValue, up, domain)
+        if state.mode == "" {
+            continue
+        }
+        ch <- prometheus.MustNewConstMetric(p.modeDesc, prometheus.GaugeValue, 1, domain, state.mode)
+        hasPolicy := state.mode != stsModeAbsent && state.mode != stsModeInvalid
+        if hasPolicy {
+            ch <- prometheus.MustNewConstMetric(p.maxAgeDesc, prometheus.GaugeValue, state.maxAge.Seconds(), domain)
+        }
+        for _, mx := range state.mx {
+            if hasPolicy {
+                compliant := 0.0
+                if mx.compliant {
+                    compliant = 1
+                }
+                ch <- prometheus.MustNewConstMetric(p.compliantDesc, prometheus.GaugeValue, compliant, domain, mx.host)
+            }
+            if mx.tlsa {
+                match := 0.0
+                if mx.tlsaMatch {
+                    match = 1
+                }
+                ch <- prometheus.MustNewConstMetric(p.tlsaDesc, prometheus.GaugeValue, match, domain, mx.host, strconv.FormatBool(mx.dnssec))
+            }
+        }
+    }
+}
@@ -2,12 +2,18 @@ package main
 
 import (
     "bufio"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
     "flag"
     "fmt"
     "log"
+    "net"
     "os"
-    "os/exec"
+    "strconv"
     "strings"
+    "sync"
     "time"
 
     "github.com/prometheus/client_golang/prometheus"
@@ -15,118 +21,1319 @@ import (
     "net/http"
 )
 
-// Metrics for start and expiry dates of SSL certificates
-var (
-    certStart = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name: "cert_start",
-            Help: "Start date of SSL certificates in Unix timestamp",
-        },
-        []string{"domain"},
-    )
-    certExpiry = prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name: "cert_expiry",
-            Help: "Expiry date of SSL certificates in Unix timestamp",
-        },
-        []string{"domain"},
-    )
+// Metric names, shared with the rule and dashboard generators so they follow renames
+const (
+    metricCertStart                = "cert_start"
+    metricCertExpiry               = "cert_expiry"
+    metricChainExpiredIntermediate = "ssl_chain_expired_intermediate"
+    metricChainExpiry              = "ssl_chain_expiry"
+    metricTLSFallback              = "ssl_probe_tls_fallback"
+    metricProbeFailureReason       = "ssl_probe_failure_reason"
+    metricProbePhaseDuration       = "ssl_probe_phase_duration_seconds"
+    metricResultStale              = "ssl_probe_result_stale"
+    metricProbeSuccess             = "ssl_probe_success"
+    metricProbeSuccessRaw          = "ssl_probe_success_raw"
+    metricRootStoreDivergence      = "ssl_chain_root_store_divergence"
+    metricCertSAN                  = "ssl_cert_san"
+    metricCertExpiryByUsage        = "ssl_cert_expiry_by_usage"
+    metricCertExtKeyUsage          = "ssl_cert_ext_key_usage_info"
+    metricCertBasicConstraints     = "ssl_cert_basic_constraints_info"
+    metricCertLifetime             = "ssl_cert_lifetime_seconds"
+    metricCertAge                  = "ssl_cert_age_seconds"
+    metricCertNotAfterMin          = "ssl_cert_not_after_min"
+    metricCertExpiryByAddress      = "ssl_cert_expiry_by_address"
+    metricProbeLastSuccess         = "ssl_probe_last_success_timestamp"
+    metricCertLeafFingerprint      = "ssl_cert_leaf_fingerprint_info"
+    metricCertChainID              = "ssl_cert_chain_id_info"
+    metricChainLength              = "ssl_chain_length"
+    metricChainDuplicates          = "ssl_chain_duplicate_certs"
+    metricOCSPStaplePresent        = "ssl_ocsp_staple_present"
+    metricOCSPStapleProducedAt     = "ssl_ocsp_staple_produced_at"
+    metricOCSPStapleNextUpdate     = "ssl_ocsp_staple_next_update"
+    metricOCSPStapleValid          = "ssl_ocsp_staple_valid"
+    metricCertMustStaple           = "ssl_cert_must_staple"
+    metricMustStapleViolation      = "ssl_ocsp_must_staple_violation"
+    metricCertPolicy               = "ssl_cert_policy_info"
+    metricCertValidationLevel      = "ssl_cert_validation_level_info"
+    metricCertAnomaly              = "ssl_cert_anomaly"
+    metricSecurityFinding          = "ssl_security_finding"
+    metricTLSGroup                 = "ssl_tls_group_info"
+    metricTLSEarlyData             = "ssl_tls_early_data"
+    metricTLSPostQuantum           = "ssl_tls_post_quantum"
+    metricScriptCheck              = "ssl_script_check_success"
+    metricCertParseError           = "ssl_cert_parse_error"
+    metricVerificationInfo         = "ssl_verification_info"
+    metricChainAnchor              = "ssl_chain_anchor_info"
+    metricTargetQuarantined        = "ssl_target_quarantined"
+    metricMTASTSMXCompliant        = "ssl_mta_sts_mx_compliant"
+    metricDANETLSAMatch            = "ssl_dane_tlsa_match"
+    metricACMERenewalReady         = "ssl_acme_renewal_ready"
+    metricCertRenewalOverdue       = "ssl_cert_renewal_overdue"
+    metricCertDeploymentSynced     = "ssl_cert_deployment_synced"
+    metricCertNotBefore            = "ssl_cert_not_before"
+    metricCertNotAfter             = "ssl_cert_not_after"
+    metricCertTargets              = "ssl_cert_targets"
 )
 
+// certMetrics holds the metrics for start and expiry dates of SSL certificates.
+// The configured targets share one globally registered set, every /probe request gets its own.
+// A set without the domain label holds the series of a single target, as blackbox style
+// relabeling expects from /probe, where the instance label is taken from the target parameter.
+type certMetrics struct {
+    // domainCerts exports cert_start and cert_expiry per domain, fingerprints per certificate if set
+    domainCerts  bool
+    fingerprints *fingerprintIndex
+
+    series                   *seriesStore
+    certStart                *gaugeFamily
+    certExpiry               *gaugeFamily
+    chainExpiredIntermediate *gaugeFamily
+    chainExpiry              *gaugeFamily
+    tlsFallback              *gaugeFamily
+    probeFailureReason       *gaugeFamily
+    probePhaseDuration       *gaugeFamily
+    resultStale              *gaugeFamily
+    probeSuccess             *gaugeFamily
+    probeSuccessRaw          *gaugeFamily
+    rootStoreDivergence      *gaugeFamily
+    certSAN                  *gaugeFamily
+    certExpiryByUsage        *gaugeFamily
+    certExtKeyUsage          *gaugeFamily
+    certBasicConstraints     *gaugeFamily
+    certLifetime             *gaugeFamily
+    certAge                  *certAges
+    availability             *availability
+    certNotAfterMin          *gaugeFamily
+    certExpiryByAddress      *gaugeFamily
+    probeLastSuccess         *gaugeFamily
+    certLeafFingerprint      *gaugeFamily
+    certChainID              *gaugeFamily
+    chainLength              *gaugeFamily
+    chainDuplicates          *gaugeFamily
+    ocspStaplePresent        *gaugeFamily
+    ocspStapleProducedAt     *gaugeFamily
+    ocspStapleNextUpdate     *gaugeFamily
+    ocspStapleValid          *gaugeFamily
+    certMustStaple           *gaugeFamily
+    mustStapleViolation      *gaugeFamily
+    certPolicy               *gaugeFamily
+    certValidationLevel      *gaugeFamily
+    certAnomaly              *gaugeFamily
+    securityFinding          *gaugeFamily
+    tlsGroup                 *gaugeFamily
+    tlsEarlyData             *gaugeFamily
+    tlsPostQuantum           *gaugeFamily
+    scriptCheck              *gaugeFamily
+    certParseError           *gaugeFamily
+    verificationInfo         *gaugeFamily
+    chainAnchor              *gaugeFamily
+    targetQuarantined        *gaugeFamily
+    acmeRenewalReady         *gaugeFamily
+    renewalOverdue           *gaugeFamily
+    deploymentSynced         *gaugeFamily
+
+    limits limitsConfig
+
+    // debounce is the number of consecutive failures before ssl_probe_success drops to 0
+    debounce int
+    // expireAfter is the number of consecutive failures after which the certificate series of a domain
+    // are dropped, so stale values can't hide a broken endpoint. They are kept if 0.
+    expireAfter int
+    mu        sync.Mutex
+    failures  map[string]int  // consecutive failures per domain
+    succeeded map[string]bool // domains that were probed successfully at least once
+}
+
+// newCertMetrics creates an unregistered set of certificate metrics, labeled by domain if domainLabel is set
+func newCertMetrics(domainLabel bool) *certMetrics {
+    series := newSeriesStore(domainLabel)
+    return &certMetrics{
+        domainCerts:              true,
+        series:                   series,
+        certStart:                series.gauge(metricCertStart, "Start date of SSL certificates in Unix timestamp"),
+        certExpiry:               series.gauge(metricCertExpiry, "Expiry date of SSL certificates in Unix timestamp"),
+        chainExpiredIntermediate: series.gauge(metricChainExpiredIntermediate, "1 if the server sends an intermediate certificate that is expired or expires within the warning window"),
+        chainExpiry:              series.gauge(metricChainExpiry, "Earliest expiry date in Unix timestamp of each verified certificate chain", "chain_no"),
+        tlsFallback:              series.gauge(metricTLSFallback, "Number of protocol downgrades needed for a successful handshake, labeled with the maximum version of that handshake", "max_version"),
+        probeFailureReason:       series.gauge(metricProbeFailureReason, "1 for the reason the last probe of a domain failed, absent if it succeeded", "reason"),
+        probePhaseDuration:       series.gauge(metricProbePhaseDuration, "Duration of each phase of the last successful probe: dns, connect, tls and ocsp", "phase"),
+        resultStale:              series.gauge(metricResultStale, "1 if the certificate metrics of a domain were restored from the state file and not probed since the restart"),
+        probeSuccess:             series.gauge(metricProbeSuccess, "1 if the last probe succeeded, only drops to 0 after the configured number of consecutive failures"),
+        probeSuccessRaw:          series.gauge(metricProbeSuccessRaw, "1 if the last probe succeeded, without debouncing"),
+        rootStoreDivergence:      series.gauge(metricRootStoreDivergence, "1 if the chain verifies against only one of the system roots and the Mozilla bundle"),
+        certSAN:                  series.gauge(metricCertSAN, "Subject alternative names of the leaf certificate, the value is always 1", "san"),
+        certExpiryByUsage:        series.gauge(metricCertExpiryByUsage, "Earliest expiry date in Unix timestamp of the certificates of a file target per usage, like code_signing or smime", "usage"),
+        certExtKeyUsage:          series.gauge(metricCertExtKeyUsage, "Extended key usages of the leaf certificate, like serverAuth or codeSigning, the value is always 1", "usage"),
+        certBasicConstraints:     series.gauge(metricCertBasicConstraints, "Basic constraints of the leaf certificate, max_path_len is empty if unlimited or not a CA, the value is always 1", "ca", "max_path_len"),
+        certLifetime:             series.gauge(metricCertLifetime, "Seconds between the start and expiry date of the leaf certificate"),
+        certAge:                  newCertAges(domainLabel),
+        availability:             newAvailability(),
+        certNotAfterMin:          series.gauge(metricCertNotAfterMin, "Earliest expiry date in Unix timestamp of the leaf certificates served by all probed addresses of the target"),
+        certExpiryByAddress:      series.gauge(metricCertExpiryByAddress, "Expiry date in Unix timestamp of the leaf certificate served by each address, for modules probing all addresses", "address"),
+        probeLastSuccess:         series.gauge(metricProbeLastSuccess, "Time in Unix timestamp of the last successful probe"),
+        certLeafFingerprint:      series.gauge(metricCertLeafFingerprint, "SHA-256 fingerprint of the leaf certificate, to compare the certificates instances at different vantage points see, the value is always 1", "fingerprint"),
+        chainLength:              series.gauge(metricChainLength, "Number of certificates presented, including the leaf"),
+        chainDuplicates:          series.gauge(metricChainDuplicates, "Number of certificates presented more than once in the chain"),
+        certChainID:              series.gauge(metricCertChainID, "SHA-256 hash of the whole chain as served, to group the targets serving the same chain, the value is always 1", "chain_id"),
+        ocspStaplePresent:        series.gauge(metricOCSPStaplePresent, "1 if the server stapled an OCSP response to the handshake"),
+        ocspStapleProducedAt:     series.gauge(metricOCSPStapleProducedAt, "Time in Unix timestamp the stapled OCSP response was signed"),
+        ocspStapleNextUpdate:     series.gauge(metricOCSPStapleNextUpdate, "Time in Unix timestamp the stapled OCSP response expires, absent if it doesn't say"),
+        ocspStapleValid:          series.gauge(metricOCSPStapleValid, "1 if the stapled OCSP response is signed by the issuer, current and reports the leaf as good"),
+        certMustStaple:           series.gauge(metricCertMustStaple, "1 if the leaf certificate carries the TLS feature extension requiring an OCSP staple"),
+        certPolicy:               series.gauge(metricCertPolicy, "Certificate policy OIDs of the leaf certificate, the value is always 1", "oid"),
+        certValidationLevel:      series.gauge(metricCertValidationLevel, "Validation level the policies of the leaf certificate assert: ev, ov, iv, dv or unknown, the value is always 1", "level"),
+        certAnomaly:              series.gauge(metricCertAnomaly, "1 if the served chain shows an anomaly warranting a security review: duplicate_serial or precertificate_poison", "anomaly"),
+        securityFinding:          series.gauge(metricSecurityFinding, "1 if the security scan found a weakness of ancient TLS stacks: heartbeat, compression or export_ciphers, absent for modules without security_scan", "finding"),
+        tlsGroup:                 series.gauge(metricTLSGroup, "Key exchange group of the handshake like X25519, P256 or X25519MLKEM768, the value is always 1", "group"),
+        tlsEarlyData:             series.gauge(metricTLSEarlyData, "1 if the session tickets of the TLS 1.3 server allow 0-RTT early data, absent for modules without early_data"),
+        tlsPostQuantum:           series.gauge(metricTLSPostQuantum, "1 if the handshake negotiated a post-quantum key exchange like X25519MLKEM768, absent for modules whose curve_preferences offer none"),
+        scriptCheck:              series.gauge(metricScriptCheck, "1 if the check function of the module script passed, absent for modules without one"),
+        verificationInfo:         series.gauge(metricVerificationInfo, "Trust store, its bundle version and the checked server name the chain was verified with, the value is always 1", "trust_store", "bundle_version", "server_name", "skip_verify"),
+        chainAnchor:              series.gauge(metricChainAnchor, "SHA-256 fingerprint of the root each verified chain ends in, the value is always 1", "chain_no", "sha256"),
+        targetQuarantined:        series.gauge(metricTargetQuarantined, "1 if the target failed hard, with NXDOMAIN or connection refused, too often in a row and is probed at -quarantine-interval until it recovers"),
+        acmeRenewalReady:         series.gauge(metricACMERenewalReady, "1 if the HTTP-01 challenge path is reachable or the DNS-01 challenge zone is served, for targets labeled acme", "challenge"),
+        renewalOverdue:           series.gauge(metricCertRenewalOverdue, "1 if the certificate is older than the max_lifetime minus the renewal_lead declared for the target"),
+        deploymentSynced:         series.gauge(metricCertDeploymentSynced, "1 if the served certificate matches the one in the target's cert_file or cert_secret, 0 if it differs", "source"),
+        certParseError:           series.gauge(metricCertParseError, "1 if a served certificate is malformed and only the fields that parse are exported"),
+        mustStapleViolation:      series.gauge(metricMustStapleViolation, "1 if the leaf certificate requires an OCSP staple and the server stapled none or an invalid one, absent for other certificates"),
+        debounce:                 1,
+        failures:                 make(map[string]int),
+        succeeded:                make(map[string]bool),
+    }
+}
+
+// register registers all metrics of the set with reg
+func (m *certMetrics) register(reg prometheus.Registerer) {
+    reg.MustRegister(m.series, m.certAge, m.availability)
+}
+
+// recordFailure exports why probing a domain failed. The certificate metrics keep their last values.
+// ssl_probe_success only drops to 0 once the debounce threshold is reached or if the domain never succeeded.
+func (m *certMetrics) recordFailure(domain string, err error) {
+    m.probeFailureReason.forget(domain)
+    m.probeFailureReason.set(domain, 1, classifyProbeError(err))
+
+    m.mu.Lock()
+    m.failures[domain]++
+    down := m.failures[domain] >= m.debounce || !m.succeeded[domain]
+    expired := m.expireAfter > 0 && m.failures[domain] >= m.expireAfter
+    m.mu.Unlock()
+
+    m.probeSuccessRaw.set(domain, 0)
+    if down {
+        m.probeSuccess.set(domain, 0)
+    }
+    if expired {
+        m.expire(domain)
+    }
+}
+
+// expire drops the certificate series of a domain. The probe status series, including the time of
+// the last success, are kept.
+func (m *certMetrics) expire(domain string) {
+    for _, family := range []*gaugeFamily{
+        m.certStart, m.certExpiry, m.chainExpiredIntermediate, m.chainExpiry, m.rootStoreDivergence, m.certSAN,
+        m.certExpiryByUsage, m.certExtKeyUsage, m.certBasicConstraints, m.certLifetime, m.certNotAfterMin, m.certExpiryByAddress,
+        m.certLeafFingerprint, m.certChainID, m.chainLength, m.chainDuplicates, m.ocspStaplePresent, m.ocspStapleProducedAt, m.ocspStapleNextUpdate, m.ocspStapleValid,
+        m.certMustStaple, m.mustStapleViolation, m.certPolicy, m.certValidationLevel, m.certAnomaly,
+        m.verificationInfo, m.chainAnchor, m.renewalOverdue, m.deploymentSynced,
+    } {
+        family.forget(domain)
+    }
+    m.certAge.remove(domain)
+    if m.fingerprints != nil {
+        m.fingerprints.remove(domain)
+    }
+}
+
+// remove drops every series of a domain that is no longer a target
+func (m *certMetrics) remove(domain string) {
+    m.expire(domain)
+    for _, family := range []*gaugeFamily{
+        m.tlsFallback, m.probeFailureReason, m.probePhaseDuration, m.resultStale, m.probeSuccess, m.probeSuccessRaw, m.probeLastSuccess,
+        m.securityFinding, m.tlsGroup, m.tlsEarlyData, m.tlsPostQuantum, m.scriptCheck,
+        m.certParseError, m.targetQuarantined, m.acmeRenewalReady,
+    } {
+        family.forget(domain)
+    }
+    m.availability.remove(domain)
+    m.mu.Lock()
+    delete(m.failures, domain)
+    delete(m.succeeded, domain)
+    m.mu.Unlock()
+}
+
+// record updates the metrics of a domain from the certificate chain it presented
+func (m *certMetrics) record(domain string, res *probeResult, intermediateWarn time.Duration) {
+    m.probeFailureReason.forget(domain)
+    m.resultStale.set(domain, 0)
+    m.probeSuccess.set(domain, 1)
+    m.probeSuccessRaw.set(domain, 1)
+    m.probeLastSuccess.set(domain, float64(time.Now().Unix()))
+    m.mu.Lock()
+    m.failures[domain] = 0
+    m.succeeded[domain] = true
+    m.mu.Unlock()
+
+    chain := res.chain
+    if m.domainCerts {
+        m.certStart.set(domain, float64(chain[0].NotBefore.Unix()))
+        m.certExpiry.set(domain, float64(chain[0].NotAfter.Unix()))
+        m.certLifetime.set(domain, chain[0].NotAfter.Sub(chain[0].NotBefore).Seconds())
+        m.certAge.set(domain, chain[0].NotBefore)
+    }
+    if m.fingerprints != nil {
+        m.fingerprints.update(domain, chain[0])
+    }
+
+    // A single series for the worst case across IPs and address families keeps alert rules simple
+    m.certNotAfterMin.set(domain, float64(res.notAfterMin().Unix()))
+    m.certExpiryByAddress.forget(domain)
+    for addr, notAfter := range res.addressNotAfter {
+        m.certExpiryByAddress.set(domain, float64(notAfter.Unix()), addr.String())
+    }
+
+    if m.limits.MaxSANs > 0 {
+        m.certSAN.forget(domain)
+        sans := certSANs(chain[0])
+        for _, san := range sans[:limit(len(sans), m.limits.MaxSANs, droppedSANs, domain)] {
+            m.certSAN.set(domain, 1, san)
+        }
+    }
+
+    m.certLeafFingerprint.forget(domain)
+    m.certLeafFingerprint.set(domain, 1, fingerprint(chain[0]))
+    // A rotated wildcard shows up as the same chain_id on every load balancer that got it
+    m.certChainID.forget(domain)
+    m.certChainID.set(domain, 1, chainID(chain))
+    // Every certificate adds to the handshake, constrained clients give up on long chains
+    m.chainLength.set(domain, float64(len(chain)))
+    m.chainDuplicates.set(domain, float64(duplicateCerts(chain)))
+
+    m.certExtKeyUsage.forget(domain)
+    for _, usage := range extKeyUsages(chain[0]) {
+        m.certExtKeyUsage.set(domain, 1, usage)
+    }
+    m.certBasicConstraints.forget(domain)
+    maxPathLen := ""
+    if chain[0].IsCA && (chain[0].MaxPathLen > 0 || chain[0].MaxPathLenZero) {
+        maxPathLen = strconv.Itoa(chain[0].MaxPathLen)
+    }
+    m.certBasicConstraints.set(domain, 1, strconv.FormatBool(chain[0].IsCA), maxPathLen)
+
+    // Renewals through another product or CA can silently drop the validation level
+    m.certPolicy.forget(domain)
+    for _, oid := range certPolicies(chain[0]) {
+        m.certPolicy.set(domain, 1, oid)
+    }
+    m.certValidationLevel.forget(domain)
+    m.certValidationLevel.set(domain, 1, validationLevel(chain[0]))
+    m.recordAnomalies(domain, chain)
+
+    // Bundles and signed files hold certificates of several usages, each of which can lapse on its own.
+    // Results restored from the state file have no TLS state either, so the series of network targets
+    // are forgotten by their first probe.
+    m.certExpiryByUsage.forget(domain)
+    if res.tlsState == nil {
+        for usage, notAfter := range expiryByUsage(chain) {
+            m.certExpiryByUsage.set(domain, float64(notAfter.Unix()), usage)
+        }
+    }
+
+    stale := 0.0
+    if hasStaleIntermediate(chain, certClock.Now().Add(intermediateWarn)) {
+        stale = 1
+        log.Printf("Domain %s serves an expired or soon to expire intermediate certificate", domain)
+    }
+    m.chainExpiredIntermediate.set(domain, stale)
+
+    m.recordStaple(domain, res, certClock.Now())
+
+    m.probePhaseDuration.forget(domain)
+    for phase, took := range res.phases {
+        m.probePhaseDuration.set(domain, took.Seconds(), phase)
+    }
+
+    m.tlsFallback.forget(domain)
+    if res.maxVersion != 0 {
+        m.tlsFallback.set(domain, float64(res.fallbackSteps), tlsVersionName(res.maxVersion))
+    }
+
+    // The group tracks the migration to X25519 and post-quantum key exchange, RSA key exchange has none
+    m.tlsGroup.forget(domain)
+    if res.tlsState != nil && res.tlsState.CurveID != 0 {
+        m.tlsGroup.set(domain, 1, curveName(res.tlsState.CurveID))
+    }
+    m.tlsPostQuantum.forget(domain)
+    if res.tlsState != nil && res.pqOffered {
+        pq := 0.0
+        if postQuantum(res.tlsState.CurveID) {
+            pq = 1
+        }
+        m.tlsPostQuantum.set(domain, pq)
+    }
+    m.tlsEarlyData.forget(domain)
+    if res.earlyData != nil {
+        earlyData := 0.0
+        if *res.earlyData {
+            earlyData = 1
+        }
+        m.tlsEarlyData.set(domain, earlyData)
+    }
+    m.scriptCheck.forget(domain)
+    if res.scriptPass != nil {
+        passed := 0.0
+        if *res.scriptPass {
+            passed = 1
+        }
+        m.scriptCheck.set(domain, passed)
+    }
+    parseError := 0.0
+    if res.parseError {
+        parseError = 1
+    }
+    m.certParseError.set(domain, parseError)
+
+    // A scan that couldn't reach the server keeps the findings of the last one
+    if res.findings != nil {
+        m.securityFinding.forget(domain)
+    }
+    for finding, found := range res.findings {
+        value := 0.0
+        if found {
+            value = 1
+            log.Printf("Domain %s has security finding %s", domain, finding)
+        }
+        m.securityFinding.set(domain, value, finding)
+    }
+
+    // Drop chains from the previous run, the number of validation paths can shrink
+    m.chainExpiry.forget(domain)
+    if res.skipVerify {
+        res.attestation = newAttestation(res, nil, nil, certClock.Now())
+        m.recordAttestation(domain, res.attestation)
+        m.rootStoreDivergence.forget(domain)
+        return
+    }
+    serverName := res.serverName
+    if res.spiffeID != "" {
+        // SVIDs identify workloads by their SPIFFE ID, not by host name
+        serverName = ""
+    }
+    chains, err := verifiedChains(serverName, chain, res.roots)
+    if err == nil && res.spiffeID != "" {
+        if err = verifySPIFFEID(chain[0], res.spiffeID); err != nil {
+            chains = nil
+        }
+    }
+    if err != nil {
+        log.Printf("No verified chain for domain %s: %v", domain, err)
+    }
+    chains = chains[:limit(len(chains), m.limits.MaxChains, droppedChains, domain)]
+    for i, c := range chains {
+        m.chainExpiry.set(domain, float64(chainNotAfter(c).Unix()), strconv.Itoa(i))
+    }
+    res.attestation = newAttestation(res, chains, err, certClock.Now())
+    m.recordAttestation(domain, res.attestation)
+
+    // A chain the servers trust but browsers don't, or the other way around
+    _, systemErr := verifiedChains(res.serverName, chain, nil)
+    _, mozillaErr := verifiedChains(res.serverName, chain, mozilla.roots())
+    divergence := 0.0
+    if (systemErr == nil) != (mozillaErr == nil) {
+        divergence = 1
+        log.Printf("Trust of domain %s differs between the system roots (%v) and the Mozilla bundle (%v)", domain, systemErr, mozillaErr)
+    }
+    m.rootStoreDivergence.set(domain, divergence)
+}
+
+// metrics are the certificate metrics of the configured targets
+var metrics = newCertMetrics(true)
+
+// dialTimeout bounds the TCP connect and TLS handshake of a single probe
+const dialTimeout = 10 * time.Second
+
 func init() {
-    prometheus.MustRegister(certStart)
-    prometheus.MustRegister(certExpiry)
+    metrics.register(prometheus.DefaultRegisterer)
 }
 
-// getSSLCertDates executes the OpenSSL command to fetch the start and expiry dates of the certificate
-func getSSLCertDates(domain string) (start, expiry time.Time, err error) {
-    cmd := fmt.Sprintf(`openssl s_client -connect %s:443 -servername %s < /dev/null 2>/dev/null | openssl x509 -noout -dates`, domain, domain)
-    output, err := exec.Command("bash", "-c", cmd).Output()
+// getSSLConnState performs the TLS handshake on conn and returns the connection state with the
+// certificates presented by the server, leaf first, and the duration of the handshake.
+// The config must skip verification so that self signed certificates can be monitored as well.
+func getSSLConnState(ctx context.Context, conn net.Conn, tlsCfg *tls.Config) (tls.ConnectionState, time.Duration, error) {
+    tlsConn, took, err := handshake(ctx, conn, tlsCfg)
     if err != nil {
-        return start, expiry, err
+        return tls.ConnectionState{}, took, err
     }
+    return tlsConn.ConnectionState(), took, nil
+}
 
-    lines := strings.Split(string(output), "\n")
-    for _, line := range lines {
-        if strings.HasPrefix(line, "notBefore=") {
-            start, err = time.Parse("Jan 2 15:04:05 2006 MST", strings.TrimPrefix(line, "notBefore="))
-            if err != nil {
-                return start, expiry, err
-            }
-        } else if strings.HasPrefix(line, "notAfter=") {
-            expiry, err = time.Parse("Jan 2 15:04:05 2006 MST", strings.TrimPrefix(line, "notAfter="))
-            if err != nil {
-                return start, expiry, err
-            }
+// errCertificateReceived aborts a handshake once the server's certificate arrived
+var errCertificateReceived = errors.New("certificate received")
+
+// getCertificateState runs the TLS handshake on conn only until the server's certificate was received and
+// returns the connection state at that point, which holds the version, cipher suite and stapled OCSP response.
+// The client then aborts with a bad_certificate alert instead of finishing the key exchange.
+func getCertificateState(ctx context.Context, conn net.Conn, tlsCfg *tls.Config) (tls.ConnectionState, time.Duration, error) {
+    var state tls.ConnectionState
+    tlsCfg = tlsCfg.Clone()
+    tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+        state = cs
+        return errCertificateReceived
+    }
+    _, took, err := handshake(ctx, conn, tlsCfg)
+    if errors.Is(err, errCertificateReceived) {
+        return state, took, nil
+    }
+    if err == nil {
+        err = errors.New("handshake finished without a certificate")
+    }
+    return tls.ConnectionState{}, took, err
+}
+
+// handshake runs a client handshake on conn and returns the TLS connection and the time it took
+func handshake(ctx context.Context, conn net.Conn, tlsCfg *tls.Config) (*tls.Conn, time.Duration, error) {
+    tlsConn := tls.Client(conn, tlsCfg)
+    start := time.Now()
+    err := tlsConn.HandshakeContext(ctx)
+    return tlsConn, time.Since(start), err
+}
+
+// hasStaleIntermediate reports whether any certificate after the leaf is expired or expires before the deadline
+func hasStaleIntermediate(chain []*x509.Certificate, deadline time.Time) bool {
+    for _, cert := range chain[1:] {
+        if cert.NotAfter.Before(deadline) {
+            return true
+        }
+    }
+    return false
+}
+
+// verifiedChains returns every chain from the leaf to a trusted root that can be built from the presented certificates.
+// A cross-signed intermediate yields one chain per issuer, so each validation path can be tracked separately.
+// The host name is only checked if serverName is set. A nil roots pool verifies against the system roots.
+// Leaves that aren't TLS server certificates, like code signing ones, are verified for any usage.
+func verifiedChains(serverName string, chain []*x509.Certificate, roots *x509.CertPool) ([][]*x509.Certificate, error) {
+    intermediates := x509.NewCertPool()
+    for _, cert := range chain[1:] {
+        intermediates.AddCert(cert)
+    }
+    opts := x509.VerifyOptions{
+        DNSName:       serverName,
+        Intermediates: intermediates,
+        Roots:         roots,
+        CurrentTime:   certClock.Now(),
+    }
+    if certUsage(chain[0]) != usageTLS {
+        opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageAny}
+    }
+    return chain[0].Verify(opts)
+}
+
+// certSANs returns the DNS names, IP addresses, email addresses and URIs of a certificate
+func certSANs(cert *x509.Certificate) []string {
+    sans := append([]string(nil), cert.DNSNames...)
+    for _, ip := range cert.IPAddresses {
+        sans = append(sans, ip.String())
+    }
+    sans = append(sans, cert.EmailAddresses...)
+    for _, uri := range cert.URIs {
+        sans = append(sans, uri.String())
+    }
+    return sans
+}
+
+// extKeyUsageNames are the names RFC 5280 gives the extended key usages
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+    x509.ExtKeyUsageAny:                            "any",
+    x509.ExtKeyUsageServerAuth:                     "serverAuth",
+    x509.ExtKeyUsageClientAuth:                     "clientAuth",
+    x509.ExtKeyUsageCodeSigning:                    "codeSigning",
+    x509.ExtKeyUsageEmailProtection:                "emailProtection",
+    x509.ExtKeyUsageIPSECEndSystem:                 "ipsecEndSystem",
+    x509.ExtKeyUsageIPSECTunnel:                    "ipsecTunnel",
+    x509.ExtKeyUsageIPSECUser:                      "ipsecUser",
+    x509.ExtKeyUsageTimeStamping:                   "timeStamping",
+    x509.ExtKeyUsageOCSPSigning:                    "OCSPSigning",
+    x509.ExtKeyUsageMicrosoftServerGatedCrypto:     "msSGC",
+    x509.ExtKeyUsageNetscapeServerGatedCrypto:      "nsSGC",
+    x509.ExtKeyUsageMicrosoftCommercialCodeSigning: "msCodeCom",
+    x509.ExtKeyUsageMicrosoftKernelCodeSigning:     "msKernelCode",
+}
+
+// extKeyUsages returns the names of the extended key usages of a certificate, unknown ones as OID
+func extKeyUsages(cert *x509.Certificate) []string {
+    var usages []string
+    for _, u := range cert.ExtKeyUsage {
+        usages = append(usages, extKeyUsageNames[u])
+    }
+    for _, oid := range cert.UnknownExtKeyUsage {
+        usages = append(usages, oid.String())
+    }
+    return usages
+}
+
+// chainNotAfter returns the earliest expiry date of all certificates in a chain
+func chainNotAfter(chain []*x509.Certificate) time.Time {
+    notAfter := chain[0].NotAfter
+    for _, cert := range chain[1:] {
+        if cert.NotAfter.Before(notAfter) {
+            notAfter = cert.NotAfter
         }
     }
-    return start, expiry, nil
+    return notAfter
 }
 
-// readDomains reads the list of domains from a configuration file
-func readDomains(filePath string) ([]string, error) {
+// target is a domain to probe together with the module and labels assigned to it in the configuration file
+type target struct {
+    Domain string
+    Module string
+    Labels map[string]string
+
+    Interval time.Duration // overrides probeInterval if set
+    Keystore *javaKeystore // set for keystores of running JVMs, read instead of the file prober
+}
+
+// hostOf returns the host of a target, which may carry a port
+func hostOf(domain string) string {
+    if host, _, err := net.SplitHostPort(domain); err == nil {
+        return host
+    }
+    return domain
+}
+
+// readTargets reads the list of targets from a configuration file.
+// Each line holds a domain optionally followed by whitespace separated key=value labels.
+// The label module selects the probe module of the target. Brace expressions in the domain,
+// like web{01..20}.{de,fr}.example.com, expand to one target per combination sharing the labels.
+// Domains can also be URLs like ldaps://dc1, whose scheme implies the port and, without label, the module.
+func readTargets(filePath string) ([]target, error) {
     file, err := os.Open(filePath)
     if err != nil {
         return nil, err
     }
     defer file.Close()
 
-    var domains []string
+    var targets []target
     scanner := bufio.NewScanner(file)
-    for scanner.Scan() {
+    for lineNo := 1; scanner.Scan(); lineNo++ {
         line := strings.TrimSpace(scanner.Text())
-        if line != "" && !strings.HasPrefix(line, "#") { // Ignore empty lines and comments
-            domains = append(domains, line)
+        if line == "" || strings.HasPrefix(line, "#") { // Ignore empty lines and comments
+            continue
+        }
+        fields := strings.Fields(line)
+        t := target{Labels: make(map[string]string)}
+        for _, field := range fields[1:] {
+            key, value, ok := strings.Cut(field, "=")
+            if !ok || key == "" {
+                return nil, fmt.Errorf("line %d: invalid label %q, expected key=value", lineNo, field)
+            }
+            if key == "module" {
+                t.Module = value
+                continue
+            }
+            t.Labels[key] = value
+        }
+        domains, err := expandBraces(fields[0])
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %v", lineNo, err)
+        }
+        for _, domain := range domains {
+            expanded := target{Domain: domain, Module: t.Module, Labels: make(map[string]string, len(t.Labels))}
+            for k, v := range t.Labels {
+                expanded.Labels[k] = v
+            }
+            targets = append(targets, expanded)
         }
     }
     if err := scanner.Err(); err != nil {
         return nil, err
     }
-    return domains, nil
+    return targets, nil
 }
 
-// updateMetrics updates the Prometheus metrics for each domain
-func updateMetrics(domains []string) {
-    for _, domain := range domains {
-        start, expiry, err := getSSLCertDates(domain)
+// loadTargets reads the targets of the domains file and of the target sources of the probe config.
+// They are validated against the modules of the probe config.
+func loadTargets(configPath string, cfg *probeConfig) ([]target, error) {
+    targets, err := readTargets(configPath)
+    if err != nil {
+        return nil, fmt.Errorf("reading domains from config file: %v", err)
+    }
+    for _, inv := range cfg.InventoryFiles {
+        inventoryTargets, err := readInventory(inv)
         if err != nil {
-            log.Printf("Error fetching SSL certificate for domain %s: %v", domain, err)
-            continue
+            return nil, fmt.Errorf("reading inventory file: %v", err)
+        }
+        log.Printf("Read %d targets from inventory file %s", len(inventoryTargets), inv.Path)
+        targets = append(targets, inventoryTargets...)
+    }
+    for _, f := range cfg.ScanResults {
+        scanTargets, err := readScanResults(*f)
+        if err != nil {
+            return nil, fmt.Errorf("reading scan results: %v", err)
+        }
+        log.Printf("Read %d targets from %s scan results %s", len(scanTargets), f.Format, f.Path)
+        targets = append(targets, scanTargets...)
+    }
+    for _, pc := range cfg.ProxyConfigs {
+        proxyTargets, err := discoverProxyCerts(pc)
+        if err != nil {
+            return nil, fmt.Errorf("reading %s config: %v", pc.Type, err)
+        }
+        log.Printf("Found %d certificates in %s config %s", len(proxyTargets), pc.Type, pc.Path)
+        targets = append(targets, proxyTargets...)
+    }
+    for _, g := range cfg.Groups {
+        groupTargets, err := groupTargets(*g)
+        if err != nil {
+            return nil, fmt.Errorf("reading group %s: %v", g.Name, err)
+        }
+        targets = append(targets, groupTargets...)
+    }
+    for _, z := range cfg.Zones {
+        zoneTargets, err := zoneTargets(*z)
+        if err != nil {
+            return nil, fmt.Errorf("reading zone %s: %v", z, err)
+        }
+        log.Printf("Found %d names in zone %s", len(zoneTargets), z)
+        targets = append(targets, zoneTargets...)
+    }
+    if n := limit(len(targets), cfg.Limits.MaxTargets, droppedTargets, ""); n < len(targets) {
+        log.Printf("Only probing the first %d of %d targets, max_targets is reached", n, len(targets))
+        targets = targets[:n]
+    }
+    // currentTargets normalizes the targets of all sources, those of the files are checked here already
+    for i, t := range targets {
+        if targets[i], err = normalizeTarget(t); err != nil {
+            return nil, fmt.Errorf("invalid target %s: %v", t.Domain, err)
+        }
+        t = targets[i]
+        if _, err := cfg.module(t.Module); err != nil {
+            return nil, fmt.Errorf("invalid module for domain %s: %v", t.Domain, err)
+        }
+        if _, _, err := renewalPolicy(t); err != nil {
+            return nil, fmt.Errorf("invalid renewal policy for domain %s: %v", t.Domain, err)
+        }
+    }
+    return targets, nil
+}
+
+// exporter bundles the configuration and the optional subsystems used while probing the configured targets
+type exporter struct {
+    cfg              *probeConfig
+    intermediateWarn time.Duration
+    alerts           *alerter
+    mails            *mailNotifier
+    state            *stateStore
+    snooze           *snoozer
+    history          *history
+    certs            *certStore
+    latency          *prometheus.HistogramVec
+    kube             *kubeClient
+    schedule         *scheduler
+    rotations        *rotationNotifier
+    ct               *ctCertificates
+    coordinator      *coordinator
+    worker           *worker
+    leader           *leaderElector
+    dialer           *net.Dialer
+    chains           *observedChains
+    configPath       string
+
+    mu sync.Mutex
+
+    targetsMu sync.Mutex
+    targets   []target // of the configuration files, replaced by reload
+
+    wake chan struct{} // interrupts the wait for the next scheduler check
+}
+
+// wakeUp makes the scheduler check for due targets right away, e.g. after targets were added
+func (e *exporter) wakeUp() {
+    select {
+    case e.wake <- struct{}{}:
+    default:
+    }
+}
+
+// configured returns the targets of the configuration files
+func (e *exporter) configured() []target {
+    e.targetsMu.Lock()
+    defer e.targetsMu.Unlock()
+    return e.targets
+}
+
+// reload reads the targets of the configuration files again and drops the series of removed ones.
+// Modules and the other settings of the probe config are kept, changing them requires a restart.
+func (e *exporter) reload() ([]target, error) {
+    targets, err := loadTargets(e.configPath, e.cfg)
+    if err != nil {
+        return nil, err
+    }
+    e.targetsMu.Lock()
+    previous := e.targets
+    e.targets = targets
+    e.targetsMu.Unlock()
+
+    for _, domain := range droppedDomains(previous, targets) {
+        e.removeTarget(domain)
+    }
+    log.Printf("Reloaded %d targets", len(targets))
+    e.wakeUp()
+    return targets, nil
+}
+
+// removeTarget drops the series and the stored result of a domain that is no longer a target
+func (e *exporter) removeTarget(domain string) {
+    metrics.remove(domain)
+    if e.state != nil {
+        e.state.forget(domain)
+    }
+}
+
+// droppedDomains returns the domains of previous that are missing in current
+func droppedDomains(previous, current []target) []string {
+    kept := make(map[string]bool, len(current))
+    for _, t := range current {
+        kept[t.Domain] = true
+    }
+    var dropped []string
+    for _, t := range previous {
+        if !kept[t.Domain] {
+            dropped = append(dropped, t.Domain)
+        }
+    }
+    return dropped
+}
+
+// updateMetrics updates the Prometheus metrics for each target
+func (e *exporter) updateMetrics(targets []target) {
+    var results []workerResult
+    for _, t := range targets {
+        res, err := e.probeTarget(t)
+        if e.worker != nil {
+            results = append(results, newWorkerResult(t.Domain, res, err, time.Now()))
+        }
+    }
+    e.saveState()
+    if len(results) > 0 {
+        e.worker.report(results)
+    }
+}
+
+// probeTarget probes a single target and updates its metrics, notifications and records.
+// Probes are serialized, so the update loop and the reprobe API don't interleave.
+func (e *exporter) probeTarget(t target) (*probeResult, error) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    domain := t.Domain
+    if e.schedule != nil {
+        e.schedule.probed(domain, time.Now())
+    }
+    // Renewal readiness doesn't depend on the certificate currently served
+    metrics.checkACME(t)
+    mod, err := e.cfg.module(t.Module)
+    if err != nil {
+        log.Printf("Error probing domain %s: %v", domain, err)
+        return nil, err
+    }
+    probeStart := time.Now()
+    var res *probeResult
+    if t.Keystore != nil {
+        res, err = t.Keystore.probe()
+    } else {
+        res, err = mod.probe(withNegativeDNS(context.Background(), negativeDNS), e.dialer, domain, e.cfg.proxyFor(hostOf(domain)))
+    }
+    if err == nil && e.latency != nil && mod.Prober != proberFile {
+        observeLatency(e.latency, res, time.Since(probeStart))
+    }
+    e.handleResult(t, mod, res, err)
+    return res, err
+}
+
+// handleResult updates the metrics, notifications and records of a target from the result of a probe,
+// run locally or by a worker. It must be called with mu held.
+func (e *exporter) handleResult(t target, mod *module, res *probeResult, err error) {
+    domain := t.Domain
+    if err != nil {
+        log.Printf("Error fetching SSL certificate for domain %s: %v", domain, err)
+        metrics.recordFailure(domain, err)
+        if e.state != nil {
+            e.state.fail(domain, err)
+        }
+        metrics.availability.record(domain, false, time.Now())
+        addWithDomainExemplar(probesTotal.WithLabelValues("failure"), 1, domain)
+        if e.history != nil {
+            e.history.recordFailure(domain, err)
+        }
+        if e.schedule != nil {
+            quarantined := 0.0
+            if e.schedule.failed(domain, isHardFailure(err)) {
+                quarantined = 1
+            }
+            metrics.targetQuarantined.set(domain, quarantined)
+        }
+        return
+    }
+    start, expiry := res.chain[0].NotBefore, res.chain[0].NotAfter
+    metrics.record(domain, res, e.intermediateWarn)
+    if e.schedule != nil {
+        e.schedule.observe(domain, expiry)
+        metrics.targetQuarantined.set(domain, 0)
+    }
+    metrics.availability.record(domain, true, time.Now())
+    addWithDomainExemplar(probesTotal.WithLabelValues("success"), 1, domain)
+
+    // Snoozed targets keep their metrics but don't notify
+    if e.snooze == nil || !e.snooze.snoozed(domain, time.Now()) {
+        if e.alerts != nil {
+            e.alerts.evaluate(domain, expiry)
+        }
+        if e.mails != nil {
+            e.mails.check(t, expiry)
+        }
+    }
+    if e.state != nil {
+        e.state.update(domain, res)
+    }
+    e.chains.update(domain, res)
+    if e.rotations != nil {
+        e.rotations.check(t, res.chain[0])
+    }
+    if e.ct != nil {
+        e.ct.observe(res.chain[0])
+    }
+    metrics.checkRenewal(t, res.chain[0], certClock.Now())
+    if mod.Prober != proberFile {
+        metrics.checkDeployment(t, res.chain[0], e.kube)
+    }
+    if e.history != nil {
+        e.history.recordResult(domain, res)
+    }
+    if e.certs != nil {
+        if err := e.certs.record(domain, res.chain, time.Now()); err != nil {
+            log.Printf("Error recording certificates for domain %s: %v", domain, err)
         }
+    }
 
-        certStart.With(prometheus.Labels{"domain": domain}).Set(float64(start.Unix()))
-        certExpiry.With(prometheus.Labels{"domain": domain}).Set(float64(expiry.Unix()))
+    log.Printf("Updated metrics for domain %s: Start=%v, Expiry=%v", domain, start, expiry)
+}
 
-        log.Printf("Updated metrics for domain %s: Start=%v, Expiry=%v", domain, start, expiry)
+// saveState persists the last probe results if a state file is configured
+func (e *exporter) saveState() {
+    if e.state != nil {
+        if err := e.state.save(); err != nil {
+            log.Printf("Error saving state: %v", err)
+        }
     }
 }
 
 func main() {
+    // Subcommands are dispatched before the exporter flags are parsed
+    if len(os.Args) > 1 {
+        switch os.Args[1] {
+        case "gen-rules":
+            os.Exit(genRules(os.Args[2:]))
+        case "gen-dashboard":
+            os.Exit(genDashboard(os.Args[2:]))
+        case "gen-file-sd":
+            os.Exit(genFileSD(os.Args[2:]))
+        case "import-blackbox":
+            os.Exit(importBlackbox(os.Args[2:]))
+        case "report":
+            os.Exit(report(os.Args[2:]))
+        }
+    }
+
     var (
-        listenAddress = flag.String("listen-address", ":8837", "The address to listen on for HTTP requests.")
-        configPath    = flag.String("config", "domains.cfg", "Path to the domains configuration file.")
+        listenAddress    = flag.String("listen-address", ":8837", "The address to listen on for HTTP requests.")
+        reusePort        = flag.Bool("reuse-port", false, "Bind the listen address with SO_REUSEPORT, so a new instance can start before the old one stops.")
+        configPath       = flag.String("config", "domains.cfg", "Path to the domains configuration file.")
+        intermediateWarn = flag.Duration("intermediate-warn", 30*24*time.Hour, "Report intermediate certificates expiring within this window as stale.")
+        webhookURL       = flag.String("webhook-url", "", "URL to post alerts to when a certificate crosses a threshold. Alerting is disabled if empty.")
+        webhookFormat    = flag.String("webhook-format", "generic", "Payload format of the alert webhook: generic, slack or pagerduty.")
+        rotationWebhook  = flag.String("rotation-webhook-url", "", "URL to post a JSON event with the old and new certificate to whenever the certificate of a target changes. Disabled if empty.")
+        pagerDutyKey     = flag.String("pagerduty-routing-key", "", "Routing key for the pagerduty webhook format.")
+        alertWarnDays    = flag.Int("alert-warn-days", 30, "Days before expiry at which a warning alert is fired.")
+        alertCritDays    = flag.Int("alert-critical-days", 7, "Days before expiry at which a critical alert is fired.")
+        smtpServer       = flag.String("smtp-server", "", "SMTP server (host:port) for expiry emails. Email notifications are disabled if empty.")
+        smtpFrom         = flag.String("smtp-from", "ssl-exporter@localhost", "Sender address of expiry emails.")
+        smtpUsername     = flag.String("smtp-username", "", "Username for SMTP authentication. The password is read from the SMTP_PASSWORD environment variable.")
+        mailDays         = flag.Int("mail-days", 14, "Days before expiry at which certificate owners are emailed.")
+        mailLabel        = flag.String("mail-label", "email", "Target label holding the comma separated recipients of expiry emails.")
+        mailDefaultTo    = flag.String("mail-default-to", "", "Recipients for targets without the mail label.")
+        mailDigest       = flag.Duration("mail-digest-interval", 0, "Send one digest per recipient at this interval instead of one email per certificate.")
+        probeConfigPath  = flag.String("probe-config", "", "Path to the YAML configuration of probe modules and the /probe endpoint. Without tenants any target may be probed.")
+        expireAfter      = flag.Int("expire-after-failures", 0, "Number of consecutive failed probes after which the certificate metrics of a target are no longer exported. Kept until the next success if 0.")
+        successDebounce  = flag.Int("success-debounce", 1, "Number of consecutive failed probes before ssl_probe_success reports 0.")
+        probeDomainLabel = flag.Bool("probe-domain-label", false, "Label the metrics returned by /probe with the domain like the ones of the configured targets. By default they carry no target label, so relabeling can set instance from the target parameter.")
+        mozillaURL       = flag.String("mozilla-bundle-url", "https://curl.se/ca/cacert.pem", "URL of the Mozilla CA bundle used by modules with trust_store mozilla.")
+        mozillaRefresh   = flag.Duration("mozilla-bundle-refresh", 24*time.Hour, "Interval to download the Mozilla CA bundle at. The embedded bundle is used if 0.")
+        historySize      = flag.Int("history-size", 10, "Number of probe results per target served by /api/v1/history. Disabled if 0.")
+        certDB           = flag.String("cert-db", "", "Database to record every observed certificate and the targets serving it in, sqlite:<path> or a postgres:// URL. Disabled if empty.")
+        certMetricsBy    = flag.String("cert-metrics", certMetricsDomain, "Layout of the certificate dates of the configured targets: domain, fingerprint to export each certificate once with the number of targets serving it, or both.")
+        createdSamples   = flag.Bool("openmetrics-created-samples", false, "Add _created samples with the creation time of counters to OpenMetrics responses.")
+        classicBuckets   = flag.Bool("latency-classic-buckets", false, "Add classic buckets to the ssl_probe_latency_seconds native histogram for scrapers without native histogram support.")
+        kubernetes       = flag.Bool("kubernetes", false, "Export the status of cert-manager Certificates and the expiry of their secrets, using the in-cluster service account. Also needed for the cert_secret target label.")
+        kubeNamespace    = flag.String("kubernetes-namespace", "", "Namespace to read cert-manager Certificates from. All namespaces if empty.")
+        kubeInterval     = flag.Duration("kubernetes-interval", 5*time.Minute, "Interval to read cert-manager Certificates at.")
+        discoverJava     = flag.Bool("discover-java-keystores", false, "Monitor the keystores running JVMs were started with, found in the javax.net.ssl.keyStore property of their command line.")
+        keystoreInterval = flag.Duration("discover-java-keystores-interval", time.Minute, "Interval at which to look for the keystores of JVMs that started or exited.")
+        urgentInterval   = flag.Duration("urgent-interval", 15*time.Minute, "Interval to probe certificates expiring within -urgent-window at, instead of every 6 hours. Disabled if 0.")
+        urgentWindow     = flag.Duration("urgent-window", 7*24*time.Hour, "Certificates expiring within this window are probed at -urgent-interval.")
+        stateFile        = flag.String("state-file", "", "File to persist the last probe results in, so they are served right after a restart. Disabled if empty.")
+        coordinate       = flag.Bool("coordinator", false, "Distribute the network targets among the workers registered at /api/v1/workers. They are probed locally while no worker is alive.")
+        coordinatorURL   = flag.String("coordinator-url", "", "Run as worker of the coordinator at this URL, probing the targets it assigns instead of the configured ones.")
+        coordinatorToken = flag.String("coordinator-token", "", "Bearer token of the coordinator's API.")
+        workerName       = flag.String("worker-name", "", "Name the worker registers with, the host name by default.")
+        workerRegion     = flag.String("worker-region", "", "Region of the worker. Targets with a region label go to the workers of their region while one is alive.")
+        shardFlag        = flag.String("shard", "", "Probe only the targets whose domain hashes to shard N of M, given as N/M, so replicas with the same configuration split the targets. All targets if empty.")
+        vantage          = flag.String("vantage-point", "", "Name of this instance's location, added as vantage_point label to every series, so instances probing the same targets from different regions can be compared.")
+        grpcAddress      = flag.String("grpc-listen-address", "", "Address to serve the gRPC admin service on, see admin.proto. Disabled if empty.")
+        targetsFile      = flag.String("targets-file", "", "File to persist the targets managed through /api/v1/targets in. They are kept in memory only if empty.")
+        dialKeepAlive    = flag.Duration("dial-keep-alive", 15*time.Second, "Interval of TCP keep-alive probes on the connections of probes. Disabled if negative.")
+        tcpFastOpen      = flag.Bool("tcp-fast-open", false, "Send the first bytes of probes with the SYN to servers that support TCP Fast Open. Linux only.")
+        fallbackDelay    = flag.Duration("happy-eyeballs-delay", defaultFallbackDelay, "Head start of the first address family of a target before its other addresses are dialed in parallel. Addresses are dialed one by one if negative.")
+        leaderElection   = flag.Bool("leader-election", false, "Elect a leader among the replicas with a Kubernetes Lease. Only the leader probes, the others serve the results they restored or probed while leading.")
+        leaderLease      = flag.String("leader-election-lease", "ssl-exporter", "Name of the Lease used for leader election.")
+        leaderNamespace  = flag.String("leader-election-namespace", "", "Namespace of the Lease used for leader election, the pod's namespace if empty.")
+        dnsNegativeTTL   = flag.Duration("dns-negative-cache-ttl", defaultDNSNegativeTTL, "Time to cache failed lookups of targets for, doubling with every consecutive failure up to an hour, so stale domains don't hit the resolvers on every probe. Disabled if 0.")
+        quarantineAfter  = flag.Int("quarantine-after", 5, "Quarantine targets after this many hard failures in a row, NXDOMAIN or connection refused, probing them at -quarantine-interval until they recover. Disabled if 0.")
+        quarantineEvery  = flag.Duration("quarantine-interval", 24*time.Hour, "Interval to probe quarantined targets at.")
+        fileSDOutput     = flag.String("file-sd-output", "", "File to write the targets of all sources to as Prometheus file_sd JSON, for scraping /probe per target with the same labels. Disabled if empty.")
+        fileSDInterval   = flag.Duration("file-sd-interval", time.Minute, "Interval to check for changed targets to write to -file-sd-output at.")
+        simulateNow      = flag.String("simulate-now", "", "Check the live certificates as if it was this RFC 3339 time or date, to see which alerts would fire then, e.g. during a change freeze. The clock keeps running from there. Applies to verification, expiry alerts and emails, not to the dates in the metrics. Disabled if empty.")
     )
     flag.Parse()
+    vantagePoint = *vantage
+    probeDialing = dialTuning{keepAlive: *dialKeepAlive, fastOpen: *tcpFastOpen, fallbackDelay: *fallbackDelay}
+    negativeDNS.ttl = *dnsNegativeTTL
+    if *simulateNow != "" {
+        now, err := parseSimulatedNow(*simulateNow)
+        if err != nil {
+            log.Fatalf("Invalid simulated time: %v", err)
+        }
+        certClock = newSimulatedClock(now)
+        log.Printf("Simulating the time %s, certificates are checked as if it was then", now.Format(time.RFC3339))
+    }
+
+    var (
+        alerts *alerter
+        err    error
+    )
+    targetShard, err := parseShard(*shardFlag)
+    if err != nil {
+        log.Fatalf("Invalid shard: %v", err)
+    }
+    if *webhookURL != "" || *pagerDutyKey != "" {
+        alerts, err = newAlerter(*webhookURL, *webhookFormat, *pagerDutyKey, *alertWarnDays, *alertCritDays)
+        if err != nil {
+            log.Fatalf("Invalid alerting configuration: %v", err)
+        }
+    }
 
-    // Read domains from the configuration file
-    domains, err := readDomains(*configPath)
+    var mails *mailNotifier
+    if *smtpServer != "" {
+        mails, err = newMailNotifier(*smtpServer, *smtpFrom, *smtpUsername, os.Getenv("SMTP_PASSWORD"), *mailLabel, *mailDefaultTo, *mailDays, *mailDigest)
+        if err != nil {
+            log.Fatalf("Invalid email configuration: %v", err)
+        }
+    }
+
+    cfg := &probeConfig{}
+    if *probeConfigPath != "" {
+        cfg, err = loadProbeConfig(*probeConfigPath)
+        if err != nil {
+            log.Fatalf("Failed to load probe config: %v", err)
+        }
+    }
+
+    // Read targets from the configuration file
+    targets, err := loadTargets(*configPath, cfg)
     if err != nil {
-        log.Fatalf("Failed to read domains from config file: %v", err)
+        log.Fatalf("Failed to load targets: %v", err)
     }
 
-    // Initial update of metrics
-    updateMetrics(domains)
+    // Only refresh the Mozilla bundle if a module verifies against it
+    for _, mod := range cfg.Modules {
+        if mod.TLSConfig.TrustStore == trustStoreMozilla {
+            prometheus.MustRegister(mozilla)
+            if *mozillaRefresh > 0 {
+                go mozilla.run(*mozillaURL, *mozillaRefresh)
+            }
+            break
+        }
+    }
 
-    // Periodically update the metrics every 6 hours
+    if *successDebounce < 1 {
+        log.Fatalf("success-debounce must be at least 1")
+    }
+    metrics.debounce = *successDebounce
+    if *expireAfter < 0 {
+        log.Fatalf("expire-after-failures must not be negative")
+    }
+    metrics.expireAfter = *expireAfter
+    metrics.limits = cfg.Limits
+    if err := checkCertMetricsLayout(*certMetricsBy); err != nil {
+        log.Fatalf("Invalid cert-metrics: %v", err)
+    }
+    metrics.domainCerts = *certMetricsBy != certMetricsFingerprint
+    if *certMetricsBy != certMetricsDomain {
+        metrics.fingerprints = newFingerprintIndex()
+        prometheus.MustRegister(metrics.fingerprints)
+    }
+
+    e := &exporter{
+        cfg:              cfg,
+        intermediateWarn: *intermediateWarn,
+        alerts:           alerts,
+        mails:            mails,
+        configPath:       *configPath,
+        targets:          targets,
+        wake:             make(chan struct{}, 1),
+        dialer:           probeDialing.dialer(nil),
+        chains:           newObservedChains(),
+    }
+
+    apiTargets, err := loadRuntimeTargets(*targetsFile, cfg)
+    if err != nil {
+        log.Fatalf("Failed to load targets file: %v", err)
+    }
+    apiTargets.changed = e.wakeUp
+    var enrich *enricher
+    if cfg.Enrichment.URL != "" {
+        enrich = newEnricher(cfg.Enrichment)
+        prometheus.MustRegister(enrich)
+    }
+    keystores := &javaKeystoreTargets{interval: *keystoreInterval}
+    if *discoverJava {
+        if *keystoreInterval <= 0 {
+            log.Fatalf("discover-java-keystores-interval must be positive")
+        }
+        keystores.update()
+    }
+    // currentTargets returns the targets to probe, including the ones discovered since startup
+    currentTargets := func() []target {
+        if e.worker != nil {
+            return e.worker.current()
+        }
+        configured := e.configured()
+        current := append(configured[:len(configured):len(configured)], apiTargets.current()...)
+        current = append(current, keystores.current()...)
+        for _, s := range cfg.PrometheusSources {
+            current = append(current, s.current()...)
+        }
+        for _, s := range cfg.NetworkScans {
+            current = append(current, s.current()...)
+        }
+        current = targetShard.filter(normalizeTargets(current))
+        if enrich != nil {
+            current = enrich.enrich(current)
+        }
+        return current
+    }
+    // forgetDropped drops the series of the domains a source no longer lists, unless another source still does
+    forgetDropped := func(domains []string) {
+        current := make(map[string]bool)
+        for _, t := range currentTargets() {
+            current[t.Domain] = true
+        }
+        for _, domain := range domains {
+            if !current[domain] {
+                e.removeTarget(domain)
+            }
+        }
+    }
+
+    // Domains dropped from the API may still be configured in files or discovered elsewhere
+    apiTargets.removed = forgetDropped
+    e.snooze = newSnoozer(cfg.MaintenanceWindows, currentTargets)
+    prometheus.MustRegister(e.snooze)
+
+    e.latency = newProbeLatency(*classicBuckets)
+    prometheus.MustRegister(e.latency)
+    if *historySize > 0 {
+        e.history = newHistory(*historySize)
+    }
+    if *certDB != "" {
+        e.certs, err = openCertStore(*certDB)
+        if err != nil {
+            log.Fatalf("Failed to open certificate database: %v", err)
+        }
+    }
+    if *stateFile != "" {
+        e.state, err = loadStateStore(*stateFile)
+        if err != nil {
+            log.Fatalf("Failed to load state file: %v", err)
+        }
+        // Serve the last known results until the first probe of each target finishes
+        restored := targetShard.filter(normalizeTargets(append(targets, apiTargets.current()...)))
+        e.state.restore(restored, cfg, metrics, *intermediateWarn)
+        for _, t := range restored {
+            if chain, observed, ok := e.state.chain(t.Domain); ok {
+                e.chains.set(t.Domain, observed, chain)
+            }
+        }
+    }
+    if *rotationWebhook != "" {
+        e.rotations = newRotationNotifier(*rotationWebhook)
+        // Rotations while the exporter was down are reported on the first probe
+        if e.state != nil {
+            for _, t := range targets {
+                if leaf := e.state.leaf(t.Domain); leaf != nil {
+                    e.rotations.seen(t.Domain, leaf)
+                }
+            }
+        }
+    }
+
+    if len(cfg.CTDiscovery.Domains) > 0 {
+        e.ct = newCTCertificates(cfg.CTDiscovery)
+        prometheus.MustRegister(e.ct)
+        go e.ct.run()
+    }
+
+    if len(cfg.Envoy.Sidecars) > 0 {
+        sidecars := newEnvoySidecars(cfg.Envoy)
+        prometheus.MustRegister(sidecars)
+        go sidecars.run()
+    }
+
+    if len(cfg.MailPolicies.Domains) > 0 {
+        policies := newMailPolicies(cfg.MailPolicies)
+        prometheus.MustRegister(policies)
+        go policies.run()
+    }
+
+    if *kubernetes {
+        e.kube, err = newInClusterClient()
+        if err != nil {
+            log.Fatalf("Failed to create Kubernetes client: %v", err)
+        }
+        go newCertManagerMetrics(prometheus.DefaultRegisterer).run(e.kube, *kubeNamespace, *kubeInterval)
+    }
+    if *leaderElection {
+        kube := e.kube
+        if kube == nil {
+            if kube, err = newInClusterClient(); err != nil {
+                log.Fatalf("Failed to create Kubernetes client: %v", err)
+            }
+        }
+        identity, err := os.Hostname()
+        if err != nil {
+            log.Fatalf("Failed to determine leader election identity: %v", err)
+        }
+        e.leader, err = newLeaderElector(kube, *leaderNamespace, *leaderLease, identity, e.wakeUp)
+        if err != nil {
+            log.Fatalf("Failed to set up leader election: %v", err)
+        }
+        prometheus.MustRegister(e.leader.leaderGauge)
+        go e.leader.run()
+    }
+
+    // Update the metrics right away and then every 6 hours, or more often for certificates about to expire.
+    // The server starts without waiting for the first update, restored results are served in the meantime.
+    e.schedule = newScheduler(*urgentInterval, *urgentWindow)
+    e.schedule.quarantineAfter, e.schedule.quarantineInterval = *quarantineAfter, *quarantineEvery
+    // Targets of Prometheus queries are picked up by the first check after they show up, the ones of the API right away
+    refresh := probeInterval
+    for _, s := range cfg.PrometheusSources {
+        s.removed = forgetDropped
+        s.update()
+        go s.run()
+        refresh = min(refresh, s.Interval)
+    }
+    if *discoverJava {
+        keystores.changed, keystores.removed = e.wakeUp, forgetDropped
+        go keystores.run()
+    }
+    // Sweeps take a while, their endpoints are probed as soon as one finishes
+    for _, s := range cfg.NetworkScans {
+        s.changed, s.removed = e.wakeUp, forgetDropped
+        go s.run()
+    }
+    if *coordinate && *coordinatorURL != "" {
+        log.Fatalf("coordinator and coordinator-url are mutually exclusive")
+    }
+    if *coordinate {
+        e.coordinator = newCoordinator(e, currentTargets)
+        prometheus.MustRegister(e.coordinator)
+    }
+    if *coordinatorURL != "" {
+        name := *workerName
+        if name == "" {
+            if name, err = os.Hostname(); err != nil {
+                log.Fatalf("Failed to determine worker name: %v", err)
+            }
+        }
+        e.worker = newWorker(*coordinatorURL, *coordinatorToken, name, *workerRegion, e.wakeUp)
+        if err := e.worker.heartbeat(); err != nil {
+            log.Printf("Error registering with coordinator %s: %v", *coordinatorURL, err)
+        }
+        go e.worker.run()
+    }
+    if *fileSDOutput != "" {
+        go runFileSD(currentTargets, *fileSDOutput, *fileSDInterval)
+    }
     go func() {
         for {
-            time.Sleep(6 * time.Hour)
-            updateMetrics(domains)
+            due := e.schedule.due(currentTargets(), time.Now())
+            if e.coordinator != nil {
+                due = e.coordinator.local(due)
+            }
+            // Standbys keep serving their last results until they are elected
+            if e.leader == nil || e.leader.isLeader() {
+                e.updateMetrics(due)
+            }
+            select {
+            case <-time.After(min(e.schedule.tick(), refresh)):
+            case <-e.wake:
+            }
         }
     }()
 
     // Start HTTP server for Prometheus metrics
-    http.Handle("/metrics", promhttp.Handler())
-    log.Printf("Starting server on %s", *listenAddress)
-    log.Fatal(http.ListenAndServe(*listenAddress, nil))
+    http.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, metricsHandler(prometheus.DefaultGatherer, *createdSamples)))
+    http.Handle("/dashboard.json", dashboardHandler())
+    http.Handle("/probe", probeHandler(cfg, *intermediateWarn, *probeDomainLabel, *createdSamples))
+    http.Handle("/api/v1/silence", cfg.API.protect(e.snooze.handler()))
+    if e.history != nil {
+        http.Handle("/api/v1/history", cfg.API.protect(e.history.handler()))
+    }
+    http.Handle("/api/v1/reprobe", cfg.API.protect(e.reprobeHandler(currentTargets)))
+    http.Handle("/api/v1/targets", cfg.API.protect(apiTargets.handler()))
+    http.Handle("/api/v1/certs/", cfg.API.protect(e.chains.handler(currentTargets)))
+    http.Handle("/api/v1/certs.csv", cfg.API.protect(e.chains.inventoryHandler(currentTargets, false)))
+    http.Handle("/api/v1/certs.xlsx", cfg.API.protect(e.chains.inventoryHandler(currentTargets, true)))
+    http.Handle("/api/v1/expiring", cfg.API.protect(e.chains.expiringHandler(currentTargets)))
+    if cfg.Chatops.SlackSigningSecret != "" {
+        http.Handle("/api/v1/chatops/slack", e.slackHandler(&cfg.Chatops, currentTargets))
+    }
+    if cfg.Chatops.TeamsSecret != "" {
+        http.Handle("/api/v1/chatops/teams", e.teamsHandler(&cfg.Chatops, currentTargets))
+    }
+    if e.coordinator != nil {
+        http.Handle("/api/v1/workers/heartbeat", cfg.API.protect(e.coordinator.heartbeatHandler()))
+        http.Handle("/api/v1/workers/results", cfg.API.protect(e.coordinator.resultsHandler()))
+    }
+    // The gRPC listener is passed on to the new process on upgrades like the HTTP one
+    var grpcLn net.Listener
+    if *grpcAddress != "" {
+        grpcLn, err = listenGRPC(*grpcAddress)
+        if err != nil {
+            log.Fatalf("Failed to listen for gRPC: %v", err)
+        }
+        log.Printf("Serving gRPC admin service on %s", grpcLn.Addr())
+        go func() {
+            log.Fatal(serveAdmin(grpcLn, e, currentTargets))
+        }()
+    }
+    ln, err := listen(*listenAddress, *reusePort)
+    if err != nil {
+        log.Fatalf("Failed to listen: %v", err)
+    }
+    log.Printf("Starting server on %s", ln.Addr())
+    if err := serve(&http.Server{}, ln, grpcLn); err != nil && err != http.ErrServerClosed {
+        log.Fatal(err)
+    }
 }
@@ -0,0 +1,695 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/pem"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "net/netip"
+    "net/smtp"
+    "os"
+    "strconv"
+    "time"
+
+    "golang.org/x/crypto/ocsp"
+)
+
+// Probers a module can use
+const (
+    proberTCP          = "tcp"
+    proberHTTPS        = "https"
+    proberSMTPStartTLS = "smtp_starttls"
+    proberRDP          = "rdp"
+    proberMongoDB      = "mongodb"
+    proberRedis        = "redis"
+    proberAMQP         = "amqp"
+    proberMQTT         = "mqtt"
+    proberSIPS         = "sips"
+    proberNTSKE        = "ntske"
+    proberFile         = "file"
+    proberExec         = "exec"
+    proberPlugin       = "plugin"
+)
+
+// module is a reusable bundle of probe options, selected per target or with /probe?module=
+type module struct {
+    Prober  string        `yaml:"prober"`
+    Port    int           `yaml:"port"`
+    Timeout time.Duration `yaml:"timeout"`
+    Path    string        `yaml:"path"` // request path of the https prober
+    // Headers are added to the request of the https prober. Host replaces the Host header, the target by
+    // default like the SNI, for CDNs and edges that route on the Host header.
+    Headers map[string]string `yaml:"headers"`
+    Host    string            `yaml:"host"`
+    // AllAddresses probes every address the host resolves to instead of the first reachable one,
+    // so a stale certificate behind one IP or address family doesn't go unnoticed
+    AllAddresses bool `yaml:"all_addresses"`
+    // HandshakeOnly aborts the handshake of the tcp prober as soon as the server's certificate arrived,
+    // sparing fragile appliances the key exchange when only the certificate is of interest
+    HandshakeOnly bool `yaml:"handshake_only"`
+    // SecurityScan checks the tcp and https probers' targets for weaknesses of ancient TLS stacks with
+    // additional hand made handshakes: heartbeats advertised, compression and export cipher suites accepted
+    SecurityScan bool `yaml:"security_scan"`
+    // EarlyData checks whether TLS 1.3 servers offer 0-RTT in their session tickets, waiting up to a second
+    // after the handshake of the tcp and https probers for the tickets
+    EarlyData bool `yaml:"early_data"`
+    // ProtocolHandshake speaks the protocol of the mongodb, redis, amqp and mqtt probers after the TLS handshake
+    // and ends the session cleanly, so servers don't log every probe as an aborted connection. The sips prober
+    // sends an OPTIONS ping, the ntske prober requests keys. Username and Password authenticate to Redis servers
+    // with requirepass or ACLs and to brokers. Without them the amqp prober stops after the TLS handshake.
+    ProtocolHandshake bool   `yaml:"protocol_handshake"`
+    Username          string `yaml:"username"`
+    Password          string `yaml:"password"`
+    // Command is run by the exec prober, Plugin is the Go plugin of the plugin prober. Options are passed
+    // to either of them.
+    Command []string          `yaml:"command"`
+    Plugin  string            `yaml:"plugin"`
+    Options map[string]string `yaml:"options"`
+    // Script is Starlark source defining before_handshake(conn), check(chain) or both, for devices
+    // that need a few bytes exchanged before the handshake or checks the exporter lacks
+    Script string `yaml:"script"`
+
+    TLSConfig tlsConfig `yaml:"tls_config"`
+
+    roots        *x509.CertPool // loaded from tls_config.ca_file by validate
+    rootsVersion string         // hash of the certificates of roots
+    external     Prober         // of the exec and plugin probers, set by validate
+    script       *moduleScript  // compiled from Script by validate
+}
+
+// protocolProbers speak their protocol after the TLS handshake with protocol_handshake
+var protocolProbers = map[string]bool{
+    proberMongoDB: true,
+    proberRedis:   true,
+    proberAMQP:    true,
+    proberMQTT:    true,
+    proberSIPS:    true,
+    proberNTSKE:   true,
+}
+
+// localProbers read files or run programs on the exporter's host. Only configured targets may use them,
+// callers of /probe and of the targets API could otherwise read any file or run the module's command.
+var localProbers = map[string]bool{
+    proberFile:   true,
+    proberExec:   true,
+    proberPlugin: true,
+}
+
+// builtinModules are available without configuration and can be overridden in the config file
+var builtinModules = map[string]*module{
+    "tcp":           {Prober: proberTCP},
+    "https":         {Prober: proberHTTPS},
+    "smtp_starttls": {Prober: proberSMTPStartTLS},
+    "file":          {Prober: proberFile},
+    // Windows servers with certificates they generated themselves
+    "rdp":   {Prober: proberRDP},
+    "winrm": {Prober: proberHTTPS, Port: 5986, Path: "/wsman"},
+    // Datastores, whose certificates are often managed outside the PKI pipeline
+    "mongodb": {Prober: proberMongoDB},
+    "redis":   {Prober: proberRedis},
+    // Message brokers like RabbitMQ and Mosquitto
+    "amqp": {Prober: proberAMQP},
+    "mqtt": {Prober: proberMQTT},
+    "sips": {Prober: proberSIPS},
+    // Network Time Security, an expired certificate silently breaks secure time sync
+    "ntske": {Prober: proberNTSKE},
+    // TLS syslog receivers of RFC 5425, whose certificates tend to live for years unnoticed. They usually demand
+    // a client certificate, so the handshake stops at the server's certificate before it's refused.
+    "syslog": {Prober: proberTCP, Port: 6514, HandshakeOnly: true},
+    // Management endpoints of BMCs like iDRAC and iLO, vCenter and ESXi, and other appliances whose TLS stack
+    // is as old as their firmware. The handshake stops at the certificate, sparing them the key exchange
+    // and the client the signature schemes Go no longer accepts.
+    "embedded": {
+        Prober:        proberTCP,
+        HandshakeOnly: true,
+        TLSConfig:     tlsConfig{MinVersion: "TLS10", CipherSuites: legacyCipherSuites(), Fallback: true},
+    },
+}
+
+func init() {
+    for name, m := range builtinModules {
+        if err := m.validate(); err != nil {
+            panic(fmt.Sprintf("builtin module %s: %v", name, err))
+        }
+    }
+}
+
+// defaultModule is used for targets that don't select a module
+const defaultModule = "tcp"
+
+// probeResult is what a prober observed about a target
+type probeResult struct {
+    chain      []*x509.Certificate
+    serverName string         // name the chain is verified against, empty if not applicable
+    spiffeID   string         // SPIFFE ID the leaf is verified against instead of serverName, if set
+    skipVerify bool           // don't verify the chain at all
+    roots      *x509.CertPool // trust anchors of the module, nil for the system roots
+    trust      trustSource    // describes roots
+
+    // fallbackSteps counts the protocol downgrades needed for a successful handshake,
+    // maxVersion is the version cap of that handshake
+    fallbackSteps int
+    maxVersion    uint16
+
+    tlsState   *tls.ConnectionState     // nil for file targets
+    phases     map[string]time.Duration // duration of each phase of a network probe
+    ocspStaple *ocsp.Response           // parsed OCSP response stapled by the server
+    ocspErr    error                    // error parsing the stapled response
+    findings   map[string]bool          // outcome of the security scan, nil if not scanned
+    earlyData  *bool                    // whether the server offers 0-RTT, nil if not checked
+    pqOffered  bool                     // whether the handshake offered a post-quantum key exchange
+    scriptPass *bool                    // whether the check of the module script passed, nil without one
+    parseError bool                     // whether a certificate was malformed and parsed only partially
+    // attestation describes how the chain was verified, set when the metrics are recorded
+    attestation *attestation
+
+    address   netip.Addr   // address the chain was fetched from
+    addresses []netip.Addr // addresses the host resolved to
+    // addressNotAfter holds the leaf expiry per address if the module probes all addresses
+    addressNotAfter map[netip.Addr]time.Time
+}
+
+// Phases of a network probe
+const (
+    phaseDNS     = "dns"
+    phaseConnect = "connect"
+    phaseTLS     = "tls"
+    phaseOCSP    = "ocsp"
+)
+
+// validate checks the module and fills in defaults
+func (m *module) validate() error {
+    switch m.Prober {
+    case proberTCP, proberHTTPS:
+        if m.Port == 0 {
+            m.Port = 443
+        }
+    case proberSMTPStartTLS:
+        if m.Port == 0 {
+            m.Port = 25
+        }
+    case proberRDP:
+        if m.Port == 0 {
+            m.Port = 3389
+        }
+    case proberMongoDB:
+        if m.Port == 0 {
+            m.Port = 27017
+        }
+    case proberRedis:
+        if m.Port == 0 {
+            m.Port = 6379
+        }
+    case proberAMQP:
+        if m.Port == 0 {
+            m.Port = 5671
+        }
+    case proberMQTT:
+        if m.Port == 0 {
+            m.Port = 8883
+        }
+    case proberSIPS:
+        if m.Port == 0 {
+            m.Port = 5061
+        }
+    case proberNTSKE:
+        if m.Port == 0 {
+            m.Port = 4460
+        }
+    case proberFile:
+    case proberExec:
+        if len(m.Command) == 0 {
+            return fmt.Errorf("the exec prober needs a command")
+        }
+        m.external = execProber{command: m.Command}
+    case proberPlugin:
+        if m.Plugin == "" {
+            return fmt.Errorf("the plugin prober needs a plugin")
+        }
+        p, err := loadPluginProber(m.Plugin)
+        if err != nil {
+            return fmt.Errorf("plugin: %v", err)
+        }
+        m.external = p
+    default:
+        return fmt.Errorf("unknown prober %q", m.Prober)
+    }
+    if len(m.Command) > 0 && m.Prober != proberExec || m.Plugin != "" && m.Prober != proberPlugin || len(m.Options) > 0 && m.external == nil {
+        return fmt.Errorf("command, plugin and options need the exec or plugin prober")
+    }
+    if m.HandshakeOnly && m.Prober != proberTCP {
+        return fmt.Errorf("handshake_only needs the tcp prober")
+    }
+    if m.EarlyData && (m.Prober != proberTCP && m.Prober != proberHTTPS || m.HandshakeOnly) {
+        return fmt.Errorf("early_data needs the tcp or https prober and a complete handshake")
+    }
+    if m.SecurityScan && m.Prober != proberTCP && m.Prober != proberHTTPS {
+        return fmt.Errorf("security_scan needs the tcp or https prober")
+    }
+    switch {
+    case m.ProtocolHandshake && !protocolProbers[m.Prober]:
+        return fmt.Errorf("protocol_handshake needs the mongodb, redis, amqp, mqtt, sips or ntske prober")
+    case (m.Username != "" || m.Password != "") && (!m.ProtocolHandshake || m.Prober != proberRedis && m.Prober != proberAMQP && m.Prober != proberMQTT):
+        return fmt.Errorf("username and password need the redis, amqp or mqtt prober with protocol_handshake")
+    }
+    if (len(m.Headers) > 0 || m.Host != "") && m.Prober != proberHTTPS {
+        return fmt.Errorf("headers and host need the https prober")
+    }
+    for name := range m.Headers {
+        if http.CanonicalHeaderKey(name) == "Host" {
+            return fmt.Errorf("headers: set the Host header with host")
+        }
+    }
+    if m.Script != "" {
+        script, err := loadModuleScript(m.Script)
+        if err != nil {
+            return fmt.Errorf("script: %v", err)
+        }
+        if script.before != nil && (m.Prober == proberFile || m.external != nil) {
+            return fmt.Errorf("script: %s needs a network prober", scriptBeforeHandshake)
+        }
+        m.script = script
+    }
+    if m.Timeout == 0 {
+        m.Timeout = dialTimeout
+    }
+    if m.Path == "" {
+        m.Path = "/"
+    }
+    if _, err := m.TLSConfig.build(""); err != nil {
+        return fmt.Errorf("tls_config: %v", err)
+    }
+    roots, version, err := m.TLSConfig.rootCAs()
+    if err != nil {
+        return fmt.Errorf("tls_config: %v", err)
+    }
+    m.roots, m.rootsVersion = roots, version
+    if m.TLSConfig.clientCert, err = m.TLSConfig.clientCertificate(); err != nil {
+        return fmt.Errorf("tls_config: %v", err)
+    }
+    if spiffe := m.TLSConfig.Spiffe; spiffe != nil {
+        if m.Prober == proberFile || m.TLSConfig.clientCert != nil {
+            return fmt.Errorf("tls_config: spiffe needs a network prober and no other client certificate")
+        }
+        if err := spiffe.load(); err != nil {
+            return fmt.Errorf("tls_config: spiffe: %v", err)
+        }
+    }
+    return nil
+}
+
+// rootPool returns the trust anchors chains are verified against, nil for the system roots
+func (m *module) rootPool() *x509.CertPool {
+    if m.TLSConfig.TrustStore == trustStoreMozilla {
+        return mozilla.roots()
+    }
+    if m.TLSConfig.Spiffe.expectedServerID() != "" {
+        return m.TLSConfig.Spiffe.bundlePool()
+    }
+    return m.roots
+}
+
+// probe runs the module's prober against the target. Network targets are a host with an optional port
+// overriding the module's, file targets are a path. Network targets are connected to through
+// the proxy if it is set. The chain is passed to the check of the module script, if it has one.
+// Every step of the probe is bounded by the module's timeout and by ctx.
+func (m *module) probe(ctx context.Context, dialer *net.Dialer, target string, proxy *proxyRule) (*probeResult, error) {
+    res, err := m.fetch(ctx, dialer, target, proxy)
+    if err != nil || m.script == nil || m.script.check == nil {
+        return res, err
+    }
+    ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+    defer cancel()
+    reason, err := m.script.passes(ctx, res.chain)
+    if err != nil {
+        reason = err.Error()
+    }
+    if reason != "" {
+        log.Printf("Script check of %s failed: %s", target, reason)
+    }
+    passed := reason == ""
+    res.scriptPass = &passed
+    return res, nil
+}
+
+// fetch runs the prober and returns what it observed
+func (m *module) fetch(ctx context.Context, dialer *net.Dialer, target string, proxy *proxyRule) (*probeResult, error) {
+    if m.Prober == proberFile {
+        chain, err := readCertFile(target)
+        if err != nil {
+            return nil, err
+        }
+        return &probeResult{chain: chain, skipVerify: m.TLSConfig.InsecureSkipVerify, roots: m.rootPool(), trust: m.trustSource()}, nil
+    }
+    if m.external != nil {
+        return m.probeExternal(target)
+    }
+
+    host, port, err := net.SplitHostPort(target)
+    if err != nil {
+        host, port = target, strconv.Itoa(m.Port)
+    }
+    tlsCfg, err := m.TLSConfig.build(host)
+    if err != nil {
+        return nil, err
+    }
+
+    versions := []uint16{tlsCfg.MaxVersion}
+    if m.TLSConfig.Fallback {
+        // Go refuses versions below TLS 1.2 unless the minimum is lowered explicitly
+        if tlsCfg.MinVersion == 0 {
+            tlsCfg.MinVersion = tls.VersionTLS10
+        }
+        versions = fallbackVersions(tlsCfg)
+    }
+
+    for step, version := range versions {
+        tlsCfg.MaxVersion = version
+        var res *probeResult
+        res, err = m.probeOnce(ctx, dialer, host, port, tlsCfg, nil, proxy)
+        if err == nil {
+            res.fallbackSteps, res.maxVersion = step, version
+            // Behind a proxy the addresses of the host are unknown
+            if m.AllAddresses && proxy == nil {
+                m.probeOtherAddresses(ctx, dialer, host, port, tlsCfg, res)
+            }
+            if m.SecurityScan {
+                res.findings = m.scan(dialer, host, port, res.address, proxy)
+            }
+            return res, nil
+        }
+        if !isHandshakeError(err) {
+            break
+        }
+        if isCertParseError(err) && m.rawChainFetchable() {
+            log.Printf("Certificates of %s don't parse, falling back to a partial parse: %v", target, err)
+            return m.probeMalformed(ctx, dialer, host, port, proxy)
+        }
+        if step+1 < len(versions) {
+            log.Printf("Handshake with %s failed with max version %s, falling back: %v", target, tlsVersionName(version), err)
+        }
+    }
+    return nil, err
+}
+
+// probeExternal fetches the chain with the exec or plugin prober. It is verified against the host of the target.
+func (m *module) probeExternal(target string) (*probeResult, error) {
+    if _, _, err := net.SplitHostPort(target); err != nil && m.Port != 0 {
+        target = net.JoinHostPort(target, strconv.Itoa(m.Port))
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+    defer cancel()
+    chain, err := m.external.Probe(ctx, target, m.Options)
+    if err != nil {
+        return nil, err
+    }
+    return &probeResult{
+        chain:      chain,
+        serverName: hostOf(target),
+        spiffeID:   m.TLSConfig.Spiffe.expectedServerID(),
+        skipVerify: m.TLSConfig.InsecureSkipVerify,
+        roots:      m.rootPool(),
+        trust:      m.trustSource(),
+    }, nil
+}
+
+// probeOtherAddresses probes the addresses of the host besides the one res was fetched from and records
+// the leaf expiry of each. Unreachable addresses are logged and left out.
+func (m *module) probeOtherAddresses(ctx context.Context, dialer *net.Dialer, host, port string, tlsCfg *tls.Config, res *probeResult) {
+    res.addressNotAfter = map[netip.Addr]time.Time{res.address: res.chain[0].NotAfter}
+    for _, addr := range res.addresses {
+        addr = addr.Unmap()
+        if addr == res.address {
+            continue
+        }
+        other, err := m.probeOnce(ctx, dialer, host, port, tlsCfg, []netip.Addr{addr}, nil)
+        if err != nil {
+            log.Printf("Error probing address %s of %s: %v", addr, host, err)
+            continue
+        }
+        res.addressNotAfter[addr] = other.chain[0].NotAfter
+    }
+}
+
+// notAfterMin returns the earliest leaf expiry of all probed addresses
+func (r *probeResult) notAfterMin() time.Time {
+    notAfter := r.chain[0].NotAfter
+    for _, t := range r.addressNotAfter {
+        if t.Before(notAfter) {
+            notAfter = t
+        }
+    }
+    return notAfter
+}
+
+// probeOnce resolves the host unless addrs is given, connects and runs the prober, timing every phase.
+// With a proxy the host is resolved by the proxy.
+func (m *module) probeOnce(ctx context.Context, dialer *net.Dialer, host, port string, tlsCfg *tls.Config, addrs []netip.Addr, proxy *proxyRule) (*probeResult, error) {
+    ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+    defer cancel()
+    res := &probeResult{
+        serverName: host,
+        spiffeID:   m.TLSConfig.Spiffe.expectedServerID(),
+        skipVerify: m.TLSConfig.InsecureSkipVerify,
+        roots:      m.rootPool(),
+        trust:      m.trustSource(),
+        phases:     make(map[string]time.Duration),
+        pqOffered:  m.TLSConfig.offersPostQuantum(),
+    }
+
+    var (
+        conn net.Conn
+        err  error
+    )
+    if proxy != nil {
+        // The proxy is set by the operator, the target policy was applied to the target before.
+        start := time.Now()
+        conn, err = dialProxy(ctx, probeDialing.proxyDialer(dialer), proxy, net.JoinHostPort(host, port))
+        res.phases[phaseConnect] = time.Since(start)
+        if err != nil {
+            return nil, &connectError{err}
+        }
+    } else {
+        start := time.Now()
+        if addrs == nil {
+            addrs, err = resolveHost(ctx, host)
+            res.phases[phaseDNS] = time.Since(start)
+            if err != nil {
+                return nil, &connectError{err}
+            }
+        }
+        res.addresses = addrs
+
+        start = time.Now()
+        conn, err = dialAny(ctx, dialer, addrs, port)
+        res.phases[phaseConnect] = time.Since(start)
+        if err != nil {
+            return nil, &connectError{err}
+        }
+        if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+            res.address = tcpAddr.AddrPort().Addr().Unmap()
+        }
+    }
+    defer conn.Close()
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+    }
+    if err := m.script.beforeHandshake(ctx, conn); err != nil {
+        return nil, fmt.Errorf("%s: %v", scriptBeforeHandshake, err)
+    }
+
+    var check *earlyDataCheck
+    if m.EarlyData {
+        check, tlsCfg = newEarlyDataCheck(conn, tlsCfg)
+        conn = check
+    }
+
+    var state tls.ConnectionState
+    switch m.Prober {
+    case proberHTTPS:
+        state, res.phases[phaseTLS], err = getHTTPSConnState(ctx, conn, tlsCfg, net.JoinHostPort(host, port), m.Path, m.Host, m.Headers)
+    case proberSMTPStartTLS:
+        state, res.phases[phaseTLS], err = getSMTPConnState(conn, tlsCfg)
+    case proberRDP:
+        state, res.phases[phaseTLS], err = getRDPConnState(ctx, conn, tlsCfg)
+    case proberMongoDB:
+        state, res.phases[phaseTLS], err = getMongoDBConnState(ctx, conn, tlsCfg, m.ProtocolHandshake)
+    case proberRedis:
+        state, res.phases[phaseTLS], err = getRedisConnState(ctx, conn, tlsCfg, m.ProtocolHandshake, m.Username, m.Password)
+    case proberAMQP:
+        state, res.phases[phaseTLS], err = getAMQPConnState(ctx, conn, tlsCfg, m.ProtocolHandshake, m.Username, m.Password)
+    case proberMQTT:
+        state, res.phases[phaseTLS], err = getMQTTConnState(ctx, conn, tlsCfg, m.ProtocolHandshake, m.Username, m.Password)
+    case proberSIPS:
+        state, res.phases[phaseTLS], err = getSIPSConnState(ctx, conn, tlsCfg, host, m.ProtocolHandshake)
+    case proberNTSKE:
+        state, res.phases[phaseTLS], err = getNTSKEConnState(ctx, conn, tlsCfg, m.ProtocolHandshake)
+    case proberTCP:
+        if m.HandshakeOnly {
+            state, res.phases[phaseTLS], err = getCertificateState(ctx, conn, tlsCfg)
+            break
+        }
+        fallthrough
+    default:
+        state, res.phases[phaseTLS], err = getSSLConnState(ctx, conn, tlsCfg)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if len(state.PeerCertificates) == 0 {
+        return nil, fmt.Errorf("no certificates presented by %s", net.JoinHostPort(host, port))
+    }
+    res.chain = state.PeerCertificates
+    res.tlsState = &state
+    if check != nil {
+        offered := check.offered(state)
+        res.earlyData = &offered
+    }
+
+    if len(state.OCSPResponse) > 0 {
+        start := time.Now()
+        res.ocspStaple, res.ocspErr = parseStaple(state.OCSPResponse, res.chain)
+        res.phases[phaseOCSP] = time.Since(start)
+    }
+    return res, nil
+}
+
+// resolveHost returns the addresses of host, which may be an IP address literal. If ctx carries a negative
+// cache, hosts that failed to resolve recently fail right away with the cached error.
+func resolveHost(ctx context.Context, host string) ([]netip.Addr, error) {
+    if addr, err := netip.ParseAddr(host); err == nil {
+        return []netip.Addr{addr}, nil
+    }
+    cache := negativeDNSFrom(ctx)
+    if cache == nil {
+        return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+    }
+    if err := cache.cached(host, time.Now()); err != nil {
+        return nil, err
+    }
+    addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+    cache.observe(host, err, time.Now())
+    return addrs, err
+}
+
+// getHTTPSConnState performs an HTTPS request over conn and returns the TLS state of the connection.
+// Redirects are not followed so the certificate belongs to the requested host. The request carries the
+// headers and the Host header host unless it is empty.
+func getHTTPSConnState(ctx context.Context, conn net.Conn, tlsCfg *tls.Config, addr, path, host string, headers map[string]string) (tls.ConnectionState, time.Duration, error) {
+    tlsConn, took, err := handshake(ctx, conn, tlsCfg)
+    if err != nil {
+        return tls.ConnectionState{}, took, err
+    }
+    state := tlsConn.ConnectionState()
+
+    client := &http.Client{
+        Transport: &http.Transport{
+            DialTLSContext: func(context.Context, string, string) (net.Conn, error) {
+                return tlsConn, nil
+            },
+            DisableKeepAlives: true,
+        },
+        CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+addr+path, nil)
+    if err != nil {
+        return state, took, err
+    }
+    for name, value := range headers {
+        req.Header.Set(name, value)
+    }
+    if host != "" {
+        req.Host = host
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return state, took, err
+    }
+    resp.Body.Close()
+    return state, took, nil
+}
+
+// getSMTPConnState upgrades an SMTP session on conn with STARTTLS and returns the TLS state
+func getSMTPConnState(conn net.Conn, tlsCfg *tls.Config) (tls.ConnectionState, time.Duration, error) {
+    c, err := smtp.NewClient(conn, tlsCfg.ServerName)
+    if err != nil {
+        return tls.ConnectionState{}, 0, err
+    }
+    defer c.Close()
+    start := time.Now()
+    if err := c.StartTLS(tlsCfg); err != nil {
+        return tls.ConnectionState{}, time.Since(start), err
+    }
+    took := time.Since(start)
+    state, _ := c.TLSConnectionState()
+    c.Quit()
+    return state, took, nil
+}
+
+// readCertFile parses all certificates in a file, leaf first. Besides PEM it reads DER encoded certificates,
+// PKCS#7 bundles and the Authenticode signatures of Windows executables.
+func readCertFile(filePath string) ([]*x509.Certificate, error) {
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return nil, err
+    }
+    var chain []*x509.Certificate
+    switch {
+    case bytes.HasPrefix(data, []byte("MZ")):
+        chain, err = authenticodeCerts(data)
+    case bytes.Contains(data, []byte("-----BEGIN ")):
+        chain, err = parseCertPEM(data)
+    default:
+        chain, err = parseCertDER(data)
+    }
+    if err == nil && len(chain) == 0 {
+        err = fmt.Errorf("no certificates found")
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", filePath, err)
+    }
+    return chain, nil
+}
+
+// parseCertPEM parses all PEM encoded certificates and PKCS#7 bundles in data, skipping other blocks like keys
+func parseCertPEM(data []byte) ([]*x509.Certificate, error) {
+    var chain []*x509.Certificate
+    for {
+        var block *pem.Block
+        block, data = pem.Decode(data)
+        if block == nil {
+            break
+        }
+        switch block.Type {
+        case "CERTIFICATE":
+            cert, err := x509.ParseCertificate(block.Bytes)
+            if err != nil {
+                return nil, err
+            }
+            chain = append(chain, cert)
+        case "PKCS7", "CMS":
+            certs, err := pkcs7Certs(block.Bytes)
+            if err != nil {
+                return nil, err
+            }
+            chain = append(chain, certs...)
+        }
+    }
+    if len(chain) == 0 {
+        return nil, fmt.Errorf("no certificates found")
+    }
+    return chain, nil
+}
+
+// parseCertDER parses a DER encoded PKCS#7 bundle or a sequence of DER encoded certificates
+func parseCertDER(data []byte) ([]*x509.Certificate, error) {
+    if chain, err := pkcs7Certs(data); err == nil {
+        return chain, nil
+    }
+    return x509.ParseCertificates(data)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "net/netip"
+    "strconv"
+    "testing"
+    "time"
+
+    "github.com/haraiko/SSL_exporter/internal/testutil"
+)
+
+// probeServer runs probeOnce of a module with the prober against the server at 127.0.0.1
+func probeServer(t *testing.T, prober string, srv *testutil.Server) (*probeResult, error) {
+    t.Helper()
+    m := &module{Prober: prober, Timeout: 5 * time.Second}
+    if err := m.validate(); err != nil {
+        t.Fatalf("validating module: %v", err)
+    }
+    m.roots = srv.Chain.RootPool()
+    tlsCfg, err := m.TLSConfig.build("localhost")
+    if err != nil {
+        t.Fatalf("building TLS config: %v", err)
+    }
+    addrs := []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+    return m.probeOnce(context.Background(), probeDialing.dialer(nil), "localhost", strconv.Itoa(srv.Port()), tlsCfg, addrs, nil)
+}
+
+func TestProbeOnce(t *testing.T) {
+    for _, tc := range []struct {
+        name   string
+        prober string
+        opts   []testutil.Option
+    }{
+        {"tcp", proberTCP, nil},
+        {"smtp starttls", proberSMTPStartTLS, []testutil.Option{testutil.WithSTARTTLS(testutil.STARTTLSSMTP)}},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            srv := testutil.NewServer(t, tc.opts...)
+            res, err := probeServer(t, tc.prober, srv)
+            if err != nil {
+                t.Fatalf("probing: %v", err)
+            }
+            if len(res.chain) != 2 || !bytes.Equal(res.chain[0].Raw, srv.Chain.Leaf.Raw) {
+                t.Fatalf("got a chain of %d certificates, want the server's leaf and intermediate", len(res.chain))
+            }
+            if res.address != netip.MustParseAddr("127.0.0.1") {
+                t.Errorf("got address %s, want 127.0.0.1", res.address)
+            }
+            if _, err := verifiedChains(res.serverName, res.chain, res.roots); err != nil {
+                t.Errorf("chain doesn't verify against the server's root: %v", err)
+            }
+        })
+    }
+}
+
+func TestProbeOnceBrokenHandshake(t *testing.T) {
+    for name, mode := range map[string]testutil.Mode{
+        "reset":   testutil.ModeReset,
+        "garbage": testutil.ModeGarbage,
+        "alert":   testutil.ModeAlert,
+    } {
+        t.Run(name, func(t *testing.T) {
+            srv := testutil.NewServer(t, testutil.WithMode(mode))
+            if _, err := probeServer(t, proberTCP, srv); err == nil {
+                t.Fatal("probe succeeded, want a handshake error")
+            }
+        })
+    }
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "crypto/x509"
+    _ "embed"
+    "encoding/hex"
+    "encoding/pem"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "regexp"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// embeddedMozillaBundle is the curl extract of the Mozilla root store, used until a newer one is downloaded
+//
+//go:embed mozilla/cacert.pem
+var embeddedMozillaBundle []byte
+
+// Trust stores a module can verify chains against
+const (
+    trustStoreSystem  = "system"
+    trustStoreMozilla = "mozilla"
+)
+
+// mozillaBundleAsOf matches the date the curl extract was generated from the Mozilla source tree
+var mozillaBundleAsOf = regexp.MustCompile(`Certificate data from Mozilla as of: (.+)`)
+
+// maxBundleSize bounds the download of a bundle, the curl extract is well below 1MB
+const maxBundleSize = 4 << 20
+
+// trustBundle is a root store that doesn't depend on the host, so every exporter instance
+// verifies against the same roots. It exports the version in use as ssl_trust_bundle_info.
+type trustBundle struct {
+    name string
+
+    mu      sync.RWMutex
+    pool    *x509.CertPool
+    version string
+    asOf    time.Time
+    source  string
+    count   int
+
+    infoDesc  *prometheus.Desc
+    countDesc *prometheus.Desc
+}
+
+// mozilla is the Mozilla root store, starting with the embedded bundle
+var mozilla = newTrustBundle(trustStoreMozilla, embeddedMozillaBundle)
+
+// newTrustBundle returns a bundle loaded from the embedded data
+func newTrustBundle(name string, embedded []byte) *trustBundle {
+    b := &trustBundle{
+        name: name,
+        infoDesc: prometheus.NewDesc(
+            "ssl_trust_bundle_info",
+            "Version and source of a trust bundle chains can be verified against, the value is always 1",
+            []string{"bundle", "version", "source"}, nil,
+        ),
+        countDesc: prometheus.NewDesc(
+            "ssl_trust_bundle_certificates",
+            "Number of root certificates in a trust bundle",
+            []string{"bundle"}, nil,
+        ),
+    }
+    if err := b.load(embedded, "embedded"); err != nil {
+        panic(fmt.Sprintf("embedded %s bundle: %v", name, err))
+    }
+    return b
+}
+
+// load parses a PEM bundle and replaces the current one, unless it is older
+func (b *trustBundle) load(data []byte, source string) error {
+    pool := x509.NewCertPool()
+    count := 0
+    for rest := data; ; {
+        var block *pem.Block
+        block, rest = pem.Decode(rest)
+        if block == nil {
+            break
+        }
+        if block.Type != "CERTIFICATE" {
+            continue
+        }
+        cert, err := x509.ParseCertificate(block.Bytes)
+        if err != nil {
+            return err
+        }
+        pool.AddCert(cert)
+        count++
+    }
+    if count == 0 {
+        return fmt.Errorf("no certificates found")
+    }
+
+    // The version is the date of the Mozilla data, or a hash of the bundle if it has no header
+    var asOf time.Time
+    sum := sha256.Sum256(data)
+    version := hex.EncodeToString(sum[:6])
+    if m := mozillaBundleAsOf.FindSubmatch(data); m != nil {
+        if t, err := time.Parse("Mon Jan _2 15:04:05 2006 MST", string(bytes.TrimSpace(m[1]))); err == nil {
+            asOf = t.UTC()
+            version = asOf.Format(time.RFC3339)
+        }
+    }
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    // Only dated bundles can be ordered, headerless ones are told apart by their hash and always taken.
+    // They keep the date of the newest bundle loaded so far, so a later one can't go back behind it.
+    if asOf.IsZero() {
+        asOf = b.asOf
+    } else if asOf.Before(b.asOf) {
+        return fmt.Errorf("bundle from %s is older than the one in use", version)
+    }
+    b.pool, b.version, b.asOf, b.source, b.count = pool, version, asOf, source, count
+    return nil
+}
+
+// roots returns the current root pool
+func (b *trustBundle) roots() *x509.CertPool {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    return b.pool
+}
+
+// refresh downloads the bundle from url
+func (b *trustBundle) refresh(url string) error {
+    client := &http.Client{Timeout: 3 * dialTimeout}
+    resp, err := client.Get(url)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("unexpected status %s", resp.Status)
+    }
+    data, err := io.ReadAll(io.LimitReader(resp.Body, maxBundleSize))
+    if err != nil {
+        return err
+    }
+    return b.load(data, url)
+}
+
+// run refreshes the bundle from url right away and then at the given interval
+func (b *trustBundle) run(url string, interval time.Duration) {
+    for {
+        if err := b.refresh(url); err != nil {
+            log.Printf("Error refreshing %s trust bundle from %s: %v", b.name, url, err)
+        } else {
+            b.mu.RLock()
+            log.Printf("Using %s trust bundle %s with %d certificates", b.name, b.version, b.count)
+            b.mu.RUnlock()
+        }
+        time.Sleep(interval)
+    }
+}
+
+func (b *trustBundle) Describe(ch chan<- *prometheus.Desc) {
+    ch <- b.infoDesc
+    ch <- b.countDesc
+}
+
+func (b *trustBundle) Collect(ch chan<- prometheus.Metric) {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    ch <- prometheus.MustNewConstMetric(b.infoDesc, prometheus.GaugeValue, 1, b.name, b.version, b.source)
+    ch <- prometheus.MustNewConstMetric(b.countDesc, prometheus.GaugeValue, float64(b.count), b.name)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/haraiko/SSL_exporter/internal/testutil"
+)
+
+func TestTrustBundleLoadOrder(t *testing.T) {
+    chain, err := testutil.GenerateChain(testutil.ChainOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    dated := func(asOf string) []byte {
+        return append([]byte("## Certificate data from Mozilla as of: "+asOf+"\n\n"), chain.RootPEM()...)
+    }
+
+    b := newTrustBundle("test", dated("Tue Mar 11 04:12:06 2025 GMT"))
+    if err := b.load(chain.RootPEM(), "headerless"); err != nil {
+        t.Fatalf("loading a headerless bundle: %v", err)
+    }
+    if got := b.trustSource().Source; got != "headerless" {
+        t.Errorf("got bundle from %s, want the headerless one", got)
+    }
+    if err := b.load(dated("Tue Jan 10 04:12:06 2023 GMT"), "older"); err == nil {
+        t.Error("loading an older bundle after a headerless one succeeded, want an error")
+    }
+    if got := b.trustSource().Source; got != "headerless" {
+        t.Errorf("got bundle from %s, want the headerless one", got)
+    }
+    if err := b.load(dated("Tue Jun 10 04:12:06 2025 GMT"), "newer"); err != nil {
+        t.Errorf("loading a newer bundle: %v", err)
+    }
+    if got := b.trustSource().Version; got != "2025-06-10T04:12:06Z" {
+        t.Errorf("got version %s, want the date of the newer bundle", got)
+    }
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "fmt"
+    "log"
+    "net"
+    "net/netip"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// maxScanHostBits bounds the size of a scanned network to 65536 addresses
+const maxScanHostBits = 16
+
+// networkScan sweeps a network for TLS endpoints and probes every one it finds, so endpoints nobody
+// put into the configuration, like appliances in office networks, are monitored as well. Scans are opt-in,
+// they are the kind of traffic intrusion detection flags.
+type networkScan struct {
+    CIDR        netip.Prefix      `yaml:"cidr"`
+    Ports       []int             `yaml:"ports"` // 443 by default
+    Module      string            `yaml:"module"`
+    Labels      map[string]string `yaml:"labels"`      // added to every target
+    Interval    time.Duration     `yaml:"interval"`    // how often the network is swept, 24h by default
+    Concurrency int               `yaml:"concurrency"` // connection attempts in flight, 64 by default
+
+    changed func()                 // called when a sweep found a different set of endpoints
+    removed func(domains []string) // called with the endpoints a sweep no longer found
+
+    mu      sync.Mutex
+    targets []target // of the last sweep
+}
+
+// validate checks the scan and fills in defaults
+func (s *networkScan) validate() error {
+    if !s.CIDR.IsValid() {
+        return fmt.Errorf("cidr is required")
+    }
+    s.CIDR = s.CIDR.Masked()
+    if s.CIDR.Addr().BitLen()-s.CIDR.Bits() > maxScanHostBits {
+        return fmt.Errorf("cidr %s is too large, at most %d addresses can be scanned", s.CIDR, 1<<maxScanHostBits)
+    }
+    if len(s.Ports) == 0 {
+        s.Ports = []int{443}
+    }
+    for _, port := range s.Ports {
+        if port < 1 || port > 65535 {
+            return fmt.Errorf("invalid port %d", port)
+        }
+    }
+    if s.Interval == 0 {
+        s.Interval = 24 * time.Hour
+    }
+    if s.Interval < time.Hour {
+        return fmt.Errorf("interval must be at least 1h")
+    }
+    if s.Concurrency == 0 {
+        s.Concurrency = 64
+    }
+    if s.Concurrency < 0 {
+        return fmt.Errorf("concurrency must not be negative")
+    }
+    return nil
+}
+
+// sweep connects to every port of every address of the network and returns a target for each that
+// completes a TLS handshake. Targets are labeled with their address and its reverse DNS name.
+func (s *networkScan) sweep() []target {
+    var (
+        mu      sync.Mutex
+        found   []netip.AddrPort
+        wg      sync.WaitGroup
+        limiter = make(chan struct{}, s.Concurrency)
+    )
+    for addr := s.CIDR.Addr(); addr.IsValid() && s.CIDR.Contains(addr); addr = addr.Next() {
+        for _, port := range s.Ports {
+            ap := netip.AddrPortFrom(addr, uint16(port))
+            limiter <- struct{}{}
+            wg.Add(1)
+            go func() {
+                defer func() { <-limiter; wg.Done() }()
+                if speaksTLS(ap) {
+                    mu.Lock()
+                    found = append(found, ap)
+                    mu.Unlock()
+                }
+            }()
+        }
+    }
+    wg.Wait()
+
+    sort.Slice(found, func(i, j int) bool { return found[i].Compare(found[j]) < 0 })
+    names := make(map[netip.Addr]string)
+    targets := make([]target, 0, len(found))
+    for _, ap := range found {
+        name, ok := names[ap.Addr()]
+        if !ok {
+            if ptrs, err := net.LookupAddr(ap.Addr().String()); err == nil && len(ptrs) > 0 {
+                name = strings.TrimSuffix(ptrs[0], ".")
+            }
+            names[ap.Addr()] = name
+        }
+        t := target{Domain: ap.String(), Module: s.Module, Labels: make(map[string]string, len(s.Labels)+2)}
+        for k, v := range s.Labels {
+            t.Labels[k] = v
+        }
+        t.Labels["ip"] = ap.Addr().String()
+        if name != "" {
+            t.Labels["reverse_dns"] = name
+        }
+        targets = append(targets, t)
+    }
+    return targets
+}
+
+// speaksTLS reports whether a TLS handshake with the endpoint succeeds. The certificate isn't verified,
+// that's up to the probes of the endpoints found.
+func speaksTLS(ap netip.AddrPort) bool {
+    ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+    defer cancel()
+    conn, err := probeDialing.dialer(nil).DialContext(ctx, "tcp", ap.String())
+    if err != nil {
+        return false
+    }
+    defer conn.Close()
+    tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+    return tlsConn.HandshakeContext(ctx) == nil
+}
+
+// current returns the targets of the last sweep
+func (s *networkScan) current() []target {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.targets
+}
+
+// run sweeps the network right away and then at the configured interval
+func (s *networkScan) run() {
+    for {
+        start := time.Now()
+        targets := s.sweep()
+        s.mu.Lock()
+        changed := !sameDomains(targets, s.targets)
+        dropped := droppedDomains(s.targets, targets)
+        s.targets = targets
+        s.mu.Unlock()
+        log.Printf("Found %d TLS endpoints in %s on ports %s in %v", len(targets), s.CIDR, joinPorts(s.Ports), time.Since(start).Round(time.Second))
+        if len(dropped) > 0 && s.removed != nil {
+            s.removed(dropped)
+        }
+        if changed && s.changed != nil {
+            s.changed()
+        }
+        time.Sleep(s.Interval)
+    }
+}
+
+// sameDomains reports whether two sorted target lists hold the same domains
+func sameDomains(a, b []target) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i].Domain != b[i].Domain {
+            return false
+        }
+    }
+    return true
+}
+
+func joinPorts(ports []int) string {
+    s := make([]string, len(ports))
+    for i, port := range ports {
+        s[i] = strconv.Itoa(port)
+    }
+    return strings.Join(s, ",")
+}
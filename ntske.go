@@ -0,0 +1,92 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "time"
+)
+
+// NTS Key Establishment of RFC 8915
+const (
+    ntskeALPN             = "ntske/1"
+    ntskeCritical         = 0x8000
+    ntskeEndOfMessage     = 0
+    ntskeNextProtocol     = 1
+    ntskeError            = 2
+    ntskeAEADAlgorithm    = 4
+    ntskeProtocolNTPv4    = 0
+    ntskeAEADAESSIVCMAC   = 15
+    ntskeMaxResponseBytes = 64 << 10
+)
+
+// ntskeRequest asks for NTPv4 keys and cookies with AES-SIV-CMAC-256, the mandatory algorithm
+var ntskeRequest = func() []byte {
+    record := func(b []byte, typ uint16, body ...uint16) []byte {
+        b = binary.BigEndian.AppendUint16(b, typ)
+        b = binary.BigEndian.AppendUint16(b, uint16(2*len(body)))
+        for _, v := range body {
+            b = binary.BigEndian.AppendUint16(b, v)
+        }
+        return b
+    }
+    req := record(nil, ntskeCritical|ntskeNextProtocol, ntskeProtocolNTPv4)
+    req = record(req, ntskeAEADAlgorithm, ntskeAEADAESSIVCMAC)
+    return record(req, ntskeCritical|ntskeEndOfMessage)
+}()
+
+// getNTSKEConnState runs the TLS 1.3 handshake with an NTS-KE server and returns its state. With exchange the
+// client requests keys like an NTP client would, so the server sees a complete key establishment.
+func getNTSKEConnState(ctx context.Context, conn net.Conn, tlsCfg *tls.Config, exchange bool) (tls.ConnectionState, time.Duration, error) {
+    tlsCfg = tlsCfg.Clone()
+    tlsCfg.NextProtos = []string{ntskeALPN}
+    tlsCfg.MinVersion = tls.VersionTLS13
+    tlsConn, took, err := handshake(ctx, conn, tlsCfg)
+    if err != nil {
+        return tls.ConnectionState{}, took, err
+    }
+    state := tlsConn.ConnectionState()
+    if state.NegotiatedProtocol != ntskeALPN {
+        log.Printf("Server %s didn't negotiate %s, it may not be an NTS-KE server", conn.RemoteAddr(), ntskeALPN)
+        return state, took, nil
+    }
+    if !exchange {
+        return state, took, nil
+    }
+    if err := ntskeExchange(tlsConn); err != nil {
+        log.Printf("Error establishing NTS keys with %s: %v", conn.RemoteAddr(), err)
+    }
+    return state, took, nil
+}
+
+// ntskeExchange sends the request and reads the response records up to the end of message
+func ntskeExchange(conn *tls.Conn) error {
+    if _, err := conn.Write(ntskeRequest); err != nil {
+        return err
+    }
+    r := io.LimitReader(conn, ntskeMaxResponseBytes)
+    header := make([]byte, 4)
+    for {
+        if _, err := io.ReadFull(r, header); err != nil {
+            return err
+        }
+        typ := binary.BigEndian.Uint16(header) &^ ntskeCritical
+        body := make([]byte, binary.BigEndian.Uint16(header[2:]))
+        if _, err := io.ReadFull(r, body); err != nil {
+            return err
+        }
+        switch typ {
+        case ntskeEndOfMessage:
+            return nil
+        case ntskeError:
+            if len(body) >= 2 {
+                return fmt.Errorf("server sent error code %d", binary.BigEndian.Uint16(body))
+            }
+            return fmt.Errorf("server sent an error")
+        }
+    }
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+    "net/http"
+    "unicode/utf8"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// probesTotal counts the probes of the configured targets. Every increment carries the probed domain
+// as exemplar, so a jump in failures can be traced to a target in OpenMetrics aware frontends.
+var probesTotal = prometheus.NewCounterVec(
+    prometheus.CounterOpts{
+        Name: "ssl_probes_total",
+        Help: "Number of probes of the configured targets by result",
+    },
+    []string{"result"},
+)
+
+func init() {
+    prometheus.MustRegister(probesTotal)
+    probesTotal.WithLabelValues("success")
+    probesTotal.WithLabelValues("failure")
+}
+
+// maxExemplarRunes is the limit OpenMetrics puts on the combined length of exemplar label names and values
+const maxExemplarRunes = 128
+
+// addWithDomainExemplar adds v to c with the domain as exemplar, or without one if the domain is too long for it
+func addWithDomainExemplar(c prometheus.Counter, v float64, domain string) {
+    adder, ok := c.(prometheus.ExemplarAdder)
+    if !ok || domain == "" || utf8.RuneCountInString("domain"+domain) > maxExemplarRunes {
+        c.Add(v)
+        return
+    }
+    adder.AddWithExemplar(v, prometheus.Labels{"domain": domain})
+}
+
+// metricsHandler serves the metrics of gatherer in the Prometheus text format or OpenMetrics, depending on
+// content negotiation. Only OpenMetrics carries exemplars, created timestamps are added as _created samples if set.
+func metricsHandler(gatherer prometheus.Gatherer, createdSamples bool) http.Handler {
+    if vantagePoint != "" {
+        gatherer = vantageGatherer{Gatherer: gatherer, name: vantagePoint}
+    }
+    return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+        EnableOpenMetrics:                   true,
+        EnableOpenMetricsTextCreatedSamples: createdSamples,
+    })
+}
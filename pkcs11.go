@@ -0,0 +1,202 @@
+//go:build cgo
+
+package main
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/rsa"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "sync"
+
+    "github.com/miekg/pkcs11"
+)
+
+// pkcs11Modules holds the loaded PKCS#11 libraries by path. A library can only be initialized once per
+// process, so config reloads share them.
+var pkcs11Modules = struct {
+    mu   sync.Mutex
+    ctxs map[string]*pkcs11.Ctx
+}{ctxs: make(map[string]*pkcs11.Ctx)}
+
+// loadPKCS11Module loads and initializes the library at path
+func loadPKCS11Module(path string) (*pkcs11.Ctx, error) {
+    pkcs11Modules.mu.Lock()
+    defer pkcs11Modules.mu.Unlock()
+    if ctx, ok := pkcs11Modules.ctxs[path]; ok {
+        return ctx, nil
+    }
+    ctx := pkcs11.New(path)
+    if ctx == nil {
+        return nil, fmt.Errorf("loading %s failed", path)
+    }
+    if err := ctx.Initialize(); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+        ctx.Destroy()
+        return nil, err
+    }
+    pkcs11Modules.ctxs[path] = ctx
+    return ctx, nil
+}
+
+// pkcs11Signer signs with a private key on a token. Sessions must not be used concurrently.
+type pkcs11Signer struct {
+    ctx     *pkcs11.Ctx
+    mu      sync.Mutex
+    session pkcs11.SessionHandle
+    key     pkcs11.ObjectHandle
+    public  crypto.PublicKey
+}
+
+// signer logs into the token and looks up the key, public is the key of the client certificate
+func (k *pkcs11Key) signer(public crypto.PublicKey) (crypto.Signer, error) {
+    if k.Module == "" {
+        return nil, errors.New("module is required")
+    }
+    if k.KeyLabel == "" && k.KeyID == "" {
+        return nil, errors.New("key_label or key_id is required")
+    }
+    switch public.(type) {
+    case *rsa.PublicKey, *ecdsa.PublicKey:
+    default:
+        return nil, fmt.Errorf("unsupported key type %T", public)
+    }
+    ctx, err := loadPKCS11Module(k.Module)
+    if err != nil {
+        return nil, err
+    }
+
+    slots, err := ctx.GetSlotList(true)
+    if err != nil {
+        return nil, err
+    }
+    slot, found := uint(0), false
+    for _, s := range slots {
+        info, err := ctx.GetTokenInfo(s)
+        if err != nil {
+            return nil, err
+        }
+        if k.TokenLabel == "" || info.Label == k.TokenLabel {
+            slot, found = s, true
+            break
+        }
+    }
+    if !found {
+        return nil, fmt.Errorf("token %q not found", k.TokenLabel)
+    }
+    session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+    if err != nil {
+        return nil, err
+    }
+    if k.PIN != "" {
+        err := ctx.Login(session, pkcs11.CKU_USER, k.PIN)
+        if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+            ctx.CloseSession(session)
+            return nil, fmt.Errorf("login: %v", err)
+        }
+    }
+    key, err := k.findKey(ctx, session)
+    if err != nil {
+        ctx.CloseSession(session)
+        return nil, err
+    }
+    return &pkcs11Signer{ctx: ctx, session: session, key: key, public: public}, nil
+}
+
+// findKey looks up the private key by label and ID
+func (k *pkcs11Key) findKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle) (pkcs11.ObjectHandle, error) {
+    template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY)}
+    if k.KeyLabel != "" {
+        template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, k.KeyLabel))
+    }
+    if k.KeyID != "" {
+        id, err := hex.DecodeString(k.KeyID)
+        if err != nil {
+            return 0, fmt.Errorf("key_id: %v", err)
+        }
+        template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+    }
+    if err := ctx.FindObjectsInit(session, template); err != nil {
+        return 0, err
+    }
+    defer ctx.FindObjectsFinal(session)
+    keys, _, err := ctx.FindObjects(session, 2)
+    if err != nil {
+        return 0, err
+    }
+    switch len(keys) {
+    case 0:
+        return 0, errors.New("private key not found")
+    case 1:
+        return keys[0], nil
+    }
+    return 0, errors.New("several private keys match, set both key_label and key_id")
+}
+
+// Public returns the key of the client certificate
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+    return s.public
+}
+
+// pkcs11Hashes maps hash functions to the PKCS#11 hash mechanism and MGF1 generator of RSA-PSS
+var pkcs11Hashes = map[crypto.Hash][2]uint{
+    crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+    crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+    crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// digestInfoPrefixes are the DER encoded DigestInfo headers PKCS #1 v1.5 signatures put in front of the digest.
+// TLS 1.0 and 1.1 sign the bare MD5 and SHA-1 hashes.
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+    crypto.MD5SHA1: {},
+    crypto.SHA1:    {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+    crypto.SHA256:  {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+    crypto.SHA384:  {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+    crypto.SHA512:  {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// Sign signs the digest on the token. The raw RSA and ECDSA mechanisms are used, tokens rarely support
+// the combined hash and sign mechanisms for every hash.
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+    var (
+        mechanism *pkcs11.Mechanism
+        data      = digest
+    )
+    switch s.public.(type) {
+    case *rsa.PublicKey:
+        if pss, ok := opts.(*rsa.PSSOptions); ok {
+            hash, ok := pkcs11Hashes[pss.HashFunc()]
+            if !ok {
+                return nil, fmt.Errorf("unsupported hash %v", pss.HashFunc())
+            }
+            // TLS always uses a salt as long as the hash
+            params := pkcs11.NewPSSParams(hash[0], hash[1], uint(pss.HashFunc().Size()))
+            mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params)
+            break
+        }
+        prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+        if !ok {
+            return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+        }
+        mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+        data = append(append([]byte{}, prefix...), digest...)
+    case *ecdsa.PublicKey:
+        mechanism = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{mechanism}, s.key); err != nil {
+        return nil, err
+    }
+    sig, err := s.ctx.Sign(s.session, data)
+    if err != nil {
+        return nil, err
+    }
+    if _, ok := s.public.(*ecdsa.PublicKey); ok {
+        return ecdsaSignature(sig[:len(sig)/2], sig[len(sig)/2:])
+    }
+    return sig, nil
+}
@@ -0,0 +1,13 @@
+//go:build !cgo
+
+package main
+
+import (
+    "crypto"
+    "errors"
+)
+
+// signer fails, loading a PKCS#11 library needs cgo
+func (k *pkcs11Key) signer(public crypto.PublicKey) (crypto.Signer, error) {
+    return nil, errors.New("PKCS#11 is not supported by this build, it needs cgo")
+}
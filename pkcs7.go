@@ -0,0 +1,271 @@
+package main
+
+import (
+    "bytes"
+    "crypto/x509"
+    "debug/pe"
+    "encoding/asn1"
+    "encoding/binary"
+    "fmt"
+    "math/big"
+    "time"
+)
+
+var (
+    oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+    // Timestamp tokens in the unauthenticated attributes of a signer, as used by Authenticode and CMS
+    oidMSTimestampToken  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 3, 3, 1}
+    oidCMSTimestampToken = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14}
+)
+
+// winCertTypePKCS7 is the WIN_CERTIFICATE type of an Authenticode signature
+const winCertTypePKCS7 = 2
+
+// Usages a certificate is exported with in ssl_cert_expiry_by_usage
+const (
+    usageTLS          = "tls"
+    usageClientAuth   = "client_auth"
+    usageCodeSigning  = "code_signing"
+    usageTimestamping = "timestamping"
+    usageSMIME        = "smime"
+    usageCA           = "ca"
+    usageOther        = "other"
+)
+
+// certUsage classifies a certificate by its basic constraints and extended key usage
+func certUsage(cert *x509.Certificate) string {
+    if cert.IsCA {
+        return usageCA
+    }
+    for _, u := range cert.ExtKeyUsage {
+        switch u {
+        case x509.ExtKeyUsageCodeSigning:
+            return usageCodeSigning
+        case x509.ExtKeyUsageTimeStamping:
+            return usageTimestamping
+        case x509.ExtKeyUsageEmailProtection:
+            return usageSMIME
+        }
+    }
+    for _, u := range cert.ExtKeyUsage {
+        switch u {
+        case x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageAny:
+            return usageTLS
+        case x509.ExtKeyUsageClientAuth:
+            return usageClientAuth
+        }
+    }
+    if len(cert.ExtKeyUsage) == 0 {
+        return usageTLS
+    }
+    return usageOther
+}
+
+// expiryByUsage returns the earliest expiry date of the certificates of each usage
+func expiryByUsage(certs []*x509.Certificate) map[string]time.Time {
+    expiry := make(map[string]time.Time)
+    for _, cert := range certs {
+        usage := certUsage(cert)
+        if t, ok := expiry[usage]; !ok || cert.NotAfter.Before(t) {
+            expiry[usage] = cert.NotAfter
+        }
+    }
+    return expiry
+}
+
+// asn1Children splits the content of a constructed ASN.1 value into its elements
+func asn1Children(content []byte) ([]asn1.RawValue, error) {
+    var children []asn1.RawValue
+    for len(content) > 0 {
+        var v asn1.RawValue
+        rest, err := asn1.Unmarshal(content, &v)
+        if err != nil {
+            return nil, err
+        }
+        children = append(children, v)
+        content = rest
+    }
+    return children, nil
+}
+
+// pkcs7Certs returns the certificates of a DER encoded PKCS#7 SignedData structure, including the ones of
+// nested timestamp tokens. The certificates of the signers come first.
+func pkcs7Certs(der []byte) ([]*x509.Certificate, error) {
+    var contentInfo asn1.RawValue
+    if _, err := asn1.Unmarshal(der, &contentInfo); err != nil {
+        return nil, err
+    }
+    outer, err := asn1Children(contentInfo.Bytes)
+    if err != nil {
+        return nil, err
+    }
+    var contentType asn1.ObjectIdentifier
+    if len(outer) != 2 {
+        return nil, fmt.Errorf("not a PKCS#7 structure")
+    }
+    if _, err := asn1.Unmarshal(outer[0].FullBytes, &contentType); err != nil || !contentType.Equal(oidSignedData) {
+        return nil, fmt.Errorf("not a PKCS#7 signed data structure")
+    }
+
+    // The content is explicitly tagged [0] and holds the SignedData sequence
+    var signedData asn1.RawValue
+    if _, err := asn1.Unmarshal(outer[1].Bytes, &signedData); err != nil {
+        return nil, err
+    }
+    fields, err := asn1Children(signedData.Bytes)
+    if err != nil {
+        return nil, err
+    }
+
+    var (
+        certs   []*x509.Certificate
+        signers []asn1.RawValue
+    )
+    // version, digestAlgorithms and contentInfo are followed by the optional [0] certificates,
+    // the optional [1] CRLs and the signerInfos
+    for _, f := range fields[min(3, len(fields)):] {
+        switch {
+        case f.Class == asn1.ClassContextSpecific && f.Tag == 0:
+            certs, err = x509.ParseCertificates(f.Bytes)
+            if err != nil {
+                return nil, err
+            }
+        case f.Class == asn1.ClassUniversal && f.Tag == asn1.TagSet:
+            signers, err = asn1Children(f.Bytes)
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    var first, rest, timestamps []*x509.Certificate
+    for _, cert := range certs {
+        if signedBy(cert, signers) {
+            first = append(first, cert)
+        } else {
+            rest = append(rest, cert)
+        }
+    }
+    for _, signer := range signers {
+        ts, err := timestampCerts(signer)
+        if err != nil {
+            return nil, err
+        }
+        timestamps = append(timestamps, ts...)
+    }
+    return append(append(first, rest...), timestamps...), nil
+}
+
+// signedBy reports whether cert is identified by the issuer and serial number of one of the signer infos
+func signedBy(cert *x509.Certificate, signers []asn1.RawValue) bool {
+    for _, signer := range signers {
+        fields, err := asn1Children(signer.Bytes)
+        if err != nil || len(fields) < 2 {
+            continue
+        }
+        sid, err := asn1Children(fields[1].Bytes)
+        if err != nil || len(sid) != 2 {
+            continue
+        }
+        serial := new(big.Int)
+        if _, err := asn1.Unmarshal(sid[1].FullBytes, &serial); err != nil {
+            continue
+        }
+        if bytes.Equal(cert.RawIssuer, sid[0].FullBytes) && cert.SerialNumber.Cmp(serial) == 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// timestampCerts returns the certificates of the timestamp tokens in the unauthenticated attributes of a signer
+func timestampCerts(signer asn1.RawValue) ([]*x509.Certificate, error) {
+    fields, err := asn1Children(signer.Bytes)
+    if err != nil {
+        return nil, err
+    }
+    var certs []*x509.Certificate
+    for _, f := range fields {
+        if f.Class != asn1.ClassContextSpecific || f.Tag != 1 {
+            continue
+        }
+        attrs, err := asn1Children(f.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        for _, attr := range attrs {
+            parts, err := asn1Children(attr.Bytes)
+            if err != nil || len(parts) != 2 {
+                continue
+            }
+            var oid asn1.ObjectIdentifier
+            if _, err := asn1.Unmarshal(parts[0].FullBytes, &oid); err != nil {
+                continue
+            }
+            if !oid.Equal(oidMSTimestampToken) && !oid.Equal(oidCMSTimestampToken) {
+                continue
+            }
+            values, err := asn1Children(parts[1].Bytes)
+            if err != nil {
+                return nil, err
+            }
+            for _, v := range values {
+                ts, err := pkcs7Certs(v.FullBytes)
+                if err != nil {
+                    return nil, fmt.Errorf("timestamp token: %v", err)
+                }
+                certs = append(certs, ts...)
+            }
+        }
+    }
+    return certs, nil
+}
+
+// authenticodeCerts returns the certificates of the Authenticode signatures embedded in a PE file
+func authenticodeCerts(data []byte) ([]*x509.Certificate, error) {
+    f, err := pe.NewFile(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    var dir pe.DataDirectory
+    switch h := f.OptionalHeader.(type) {
+    case *pe.OptionalHeader32:
+        dir = h.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+    case *pe.OptionalHeader64:
+        dir = h.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+    default:
+        return nil, fmt.Errorf("no optional header")
+    }
+    if dir.Size == 0 {
+        return nil, fmt.Errorf("file is not signed")
+    }
+    // The security directory holds a file offset, not a virtual address
+    end := uint64(dir.VirtualAddress) + uint64(dir.Size)
+    if end > uint64(len(data)) {
+        return nil, fmt.Errorf("security directory exceeds the file")
+    }
+    table := data[dir.VirtualAddress:end]
+
+    var certs []*x509.Certificate
+    for len(table) >= 8 {
+        length := binary.LittleEndian.Uint32(table)
+        certType := binary.LittleEndian.Uint16(table[6:])
+        if length < 8 || uint64(length) > uint64(len(table)) {
+            return nil, fmt.Errorf("invalid attribute certificate table")
+        }
+        if certType == winCertTypePKCS7 {
+            c, err := pkcs7Certs(table[8:length])
+            if err != nil {
+                return nil, err
+            }
+            certs = append(certs, c...)
+        }
+        // Entries are aligned to 8 bytes
+        next := (length + 7) &^ 7
+        if uint64(next) >= uint64(len(table)) {
+            break
+        }
+        table = table[next:]
+    }
+    return certs, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+    "crypto/x509"
+)
+
+// Validation levels of a certificate, from the policies it asserts
+const (
+    validationEV      = "ev"
+    validationOV      = "ov"
+    validationIV      = "iv"
+    validationDV      = "dv"
+    validationUnknown = "unknown"
+)
+
+// validationPolicies maps the policy OIDs the CA/Browser Forum reserved for each validation level, which the
+// Baseline Requirements oblige CAs to assert, and the EV OIDs of large CAs from before, to the level
+var validationPolicies = map[string]string{
+    "2.23.140.1.1":   validationEV,
+    "2.23.140.1.2.2": validationOV,
+    "2.23.140.1.2.3": validationIV,
+    "2.23.140.1.2.1": validationDV,
+
+    "2.16.840.1.114412.2.1":        validationEV, // DigiCert
+    "2.16.840.1.114028.10.1.2":     validationEV, // Entrust
+    "1.3.6.1.4.1.4146.1.1":         validationEV, // GlobalSign
+    "1.3.6.1.4.1.6449.1.2.1.5.1":   validationEV, // Sectigo
+    "2.16.840.1.114413.1.7.23.3":   validationEV, // GoDaddy
+    "2.16.840.1.114414.1.7.23.3":   validationEV, // Starfield
+    "2.16.840.1.113733.1.7.23.6":   validationEV, // Symantec
+    "1.3.6.1.4.1.14370.1.6":        validationEV, // GeoTrust
+    "1.3.6.1.4.1.8024.0.2.100.1.2": validationEV, // QuoVadis
+    "2.16.578.1.26.1.3.3":          validationEV, // Buypass
+    "2.16.756.1.89.1.2.1.1":        validationEV, // SwissSign
+    "1.3.6.1.4.1.4788.2.202.1":     validationEV, // D-TRUST
+}
+
+// validationRank orders the levels, a certificate asserting several has the highest
+var validationRank = map[string]int{validationUnknown: 0, validationDV: 1, validationIV: 2, validationOV: 3, validationEV: 4}
+
+// validationLevel classifies a certificate by the highest validation level of its policies
+func validationLevel(cert *x509.Certificate) string {
+    level := validationUnknown
+    for _, oid := range certPolicies(cert) {
+        if l, ok := validationPolicies[oid]; ok && validationRank[l] > validationRank[level] {
+            level = l
+        }
+    }
+    return level
+}
+
+// certPolicies returns the policy OIDs of a certificate in dotted notation
+func certPolicies(cert *x509.Certificate) []string {
+    var policies []string
+    for _, oid := range cert.Policies {
+        policies = append(policies, oid.String())
+    }
+    return policies
+}
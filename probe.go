@@ -0,0 +1,90 @@
+package main
+
+import (
+    "log"
+    "net"
+    "net/http"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// probeHandler probes the target given as URL parameter and returns its metrics, blackbox exporter style.
+// When tenants are configured the request must authenticate and the target must be in the tenant's scope.
+// The metrics are only labeled with the domain if domainLabel is set.
+func probeHandler(cfg *probeConfig, intermediateWarn time.Duration, domainLabel, createdSamples bool) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        domain := r.URL.Query().Get("target")
+        if domain == "" {
+            http.Error(w, "target parameter is missing", http.StatusBadRequest)
+            return
+        }
+
+        t, err := normalizeTarget(target{Domain: domain, Module: r.URL.Query().Get("module")})
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        domain, moduleName := t.Domain, t.Module
+        mod, err := cfg.module(moduleName)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if localProbers[mod.Prober] {
+            http.Error(w, mod.Prober+" modules can't be used with /probe", http.StatusBadRequest)
+            return
+        }
+        host, _, err := net.SplitHostPort(domain)
+        if err != nil {
+            host = domain
+        }
+
+        if len(cfg.Tenants) > 0 {
+            name, tenant := cfg.tenantFor(r)
+            if tenant == nil {
+                w.Header().Set("WWW-Authenticate", `Basic realm="ssl_exporter"`)
+                http.Error(w, "unauthorized", http.StatusUnauthorized)
+                return
+            }
+            if !tenant.allowsModule(moduleName) {
+                log.Printf("Tenant %s is not allowed to use module %s", name, moduleName)
+                http.Error(w, "module not allowed for tenant", http.StatusForbidden)
+                return
+            }
+            if !tenant.allows(host) {
+                log.Printf("Tenant %s is not allowed to probe %s", name, domain)
+                http.Error(w, "target not allowed for tenant", http.StatusForbidden)
+                return
+            }
+        }
+
+        if err := cfg.TargetPolicy.check(r.Context(), host); err != nil {
+            log.Printf("Refusing to probe %s: %v", domain, err)
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+
+        probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+            Name: "ssl_probe_duration_seconds",
+            Help: "Duration of the probe in seconds",
+        })
+        reg := prometheus.NewRegistry()
+        reg.MustRegister(probeDuration)
+        m := newCertMetrics(domainLabel)
+        m.limits = cfg.Limits
+        m.register(reg)
+
+        start := time.Now()
+        res, err := mod.probe(r.Context(), cfg.TargetPolicy.dialer(), domain, cfg.proxyFor(host))
+        probeDuration.Set(time.Since(start).Seconds())
+        if err != nil {
+            log.Printf("Error probing domain %s: %v", domain, err)
+            m.recordFailure(domain, err)
+        } else {
+            m.record(domain, res, intermediateWarn)
+        }
+
+        metricsHandler(reg, createdSamples).ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// promSource derives targets from the series a Prometheus query returns, so probing follows
+// whatever is already scraped, e.g. up{job="nginx"}
+type promSource struct {
+    URL   string `yaml:"url"` // of the Prometheus server, like http://prometheus:9090
+    Query string `yaml:"query"`
+    // Label holds the host to probe, instance by default. Its port is replaced by Port if set.
+    Label       string            `yaml:"label"`
+    Port        int               `yaml:"port"`
+    Module      string            `yaml:"module"`
+    Labels      map[string]string `yaml:"labels"`      // added to every target
+    CopyLabels  []string          `yaml:"copy_labels"` // series labels copied to the targets, like job
+    Interval    time.Duration     `yaml:"interval"`    // how often the query runs, 5m by default
+    BearerToken string            `yaml:"bearer_token"`
+
+    client  *http.Client
+    removed func(domains []string) // called with the targets a query no longer returns
+
+    mu      sync.Mutex
+    targets []target // of the last successful query
+}
+
+// validate checks the source and fills in defaults
+func (s *promSource) validate() error {
+    if s.URL == "" || s.Query == "" {
+        return fmt.Errorf("url and query are required")
+    }
+    if _, err := url.Parse(s.URL); err != nil {
+        return err
+    }
+    if s.Label == "" {
+        s.Label = "instance"
+    }
+    if s.Port < 0 || s.Port > 65535 {
+        return fmt.Errorf("invalid port %d", s.Port)
+    }
+    if s.Interval == 0 {
+        s.Interval = 5 * time.Minute
+    }
+    if s.Interval < time.Minute {
+        return fmt.Errorf("interval must be at least 1m")
+    }
+    s.client = &http.Client{Timeout: 6 * dialTimeout}
+    return nil
+}
+
+// promResponse is the response of the Prometheus instant query API
+type promResponse struct {
+    Status string `json:"status"`
+    Error  string `json:"error"`
+    Data   struct {
+        ResultType string `json:"resultType"`
+        Result     []struct {
+            Metric map[string]string `json:"metric"`
+        } `json:"result"`
+    } `json:"data"`
+}
+
+// query runs the query and returns a target for every distinct host in the result
+func (s *promSource) query() ([]target, error) {
+    req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(s.URL, "/")+"/api/v1/query?"+url.Values{"query": {s.Query}}.Encode(), nil)
+    if err != nil {
+        return nil, err
+    }
+    if s.BearerToken != "" {
+        req.Header.Set("Authorization", "Bearer "+s.BearerToken)
+    }
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    var body promResponse
+    if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+        return nil, fmt.Errorf("unexpected response with status %s: %v", resp.Status, err)
+    }
+    if body.Status != "success" {
+        return nil, fmt.Errorf("query failed: %s", body.Error)
+    }
+    if body.Data.ResultType != "vector" {
+        return nil, fmt.Errorf("query returned a %s, expected a vector", body.Data.ResultType)
+    }
+
+    seen := make(map[string]bool)
+    var targets []target
+    for _, series := range body.Data.Result {
+        domain := series.Metric[s.Label]
+        if domain == "" {
+            continue
+        }
+        if s.Port != 0 {
+            domain = net.JoinHostPort(hostOf(domain), strconv.Itoa(s.Port))
+        }
+        if seen[domain] {
+            continue
+        }
+        seen[domain] = true
+        t := target{Domain: domain, Module: s.Module, Labels: make(map[string]string)}
+        for k, v := range s.Labels {
+            t.Labels[k] = v
+        }
+        for _, name := range s.CopyLabels {
+            if v, ok := series.Metric[name]; ok {
+                t.Labels[name] = v
+            }
+        }
+        targets = append(targets, t)
+    }
+    sort.Slice(targets, func(i, j int) bool { return targets[i].Domain < targets[j].Domain })
+    return targets, nil
+}
+
+// current returns the targets of the last successful query
+func (s *promSource) current() []target {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.targets
+}
+
+// update runs the query. A failed query keeps the previous targets, so a Prometheus outage doesn't drop them.
+func (s *promSource) update() {
+    targets, err := s.query()
+    if err != nil {
+        log.Printf("Error querying %s for targets: %v", s.URL, err)
+        return
+    }
+    s.mu.Lock()
+    dropped := droppedDomains(s.targets, targets)
+    changed := len(targets) != len(s.targets) || len(dropped) > 0
+    s.targets = targets
+    s.mu.Unlock()
+    if changed {
+        log.Printf("Found %d targets with query %s", len(targets), s.Query)
+    }
+    if len(dropped) > 0 && s.removed != nil {
+        s.removed(dropped)
+    }
+}
+
+// run updates the targets at the configured interval
+func (s *promSource) run() {
+    for {
+        time.Sleep(s.Interval)
+        s.update()
+    }
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "crypto/tls"
+    "encoding/base64"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+
+    "github.com/Azure/go-ntlmssp"
+    "github.com/jcmturner/gokrb5/v8/client"
+    krb5config "github.com/jcmturner/gokrb5/v8/config"
+    "github.com/jcmturner/gokrb5/v8/credentials"
+    "github.com/jcmturner/gokrb5/v8/keytab"
+    "github.com/jcmturner/gokrb5/v8/spnego"
+    "golang.org/x/net/proxy"
+)
+
+// proxyDirect as rule URL connects to the matching targets without a proxy
+const proxyDirect = "direct"
+
+// Authentication schemes for HTTP proxies
+const (
+    proxyAuthBasic     = "basic"
+    proxyAuthNTLM      = "ntlm"
+    proxyAuthNegotiate = "negotiate" // SPNEGO with Kerberos
+)
+
+// proxyRule routes the targets matching one of the patterns through a proxy. Rules are evaluated in order,
+// the first match wins and targets matching none connect directly.
+type proxyRule struct {
+    Targets []string `yaml:"targets"` // glob patterns of host names, like *.corp.example.com
+    URL     string   `yaml:"url"`     // http, https or socks5 URL with optional credentials, or direct
+    // Auth is the scheme of HTTP proxies: basic, ntlm with DOMAIN\user credentials in the URL,
+    // or negotiate. Basic is used if the URL has credentials and no scheme is set.
+    Auth     string         `yaml:"auth"`
+    Kerberos kerberosConfig `yaml:"kerberos"`
+
+    url *url.URL // parsed by validate, nil for direct
+
+    mu  sync.Mutex
+    krb *client.Client // logged in on first use, renews its tickets itself
+}
+
+// kerberosConfig holds the credentials of the negotiate scheme. Without a keytab the password of the
+// proxy URL is used, without both the credential cache.
+type kerberosConfig struct {
+    Krb5Conf  string `yaml:"krb5_conf"` // /etc/krb5.conf by default
+    Principal string `yaml:"principal"` // user@REALM
+    Keytab    string `yaml:"keytab"`
+    CCache    string `yaml:"ccache"` // KRB5CCNAME or /tmp/krb5cc_<uid> by default
+}
+
+// validate parses the proxy URL
+func (r *proxyRule) validate() error {
+    if len(r.Targets) == 0 || r.URL == "" {
+        return fmt.Errorf("targets and url are required")
+    }
+    if r.URL == proxyDirect {
+        return nil
+    }
+    u, err := url.Parse(r.URL)
+    if err != nil {
+        return err
+    }
+    switch u.Scheme {
+    case "http", "https", "socks5", "socks5h":
+    default:
+        return fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+    }
+    if u.Hostname() == "" {
+        return fmt.Errorf("proxy url %q has no host", r.URL)
+    }
+    r.url = u
+
+    if r.Auth == "" && u.User != nil {
+        r.Auth = proxyAuthBasic
+    }
+    switch r.Auth {
+    case "":
+    case proxyAuthBasic, proxyAuthNTLM:
+        if u.User == nil {
+            return fmt.Errorf("auth %s requires credentials in the url", r.Auth)
+        }
+    case proxyAuthNegotiate:
+        if r.Kerberos.Principal == "" && r.Kerberos.Keytab != "" {
+            return fmt.Errorf("kerberos keytab requires a principal")
+        }
+    default:
+        return fmt.Errorf("unknown auth %q, expected basic, ntlm or negotiate", r.Auth)
+    }
+    if r.Auth != "" && strings.HasPrefix(u.Scheme, "socks5") && r.Auth != proxyAuthBasic {
+        return fmt.Errorf("auth %s is only supported by http and https proxies", r.Auth)
+    }
+    return nil
+}
+
+// proxyFor returns the rule of the proxy the host is reached through, nil to connect directly
+func (c *probeConfig) proxyFor(host string) *proxyRule {
+    for _, r := range c.Proxies {
+        if matchesAny(r.Targets, host) {
+            if r.url == nil {
+                return nil
+            }
+            return r
+        }
+    }
+    return nil
+}
+
+// kerberosClient returns the Kerberos client of the negotiate scheme, logging in on first use
+func (r *proxyRule) kerberosClient() (*client.Client, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.krb != nil {
+        return r.krb, nil
+    }
+
+    confPath := r.Kerberos.Krb5Conf
+    if confPath == "" {
+        confPath = "/etc/krb5.conf"
+    }
+    conf, err := krb5config.Load(confPath)
+    if err != nil {
+        return nil, err
+    }
+    user, realm, _ := strings.Cut(r.Kerberos.Principal, "@")
+    if realm == "" {
+        realm = conf.LibDefaults.DefaultRealm
+    }
+
+    var cl *client.Client
+    switch {
+    case r.Kerberos.Keytab != "":
+        kt, err := keytab.Load(r.Kerberos.Keytab)
+        if err != nil {
+            return nil, err
+        }
+        cl = client.NewWithKeytab(user, realm, kt, conf)
+    case r.url.User != nil:
+        password, _ := r.url.User.Password()
+        if user == "" {
+            user = r.url.User.Username()
+        }
+        cl = client.NewWithPassword(user, realm, password, conf)
+    default:
+        ccache, err := credentials.LoadCCache(ccachePath(r.Kerberos.CCache))
+        if err != nil {
+            return nil, err
+        }
+        if cl, err = client.NewFromCCache(ccache, conf); err != nil {
+            return nil, err
+        }
+    }
+    if err := cl.Login(); err != nil {
+        return nil, err
+    }
+    r.krb = cl
+    return cl, nil
+}
+
+// ccachePath returns the credential cache to use, following the MIT Kerberos defaults
+func ccachePath(path string) string {
+    if path == "" {
+        path = os.Getenv("KRB5CCNAME")
+    }
+    if path == "" {
+        path = fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())
+    }
+    return strings.TrimPrefix(path, "FILE:")
+}
+
+// negotiateToken returns the SPNEGO token for the HTTP service of the proxy
+func (r *proxyRule) negotiateToken() (string, error) {
+    cl, err := r.kerberosClient()
+    if err != nil {
+        return "", err
+    }
+    token, err := spnego.SPNEGOClient(cl, "HTTP/"+r.url.Hostname()).InitSecContext()
+    if err != nil {
+        return "", err
+    }
+    data, err := token.Marshal()
+    if err != nil {
+        return "", err
+    }
+    return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// dialProxy connects to addr through the proxy. The proxy resolves the host name, so targets
+// the exporter's own DNS can't resolve are reachable as well.
+func dialProxy(ctx context.Context, dialer *net.Dialer, rule *proxyRule, addr string) (net.Conn, error) {
+    proxyURL := rule.url
+    if proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h" {
+        d, err := proxy.FromURL(proxyURL, dialer)
+        if err != nil {
+            return nil, err
+        }
+        return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+    }
+
+    proxyAddr := proxyURL.Host
+    if proxyURL.Port() == "" {
+        port := "80"
+        if proxyURL.Scheme == "https" {
+            port = "443"
+        }
+        proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+    }
+    conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+    if err != nil {
+        return nil, err
+    }
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+    }
+    if proxyURL.Scheme == "https" {
+        tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+        if err := tlsConn.HandshakeContext(ctx); err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("proxy %s: %v", proxyURL.Redacted(), err)
+        }
+        conn = tlsConn
+    }
+
+    br := bufio.NewReader(conn)
+    resp, err := rule.connect(conn, br, addr)
+    if err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("proxy %s: %v", proxyURL.Redacted(), err)
+    }
+    if resp.StatusCode != http.StatusOK {
+        conn.Close()
+        return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", proxyURL.Redacted(), addr, strings.TrimSpace(resp.Status))
+    }
+    // Servers speaking first, like SMTP, may have sent their greeting along with the response
+    if br.Buffered() > 0 {
+        return &bufferedConn{Conn: conn, r: br}, nil
+    }
+    return conn, nil
+}
+
+// connect sends the CONNECT request, authenticating with the rule's scheme. NTLM takes a second
+// round trip on the same connection to answer the proxy's challenge.
+func (r *proxyRule) connect(conn net.Conn, br *bufio.Reader, addr string) (*http.Response, error) {
+    var user, password string
+    if r.url.User != nil {
+        user = r.url.User.Username()
+        password, _ = r.url.User.Password()
+    }
+
+    var authorization string
+    switch r.Auth {
+    case proxyAuthBasic:
+        authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+    case proxyAuthNegotiate:
+        token, err := r.negotiateToken()
+        if err != nil {
+            return nil, fmt.Errorf("kerberos: %v", err)
+        }
+        authorization = "Negotiate " + token
+    case proxyAuthNTLM:
+        negotiate, err := ntlmssp.NewNegotiateMessage("", "")
+        if err != nil {
+            return nil, err
+        }
+        authorization = "NTLM " + base64.StdEncoding.EncodeToString(negotiate)
+    }
+    resp, err := connectRequest(conn, br, addr, authorization)
+    if err != nil || r.Auth != proxyAuthNTLM || resp.StatusCode != http.StatusProxyAuthRequired {
+        return resp, err
+    }
+
+    var challenge []byte
+    for _, h := range resp.Header.Values("Proxy-Authenticate") {
+        if encoded, ok := strings.CutPrefix(h, "NTLM "); ok {
+            challenge, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+            if err != nil {
+                return nil, fmt.Errorf("invalid NTLM challenge: %v", err)
+            }
+        }
+    }
+    if challenge == nil {
+        return resp, nil
+    }
+    authenticate, err := ntlmssp.NewAuthenticateMessage(challenge, user, password, nil)
+    if err != nil {
+        return nil, err
+    }
+    return connectRequest(conn, br, addr, "NTLM "+base64.StdEncoding.EncodeToString(authenticate))
+}
+
+// connectRequest writes a CONNECT request and reads the response, discarding the body of a refusal
+func connectRequest(conn net.Conn, br *bufio.Reader, addr, authorization string) (*http.Response, error) {
+    req := &http.Request{
+        Method: http.MethodConnect,
+        URL:    &url.URL{Opaque: addr},
+        Host:   addr,
+        Header: make(http.Header),
+    }
+    if authorization != "" {
+        req.Header.Set("Proxy-Authorization", authorization)
+    }
+    if err := req.Write(conn); err != nil {
+        return nil, err
+    }
+    resp, err := http.ReadResponse(br, req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode != http.StatusOK {
+        io.Copy(io.Discard, resp.Body)
+    }
+    resp.Body.Close()
+    return resp, nil
+}
+
+// bufferedConn reads the data buffered while reading the CONNECT response before the connection
+type bufferedConn struct {
+    net.Conn
+    r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+    return c.r.Read(b)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// Proxy servers whose configuration can be scanned for certificates
+const (
+    proxyNginx   = "nginx"
+    proxyHAProxy = "haproxy"
+)
+
+// proxyConfigFile is the configuration of a reverse proxy whose certificate files become file targets
+type proxyConfigFile struct {
+    Type   string            `yaml:"type"` // nginx or haproxy
+    Path   string            `yaml:"path"`
+    Labels map[string]string `yaml:"labels"` // added to every discovered target
+}
+
+// discoverProxyCerts returns a file target for every certificate the proxy configuration references
+func discoverProxyCerts(pc proxyConfigFile) ([]target, error) {
+    var (
+        paths []string
+        err   error
+    )
+    switch pc.Type {
+    case proxyNginx:
+        paths, err = nginxCerts(pc.Path, filepath.Dir(pc.Path), make(map[string]bool))
+    case proxyHAProxy:
+        paths, err = haproxyCerts(pc.Path)
+    default:
+        return nil, fmt.Errorf("unknown proxy type %q", pc.Type)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    var targets []target
+    seen := make(map[string]bool)
+    for _, p := range paths {
+        if seen[p] {
+            continue
+        }
+        seen[p] = true
+        t := target{Domain: p, Module: proberFile, Labels: make(map[string]string)}
+        for k, v := range pc.Labels {
+            t.Labels[k] = v
+        }
+        targets = append(targets, t)
+    }
+    return targets, nil
+}
+
+// nginxCerts returns the ssl_certificate paths of an nginx configuration file and the files it includes.
+// Relative paths are resolved against confDir, the directory of the main configuration, like nginx does.
+// Paths containing variables are resolved per request by nginx and skipped.
+func nginxCerts(filePath, confDir string, visited map[string]bool) ([]string, error) {
+    if visited[filePath] {
+        return nil, nil
+    }
+    visited[filePath] = true
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return nil, err
+    }
+
+    var paths []string
+    for _, stmt := range nginxStatements(string(data)) {
+        if len(stmt) != 2 {
+            continue
+        }
+        arg := strings.Trim(stmt[1], `"'`)
+        switch stmt[0] {
+        case "ssl_certificate", "proxy_ssl_certificate":
+            if !strings.Contains(arg, "$") {
+                paths = append(paths, resolvePath(confDir, arg))
+            }
+        case "include":
+            matches, err := filepath.Glob(resolvePath(confDir, arg))
+            if err != nil {
+                return nil, fmt.Errorf("%s: include %s: %v", filePath, arg, err)
+            }
+            for _, m := range matches {
+                included, err := nginxCerts(m, confDir, visited)
+                if err != nil {
+                    return nil, err
+                }
+                paths = append(paths, included...)
+            }
+        }
+    }
+    return paths, nil
+}
+
+// resolvePath returns p relative to dir unless it is absolute
+func resolvePath(dir, p string) string {
+    if filepath.IsAbs(p) {
+        return p
+    }
+    return filepath.Join(dir, p)
+}
+
+// nginxStatements splits an nginx configuration into the words of its simple statements,
+// ignoring comments and block structure
+func nginxStatements(config string) [][]string {
+    var (
+        stmts [][]string
+        words []string
+    )
+    for _, line := range strings.Split(config, "\n") {
+        if i := strings.Index(line, "#"); i >= 0 {
+            line = line[:i]
+        }
+        line = strings.NewReplacer("{", " { ", "}", " } ", ";", " ; ").Replace(line)
+        for _, word := range strings.Fields(line) {
+            switch word {
+            case ";":
+                stmts = append(stmts, words)
+                words = nil
+            case "{", "}":
+                words = nil
+            default:
+                words = append(words, word)
+            }
+        }
+    }
+    return stmts
+}
+
+// haproxyCerts returns the certificates of the crt and crt-list arguments of an haproxy configuration.
+// A crt directory stands for all files in it.
+func haproxyCerts(filePath string) ([]string, error) {
+    file, err := os.Open(filePath)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    var paths []string
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if i := strings.Index(line, "#"); i >= 0 {
+            line = line[:i]
+        }
+        fields := strings.Fields(line)
+        if len(fields) == 0 || fields[0] != "bind" {
+            continue
+        }
+        for i := 1; i+1 < len(fields); i++ {
+            arg := resolvePath(filepath.Dir(filePath), fields[i+1])
+            switch fields[i] {
+            case "crt":
+                certs, err := haproxyCrt(arg)
+                if err != nil {
+                    return nil, err
+                }
+                paths = append(paths, certs...)
+            case "crt-list":
+                certs, err := haproxyCrtList(arg)
+                if err != nil {
+                    return nil, err
+                }
+                paths = append(paths, certs...)
+            }
+        }
+    }
+    return paths, scanner.Err()
+}
+
+// haproxyCrt expands a crt argument, which is a file or a directory of certificates
+func haproxyCrt(p string) ([]string, error) {
+    info, err := os.Stat(p)
+    if err != nil {
+        return nil, err
+    }
+    if !info.IsDir() {
+        return []string{p}, nil
+    }
+    entries, err := os.ReadDir(p)
+    if err != nil {
+        return nil, err
+    }
+    var paths []string
+    for _, e := range entries {
+        // haproxy loads keys, OCSP responses and issuers stored next to a certificate on its own
+        ext := filepath.Ext(e.Name())
+        if e.IsDir() || ext == ".key" || ext == ".ocsp" || ext == ".issuer" || ext == ".sctl" {
+            continue
+        }
+        paths = append(paths, filepath.Join(p, e.Name()))
+    }
+    return paths, nil
+}
+
+// haproxyCrtList returns the certificates of a crt-list file, the first field of each line
+func haproxyCrtList(p string) ([]string, error) {
+    data, err := os.ReadFile(p)
+    if err != nil {
+        return nil, err
+    }
+    var paths []string
+    for _, line := range strings.Split(string(data), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+            continue
+        }
+        certs, err := haproxyCrt(resolvePath(filepath.Dir(p), fields[0]))
+        if err != nil {
+            return nil, err
+        }
+        paths = append(paths, certs...)
+    }
+    return paths, nil
+}
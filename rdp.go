@@ -0,0 +1,77 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "time"
+)
+
+// RDP negotiation of MS-RDPBCGR 2.2.1.1 and 2.2.1.2
+const (
+    x224ConnectionRequest = 0xe0
+    x224ConnectionConfirm = 0xd0
+    rdpNegResponse        = 0x02
+    rdpNegFailure         = 0x03
+    rdpProtocolRDP        = 0x0 // standard RDP security without TLS
+    // rdpProtocols requests TLS, CredSSP and CredSSP with early user authorization, all of which start
+    // with a TLS handshake
+    rdpProtocols = 0x1 | 0x2 | 0x8
+)
+
+// rdpNegotiationRequest is the X.224 Connection Request PDU in a TPKT, carrying an RDP Negotiation Request
+var rdpNegotiationRequest = func() []byte {
+    neg := []byte{0x01, 0, 8, 0}
+    neg = binary.LittleEndian.AppendUint32(neg, rdpProtocols)
+    x224 := append([]byte{byte(6 + len(neg)), x224ConnectionRequest, 0, 0, 0, 0, 0}, neg...)
+    tpkt := []byte{3, 0}
+    tpkt = binary.BigEndian.AppendUint16(tpkt, uint16(4+len(x224)))
+    return append(tpkt, x224...)
+}()
+
+// getRDPConnState negotiates enhanced RDP security on conn and returns the TLS state of the handshake that
+// follows. The connection is closed before CredSSP authentication starts.
+func getRDPConnState(ctx context.Context, conn net.Conn, tlsCfg *tls.Config) (tls.ConnectionState, time.Duration, error) {
+    if _, err := conn.Write(rdpNegotiationRequest); err != nil {
+        return tls.ConnectionState{}, 0, err
+    }
+    header := make([]byte, 4)
+    if _, err := io.ReadFull(conn, header); err != nil {
+        return tls.ConnectionState{}, 0, fmt.Errorf("reading RDP negotiation response: %v", err)
+    }
+    if header[0] != 3 {
+        return tls.ConnectionState{}, 0, errors.New("not an RDP server")
+    }
+    length := int(binary.BigEndian.Uint16(header[2:]))
+    if length < 4+7 {
+        return tls.ConnectionState{}, 0, errors.New("malformed RDP negotiation response")
+    }
+    x224 := make([]byte, length-4)
+    if _, err := io.ReadFull(conn, x224); err != nil {
+        return tls.ConnectionState{}, 0, fmt.Errorf("reading RDP negotiation response: %v", err)
+    }
+    if x224[1] != x224ConnectionConfirm {
+        return tls.ConnectionState{}, 0, errors.New("not an RDP server")
+    }
+    // Servers without a negotiation response only speak standard RDP security, which has no certificate
+    if len(x224) < 7+8 {
+        return tls.ConnectionState{}, 0, errors.New("RDP server only supports standard RDP security")
+    }
+    neg := x224[7:]
+    switch neg[0] {
+    case rdpNegResponse:
+        // selectedProtocol 0 is standard RDP security, the server didn't pick one of the TLS based protocols
+        if binary.LittleEndian.Uint32(neg[4:]) == rdpProtocolRDP {
+            return tls.ConnectionState{}, 0, errors.New("RDP server does not support TLS, it selected standard RDP security")
+        }
+    case rdpNegFailure:
+        return tls.ConnectionState{}, 0, fmt.Errorf("RDP server refused TLS, failure code %d", binary.LittleEndian.Uint32(neg[4:]))
+    default:
+        return tls.ConnectionState{}, 0, fmt.Errorf("unexpected RDP negotiation response type %d", neg[0])
+    }
+    return getSSLConnState(ctx, conn, tlsCfg)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "encoding/binary"
+    "io"
+    "net"
+    "strings"
+    "testing"
+)
+
+func TestRDPNegotiationRequest(t *testing.T) {
+    want := []byte{
+        0x03, 0x00, 0x00, 0x13, // TPKT, 19 bytes
+        0x0e, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00, // X.224 Connection Request
+        0x01, 0x00, 0x08, 0x00, 0x0b, 0x00, 0x00, 0x00, // TLS, CredSSP and CredSSP with early user authorization
+    }
+    if !bytes.Equal(rdpNegotiationRequest, want) {
+        t.Errorf("got % x, want % x", rdpNegotiationRequest, want)
+    }
+}
+
+// rdpConfirm encodes an X.224 Connection Confirm in a TPKT, carrying neg if it isn't empty
+func rdpConfirm(neg []byte) []byte {
+    x224 := append([]byte{byte(6 + len(neg)), x224ConnectionConfirm, 0, 0, 0, 0, 0}, neg...)
+    return append(binary.BigEndian.AppendUint16([]byte{3, 0}, uint16(4+len(x224))), x224...)
+}
+
+func TestGetRDPConnStateNegotiation(t *testing.T) {
+    negotiation := func(typ byte, value uint32) []byte {
+        return binary.LittleEndian.AppendUint32([]byte{typ, 0, 8, 0}, value)
+    }
+    for _, tc := range []struct {
+        name     string
+        response []byte
+        wantErr  string
+    }{
+        {"standard security", rdpConfirm(negotiation(rdpNegResponse, rdpProtocolRDP)), "selected standard RDP security"},
+        {"failure", rdpConfirm(negotiation(rdpNegFailure, 2)), "refused TLS, failure code 2"},
+        {"no negotiation", rdpConfirm(nil), "only supports standard RDP security"},
+        {"unknown type", rdpConfirm(negotiation(0x07, 0)), "unexpected RDP negotiation response type 7"},
+        {"not TPKT", []byte("HTTP/1.1 400 Bad Request\r\n\r\n"), "not an RDP server"},
+        {"not a confirm", append([]byte{3, 0, 0, 11, 6, x224ConnectionRequest}, 0, 0, 0, 0, 0), "not an RDP server"},
+        {"short TPKT", []byte{3, 0, 0, 4}, "malformed RDP negotiation response"},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            client, server := net.Pipe()
+            defer client.Close()
+            go func() {
+                defer server.Close()
+                if _, err := io.ReadFull(server, make([]byte, len(rdpNegotiationRequest))); err != nil {
+                    return
+                }
+                server.Write(tc.response)
+            }()
+            _, _, err := getRDPConnState(context.Background(), client, &tls.Config{})
+            if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+                t.Errorf("got error %v, want one containing %q", err, tc.wantErr)
+            }
+        })
+    }
+}
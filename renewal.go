@@ -0,0 +1,71 @@
+package main
+
+import (
+    "crypto/x509"
+    "fmt"
+    "log"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Target labels declaring the renewal policy of a certificate, as days like 90d or Go durations
+const (
+    maxLifetimeLabel = "max_lifetime" // lifetime the certificates of the target are issued with
+    renewalLeadLabel = "renewal_lead" // time before expiry they should be renewed at, a third of the lifetime by default
+)
+
+// parseDays parses a number of days like 90d, or a Go duration
+func parseDays(s string) (time.Duration, error) {
+    if days, ok := strings.CutSuffix(s, "d"); ok {
+        n, err := strconv.Atoi(days)
+        if err != nil {
+            return 0, fmt.Errorf("invalid number of days %q", s)
+        }
+        return time.Duration(n) * 24 * time.Hour, nil
+    }
+    return time.ParseDuration(s)
+}
+
+// renewalPolicy returns the time after its start a certificate of the target should be renewed at.
+// ok is false if the target declares no policy.
+func renewalPolicy(t target) (renewAfter time.Duration, ok bool, err error) {
+    lifetimeLabel, ok := t.Labels[maxLifetimeLabel]
+    if !ok {
+        if _, lead := t.Labels[renewalLeadLabel]; lead {
+            return 0, false, fmt.Errorf("%s requires %s", renewalLeadLabel, maxLifetimeLabel)
+        }
+        return 0, false, nil
+    }
+    lifetime, err := parseDays(lifetimeLabel)
+    if err != nil || lifetime <= 0 {
+        return 0, false, fmt.Errorf("invalid %s %q", maxLifetimeLabel, lifetimeLabel)
+    }
+    lead := lifetime / 3
+    if l, ok := t.Labels[renewalLeadLabel]; ok {
+        lead, err = parseDays(l)
+        if err != nil || lead < 0 || lead >= lifetime {
+            return 0, false, fmt.Errorf("invalid %s %q, must be below %s", renewalLeadLabel, l, maxLifetimeLabel)
+        }
+    }
+    return lifetime - lead, true, nil
+}
+
+// checkRenewal exports whether the leaf of a target is overdue for renewal by the target's policy,
+// e.g. a 90 day Let's Encrypt certificate still served after 60 days, long before the expiry alerts fire
+func (m *certMetrics) checkRenewal(t target, leaf *x509.Certificate, now time.Time) {
+    renewAfter, ok, err := renewalPolicy(t)
+    if err != nil {
+        log.Printf("Error checking renewal policy for domain %s: %v", t.Domain, err)
+        return
+    }
+    if !ok {
+        return
+    }
+    overdue := 0.0
+    if due := leaf.NotBefore.Add(renewAfter); now.After(due) {
+        overdue = 1
+        log.Printf("Certificate of domain %s was due for renewal at %v", t.Domain, due)
+    }
+    m.renewalOverdue.set(t.Domain, overdue)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+    "encoding/csv"
+    "flag"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "sort"
+    "strconv"
+    "text/tabwriter"
+    "time"
+)
+
+// Formats of the expiry report
+const (
+    reportJSON = "json"
+    reportText = "text"
+    reportCSV  = "csv"
+)
+
+// defaultReportWithin is the window of the expiry report without a within parameter
+const defaultReportWithin = 30 * 24 * time.Hour
+
+// expiringCert is a row of the expiry report: the leaf a target served on its last successful probe
+type expiringCert struct {
+    Target       string            `json:"target"`
+    Module       string            `json:"module,omitempty"`
+    Labels       map[string]string `json:"labels,omitempty"`
+    NotAfter     time.Time         `json:"not_after"`
+    DaysLeft     int               `json:"days_left"`
+    Subject      string            `json:"subject"`
+    Issuer       string            `json:"issuer"`
+    SerialNumber string            `json:"serial_number"`
+    ObservedAt   time.Time         `json:"observed_at"`
+}
+
+// expiring returns the leaves of the targets expiring before now plus within, soonest first.
+// Expired leaves are included, targets that weren't probed successfully yet are not.
+func (o *observedChains) expiring(targets []target, now time.Time, within time.Duration) []expiringCert {
+    report := []expiringCert{}
+    for _, t := range targets {
+        observed, ok := o.current(t.Domain)
+        if !ok {
+            continue
+        }
+        leaf, _, err := parseCertificate(observed.chain[0])
+        if err != nil || leaf.NotAfter.After(now.Add(within)) {
+            continue
+        }
+        report = append(report, expiringCert{
+            Target:       t.Domain,
+            Module:       t.Module,
+            Labels:       t.Labels,
+            NotAfter:     leaf.NotAfter.UTC(),
+            DaysLeft:     int(leaf.NotAfter.Sub(now).Hours() / 24),
+            Subject:      leaf.Subject.String(),
+            Issuer:       leaf.Issuer.String(),
+            SerialNumber: fmt.Sprintf("%x", leaf.SerialNumber),
+            ObservedAt:   observed.time.UTC(),
+        })
+    }
+    sort.SliceStable(report, func(i, j int) bool {
+        if !report[i].NotAfter.Equal(report[j].NotAfter) {
+            return report[i].NotAfter.Before(report[j].NotAfter)
+        }
+        return report[i].Target < report[j].Target
+    })
+    return report
+}
+
+// expiringHandler serves /api/v1/expiring, the report of the certificates expiring within the duration
+// of the within parameter, 30 days by default, as json, text or csv per the format parameter.
+// Days are counted from the time of certClock, so -simulate-now reports what expires after that date.
+func (o *observedChains) expiringHandler(targets func() []target) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            w.Header().Set("Allow", "GET")
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        within := defaultReportWithin
+        if s := r.URL.Query().Get("within"); s != "" {
+            var err error
+            if within, err = parseDays(s); err != nil || within < 0 {
+                http.Error(w, fmt.Sprintf("invalid within %q, expected a number of days like 30d or a duration like 720h", s), http.StatusBadRequest)
+                return
+            }
+        }
+        format := r.URL.Query().Get("format")
+        if format == "" {
+            format = reportJSON
+        }
+        report := o.expiring(targets(), certClock.Now(), within)
+        switch format {
+        case reportJSON:
+            writeJSON(w, http.StatusOK, report)
+        case reportText:
+            w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+            writeReportText(w, report)
+        case reportCSV:
+            w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+            writeReportCSV(w, report)
+        default:
+            http.Error(w, fmt.Sprintf("invalid format %q, expected json, text or csv", format), http.StatusBadRequest)
+        }
+    })
+}
+
+// writeReportText writes the report as aligned columns for reading in a terminal or pasting into an email
+func writeReportText(w io.Writer, report []expiringCert) error {
+    tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(tw, "EXPIRES\tDAYS\tTARGET\tSUBJECT\tISSUER")
+    for _, c := range report {
+        fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", c.NotAfter.Format(time.DateOnly), c.DaysLeft, c.Target, c.Subject, c.Issuer)
+    }
+    return tw.Flush()
+}
+
+// writeReportCSV writes the report as CSV with a header row, for spreadsheets
+func writeReportCSV(w io.Writer, report []expiringCert) error {
+    cw := csv.NewWriter(w)
+    cw.Write([]string{"target", "module", "not_after", "days_left", "subject", "issuer", "serial_number", "observed_at"})
+    for _, c := range report {
+        cw.Write(csvSafeRow([]string{
+            c.Target, c.Module, c.NotAfter.Format(time.RFC3339), strconv.Itoa(c.DaysLeft),
+            c.Subject, c.Issuer, c.SerialNumber, c.ObservedAt.Format(time.RFC3339),
+        }))
+    }
+    cw.Flush()
+    return cw.Error()
+}
+
+// report implements the report subcommand, which prints the expiry report of a running exporter,
+// covering the targets of all its sources. The API password is read from the SSL_EXPORTER_API_PASSWORD
+// environment variable.
+func report(args []string) int {
+    fs := flag.NewFlagSet("report", flag.ExitOnError)
+    var (
+        exporterURL = fs.String("url", "http://localhost:8837", "URL of the exporter to query.")
+        withinFlag  = fs.String("within", "30d", "Report the certificates expiring within this many days like 30d, or a duration like 720h.")
+        format      = fs.String("format", reportText, "Format of the report: text, json or csv.")
+        bearerToken = fs.String("bearer-token", "", "Bearer token of the exporter's API.")
+        username    = fs.String("username", "", "Username of the exporter's API.")
+        timeout     = fs.Duration("timeout", 30*time.Second, "Timeout of the request to the exporter.")
+    )
+    fs.Parse(args)
+
+    within, err := parseDays(*withinFlag)
+    if err != nil || within < 0 {
+        fmt.Fprintf(os.Stderr, "Invalid -within %q, expected a number of days like 30d or a duration like 720h\n", *withinFlag)
+        return 1
+    }
+    u, err := url.Parse(*exporterURL)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Invalid -url: %v\n", err)
+        return 1
+    }
+    u = u.JoinPath("/api/v1/expiring")
+    u.RawQuery = url.Values{"within": {within.String()}, "format": {*format}}.Encode()
+
+    req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to build request: %v\n", err)
+        return 1
+    }
+    if *bearerToken != "" {
+        req.Header.Set("Authorization", "Bearer "+*bearerToken)
+    } else if *username != "" {
+        req.SetBasicAuth(*username, os.Getenv("SSL_EXPORTER_API_PASSWORD"))
+    }
+    resp, err := (&http.Client{Timeout: *timeout}).Do(req)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to query the exporter: %v\n", err)
+        return 1
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        fmt.Fprintf(os.Stderr, "Exporter answered %s: %s", resp.Status, body)
+        return 1
+    }
+    if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to read the report: %v\n", err)
+        return 1
+    }
+    return 0
+}
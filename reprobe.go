@@ -0,0 +1,46 @@
+package main
+
+import (
+    "net/http"
+    "time"
+)
+
+// reprobeHandler serves POST /api/v1/reprobe?target=, which probes a configured target right away
+// and returns the result, so a fix can be confirmed without waiting for the next update
+func (e *exporter) reprobeHandler(targets func() []target) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            w.Header().Set("Allow", "POST")
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        domain := r.URL.Query().Get("target")
+        if domain == "" {
+            http.Error(w, "target parameter is missing", http.StatusBadRequest)
+            return
+        }
+        // Only configured targets can be probed, /probe covers arbitrary ones
+        var (
+            t     target
+            found bool
+        )
+        for _, candidate := range targets() {
+            if candidate.Domain == domain {
+                t, found = candidate, true
+                break
+            }
+        }
+        if !found {
+            http.Error(w, "unknown target", http.StatusNotFound)
+            return
+        }
+
+        res, err := e.probeTarget(t)
+        e.saveState()
+        if err != nil {
+            writeJSON(w, http.StatusBadGateway, failureEntry(err, time.Now()))
+            return
+        }
+        writeJSON(w, http.StatusOK, resultEntry(res, time.Now()))
+    })
+}
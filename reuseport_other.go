@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+    "errors"
+    "os"
+    "syscall"
+)
+
+// upgradeSignals is empty, hitless upgrades need SIGUSR2
+var upgradeSignals []os.Signal
+
+// reusePortControl fails, SO_REUSEPORT is not available on this platform
+func reusePortControl(network, address string, c syscall.RawConn) error {
+    return errors.New("SO_REUSEPORT is not supported on this platform")
+}
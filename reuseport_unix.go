@@ -0,0 +1,25 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+    "os"
+    "syscall"
+
+    "golang.org/x/sys/unix"
+)
+
+// upgradeSignals trigger a hitless upgrade to the binary currently on disk
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// reusePortControl sets SO_REUSEPORT, so a new process can bind the address while the old one still serves
+func reusePortControl(network, address string, c syscall.RawConn) error {
+    var sockErr error
+    err := c.Control(func(fd uintptr) {
+        sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+    })
+    if err != nil {
+        return err
+    }
+    return sockErr
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+    "bytes"
+    "crypto/x509"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// rotationNotifier posts an event to a webhook whenever the leaf certificate of a target changes,
+// so change management gets an audit record of every rotation
+type rotationNotifier struct {
+    url    string
+    client *http.Client
+
+    mu     sync.Mutex
+    leaves map[string]*x509.Certificate // last leaf seen per domain
+}
+
+// newRotationNotifier returns a notifier posting to url
+func newRotationNotifier(url string) *rotationNotifier {
+    return &rotationNotifier{
+        url:    url,
+        client: &http.Client{Timeout: 10 * time.Second},
+        leaves: make(map[string]*x509.Certificate),
+    }
+}
+
+// certDetails identifies a certificate in a rotation event
+type certDetails struct {
+    Fingerprint  string    `json:"fingerprint_sha256"`
+    Subject      string    `json:"subject"`
+    Issuer       string    `json:"issuer"`
+    SerialNumber string    `json:"serial_number"`
+    NotBefore    time.Time `json:"not_before"`
+    NotAfter     time.Time `json:"not_after"`
+    DNSNames     []string  `json:"dns_names,omitempty"`
+}
+
+// newCertDetails returns the details of cert
+func newCertDetails(cert *x509.Certificate) *certDetails {
+    return &certDetails{
+        Fingerprint:  fingerprint(cert),
+        Subject:      cert.Subject.String(),
+        Issuer:       cert.Issuer.String(),
+        SerialNumber: fmt.Sprintf("%x", cert.SerialNumber),
+        NotBefore:    cert.NotBefore,
+        NotAfter:     cert.NotAfter,
+        DNSNames:     cert.DNSNames,
+    }
+}
+
+// rotationEvent is the payload posted for a changed certificate
+type rotationEvent struct {
+    Domain string            `json:"domain"`
+    Labels map[string]string `json:"labels,omitempty"`
+    Time   time.Time         `json:"time"`
+    Old    *certDetails      `json:"old"`
+    New    *certDetails      `json:"new"`
+}
+
+// seen remembers the leaf of a domain without notifying, e.g. one restored from the state file
+func (r *rotationNotifier) seen(domain string, leaf *x509.Certificate) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.leaves[domain] = leaf
+}
+
+// check notifies if the leaf differs from the one seen last. The first leaf of a domain is only remembered.
+func (r *rotationNotifier) check(t target, leaf *x509.Certificate) {
+    r.mu.Lock()
+    previous := r.leaves[t.Domain]
+    r.leaves[t.Domain] = leaf
+    r.mu.Unlock()
+
+    if previous == nil || fingerprint(previous) == fingerprint(leaf) {
+        return
+    }
+    event := rotationEvent{
+        Domain: t.Domain,
+        Labels: t.Labels,
+        Time:   time.Now(),
+        Old:    newCertDetails(previous),
+        New:    newCertDetails(leaf),
+    }
+    if err := r.send(event); err != nil {
+        log.Printf("Error sending rotation webhook for domain %s: %v", t.Domain, err)
+        return
+    }
+    log.Printf("Sent rotation webhook for domain %s: %s -> %s", t.Domain, event.Old.Fingerprint, event.New.Fingerprint)
+}
+
+// send posts the event as JSON
+func (r *rotationNotifier) send(event rotationEvent) error {
+    body, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    resp, err := r.client.Post(r.url, "application/json", bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("unexpected status %s", resp.Status)
+    }
+    return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// threshold holds the warning and critical days for the series selected by matcher
+type threshold struct {
+    matcher      string
+    warnDays     int
+    criticalDays int
+}
+
+// thresholdFlags collects repeated -threshold flags of the form <matchers>:<warn days>:<critical days>
+type thresholdFlags []threshold
+
+func (t *thresholdFlags) String() string {
+    parts := make([]string, 0, len(*t))
+    for _, th := range *t {
+        parts = append(parts, fmt.Sprintf("%s:%d:%d", th.matcher, th.warnDays, th.criticalDays))
+    }
+    return strings.Join(parts, ",")
+}
+
+func (t *thresholdFlags) Set(value string) error {
+    fields := strings.Split(value, ":")
+    if len(fields) < 3 {
+        return fmt.Errorf("expected <matchers>:<warn days>:<critical days>, got %q", value)
+    }
+    n := len(fields)
+    warn, err := strconv.Atoi(fields[n-2])
+    if err != nil {
+        return fmt.Errorf("invalid warn days in %q: %v", value, err)
+    }
+    critical, err := strconv.Atoi(fields[n-1])
+    if err != nil {
+        return fmt.Errorf("invalid critical days in %q: %v", value, err)
+    }
+    matcher := strings.Join(fields[:n-2], ":")
+    if matcher == "" {
+        return fmt.Errorf("empty label matcher in %q", value)
+    }
+    *t = append(*t, threshold{matcher: matcher, warnDays: warn, criticalDays: critical})
+    return nil
+}
+
+// alertRule is a single Prometheus alerting rule
+type alertRule struct {
+    name     string
+    expr     string
+    forDur   string
+    severity string
+    summary  string
+}
+
+// genRules implements the gen-rules subcommand, writing alerting rules for the exporter's metrics to stdout
+func genRules(args []string) int {
+    fs := flag.NewFlagSet("gen-rules", flag.ExitOnError)
+    var (
+        warnDays     = fs.Int("warn-days", 30, "Default days before expiry for the warning alert.")
+        criticalDays = fs.Int("critical-days", 7, "Default days before expiry for the critical alert.")
+        group        = fs.String("group", "ssl_exporter", "Name of the rule group.")
+        forDur       = fs.String("for", "15m", "Duration an expiry condition must hold before the alert fires.")
+        crd          = fs.Bool("prometheus-rule", false, "Wrap the rules in a PrometheusRule resource for the Prometheus operator.")
+        crdName      = fs.String("name", "ssl-exporter", "Name of the PrometheusRule resource.")
+        maxChain     = fs.Int("max-chain-length", 4, "Number of certificates in a chain beyond which an alert fires, like duplicated certificates do.")
+        vantage      = fs.Bool("vantage-points", false, "Alert when instances at different -vantage-point locations see different certificates for a domain.")
+        certMetrics  = fs.String("cert-metrics", certMetricsDomain, "Layout of the certificate metrics, as set with -cert-metrics of the exporter. With fingerprint the expiry rules use "+metricCertNotAfter+", labeled with fingerprint and subject_cn instead of domain.")
+        thresholds   thresholdFlags
+    )
+    fs.Var(&thresholds, "threshold", "Per label thresholds as <matchers>:<warn days>:<critical days>, e.g. 'domain=~\".*\\.internal\"':14:3. Can be repeated.")
+    fs.Parse(args)
+    if err := checkCertMetricsLayout(*certMetrics); err != nil {
+        fmt.Fprintf(os.Stderr, "Invalid cert-metrics: %v\n", err)
+        return 2
+    }
+
+    rules := expiryRules(threshold{warnDays: *warnDays, criticalDays: *criticalDays}, thresholds, *forDur, *certMetrics)
+    rules = append(rules, alertRule{
+        name:     "SSLIntermediateCertificateStale",
+        expr:     metricChainExpiredIntermediate + " == 1",
+        forDur:   *forDur,
+        severity: "warning",
+        summary:  "{{ $labels.domain }} serves an expired or soon to expire intermediate certificate",
+    })
+    rules = append(rules, alertRule{
+        name:     "SSLMustStapleViolation",
+        expr:     metricMustStapleViolation + " == 1",
+        forDur:   *forDur,
+        severity: "critical",
+        summary:  "{{ $labels.domain }} serves a must-staple certificate without a valid OCSP staple, browsers refuse the connection",
+    })
+    rules = append(rules, alertRule{
+        name:     "SSLSecurityFinding",
+        expr:     metricSecurityFinding + " == 1",
+        forDur:   "0m",
+        severity: "warning",
+        summary:  "{{ $labels.domain }} runs an ancient TLS stack, security scan finding {{ $labels.finding }}",
+    })
+    rules = append(rules, alertRule{
+        name:     "SSLChainBloated",
+        expr:     fmt.Sprintf("%s > %d or %s > 0", metricChainLength, *maxChain, metricChainDuplicates),
+        forDur:   *forDur,
+        severity: "warning",
+        summary:  "{{ $labels.domain }} serves a chain with too many or duplicated certificates, slowing handshakes",
+    })
+    rules = append(rules, alertRule{
+        name:     "SSLMTASTSViolation",
+        expr:     metricMTASTSMXCompliant + " == 0",
+        forDur:   *forDur,
+        severity: "warning",
+        summary:  "MX {{ $labels.mx }} of {{ $labels.mail_domain }} doesn't satisfy the MTA-STS policy, enforcing senders don't deliver to it",
+    })
+    rules = append(rules, alertRule{
+        name:     "SSLDANEMismatch",
+        expr:     metricDANETLSAMatch + `{dnssec="true"} == 0`,
+        forDur:   *forDur,
+        severity: "critical",
+        summary:  "No TLSA record of MX {{ $labels.mx }} of {{ $labels.mail_domain }} matches its certificate, DANE senders don't deliver to it",
+    })
+    rules = append(rules, alertRule{
+        name:     "SSLCertificateAnomaly",
+        expr:     metricCertAnomaly + " == 1",
+        forDur:   "0m",
+        severity: "warning",
+        summary:  "{{ $labels.domain }} serves a certificate chain with anomaly {{ $labels.anomaly }}, review its issuance",
+    })
+    rules = append(rules, alertRule{
+        name:     "SSLScriptCheckFailed",
+        expr:     metricScriptCheck + " == 0",
+        forDur:   *forDur,
+        severity: "warning",
+        summary:  "{{ $labels.domain }} fails the check of its module script, the exporter log has the reason",
+    })
+    rules = append(rules, alertRule{
+        name:     "SSLCertParseError",
+        expr:     metricCertParseError + " == 1",
+        forDur:   *forDur,
+        severity: "warning",
+        summary:  "{{ $labels.domain }} serves a malformed certificate that parses only partially",
+    })
+    if *vantage {
+        // Rotations reach the vantage points at slightly different times, so the mismatch must last an hour
+        rules = append(rules, alertRule{
+            name:     "SSLCertificateVantagePointMismatch",
+            expr:     fmt.Sprintf("count by (domain) (count by (domain, fingerprint) (%s)) > 1", metricCertLeafFingerprint),
+            forDur:   "1h",
+            severity: "warning",
+            summary:  "Vantage points see {{ $value }} different certificates for {{ $labels.domain }}, check regional load balancers or interception",
+        })
+    }
+
+    if err := writeRules(os.Stdout, *group, rules, *crd, *crdName); err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to write rules: %v\n", err)
+        return 1
+    }
+    return 0
+}
+
+// expiryRules builds warning and critical rules for the defaults and every override.
+// The default rules exclude series selected by an override so no certificate alerts twice.
+// The expiry series are those the layout of the certificate metrics exports.
+func expiryRules(defaults threshold, overrides []threshold, forDur, layout string) []alertRule {
+    metric, subject := metricCertExpiry, "{{ $labels.domain }}"
+    if layout == certMetricsFingerprint {
+        metric, subject = metricCertNotAfter, "{{ $labels.subject_cn }} ({{ $labels.fingerprint }})"
+    }
+    var rules []alertRule
+    add := func(suffix, selector, unless string, th threshold) {
+        for _, level := range []struct {
+            name     string
+            severity string
+            days     int
+        }{{"Warning", "warning", th.warnDays}, {"Critical", "critical", th.criticalDays}} {
+            rules = append(rules, alertRule{
+                name:     "SSLCertificateExpiry" + level.name + suffix,
+                expr:     fmt.Sprintf("(%s%s - time()) / 86400 < %d%s", metric, selector, level.days, unless),
+                forDur:   forDur,
+                severity: level.severity,
+                summary:  "SSL certificate for " + subject + " expires in {{ $value | humanize }} days",
+            })
+        }
+    }
+
+    var unless strings.Builder
+    for i, th := range overrides {
+        selector := "{" + th.matcher + "}"
+        add(strconv.Itoa(i+1), selector, "", th)
+        fmt.Fprintf(&unless, " unless %s%s", metric, selector)
+    }
+    add("", "", unless.String(), defaults)
+    return rules
+}
+
+// writeRules renders the rules as a Prometheus rule file or PrometheusRule resource.
+// Strings are written as JSON literals, which are valid YAML double quoted scalars.
+func writeRules(w io.Writer, group string, rules []alertRule, crd bool, name string) error {
+    q := func(s string) string {
+        var b strings.Builder
+        enc := json.NewEncoder(&b)
+        enc.SetEscapeHTML(false)
+        enc.Encode(s)
+        return strings.TrimSuffix(b.String(), "\n")
+    }
+    indent := ""
+    if crd {
+        fmt.Fprintf(w, "apiVersion: monitoring.coreos.com/v1\nkind: PrometheusRule\nmetadata:\n  name: %s\nspec:\n", q(name))
+        indent = "  "
+    }
+    fmt.Fprintf(w, "%sgroups:\n%s- name: %s\n%s  rules:\n", indent, indent, q(group), indent)
+    for _, r := range rules {
+        p := indent + "  "
+        fmt.Fprintf(w, "%s- alert: %s\n", p, r.name)
+        fmt.Fprintf(w, "%s  expr: %s\n", p, q(r.expr))
+        fmt.Fprintf(w, "%s  for: %s\n", p, r.forDur)
+        fmt.Fprintf(w, "%s  labels:\n%s    severity: %s\n", p, p, r.severity)
+        if _, err := fmt.Fprintf(w, "%s  annotations:\n%s    summary: %s\n", p, p, q(r.summary)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestExpiryRulesLayout(t *testing.T) {
+    for _, tc := range []struct {
+        layout string
+        metric string
+    }{
+        {certMetricsDomain, metricCertExpiry},
+        {certMetricsBoth, metricCertExpiry},
+        {certMetricsFingerprint, metricCertNotAfter},
+    } {
+        t.Run(tc.layout, func(t *testing.T) {
+            rules := expiryRules(threshold{warnDays: 30, criticalDays: 7}, []threshold{{matcher: `env="dev"`, warnDays: 7, criticalDays: 1}}, "15m", tc.layout)
+            if len(rules) != 4 {
+                t.Fatalf("got %d rules, want 4", len(rules))
+            }
+            for _, r := range rules {
+                if !strings.HasPrefix(r.expr, "("+tc.metric) {
+                    t.Errorf("%s: got expression %s, want one on %s", r.name, r.expr, tc.metric)
+                }
+            }
+            if want := " unless " + tc.metric + `{env="dev"}`; !strings.HasSuffix(rules[3].expr, want) {
+                t.Errorf("got default expression %s, want it to end in %s", rules[3].expr, want)
+            }
+        })
+    }
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/netip"
+    "time"
+)
+
+// Findings of the security scan, weaknesses of ancient TLS stacks that Go's TLS client can't negotiate
+const (
+    // findingHeartbeat is the heartbeat extension of RFC 6520, whose implementation in OpenSSL before 1.0.1g
+    // leaked memory (Heartbleed). Only the advertisement is checked, no heartbeat is sent.
+    findingHeartbeat = "heartbeat"
+    // findingCompression is TLS level compression, which leaks secrets through the length of records (CRIME)
+    findingCompression = "compression"
+    // findingExportCiphers are the 40 and 56 bit export cipher suites (FREAK, Logjam)
+    findingExportCiphers = "export_ciphers"
+)
+
+// scanCipherSuites are offered to find out whether the server advertises heartbeats and accepts compression.
+// Besides the usual ECDHE and RSA suites they include the CBC suites appliances of that age speak.
+var scanCipherSuites = []uint16{
+    0xc02f, 0xc030, 0xc02b, 0xc02c, 0xc013, 0xc014, 0xc009, 0xc00a,
+    0x009c, 0x009d, 0x002f, 0x0035, 0x0033, 0x0039, 0x000a,
+}
+
+// exportCipherSuites are the export suites of SSL 3.0 and TLS 1.0, including the 1024 bit ones of the 1999 draft
+var exportCipherSuites = []uint16{
+    0x0003, 0x0006, 0x0008, 0x000b, 0x000e, 0x0011, 0x0014, 0x0017, 0x0019, 0x0062, 0x0063, 0x0064, 0x0065,
+}
+
+// TLS constants of the hand made handshakes
+const (
+    recordHandshake       = 22
+    recordAlert           = 21
+    handshakeClientHello  = 1
+    handshakeServerHello  = 2
+    extServerName         = 0
+    extSupportedGroups    = 10
+    extECPointFormats     = 11
+    extSignatureAlgs      = 13
+    extHeartbeat          = 15
+    extRenegotiationInfo  = 0xff01
+    compressionDeflate    = 1
+    compressionNull       = 0
+    heartbeatPeerAllowed  = 1
+    maxServerHelloRecords = 8
+)
+
+// errHelloRejected means the server answered the ClientHello with an alert or by closing the connection
+var errHelloRejected = errors.New("ClientHello rejected")
+
+// serverHello holds what the server selected from a ClientHello
+type serverHello struct {
+    cipherSuite uint16
+    compression uint8
+    extensions  map[uint16]bool
+}
+
+// scan runs the security scan against the address the probe connected to, or through the proxy. The checks are
+// safe: each one sends a single ClientHello and closes the connection after the ServerHello. Nil if the server
+// couldn't be reached.
+func (m *module) scan(dialer *net.Dialer, host, port string, addr netip.Addr, proxy *proxyRule) map[string]bool {
+    findings := map[string]bool{findingHeartbeat: false, findingCompression: false, findingExportCiphers: false}
+
+    hello, err := m.sendHello(dialer, host, port, addr, proxy, clientHello(0x0303, host, scanCipherSuites, true))
+    switch {
+    case err == nil:
+        findings[findingHeartbeat] = hello.extensions[extHeartbeat]
+        findings[findingCompression] = hello.compression == compressionDeflate
+    case !errors.Is(err, errHelloRejected):
+        log.Printf("Error scanning %s: %v", net.JoinHostPort(host, port), err)
+        return nil
+    }
+
+    // TLS 1.1 forbids negotiating export suites, so they are offered with TLS 1.0
+    hello, err = m.sendHello(dialer, host, port, addr, proxy, clientHello(0x0301, host, exportCipherSuites, false))
+    switch {
+    case err == nil:
+        for _, suite := range exportCipherSuites {
+            if hello.cipherSuite == suite {
+                findings[findingExportCiphers] = true
+            }
+        }
+    case !errors.Is(err, errHelloRejected):
+        log.Printf("Error scanning %s: %v", net.JoinHostPort(host, port), err)
+        return nil
+    }
+    return findings
+}
+
+// sendHello sends a ClientHello on a new connection and reads the ServerHello
+func (m *module) sendHello(dialer *net.Dialer, host, port string, addr netip.Addr, proxy *proxyRule, hello []byte) (*serverHello, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+    defer cancel()
+    var (
+        conn net.Conn
+        err  error
+    )
+    if proxy != nil {
+        conn, err = dialProxy(ctx, probeDialing.proxyDialer(dialer), proxy, net.JoinHostPort(host, port))
+    } else {
+        conn, err = dialAny(ctx, dialer, []netip.Addr{addr}, port)
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(m.Timeout))
+    if _, err := conn.Write(hello); err != nil {
+        return nil, err
+    }
+    return readServerHello(conn)
+}
+
+// clientHello builds a ClientHello record offering the cipher suites, with deflate compression and the
+// heartbeat extension if heartbeat is set
+func clientHello(version uint16, serverName string, suites []uint16, heartbeat bool) []byte {
+    var ext []byte
+    addExt := func(typ uint16, data []byte) {
+        ext = binary.BigEndian.AppendUint16(ext, typ)
+        ext = binary.BigEndian.AppendUint16(ext, uint16(len(data)))
+        ext = append(ext, data...)
+    }
+    if _, err := netip.ParseAddr(serverName); err != nil && serverName != "" {
+        name := []byte{0}
+        name = binary.BigEndian.AppendUint16(name, uint16(len(serverName)))
+        name = append(name, serverName...)
+        addExt(extServerName, append(binary.BigEndian.AppendUint16(nil, uint16(len(name))), name...))
+    }
+    addExt(extSupportedGroups, []byte{0, 8, 0, 29, 0, 23, 0, 24, 0, 25})
+    addExt(extECPointFormats, []byte{1, 0})
+    if version >= 0x0303 {
+        addExt(extSignatureAlgs, []byte{0, 16, 4, 1, 5, 1, 6, 1, 4, 3, 5, 3, 8, 4, 2, 1, 2, 3})
+    }
+    addExt(extRenegotiationInfo, []byte{0})
+    compression := []byte{compressionNull}
+    if heartbeat {
+        addExt(extHeartbeat, []byte{heartbeatPeerAllowed})
+        compression = []byte{compressionDeflate, compressionNull}
+    }
+
+    body := binary.BigEndian.AppendUint16(nil, version)
+    body = append(body, make([]byte, 32)...) // random, the connection never gets to use it
+    body = append(body, 0)                   // no session ID
+    body = binary.BigEndian.AppendUint16(body, uint16(2*len(suites)))
+    for _, s := range suites {
+        body = binary.BigEndian.AppendUint16(body, s)
+    }
+    body = append(body, byte(len(compression)))
+    body = append(body, compression...)
+    body = binary.BigEndian.AppendUint16(body, uint16(len(ext)))
+    body = append(body, ext...)
+
+    msg := []byte{handshakeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+    msg = append(msg, body...)
+    record := []byte{recordHandshake, 3, 1}
+    record = binary.BigEndian.AppendUint16(record, uint16(len(msg)))
+    return append(record, msg...)
+}
+
+// readServerHello reads records up to the ServerHello and parses it
+func readServerHello(conn net.Conn) (*serverHello, error) {
+    var msg []byte
+    for i := 0; i < maxServerHelloRecords; i++ {
+        header := make([]byte, 5)
+        if _, err := io.ReadFull(conn, header); err != nil {
+            // Ancient stacks drop the connection instead of sending an alert
+            return nil, errHelloRejected
+        }
+        payload := make([]byte, binary.BigEndian.Uint16(header[3:]))
+        if _, err := io.ReadFull(conn, payload); err != nil {
+            return nil, errHelloRejected
+        }
+        switch header[0] {
+        case recordAlert:
+            return nil, errHelloRejected
+        case recordHandshake:
+            msg = append(msg, payload...)
+        default:
+            return nil, fmt.Errorf("unexpected record type %d", header[0])
+        }
+        if len(msg) < 4 {
+            continue
+        }
+        if msg[0] != handshakeServerHello {
+            return nil, fmt.Errorf("unexpected handshake message %d", msg[0])
+        }
+        length := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+        if len(msg) >= 4+length {
+            return parseServerHello(msg[4 : 4+length])
+        }
+    }
+    return nil, fmt.Errorf("no ServerHello")
+}
+
+// parseServerHello parses the body of a ServerHello message
+func parseServerHello(body []byte) (*serverHello, error) {
+    malformed := errors.New("malformed ServerHello")
+    // version and random
+    if len(body) < 35 {
+        return nil, malformed
+    }
+    body = body[34:]
+    sessionLen := int(body[0])
+    if len(body) < 1+sessionLen+3 {
+        return nil, malformed
+    }
+    body = body[1+sessionLen:]
+    hello := &serverHello{
+        cipherSuite: binary.BigEndian.Uint16(body),
+        compression: body[2],
+        extensions:  make(map[uint16]bool),
+    }
+    body = body[3:]
+    // Extensions are optional
+    if len(body) < 2 {
+        return hello, nil
+    }
+    body = body[2:]
+    for len(body) >= 4 {
+        typ, length := binary.BigEndian.Uint16(body), int(binary.BigEndian.Uint16(body[2:]))
+        if len(body) < 4+length {
+            return nil, malformed
+        }
+        hello.extensions[typ] = true
+        body = body[4+length:]
+    }
+    return hello, nil
+}
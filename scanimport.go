@@ -0,0 +1,220 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "regexp"
+    "slices"
+    "strconv"
+    "strings"
+)
+
+// Formats of scan result files
+const (
+    scanFormatNmap    = "nmap"
+    scanFormatMasscan = "masscan"
+)
+
+// scanResultFile imports the open ports of a port scan as targets, so the periodic scans of a security team
+// feed into monitoring. The file is read again on every reload.
+type scanResultFile struct {
+    Path string `yaml:"path"`
+    // Format is nmap for XML output of -oX or masscan for JSON output of -oJ, by default derived
+    // from the extension of the file
+    Format string `yaml:"format"`
+    // Ports restricts the import to these ports. Without, nmap results contribute the ports whose service
+    // detection found TLS and masscan results, which know nothing about services, all open ports.
+    Ports  []int             `yaml:"ports"`
+    Module string            `yaml:"module"`
+    Labels map[string]string `yaml:"labels"` // added to every target
+}
+
+// validate checks the file's settings and fills in the format
+func (f *scanResultFile) validate() error {
+    if f.Path == "" {
+        return fmt.Errorf("path is required")
+    }
+    if f.Format == "" {
+        switch strings.ToLower(filepath.Ext(f.Path)) {
+        case ".xml":
+            f.Format = scanFormatNmap
+        case ".json":
+            f.Format = scanFormatMasscan
+        }
+    }
+    if f.Format != scanFormatNmap && f.Format != scanFormatMasscan {
+        return fmt.Errorf("format must be nmap or masscan")
+    }
+    for _, port := range f.Ports {
+        if port < 1 || port > 65535 {
+            return fmt.Errorf("invalid port %d", port)
+        }
+    }
+    return nil
+}
+
+// scannedPort is an open TCP port of a scan result
+type scannedPort struct {
+    ip   string
+    name string // scanned host name, if the scan targeted one
+    ptr  string // reverse DNS name
+    port int
+    tls  bool // service detection found TLS
+}
+
+// readScanResults reads the targets of a scan result file. Targets are named after the scanned host name
+// if there is one, so the certificate is verified against it, and labeled with the address and reverse DNS name.
+func readScanResults(f scanResultFile) ([]target, error) {
+    data, err := os.ReadFile(f.Path)
+    if err != nil {
+        return nil, err
+    }
+    var ports []scannedPort
+    switch f.Format {
+    case scanFormatNmap:
+        ports, err = parseNmapXML(data)
+    case scanFormatMasscan:
+        ports, err = parseMasscanJSON(data)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", f.Path, err)
+    }
+
+    seen := make(map[string]bool)
+    var targets []target
+    for _, p := range ports {
+        if len(f.Ports) > 0 && !slices.Contains(f.Ports, p.port) || len(f.Ports) == 0 && f.Format == scanFormatNmap && !p.tls {
+            continue
+        }
+        host := p.name
+        if host == "" {
+            host = p.ip
+        }
+        domain := net.JoinHostPort(host, strconv.Itoa(p.port))
+        if seen[domain] {
+            continue
+        }
+        seen[domain] = true
+        t := target{Domain: domain, Module: f.Module, Labels: make(map[string]string, len(f.Labels)+2)}
+        for k, v := range f.Labels {
+            t.Labels[k] = v
+        }
+        t.Labels["ip"] = p.ip
+        if p.ptr != "" {
+            t.Labels["reverse_dns"] = p.ptr
+        }
+        targets = append(targets, t)
+    }
+    return targets, nil
+}
+
+// nmapRun is the part of nmap's XML output the import needs
+type nmapRun struct {
+    Hosts []struct {
+        Status struct {
+            State string `xml:"state,attr"`
+        } `xml:"status"`
+        Addresses []struct {
+            Addr     string `xml:"addr,attr"`
+            AddrType string `xml:"addrtype,attr"`
+        } `xml:"address"`
+        Hostnames []struct {
+            Name string `xml:"name,attr"`
+            Type string `xml:"type,attr"`
+        } `xml:"hostnames>hostname"`
+        Ports []struct {
+            Protocol string `xml:"protocol,attr"`
+            PortID   int    `xml:"portid,attr"`
+            State    struct {
+                State string `xml:"state,attr"`
+            } `xml:"state"`
+            Service struct {
+                Name   string `xml:"name,attr"`
+                Tunnel string `xml:"tunnel,attr"`
+            } `xml:"service"`
+        } `xml:"ports>port"`
+    } `xml:"host"`
+}
+
+// nmapTLSServices are the names nmap gives TLS services by port, without version detection
+var nmapTLSServices = map[string]bool{
+    "https": true, "imaps": true, "pop3s": true, "smtps": true, "submissions": true,
+    "ftps": true, "ircs": true, "nntps": true, "xmpps": true,
+}
+
+// parseNmapXML returns the open TCP ports of the hosts that are up
+func parseNmapXML(data []byte) ([]scannedPort, error) {
+    var run nmapRun
+    if err := xml.Unmarshal(data, &run); err != nil {
+        return nil, err
+    }
+    var ports []scannedPort
+    for _, h := range run.Hosts {
+        if h.Status.State != "" && h.Status.State != "up" {
+            continue
+        }
+        var p scannedPort
+        for _, a := range h.Addresses {
+            if a.AddrType == "ipv4" || a.AddrType == "ipv6" {
+                p.ip = a.Addr
+                break
+            }
+        }
+        if p.ip == "" {
+            continue
+        }
+        for _, n := range h.Hostnames {
+            switch n.Type {
+            case "user":
+                p.name = n.Name
+            case "PTR":
+                p.ptr = n.Name
+            }
+        }
+        for _, port := range h.Ports {
+            if port.Protocol != "tcp" || port.State.State != "open" {
+                continue
+            }
+            p.port = port.PortID
+            p.tls = port.Service.Tunnel == "ssl" || nmapTLSServices[port.Service.Name] || strings.Contains(port.Service.Name, "ssl")
+            ports = append(ports, p)
+        }
+    }
+    return ports, nil
+}
+
+// masscanTrailingComma matches the comma older masscan versions leave after the last record
+var masscanTrailingComma = regexp.MustCompile(`,\s*\]\s*$`)
+
+// masscanRecord is a record of masscan's JSON output
+type masscanRecord struct {
+    IP    string `json:"ip"`
+    Ports []struct {
+        Port   int    `json:"port"`
+        Proto  string `json:"proto"`
+        Status string `json:"status"`
+    } `json:"ports"`
+}
+
+// parseMasscanJSON returns the open TCP ports of masscan's JSON output
+func parseMasscanJSON(data []byte) ([]scannedPort, error) {
+    var records []masscanRecord
+    if err := json.Unmarshal(masscanTrailingComma.ReplaceAll(bytes.TrimSpace(data), []byte("]")), &records); err != nil {
+        return nil, err
+    }
+    var ports []scannedPort
+    for _, r := range records {
+        for _, port := range r.Ports {
+            if port.Proto != "tcp" || port.Status != "open" {
+                continue
+            }
+            ports = append(ports, scannedPort{ip: r.IP, port: port.Port})
+        }
+    }
+    return ports, nil
+}
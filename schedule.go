@@ -0,0 +1,136 @@
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+// probeInterval is how often the configured targets are probed
+const probeInterval = 6 * time.Hour
+
+// scheduler decides which targets are due. Certificates expiring within urgentWindow are probed every
+// urgentInterval, so a last minute renewal shows up quickly while the others keep the normal interval.
+// Targets failing hard quarantineAfter times in a row are quarantined: they are probed every
+// quarantineInterval until a probe succeeds, so domains rotting in the configuration don't slow down runs.
+type scheduler struct {
+    urgentInterval     time.Duration // disabled if 0
+    urgentWindow       time.Duration
+    quarantineAfter    int // disabled if 0
+    quarantineInterval time.Duration
+
+    mu           sync.Mutex
+    expiry       map[string]time.Time // expiry of the last certificate seen per domain
+    lastRun      map[string]time.Time
+    hardFailures map[string]int // consecutive hard failures per domain
+    shortest     time.Duration  // shortest interval of the targets passed to due
+}
+
+// newScheduler returns a scheduler probing certificates expiring within window at the given interval
+func newScheduler(urgentInterval, urgentWindow time.Duration) *scheduler {
+    return &scheduler{
+        urgentInterval: urgentInterval,
+        urgentWindow:   urgentWindow,
+        expiry:         make(map[string]time.Time),
+        lastRun:        make(map[string]time.Time),
+        hardFailures:   make(map[string]int),
+    }
+}
+
+// tick is the time to wait between two checks for due targets
+func (s *scheduler) tick() time.Duration {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.tickLocked()
+}
+
+// tickLocked is tick with mu held
+func (s *scheduler) tickLocked() time.Duration {
+    tick := probeInterval
+    if s.shortest > 0 && s.shortest < tick {
+        tick = s.shortest
+    }
+    if s.urgentInterval > 0 && s.urgentInterval < tick {
+        tick = s.urgentInterval
+    }
+    return tick
+}
+
+// interval returns how often a target is probed. It must be called with mu held.
+func (s *scheduler) interval(t target, now time.Time) time.Duration {
+    interval := probeInterval
+    if t.Interval > 0 {
+        interval = t.Interval
+    }
+    if s.quarantinedLocked(t.Domain) {
+        return max(interval, s.quarantineInterval)
+    }
+    expiry, ok := s.expiry[t.Domain]
+    if ok && s.urgentInterval > 0 && s.urgentInterval < interval && expiry.Before(now.Add(s.urgentWindow)) {
+        return s.urgentInterval
+    }
+    return interval
+}
+
+// due returns the targets whose interval has passed since their last probe, targets never probed included
+func (s *scheduler) due(targets []target, now time.Time) []target {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.shortest = 0
+    for _, t := range targets {
+        if t.Interval > 0 && (s.shortest == 0 || t.Interval < s.shortest) {
+            s.shortest = t.Interval
+        }
+    }
+    tick := s.tickLocked()
+
+    var due []target
+    for _, t := range targets {
+        last, ok := s.lastRun[t.Domain]
+        // Allow for the time the previous run took, so a target isn't pushed back by a full tick
+        if !ok || now.Sub(last) >= s.interval(t, now)-tick/2 {
+            due = append(due, t)
+        }
+    }
+    return due
+}
+
+// probed records that a domain is being probed
+func (s *scheduler) probed(domain string, now time.Time) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.lastRun[domain] = now
+}
+
+// observe records the expiry of the certificate a domain presented and releases the domain from quarantine.
+// Failed probes keep the last known expiry.
+func (s *scheduler) observe(domain string, expiry time.Time) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.expiry[domain] = expiry
+    if s.quarantinedLocked(domain) {
+        log.Printf("Releasing domain %s from quarantine, it was probed successfully", domain)
+    }
+    delete(s.hardFailures, domain)
+}
+
+// failed counts the consecutive hard failures of a domain, other failures reset the count.
+// It reports whether the domain is quarantined.
+func (s *scheduler) failed(domain string, hard bool) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if !hard {
+        delete(s.hardFailures, domain)
+        return false
+    }
+    s.hardFailures[domain]++
+    if s.quarantineAfter > 0 && s.hardFailures[domain] == s.quarantineAfter {
+        log.Printf("Quarantining domain %s after %d hard failures in a row, probing it every %s", domain, s.quarantineAfter, s.quarantineInterval)
+    }
+    return s.quarantinedLocked(domain)
+}
+
+// quarantinedLocked reports whether a domain is quarantined. It must be called with mu held.
+func (s *scheduler) quarantinedLocked(domain string) bool {
+    return s.quarantineAfter > 0 && s.hardFailures[domain] >= s.quarantineAfter
+}
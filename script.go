@@ -0,0 +1,218 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net"
+
+    "go.starlark.net/starlark"
+    "go.starlark.net/starlarkstruct"
+    "go.starlark.net/syntax"
+)
+
+// Functions a module script can define
+const (
+    scriptBeforeHandshake = "before_handshake"
+    scriptCheck           = "check"
+)
+
+// Limits of module scripts, so a script can't stall probes
+const (
+    scriptMaxSteps   = 1 << 20
+    scriptMaxReadLen = 64 << 10
+)
+
+// moduleScript is the Starlark script of a module, covering devices with quirks that don't warrant a prober.
+// before_handshake(conn) runs on the connection before the TLS handshake, e.g. to send the magic bytes
+// a device expects first: conn.send(data), conn.recv(n), conn.read_until(delim) and conn.expect(prefix)
+// exchange bytes, failing the probe on errors. check(chain) runs after the probe with the certificates,
+// leaf first, and fails the check by returning False or a string with the reason.
+type moduleScript struct {
+    before *starlark.Function
+    check  *starlark.Function
+}
+
+// loadModuleScript runs the top level of a script and looks up its functions
+func loadModuleScript(src string) (*moduleScript, error) {
+    thread := &starlark.Thread{Name: "module script"}
+    thread.SetMaxExecutionSteps(scriptMaxSteps)
+    globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, "script", src, nil)
+    if err != nil {
+        return nil, err
+    }
+    s := &moduleScript{}
+    for name, fn := range map[string]**starlark.Function{scriptBeforeHandshake: &s.before, scriptCheck: &s.check} {
+        v, ok := globals[name]
+        if !ok {
+            continue
+        }
+        if *fn, ok = v.(*starlark.Function); !ok {
+            return nil, fmt.Errorf("%s must be a function", name)
+        }
+    }
+    if s.before == nil && s.check == nil {
+        return nil, fmt.Errorf("script defines neither %s nor %s", scriptBeforeHandshake, scriptCheck)
+    }
+    return s, nil
+}
+
+// call runs a function of the script on a thread that is cancelled with ctx
+func (s *moduleScript) call(ctx context.Context, fn *starlark.Function, args ...starlark.Value) (starlark.Value, error) {
+    thread := &starlark.Thread{Name: fn.Name()}
+    thread.SetMaxExecutionSteps(scriptMaxSteps)
+    stop := context.AfterFunc(ctx, func() { thread.Cancel(ctx.Err().Error()) })
+    defer stop()
+    return starlark.Call(thread, fn, args, nil)
+}
+
+// beforeHandshake runs before_handshake on the connection, if the script defines it
+func (s *moduleScript) beforeHandshake(ctx context.Context, conn net.Conn) error {
+    if s == nil || s.before == nil {
+        return nil
+    }
+    _, err := s.call(ctx, s.before, scriptConn(conn))
+    return err
+}
+
+// passes runs check on the chain and returns the reason it failed, empty if it passed
+func (s *moduleScript) passes(ctx context.Context, chain []*x509.Certificate) (string, error) {
+    certs := make([]starlark.Value, len(chain))
+    for i, cert := range chain {
+        certs[i] = scriptCert(cert)
+    }
+    v, err := s.call(ctx, s.check, starlark.NewList(certs))
+    if err != nil {
+        return "", err
+    }
+    switch v := v.(type) {
+    case starlark.NoneType:
+        return "", nil
+    case starlark.Bool:
+        if !v {
+            return "check returned False", nil
+        }
+        return "", nil
+    case starlark.String:
+        return string(v), nil
+    }
+    return "", fmt.Errorf("check returned a %s, expected None, a bool or a string", v.Type())
+}
+
+// scriptConn exposes a connection to before_handshake. Reads never go beyond what the script asks for,
+// so the TLS handshake starts with the first byte the script left unread.
+func scriptConn(conn net.Conn) *starlarkstruct.Struct {
+    data := func(v starlark.Value) ([]byte, error) {
+        switch v := v.(type) {
+        case starlark.Bytes:
+            return []byte(v), nil
+        case starlark.String:
+            return []byte(v), nil
+        }
+        return nil, fmt.Errorf("got %s, want bytes or string", v.Type())
+    }
+    return starlarkstruct.FromStringDict(starlark.String("conn"), starlark.StringDict{
+        "send": starlark.NewBuiltin("send", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+            var v starlark.Value
+            if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &v); err != nil {
+                return nil, err
+            }
+            p, err := data(v)
+            if err != nil {
+                return nil, fmt.Errorf("%s: %v", b.Name(), err)
+            }
+            _, err = conn.Write(p)
+            return starlark.None, err
+        }),
+        "recv": starlark.NewBuiltin("recv", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+            var n int
+            if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &n); err != nil {
+                return nil, err
+            }
+            if n < 1 || n > scriptMaxReadLen {
+                return nil, fmt.Errorf("%s: n must be between 1 and %d", b.Name(), scriptMaxReadLen)
+            }
+            p := make([]byte, n)
+            n, err := conn.Read(p)
+            if err != nil {
+                return nil, err
+            }
+            return starlark.Bytes(p[:n]), nil
+        }),
+        "read_until": starlark.NewBuiltin("read_until", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+            var v starlark.Value
+            if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &v); err != nil {
+                return nil, err
+            }
+            delim, err := data(v)
+            if err != nil || len(delim) == 0 {
+                return nil, fmt.Errorf("%s: delimiter must be non-empty bytes or string", b.Name())
+            }
+            var read []byte
+            p := make([]byte, 1)
+            for !bytes.HasSuffix(read, delim) {
+                if len(read) == scriptMaxReadLen {
+                    return nil, fmt.Errorf("%s: no delimiter in %d bytes", b.Name(), scriptMaxReadLen)
+                }
+                if _, err := io.ReadFull(conn, p); err != nil {
+                    return nil, err
+                }
+                read = append(read, p[0])
+            }
+            return starlark.Bytes(read), nil
+        }),
+        "expect": starlark.NewBuiltin("expect", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+            var v starlark.Value
+            if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &v); err != nil {
+                return nil, err
+            }
+            want, err := data(v)
+            if err != nil || len(want) > scriptMaxReadLen {
+                return nil, fmt.Errorf("%s: expected at most %d bytes or characters", b.Name(), scriptMaxReadLen)
+            }
+            got := make([]byte, len(want))
+            if _, err := io.ReadFull(conn, got); err != nil {
+                return nil, err
+            }
+            if !bytes.Equal(got, want) {
+                return nil, fmt.Errorf("%s: got %q, want %q", b.Name(), got, want)
+            }
+            return starlark.None, nil
+        }),
+    })
+}
+
+// scriptCert exposes the fields of a certificate to check
+func scriptCert(cert *x509.Certificate) *starlarkstruct.Struct {
+    strings := func(s []string) *starlark.List {
+        values := make([]starlark.Value, len(s))
+        for i, v := range s {
+            values[i] = starlark.String(v)
+        }
+        return starlark.NewList(values)
+    }
+    ips := make([]string, len(cert.IPAddresses))
+    for i, ip := range cert.IPAddresses {
+        ips[i] = ip.String()
+    }
+    fingerprint := sha256.Sum256(cert.Raw)
+    return starlarkstruct.FromStringDict(starlark.String("cert"), starlark.StringDict{
+        "subject":              starlark.String(cert.Subject.String()),
+        "issuer":               starlark.String(cert.Issuer.String()),
+        "common_name":          starlark.String(cert.Subject.CommonName),
+        "dns_names":            strings(cert.DNSNames),
+        "ip_addresses":         strings(ips),
+        "email_addresses":      strings(cert.EmailAddresses),
+        "serial":               starlark.String(cert.SerialNumber.Text(16)),
+        "not_before":           starlark.MakeInt64(cert.NotBefore.Unix()),
+        "not_after":            starlark.MakeInt64(cert.NotAfter.Unix()),
+        "signature_algorithm":  starlark.String(cert.SignatureAlgorithm.String()),
+        "public_key_algorithm": starlark.String(cert.PublicKeyAlgorithm.String()),
+        "sha256":               starlark.String(hex.EncodeToString(fingerprint[:])),
+        "is_ca":                starlark.Bool(cert.IsCA),
+    })
+}
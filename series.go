@@ -0,0 +1,121 @@
+package main
+
+import (
+    "slices"
+    "sync"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// seriesStore holds the values of the certificate metrics grouped by domain and streams them as const
+// metrics when collected. A GaugeVec keeps a child with its own label pairs per series, which adds up to
+// gigabytes for fleets of 100k targets, while a sample here is a label value slice and a float.
+type seriesStore struct {
+    domainLabel bool
+    families    []*gaugeFamily
+
+    mu      sync.RWMutex
+    domains map[string][]storedSample
+}
+
+// storedSample is the value of one series, labeled with the values of its family's labels after the domain
+type storedSample struct {
+    family int
+    labels []string
+    value  float64
+}
+
+// gaugeFamily is a gauge metric whose series live in a seriesStore
+type gaugeFamily struct {
+    store *seriesStore
+    id    int
+    desc  *prometheus.Desc
+}
+
+// newSeriesStore returns an empty store whose series are labeled with the domain if domainLabel is set.
+// Without the label it only keeps the series of the last domain set.
+func newSeriesStore(domainLabel bool) *seriesStore {
+    return &seriesStore{
+        domainLabel: domainLabel,
+        domains:     make(map[string][]storedSample),
+    }
+}
+
+// gauge adds a family with the given labels, after the domain label if the store has it
+func (s *seriesStore) gauge(name, help string, labels ...string) *gaugeFamily {
+    if s.domainLabel {
+        labels = append([]string{"domain"}, labels...)
+    }
+    f := &gaugeFamily{store: s, id: len(s.families), desc: prometheus.NewDesc(name, help, labels, nil)}
+    s.families = append(s.families, f)
+    return f
+}
+
+// set sets the series of domain with the label values, given in the order of the family's labels
+func (f *gaugeFamily) set(domain string, value float64, labelValues ...string) {
+    s := f.store
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if !s.domainLabel {
+        for d := range s.domains {
+            if d != domain {
+                delete(s.domains, d)
+            }
+        }
+    }
+    samples := s.domains[domain]
+    for i := range samples {
+        if samples[i].family == f.id && slices.Equal(samples[i].labels, labelValues) {
+            samples[i].value = value
+            return
+        }
+    }
+    s.domains[domain] = append(samples, storedSample{family: f.id, labels: labelValues, value: value})
+}
+
+// forget deletes all series of domain in the family
+func (f *gaugeFamily) forget(domain string) {
+    s := f.store
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    samples := slices.DeleteFunc(s.domains[domain], func(sample storedSample) bool { return sample.family == f.id })
+    if len(samples) == 0 {
+        delete(s.domains, domain)
+        return
+    }
+    s.domains[domain] = samples
+}
+
+func (s *seriesStore) Describe(ch chan<- *prometheus.Desc) {
+    for _, f := range s.families {
+        ch <- f.desc
+    }
+}
+
+// Collect streams the series domain by domain, so probes recording results only wait for the domain
+// being sent rather than the whole scrape
+func (s *seriesStore) Collect(ch chan<- prometheus.Metric) {
+    s.mu.RLock()
+    domains := make([]string, 0, len(s.domains))
+    for domain := range s.domains {
+        domains = append(domains, domain)
+    }
+    s.mu.RUnlock()
+
+    var metrics []prometheus.Metric
+    for _, domain := range domains {
+        metrics = metrics[:0]
+        s.mu.RLock()
+        for _, sample := range s.domains[domain] {
+            labels := sample.labels
+            if s.domainLabel {
+                labels = append([]string{domain}, sample.labels...)
+            }
+            metrics = append(metrics, prometheus.MustNewConstMetric(s.families[sample.family].desc, prometheus.GaugeValue, sample.value, labels...))
+        }
+        s.mu.RUnlock()
+        for _, m := range metrics {
+            ch <- m
+        }
+    }
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+    "fmt"
+    "hash/fnv"
+    "strconv"
+    "strings"
+)
+
+// shard selects the targets one of several replicas with identical configurations probes.
+// Every target belongs to exactly one shard by the hash of its domain.
+type shard struct {
+    index int // 1 based
+    count int
+}
+
+// parseShard parses N/M, the Nth of M shards. An empty string selects all targets.
+func parseShard(s string) (shard, error) {
+    if s == "" {
+        return shard{index: 1, count: 1}, nil
+    }
+    n, m, ok := strings.Cut(s, "/")
+    index, err1 := strconv.Atoi(n)
+    count, err2 := strconv.Atoi(m)
+    if !ok || err1 != nil || err2 != nil || count < 1 || index < 1 || index > count {
+        return shard{}, fmt.Errorf("invalid shard %q, expected N/M with 1 <= N <= M", s)
+    }
+    return shard{index: index, count: count}, nil
+}
+
+// owns reports whether the domain belongs to the shard
+func (s shard) owns(domain string) bool {
+    if s.count <= 1 {
+        return true
+    }
+    h := fnv.New64a()
+    h.Write([]byte(domain))
+    return int(h.Sum64()%uint64(s.count)) == s.index-1
+}
+
+// filter returns the targets of the shard
+func (s shard) filter(targets []target) []target {
+    if s.count <= 1 {
+        return targets
+    }
+    var owned []target
+    for _, t := range targets {
+        if s.owns(t.Domain) {
+            owned = append(owned, t)
+        }
+    }
+    return owned
+}
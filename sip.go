@@ -0,0 +1,81 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "crypto/rand"
+    "crypto/tls"
+    "encoding/hex"
+    "fmt"
+    "log"
+    "net"
+    "strings"
+    "time"
+)
+
+// getSIPSConnState runs the TLS handshake with a SIP server and returns its state. With ping an OPTIONS request
+// is sent and its response read, the keepalive SIP servers and their monitoring expect.
+func getSIPSConnState(ctx context.Context, conn net.Conn, tlsCfg *tls.Config, host string, ping bool) (tls.ConnectionState, time.Duration, error) {
+    tlsConn, took, err := handshake(ctx, conn, tlsCfg)
+    if err != nil {
+        return tls.ConnectionState{}, took, err
+    }
+    state := tlsConn.ConnectionState()
+    if !ping {
+        return state, took, nil
+    }
+    status, err := sipOptions(tlsConn, host)
+    if err != nil {
+        log.Printf("Error sending OPTIONS to SIP server %s: %v", conn.RemoteAddr(), err)
+    } else if !strings.HasPrefix(status, "2") {
+        log.Printf("SIP server %s answered OPTIONS with %s", conn.RemoteAddr(), status)
+    }
+    return state, took, nil
+}
+
+// sipOptions sends an OPTIONS request to host and returns the status of the final response
+func sipOptions(conn *tls.Conn, host string) (string, error) {
+    id := make([]byte, 8)
+    rand.Read(id)
+    token := hex.EncodeToString(id)
+    local := conn.LocalAddr().String()
+    req := strings.Join([]string{
+        "OPTIONS sip:" + host + " SIP/2.0",
+        "Via: SIP/2.0/TLS " + local + ";branch=z9hG4bK" + token + ";rport",
+        "Max-Forwards: 70",
+        "From: <sip:ssl-exporter@" + host + ">;tag=" + token,
+        "To: <sip:" + host + ">",
+        "Call-ID: " + token + "@" + local,
+        "CSeq: 1 OPTIONS",
+        "Accept: application/sdp",
+        "Content-Length: 0",
+        "", "",
+    }, "\r\n")
+    if _, err := conn.Write([]byte(req)); err != nil {
+        return "", err
+    }
+    r := bufio.NewReader(conn)
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil {
+            return "", err
+        }
+        fields := strings.Fields(line)
+        if len(fields) < 2 || fields[0] != "SIP/2.0" {
+            return "", fmt.Errorf("unexpected response %q", strings.TrimSpace(line))
+        }
+        // Skip provisional responses like 100 Trying and their headers
+        if !strings.HasPrefix(fields[1], "1") {
+            return strings.Join(fields[1:], " "), nil
+        }
+        for {
+            header, err := r.ReadString('\n')
+            if err != nil {
+                return "", err
+            }
+            if strings.TrimSpace(header) == "" {
+                break
+            }
+        }
+    }
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "path"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// silence snoozes the targets matching a pattern until it ends
+type silence struct {
+    ID      string    `json:"id"`
+    Target  string    `json:"target"` // shell pattern as understood by path.Match
+    Start   time.Time `json:"start"`
+    End     time.Time `json:"end"`
+    Comment string    `json:"comment,omitempty"`
+}
+
+// snoozer tracks maintenance windows from the config and silences created through the API.
+// It exports ssl_target_snoozed at scrape time, so windows take effect without waiting for a probe.
+type snoozer struct {
+    windows []maintenanceWindow
+    targets func() []target // of all sources, looked up at scrape time so later added targets are covered
+    desc    *prometheus.Desc
+
+    mu       sync.Mutex
+    silences map[string]*silence
+}
+
+// newSnoozer returns a snoozer for the targets the function returns
+func newSnoozer(windows []maintenanceWindow, targets func() []target) *snoozer {
+    return &snoozer{
+        windows:  windows,
+        targets:  targets,
+        silences: make(map[string]*silence),
+        desc: prometheus.NewDesc(
+            "ssl_target_snoozed",
+            "1 if the target is in a maintenance window or silenced through the API",
+            []string{"domain"}, nil,
+        ),
+    }
+}
+
+// snoozed reports whether the domain is in a maintenance window or silenced at the given time
+func (s *snoozer) snoozed(domain string, now time.Time) bool {
+    for _, w := range s.windows {
+        if !now.Before(w.Start) && now.Before(w.End) && matchesAny(w.Targets, domain) {
+            return true
+        }
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for id, sil := range s.silences {
+        if !now.Before(sil.End) {
+            delete(s.silences, id)
+            continue
+        }
+        if !now.Before(sil.Start) && matchesAny([]string{sil.Target}, domain) {
+            return true
+        }
+    }
+    return false
+}
+
+func (s *snoozer) Describe(ch chan<- *prometheus.Desc) {
+    ch <- s.desc
+}
+
+func (s *snoozer) Collect(ch chan<- prometheus.Metric) {
+    now := time.Now()
+    seen := make(map[string]bool)
+    for _, t := range s.targets() {
+        if seen[t.Domain] {
+            continue
+        }
+        seen[t.Domain] = true
+        value := 0.0
+        if s.snoozed(t.Domain, now) {
+            value = 1
+        }
+        ch <- prometheus.MustNewConstMetric(s.desc, prometheus.GaugeValue, value, t.Domain)
+    }
+}
+
+// silenceRequest is the body of POST /api/v1/silence. Either duration or end must be set, start defaults to now.
+type silenceRequest struct {
+    Target   string    `json:"target"`
+    Start    time.Time `json:"start"`
+    End      time.Time `json:"end"`
+    Duration string    `json:"duration"`
+    Comment  string    `json:"comment"`
+}
+
+// handler serves /api/v1/silence: GET lists the active silences, POST creates one and DELETE ?id= removes one
+func (s *snoozer) handler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet:
+            writeJSON(w, http.StatusOK, s.active())
+        case http.MethodPost:
+            var req silenceRequest
+            if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+                return
+            }
+            sil, err := s.add(req)
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+            writeJSON(w, http.StatusCreated, sil)
+        case http.MethodDelete:
+            id := r.URL.Query().Get("id")
+            s.mu.Lock()
+            _, ok := s.silences[id]
+            delete(s.silences, id)
+            s.mu.Unlock()
+            if !ok {
+                http.Error(w, "silence not found", http.StatusNotFound)
+                return
+            }
+            w.WriteHeader(http.StatusNoContent)
+        default:
+            w.Header().Set("Allow", "GET, POST, DELETE")
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        }
+    })
+}
+
+// add validates a silence request and stores the silence
+func (s *snoozer) add(req silenceRequest) (*silence, error) {
+    if req.Target == "" {
+        return nil, fmt.Errorf("target is required")
+    }
+    if _, err := path.Match(req.Target, ""); err != nil {
+        return nil, fmt.Errorf("invalid target pattern: %v", err)
+    }
+    if req.Start.IsZero() {
+        req.Start = time.Now()
+    }
+    if req.Duration != "" {
+        d, err := time.ParseDuration(req.Duration)
+        if err != nil {
+            return nil, fmt.Errorf("invalid duration: %v", err)
+        }
+        req.End = req.Start.Add(d)
+    }
+    if !req.End.After(req.Start) {
+        return nil, fmt.Errorf("end or a positive duration is required")
+    }
+
+    id := make([]byte, 8)
+    rand.Read(id)
+    sil := &silence{
+        ID:      hex.EncodeToString(id),
+        Target:  req.Target,
+        Start:   req.Start,
+        End:     req.End,
+        Comment: req.Comment,
+    }
+    s.mu.Lock()
+    s.silences[sil.ID] = sil
+    s.mu.Unlock()
+    return sil, nil
+}
+
+// active returns the silences that haven't ended, ordered by start
+func (s *snoozer) active() []*silence {
+    now := time.Now()
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    list := []*silence{}
+    for _, sil := range s.silences {
+        if now.Before(sil.End) {
+            list = append(list, sil)
+        }
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+    return list
+}
+
+// writeJSON writes v as JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/spiffe/go-spiffe/v2/spiffeid"
+    "github.com/spiffe/go-spiffe/v2/svid/x509svid"
+    "github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// spiffeConfig obtains the workload's X509-SVID and the trust bundles from the SPIFFE Workload API, e.g. of a
+// SPIRE agent, for probing mesh services that require SPIFFE mTLS. The SVID is presented as client certificate.
+type spiffeConfig struct {
+    // Socket is the address of the Workload API like unix:///run/spire/sockets/agent.sock,
+    // SPIFFE_ENDPOINT_SOCKET if empty
+    Socket string `yaml:"socket"`
+    // VerifyServer verifies server chains against the trust bundle instead of the system roots, and the
+    // SPIFFE ID of the leaf instead of the host name
+    VerifyServer bool `yaml:"verify_server"`
+    // ServerID is the SPIFFE ID servers must present, any ID of the workload's trust domain if empty
+    ServerID string `yaml:"server_id"`
+
+    source   *workloadapi.X509Source
+    serverID spiffeid.ID // the trust domain's ID if any member is accepted
+}
+
+// spiffeSourceTimeout bounds the wait for the first SVID of the Workload API
+const spiffeSourceTimeout = 10 * time.Second
+
+// load connects to the Workload API and waits for the first SVID
+func (c *spiffeConfig) load() error {
+    if c.Socket == "" {
+        c.Socket = os.Getenv("SPIFFE_ENDPOINT_SOCKET")
+    }
+    if c.ServerID != "" && !c.VerifyServer {
+        return fmt.Errorf("server_id needs verify_server")
+    }
+    source, err := spiffeSources.source(c.Socket)
+    if err != nil {
+        return err
+    }
+    svid, err := source.GetX509SVID()
+    if err != nil {
+        return err
+    }
+    c.source, c.serverID = source, svid.ID.TrustDomain().ID()
+    if c.ServerID != "" {
+        if c.serverID, err = spiffeid.FromString(c.ServerID); err != nil {
+            return fmt.Errorf("server_id: %v", err)
+        }
+    }
+    return nil
+}
+
+// clientCertificate returns the current SVID, which the Workload API rotates long before it expires
+func (c *spiffeConfig) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+    svid, err := c.source.GetX509SVID()
+    if err != nil {
+        return nil, err
+    }
+    cert := &tls.Certificate{PrivateKey: svid.PrivateKey, Leaf: svid.Certificates[0]}
+    for _, c := range svid.Certificates {
+        cert.Certificate = append(cert.Certificate, c.Raw)
+    }
+    return cert, nil
+}
+
+// bundlePool returns the current trust bundle of the servers' trust domain. It's empty if the Workload
+// API doesn't provide one, so verification fails.
+func (c *spiffeConfig) bundlePool() *x509.CertPool {
+    pool := x509.NewCertPool()
+    bundle, err := c.source.GetX509BundleForTrustDomain(c.serverID.TrustDomain())
+    if err != nil {
+        return pool
+    }
+    for _, cert := range bundle.X509Authorities() {
+        pool.AddCert(cert)
+    }
+    return pool
+}
+
+// expectedServerID returns the SPIFFE ID servers must present, or their trust domain's ID. Empty if server
+// chains are verified as usual.
+func (c *spiffeConfig) expectedServerID() string {
+    if c == nil || !c.VerifyServer {
+        return ""
+    }
+    return c.serverID.String()
+}
+
+// verifySPIFFEID checks the SPIFFE ID of an SVID. An expected ID without path accepts any member of its trust domain.
+func verifySPIFFEID(leaf *x509.Certificate, expected string) error {
+    want, err := spiffeid.FromString(expected)
+    if err != nil {
+        return err
+    }
+    id, err := x509svid.IDFromCert(leaf)
+    if err != nil {
+        return err
+    }
+    if want.Path() == "" && !id.MemberOf(want.TrustDomain()) {
+        return fmt.Errorf("SPIFFE ID %s is not a member of trust domain %s", id, want.TrustDomain())
+    }
+    if want.Path() != "" && id != want {
+        return fmt.Errorf("SPIFFE ID %s doesn't match %s", id, want)
+    }
+    return nil
+}
+
+// workloadSources holds a Workload API connection per socket, shared by modules and config reloads. As a
+// collector it exports the expiry of each SVID.
+type workloadSources struct {
+    desc *prometheus.Desc
+
+    mu      sync.Mutex
+    sources map[string]*workloadapi.X509Source
+}
+
+// spiffeSources are the Workload API connections of the modules
+var spiffeSources = &workloadSources{
+    desc: prometheus.NewDesc(
+        "ssl_spiffe_svid_not_after",
+        "Expiry date of the X509-SVID the Workload API provides to the exporter in Unix timestamp",
+        []string{"socket", "spiffe_id"}, nil,
+    ),
+    sources: make(map[string]*workloadapi.X509Source),
+}
+
+func init() {
+    prometheus.MustRegister(spiffeSources)
+}
+
+// source returns the connection to the Workload API at socket, connecting on first use
+func (w *workloadSources) source(socket string) (*workloadapi.X509Source, error) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if source, ok := w.sources[socket]; ok {
+        return source, nil
+    }
+    var opts []workloadapi.X509SourceOption
+    if socket != "" {
+        opts = append(opts, workloadapi.WithClientOptions(workloadapi.WithAddr(socket)))
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), spiffeSourceTimeout)
+    defer cancel()
+    source, err := workloadapi.NewX509Source(ctx, opts...)
+    if err != nil {
+        return nil, fmt.Errorf("connecting to the Workload API: %v", err)
+    }
+    w.sources[socket] = source
+    return source, nil
+}
+
+func (w *workloadSources) Describe(ch chan<- *prometheus.Desc) {
+    ch <- w.desc
+}
+
+func (w *workloadSources) Collect(ch chan<- prometheus.Metric) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    for socket, source := range w.sources {
+        svid, err := source.GetX509SVID()
+        if err != nil {
+            continue
+        }
+        ch <- prometheus.MustNewConstMetric(w.desc, prometheus.GaugeValue,
+            float64(svid.Certificates[0].NotAfter.Unix()), socket, svid.ID.String())
+    }
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "bytes"
+    "crypto/x509"
+    "encoding/asn1"
+    "errors"
+    "fmt"
+    "log"
+    "time"
+
+    "golang.org/x/crypto/ocsp"
+)
+
+// oidTLSFeature is the TLS feature extension of RFC 7633, which holds the must-staple flag
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// tlsFeatureStatusRequest is the status_request extension, requiring an OCSP staple in the handshake
+const tlsFeatureStatusRequest = 5
+
+// mustStaple reports whether the certificate requires its server to staple an OCSP response
+func mustStaple(cert *x509.Certificate) bool {
+    for _, ext := range cert.Extensions {
+        if !ext.Id.Equal(oidTLSFeature) {
+            continue
+        }
+        var features []int
+        if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+            return false
+        }
+        for _, f := range features {
+            if f == tlsFeatureStatusRequest {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// parseStaple parses a stapled OCSP response and verifies its signature against the issuer, the second
+// certificate of the chain. Without an issuer the signature can't be checked. The response is returned
+// along with a failed verification, so its dates can still be reported.
+func parseStaple(raw []byte, chain []*x509.Certificate) (*ocsp.Response, error) {
+    // Without an issuer only the signature of an embedded responder certificate is checked
+    staple, err := ocsp.ParseResponse(raw, nil)
+    if err != nil || len(chain) < 2 {
+        return staple, err
+    }
+    issuer := chain[1]
+    // Responders signing with the issuer's key may embed the issuer itself, which ocsp.ParseResponse
+    // rejects since the issuer didn't sign its own certificate
+    if staple.Certificate == nil || bytes.Equal(staple.Certificate.Raw, issuer.Raw) {
+        err = staple.CheckSignatureFrom(issuer)
+    } else {
+        err = staple.Certificate.CheckSignatureFrom(issuer)
+    }
+    if err != nil {
+        return staple, fmt.Errorf("bad OCSP signature: %v", err)
+    }
+    return staple, nil
+}
+
+// stapleValidity returns why the stapled response doesn't vouch for the leaf at the given time, nil if it does
+func stapleValidity(res *probeResult, now time.Time) error {
+    if res.ocspErr != nil {
+        return res.ocspErr
+    }
+    staple := res.ocspStaple
+    if staple.SerialNumber.Cmp(res.chain[0].SerialNumber) != 0 {
+        return errors.New("response is for another certificate")
+    }
+    if now.Before(staple.ThisUpdate) {
+        return fmt.Errorf("response is not valid before %s", staple.ThisUpdate.UTC().Format(time.RFC3339))
+    }
+    if !staple.NextUpdate.IsZero() && now.After(staple.NextUpdate) {
+        return fmt.Errorf("response expired at %s", staple.NextUpdate.UTC().Format(time.RFC3339))
+    }
+    switch staple.Status {
+    case ocsp.Good:
+        return nil
+    case ocsp.Revoked:
+        return fmt.Errorf("certificate was revoked at %s", staple.RevokedAt.UTC().Format(time.RFC3339))
+    }
+    return errors.New("responder doesn't know the certificate")
+}
+
+// recordStaple exports what the server stapled during the handshake and whether the leaf requires it.
+// Results without a handshake, like file targets and those restored from the state file, leave the staple unknown.
+func (m *certMetrics) recordStaple(domain string, res *probeResult, now time.Time) {
+    required := 0.0
+    if mustStaple(res.chain[0]) {
+        required = 1
+    }
+    m.certMustStaple.set(domain, required)
+    for _, family := range []*gaugeFamily{m.ocspStaplePresent, m.ocspStapleProducedAt, m.ocspStapleNextUpdate, m.ocspStapleValid, m.mustStapleViolation} {
+        family.forget(domain)
+    }
+    if res.tlsState == nil {
+        return
+    }
+    // Browsers hard fail must-staple certificates served without a valid staple
+    if required == 1 {
+        violation := 0.0
+        if res.ocspStaple == nil || stapleValidity(res, now) != nil {
+            violation = 1
+            log.Printf("Domain %s serves a must-staple certificate without a valid OCSP staple", domain)
+        }
+        m.mustStapleViolation.set(domain, violation)
+    }
+    if res.ocspStaple == nil && res.ocspErr == nil {
+        m.ocspStaplePresent.set(domain, 0)
+        return
+    }
+    m.ocspStaplePresent.set(domain, 1)
+    if res.ocspStaple != nil {
+        m.ocspStapleProducedAt.set(domain, float64(res.ocspStaple.ProducedAt.Unix()))
+        if !res.ocspStaple.NextUpdate.IsZero() {
+            m.ocspStapleNextUpdate.set(domain, float64(res.ocspStaple.NextUpdate.Unix()))
+        }
+    }
+    valid := 1.0
+    if err := stapleValidity(res, now); err != nil {
+        valid = 0
+        log.Printf("Domain %s staples an invalid OCSP response: %v", domain, err)
+    }
+    m.ocspStapleValid.set(domain, valid)
+}
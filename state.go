@@ -0,0 +1,207 @@
+package main
+
+import (
+    "crypto/x509"
+    "encoding/json"
+    "log"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// storedResult is the persisted form of the last successful probe and of the failures since
+type storedResult struct {
+    Time       time.Time `json:"time"`
+    Chain      [][]byte  `json:"chain"` // DER encoded certificates, leaf first
+    ServerName string    `json:"server_name,omitempty"`
+    SkipVerify bool      `json:"skip_verify,omitempty"`
+
+    // Failures counts the probes that failed in a row since, FailureReason is the reason of the last one
+    Failures      int    `json:"failures,omitempty"`
+    FailureReason string `json:"failure_reason,omitempty"`
+}
+
+// stateStore keeps the last successful probe result of every domain and the failures since, and
+// persists them as JSON
+type stateStore struct {
+    path string
+
+    mu      sync.Mutex
+    results map[string]*storedResult
+}
+
+// loadStateStore reads the state file. A missing file is not an error, it is created on the first save.
+func loadStateStore(path string) (*stateStore, error) {
+    s := &stateStore{path: path, results: make(map[string]*storedResult)}
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return s, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(data, &s.results); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+// update remembers the result of a successful probe
+func (s *stateStore) update(domain string, res *probeResult) {
+    stored := &storedResult{
+        Time:       time.Now(),
+        ServerName: res.serverName,
+        SkipVerify: res.skipVerify,
+    }
+    for _, cert := range res.chain {
+        stored.Chain = append(stored.Chain, cert.Raw)
+    }
+
+    s.mu.Lock()
+    s.results[domain] = stored
+    s.mu.Unlock()
+}
+
+// fail counts a failed probe of a domain, the last successful result is kept
+func (s *stateStore) fail(domain string, err error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    stored, ok := s.results[domain]
+    if !ok {
+        stored = &storedResult{}
+        s.results[domain] = stored
+    }
+    stored.Failures++
+    stored.FailureReason = classifyProbeError(err)
+}
+
+// forget drops the stored result of a domain that is no longer a target
+func (s *stateStore) forget(domain string) {
+    s.mu.Lock()
+    delete(s.results, domain)
+    s.mu.Unlock()
+}
+
+// save writes the state file atomically, so a crash never leaves a truncated file behind
+func (s *stateStore) save() error {
+    s.mu.Lock()
+    data, err := json.Marshal(s.results)
+    s.mu.Unlock()
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic replaces the file with data through a temporary file renamed over it
+func writeFileAtomic(path string, data []byte) error {
+    tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
+
+// leaf returns the stored leaf certificate of a domain, nil if there is none
+func (s *stateStore) leaf(domain string) *x509.Certificate {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    stored, ok := s.results[domain]
+    if !ok || len(stored.Chain) == 0 {
+        return nil
+    }
+    cert, err := x509.ParseCertificate(stored.Chain[0])
+    if err != nil {
+        return nil
+    }
+    return cert
+}
+
+// chain returns the stored chain of a domain and the time it was observed
+func (s *stateStore) chain(domain string) ([][]byte, time.Time, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    stored, ok := s.results[domain]
+    if !ok || len(stored.Chain) == 0 {
+        return nil, time.Time{}, false
+    }
+    return stored.Chain, stored.Time, true
+}
+
+// restore records the stored results of the targets and flags them as stale. The chains are verified
+// against the trust anchors of each target's module. Targets that were failing stay down, with the
+// failures counted towards the debounce and the expiry of their series as before the restart.
+// Results of domains that are no longer targets are dropped.
+func (s *stateStore) restore(targets []target, cfg *probeConfig, m *certMetrics, intermediateWarn time.Duration) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    current := make(map[string]bool, len(targets))
+    for _, t := range targets {
+        current[t.Domain] = true
+    }
+    for domain := range s.results {
+        if !current[domain] {
+            delete(s.results, domain)
+        }
+    }
+
+    for _, t := range targets {
+        stored, ok := s.results[t.Domain]
+        if !ok {
+            continue
+        }
+        succeeded := false
+        if len(stored.Chain) > 0 {
+            res := &probeResult{serverName: stored.ServerName, skipVerify: stored.SkipVerify}
+            if mod, err := cfg.module(t.Module); err == nil {
+                res.roots, res.trust, res.spiffeID = mod.rootPool(), mod.trustSource(), mod.TLSConfig.Spiffe.expectedServerID()
+            }
+            var err error
+            if res.chain, res.parseError, err = parseChain(stored.Chain); err != nil {
+                log.Printf("Error restoring certificate for domain %s: %v", t.Domain, err)
+            } else if len(res.chain) > 0 {
+                m.record(t.Domain, res, intermediateWarn)
+                m.resultStale.set(t.Domain, 1)
+                m.probeLastSuccess.set(t.Domain, float64(stored.Time.Unix()))
+                // The debounced success carries over the last known state, the raw one is unknown until probed
+                m.probeSuccessRaw.forget(t.Domain)
+                succeeded = true
+                log.Printf("Restored metrics for domain %s from %s", t.Domain, stored.Time.Format(time.RFC3339))
+            }
+        }
+        if stored.Failures > 0 {
+            m.restoreFailures(t.Domain, stored.Failures, stored.FailureReason, succeeded)
+        }
+    }
+}
+
+// restoreFailures puts a domain back into the state of recordFailure after failures probes failed in a row
+func (m *certMetrics) restoreFailures(domain string, failures int, reason string, succeeded bool) {
+    m.probeFailureReason.forget(domain)
+    m.probeFailureReason.set(domain, 1, reason)
+
+    m.mu.Lock()
+    m.failures[domain] = failures
+    m.succeeded[domain] = succeeded
+    down := failures >= m.debounce || !succeeded
+    expired := m.expireAfter > 0 && failures >= m.expireAfter
+    m.mu.Unlock()
+
+    m.probeSuccessRaw.set(domain, 0)
+    if down {
+        m.probeSuccess.set(domain, 0)
+    }
+    if expired {
+        m.expire(domain)
+    }
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/haraiko/SSL_exporter/internal/testutil"
+)
+
+var errProbeTest = errors.New("connection refused")
+
+// seriesValue returns the value of the series of domain in the family, false if there is none
+func seriesValue(f *gaugeFamily, domain string) (float64, bool) {
+    f.store.mu.RLock()
+    defer f.store.mu.RUnlock()
+    for _, sample := range f.store.domains[domain] {
+        if sample.family == f.id {
+            return sample.value, true
+        }
+    }
+    return 0, false
+}
+
+func TestStateRestore(t *testing.T) {
+    chain, err := testutil.GenerateChain(testutil.ChainOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    stored := func(failures int) *storedResult {
+        return &storedResult{
+            Time:          time.Now().Add(-time.Hour),
+            Chain:         [][]byte{chain.Leaf.Raw, chain.Intermediates[0].Raw},
+            Failures:      failures,
+            FailureReason: "connection_refused",
+        }
+    }
+    s := &stateStore{results: map[string]*storedResult{
+        "up.example.com":      stored(0),
+        "flaky.example.com":   stored(1),
+        "down.example.com":    stored(2),
+        "new.example.com":     {Failures: 1, FailureReason: "dns_error"},
+        "removed.example.com": stored(0),
+    }}
+    m := newCertMetrics(true)
+    m.debounce = 2
+    var targets []target
+    for _, domain := range []string{"up.example.com", "flaky.example.com", "down.example.com", "new.example.com"} {
+        targets = append(targets, target{Domain: domain})
+    }
+    s.restore(targets, &probeConfig{}, m, 0)
+
+    for domain, want := range map[string]float64{
+        "up.example.com":    1,
+        "flaky.example.com": 1, // below the debounce threshold
+        "down.example.com":  0,
+        "new.example.com":   0, // never succeeded
+    } {
+        if got, ok := seriesValue(m.probeSuccess, domain); !ok || got != want {
+            t.Errorf("%s: got probe success %v (%v), want %v", domain, got, ok, want)
+        }
+    }
+    if _, ok := seriesValue(m.probeFailureReason, "up.example.com"); ok {
+        t.Error("up.example.com: got a failure reason, want none")
+    }
+    if _, ok := seriesValue(m.probeFailureReason, "down.example.com"); !ok {
+        t.Error("down.example.com: got no failure reason")
+    }
+    if _, ok := seriesValue(m.certExpiry, "down.example.com"); !ok {
+        t.Error("down.example.com: got no certificate expiry, want the restored one")
+    }
+
+    // The failures before the restart count towards the debounce
+    m.recordFailure("flaky.example.com", errProbeTest)
+    if got, _ := seriesValue(m.probeSuccess, "flaky.example.com"); got != 0 {
+        t.Errorf("flaky.example.com: got probe success %v after another failure, want 0", got)
+    }
+
+    if _, ok := s.results["removed.example.com"]; ok {
+        t.Error("got the result of removed.example.com, want it dropped")
+    }
+    if _, ok := seriesValue(m.probeSuccess, "removed.example.com"); ok {
+        t.Error("got series of removed.example.com, want none")
+    }
+}
+
+func TestStateFail(t *testing.T) {
+    s := &stateStore{results: make(map[string]*storedResult)}
+    s.fail("example.com", errProbeTest)
+    s.fail("example.com", errProbeTest)
+    if got := s.results["example.com"].Failures; got != 2 {
+        t.Errorf("got %d failures, want 2", got)
+    }
+    s.forget("example.com")
+    if _, ok := s.results["example.com"]; ok {
+        t.Error("got a result after forget, want none")
+    }
+}
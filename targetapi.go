@@ -0,0 +1,197 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+)
+
+// targetSpec is the JSON form of a target in the targets API and in the assignments of workers
+type targetSpec struct {
+    Domain   string            `json:"domain"`
+    Module   string            `json:"module,omitempty"`
+    Labels   map[string]string `json:"labels,omitempty"`
+    Interval string            `json:"interval,omitempty"` // Go duration overriding the probe interval
+}
+
+// runtimeTargets holds the targets managed through /api/v1/targets, so provisioning systems can
+// register domains without editing files and restarting. They are persisted to a file if one is set.
+type runtimeTargets struct {
+    path    string
+    cfg     *probeConfig
+    changed func()                 // called when a PUT replaced the targets
+    removed func(domains []string) // called with the targets a PUT dropped
+
+    mu    sync.Mutex
+    specs []targetSpec
+}
+
+// loadRuntimeTargets reads the persisted targets. A missing file is not an error, it is created on the first PUT.
+func loadRuntimeTargets(path string, cfg *probeConfig) (*runtimeTargets, error) {
+    rt := &runtimeTargets{path: path, cfg: cfg, specs: []targetSpec{}}
+    if path == "" {
+        return rt, nil
+    }
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return rt, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var specs []targetSpec
+    if err := json.Unmarshal(data, &specs); err != nil {
+        return nil, err
+    }
+    if err := rt.validate(specs); err != nil {
+        return nil, err
+    }
+    rt.specs = specs
+    return rt, nil
+}
+
+// validate checks the targets like the ones of the configuration files. As they come from the network,
+// the target policy applies to them as well.
+func (rt *runtimeTargets) validate(specs []targetSpec) error {
+    seen := make(map[string]bool, len(specs))
+    for _, s := range specs {
+        if s.Domain == "" {
+            return fmt.Errorf("target without domain")
+        }
+        if seen[s.Domain] {
+            return fmt.Errorf("duplicate target %s", s.Domain)
+        }
+        seen[s.Domain] = true
+        t, err := normalizeTarget(s.target())
+        if err != nil {
+            return fmt.Errorf("target %s: %v", s.Domain, err)
+        }
+        mod, err := rt.cfg.module(t.Module)
+        if err != nil {
+            return fmt.Errorf("target %s: %v", s.Domain, err)
+        }
+        if localProbers[mod.Prober] {
+            return fmt.Errorf("target %s: %s modules can't be used with the targets API", s.Domain, mod.Prober)
+        }
+        if s.Interval != "" {
+            if d, err := time.ParseDuration(s.Interval); err != nil || d <= 0 {
+                return fmt.Errorf("target %s: invalid interval %q", s.Domain, s.Interval)
+            }
+        }
+        if _, _, err := renewalPolicy(t); err != nil {
+            return fmt.Errorf("target %s: %v", s.Domain, err)
+        }
+        if err := rt.cfg.TargetPolicy.checkDomain(hostOf(t.Domain)); err != nil {
+            return err
+        }
+    }
+    if n := rt.cfg.Limits.MaxTargets; n > 0 && len(specs) > n {
+        return fmt.Errorf("%d targets exceed max_targets of %d", len(specs), n)
+    }
+    return nil
+}
+
+// target returns the target the spec describes. An invalid interval is ignored, validate reports it.
+func (s targetSpec) target() target {
+    t := target{Domain: s.Domain, Module: s.Module, Labels: make(map[string]string, len(s.Labels))}
+    for k, v := range s.Labels {
+        t.Labels[k] = v
+    }
+    if d, err := time.ParseDuration(s.Interval); err == nil && d > 0 {
+        t.Interval = d
+    }
+    return t
+}
+
+// newTargetSpec returns the spec of a target, so workers probe it at the interval of its group or its own
+func newTargetSpec(t target) targetSpec {
+    s := targetSpec{Domain: t.Domain, Module: t.Module, Labels: t.Labels}
+    if t.Interval > 0 {
+        s.Interval = t.Interval.String()
+    }
+    return s
+}
+
+// current returns the managed targets
+func (rt *runtimeTargets) current() []target {
+    rt.mu.Lock()
+    defer rt.mu.Unlock()
+    targets := make([]target, 0, len(rt.specs))
+    for _, s := range rt.specs {
+        targets = append(targets, s.target())
+    }
+    return targets
+}
+
+// handler serves GET /api/v1/targets, which returns the managed targets, and PUT, which replaces them
+// with the JSON array in the body. New targets are probed right away.
+func (rt *runtimeTargets) handler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet:
+            rt.mu.Lock()
+            defer rt.mu.Unlock()
+            writeJSON(w, http.StatusOK, rt.specs)
+        case http.MethodPut:
+            var specs []targetSpec
+            dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<20))
+            dec.DisallowUnknownFields()
+            if err := dec.Decode(&specs); err != nil {
+                http.Error(w, "invalid targets: "+err.Error(), http.StatusBadRequest)
+                return
+            }
+            if specs == nil {
+                specs = []targetSpec{}
+            }
+            if err := rt.validate(specs); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+            // Like /probe, the addresses are checked too, validate only covers the domains
+            for _, s := range specs {
+                t, _ := normalizeTarget(s.target())
+                if err := rt.cfg.TargetPolicy.check(r.Context(), hostOf(t.Domain)); err != nil {
+                    log.Printf("Refusing target %s: %v", s.Domain, err)
+                    http.Error(w, err.Error(), http.StatusForbidden)
+                    return
+                }
+            }
+
+            rt.mu.Lock()
+            if rt.path != "" {
+                data, err := json.MarshalIndent(specs, "", "  ")
+                if err == nil {
+                    err = writeFileAtomic(rt.path, data)
+                }
+                if err != nil {
+                    rt.mu.Unlock()
+                    http.Error(w, "saving targets: "+err.Error(), http.StatusInternalServerError)
+                    return
+                }
+            }
+            previous := rt.specs
+            rt.specs = specs
+            rt.mu.Unlock()
+
+            // The hooks run without the lock, as removed looks up the targets of all sources including these
+            previousTargets := make([]target, 0, len(previous))
+            for _, s := range previous {
+                previousTargets = append(previousTargets, s.target())
+            }
+            if dropped := droppedDomains(previousTargets, rt.current()); len(dropped) > 0 && rt.removed != nil {
+                rt.removed(dropped)
+            }
+            if rt.changed != nil {
+                rt.changed()
+            }
+            writeJSON(w, http.StatusOK, specs)
+        default:
+            w.Header().Set("Allow", "GET, PUT")
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        }
+    })
+}
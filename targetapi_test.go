@@ -0,0 +1,56 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "net/netip"
+    "strings"
+    "testing"
+)
+
+// putTargets sends the JSON body to the PUT handler of the targets and returns the status
+func putTargets(t *testing.T, rt *runtimeTargets, body string) int {
+    t.Helper()
+    rec := httptest.NewRecorder()
+    rt.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/api/v1/targets", strings.NewReader(body)))
+    return rec.Code
+}
+
+func TestTargetsAPIRejects(t *testing.T) {
+    cfg := &probeConfig{
+        Modules: map[string]*module{
+            "script": {Prober: proberExec, Command: []string{"/usr/local/bin/probe"}},
+        },
+        TargetPolicy: targetPolicy{DenyCIDRs: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}},
+    }
+    for _, tc := range []struct {
+        name string
+        body string
+        want int
+    }{
+        {"file module", `[{"domain": "/etc/ssl/private/server.key", "module": "file"}]`, http.StatusBadRequest},
+        {"exec module", `[{"domain": "example.com", "module": "script"}]`, http.StatusBadRequest},
+        {"denied address", `[{"domain": "127.0.0.1:443"}]`, http.StatusForbidden},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            rt := &runtimeTargets{cfg: cfg, specs: []targetSpec{}}
+            if got := putTargets(t, rt, tc.body); got != tc.want {
+                t.Errorf("got status %d, want %d", got, tc.want)
+            }
+            if targets := rt.current(); len(targets) != 0 {
+                t.Errorf("got targets %v, want none", targets)
+            }
+        })
+    }
+}
+
+func TestTargetsAPIAccepts(t *testing.T) {
+    rt := &runtimeTargets{cfg: &probeConfig{}, specs: []targetSpec{}}
+    if got := putTargets(t, rt, `[{"domain": "192.0.2.1:8443", "module": "https", "interval": "5m"}]`); got != http.StatusOK {
+        t.Fatalf("got status %d, want %d", got, http.StatusOK)
+    }
+    targets := rt.current()
+    if len(targets) != 1 || targets[0].Domain != "192.0.2.1:8443" || targets[0].Module != "https" {
+        t.Errorf("got targets %v, want 192.0.2.1:8443 with module https", targets)
+    }
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "net/url"
+    "strconv"
+    "strings"
+)
+
+// targetScheme is what a URL scheme implies for a target: the module probing it and the port,
+// 0 for the default port of the module
+type targetScheme struct {
+    module string
+    port   int
+}
+
+// targetSchemes maps the URL schemes accepted as targets to their modules and well known ports
+var targetSchemes = map[string]targetScheme{
+    "https":      {module: "https"},
+    "wss":        {module: "https"},
+    "ldaps":      {module: "tcp", port: 636},
+    "smtps":      {module: "tcp", port: 465},
+    "smtp":       {module: "smtp_starttls"},
+    "submission": {module: "smtp_starttls", port: 587},
+    "imaps":      {module: "tcp", port: 993},
+    "pop3s":      {module: "tcp", port: 995},
+    "ftps":       {module: "tcp", port: 990},
+    "ircs":       {module: "tcp", port: 6697},
+    "xmpps":      {module: "tcp", port: 5223},
+    "rdp":        {module: "rdp"},
+    "winrm":      {module: "winrm"},
+    "mongodb":    {module: "mongodb"},
+    "rediss":     {module: "redis"},
+    "amqps":      {module: "amqp"},
+    "mqtts":      {module: "mqtt"},
+    "sips":       {module: "sips"},
+    "ntske":      {module: "ntske"},
+    "syslog":     {module: "syslog"},
+    "file":       {module: "file"},
+}
+
+// isTargetURL reports whether a target is given as URL rather than as host[:port] or path
+func isTargetURL(s string) bool {
+    return strings.Contains(s, "://")
+}
+
+// parseTargetURL turns a target URL like ldaps://dc1 into the domain and module the scheme implies, here
+// dc1:636 and tcp. A port in the URL wins over the scheme's. file URLs yield the path of the file, the paths
+// of other URLs are ignored as the modules set them.
+func parseTargetURL(s string) (domain, module string, err error) {
+    u, err := url.Parse(s)
+    if err != nil {
+        return "", "", err
+    }
+    scheme, ok := targetSchemes[strings.ToLower(u.Scheme)]
+    if !ok {
+        return "", "", fmt.Errorf("unsupported scheme %q in %s", u.Scheme, s)
+    }
+    if scheme.module == "file" {
+        if u.Host != "" && u.Host != "localhost" {
+            return "", "", fmt.Errorf("file URL %s must not name a remote host", s)
+        }
+        if u.Path == "" {
+            return "", "", fmt.Errorf("file URL %s has no path", s)
+        }
+        return u.Path, scheme.module, nil
+    }
+    host := u.Hostname()
+    if host == "" {
+        return "", "", fmt.Errorf("URL %s has no host", s)
+    }
+    switch {
+    case u.Port() != "":
+        return net.JoinHostPort(host, u.Port()), scheme.module, nil
+    case scheme.port != 0:
+        return net.JoinHostPort(host, strconv.Itoa(scheme.port)), scheme.module, nil
+    }
+    return host, scheme.module, nil
+}
+
+// normalizeTarget returns the target with a URL domain replaced by the domain and, unless the target selects
+// a module, the module the URL implies. Other targets are returned as they are.
+func normalizeTarget(t target) (target, error) {
+    if !isTargetURL(t.Domain) {
+        return t, nil
+    }
+    domain, module, err := parseTargetURL(t.Domain)
+    if err != nil {
+        return t, err
+    }
+    t.Domain = domain
+    if t.Module == "" {
+        t.Module = module
+    }
+    return t, nil
+}
+
+// normalizeTargets normalizes the targets of all sources, so any of them may list URLs. Targets with
+// invalid URLs are dropped, the sources validating their targets reported them already.
+func normalizeTargets(targets []target) []target {
+    normalized := make([]target, 0, len(targets))
+    for _, t := range targets {
+        n, err := normalizeTarget(t)
+        if err != nil {
+            log.Printf("Ignoring target %s: %v", t.Domain, err)
+            continue
+        }
+        normalized = append(normalized, n)
+    }
+    return normalized
+}
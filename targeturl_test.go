@@ -0,0 +1,98 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestIsTargetURL(t *testing.T) {
+    for _, tc := range []struct {
+        target string
+        want   bool
+    }{
+        {"example.com", false},
+        {"example.com:8443", false},
+        {"[2001:db8::1]:443", false},
+        {"/etc/ssl/certs/server.pem", false},
+        {"https://example.com", true},
+        {"ldaps://dc1", true},
+        {"file:///etc/ssl/certs/server.pem", true},
+    } {
+        if got := isTargetURL(tc.target); got != tc.want {
+            t.Errorf("isTargetURL(%q) = %v, want %v", tc.target, got, tc.want)
+        }
+    }
+}
+
+func TestParseTargetURL(t *testing.T) {
+    for _, tc := range []struct {
+        url    string
+        domain string
+        module string
+    }{
+        {"https://example.com", "example.com", "https"},
+        {"https://example.com:8443/health", "example.com:8443", "https"},
+        {"HTTPS://example.com", "example.com", "https"},
+        {"ldaps://dc1", "dc1:636", "tcp"},
+        {"ldaps://dc1:3269", "dc1:3269", "tcp"},
+        {"submission://mail.example.com", "mail.example.com:587", "smtp_starttls"},
+        {"smtp://mail.example.com", "mail.example.com", "smtp_starttls"},
+        {"rediss://[2001:db8::1]:6380", "[2001:db8::1]:6380", "redis"},
+        {"file:///etc/ssl/certs/server.pem", "/etc/ssl/certs/server.pem", "file"},
+        {"file://localhost/etc/ssl/certs/server.pem", "/etc/ssl/certs/server.pem", "file"},
+    } {
+        t.Run(tc.url, func(t *testing.T) {
+            domain, module, err := parseTargetURL(tc.url)
+            if err != nil {
+                t.Fatalf("parsing: %v", err)
+            }
+            if domain != tc.domain || module != tc.module {
+                t.Errorf("got %s with module %s, want %s with module %s", domain, module, tc.domain, tc.module)
+            }
+        })
+    }
+}
+
+func TestParseTargetURLErrors(t *testing.T) {
+    for _, url := range []string{
+        "gopher://example.com",
+        "https://",
+        "https://:443",
+        "file://fileserver/etc/ssl/certs/server.pem",
+        "file://",
+        "https://exa mple.com",
+    } {
+        if domain, module, err := parseTargetURL(url); err == nil {
+            t.Errorf("parseTargetURL(%q) = %s, %s, want an error", url, domain, module)
+        }
+    }
+}
+
+func TestNormalizeTargets(t *testing.T) {
+    g := targetGroup{Name: "ldap", Port: 8443, Targets: []groupTarget{{Domain: "ldaps://dc{1..2}"}, {Domain: "web"}}}
+    if err := g.validate(); err != nil {
+        t.Fatalf("validating group: %v", err)
+    }
+    grouped, err := groupTargets(g)
+    if err != nil {
+        t.Fatalf("expanding group: %v", err)
+    }
+    targets := append(grouped,
+        target{Domain: "https://api.example.com:8443/v1", Module: "winrm"},
+        target{Domain: "gopher://example.com"},
+    )
+    want := []target{
+        {Domain: "dc1:636", Module: "tcp"},
+        {Domain: "dc2:636", Module: "tcp"},
+        {Domain: "web:8443"},
+        {Domain: "api.example.com:8443", Module: "winrm"},
+    }
+    got := normalizeTargets(targets)
+    if len(got) != len(want) {
+        t.Fatalf("got %d targets, want %d", len(got), len(want))
+    }
+    for i := range want {
+        if got[i].Domain != want[i].Domain || got[i].Module != want[i].Module {
+            t.Errorf("target %d: got %s with module %q, want %s with module %q", i, got[i].Domain, got[i].Module, want[i].Domain, want[i].Module)
+        }
+    }
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "net"
+)
+
+// tlsConfig holds the tls.Config knobs a module can set
+type tlsConfig struct {
+    MinVersion       string   `yaml:"min_version"`
+    MaxVersion       string   `yaml:"max_version"`
+    CipherSuites     []string `yaml:"cipher_suites"`
+    CurvePreferences []string `yaml:"curve_preferences"`
+
+    // Renegotiation is never, once or freely. Some legacy servers renegotiate to request client certificates.
+    Renegotiation string `yaml:"renegotiation"`
+    // Fallback retries a failed handshake with lower maximum versions down to min_version
+    Fallback bool `yaml:"fallback"`
+
+    // InsecureSkipVerify skips the verification of the chain after the handshake. The handshake itself
+    // always accepts the certificate, otherwise expired and self signed certificates couldn't be monitored.
+    InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+    // CAFile is a PEM bundle of the trust anchors chains are verified against instead of the system roots,
+    // e.g. the internal CA for internal services
+    CAFile string `yaml:"ca_file"`
+    // TrustStore is system or mozilla, the latter verifies against the Mozilla bundle independent of the host
+    TrustStore string `yaml:"trust_store"`
+
+    // CertFile is the PEM client certificate, with its chain, presented to servers asking for one. Its key is
+    // read from KeyFile or stays on a PKCS#11 token or TPM, so hardware backed credentials needn't be exported.
+    CertFile string     `yaml:"cert_file"`
+    KeyFile  string     `yaml:"key_file"`
+    PKCS11   *pkcs11Key `yaml:"pkcs11"`
+    TPM      *tpmKey    `yaml:"tpm"`
+    // Spiffe presents the workload's SPIFFE SVID instead
+    Spiffe *spiffeConfig `yaml:"spiffe"`
+
+    clientCert *tls.Certificate // loaded by the module's validate
+}
+
+var tlsVersions = map[string]uint16{
+    "TLS10": tls.VersionTLS10,
+    "TLS11": tls.VersionTLS11,
+    "TLS12": tls.VersionTLS12,
+    "TLS13": tls.VersionTLS13,
+}
+
+var tlsRenegotiation = map[string]tls.RenegotiationSupport{
+    "never":  tls.RenegotiateNever,
+    "once":   tls.RenegotiateOnceAsClient,
+    "freely": tls.RenegotiateFreelyAsClient,
+}
+
+// tlsVersionName returns the config name of a TLS version
+func tlsVersionName(v uint16) string {
+    for name, version := range tlsVersions {
+        if version == v {
+            return name
+        }
+    }
+    return fmt.Sprintf("0x%04x", v)
+}
+
+var tlsCurves = map[string]tls.CurveID{
+    "X25519":         tls.X25519,
+    "P256":           tls.CurveP256,
+    "P384":           tls.CurveP384,
+    "P521":           tls.CurveP521,
+    "X25519MLKEM768": tls.X25519MLKEM768,
+
+    "SecP256r1MLKEM768":  tls.SecP256r1MLKEM768,
+    "SecP384r1MLKEM1024": tls.SecP384r1MLKEM1024,
+    "MLKEM1024":          tls.MLKEM1024,
+}
+
+// postQuantum reports whether a key exchange group resists quantum computers, all but MLKEM1024 are
+// hybrids with a classic curve
+func postQuantum(id tls.CurveID) bool {
+    switch id {
+    case tls.X25519MLKEM768, tls.SecP256r1MLKEM768, tls.SecP384r1MLKEM1024, tls.MLKEM1024:
+        return true
+    }
+    return false
+}
+
+// offersPostQuantum reports whether handshakes offer a post-quantum key exchange. Go's defaults do.
+func (c *tlsConfig) offersPostQuantum() bool {
+    if len(c.CurvePreferences) == 0 {
+        return true
+    }
+    for _, name := range c.CurvePreferences {
+        if postQuantum(tlsCurves[name]) {
+            return true
+        }
+    }
+    return false
+}
+
+// curveName returns the config name of a key exchange group
+func curveName(id tls.CurveID) string {
+    for name, curve := range tlsCurves {
+        if curve == id {
+            return name
+        }
+    }
+    return id.String()
+}
+
+// cipherSuiteID looks up a cipher suite by its IANA name, including the ones Go considers insecure
+// since legacy appliances often support nothing else
+func cipherSuiteID(name string) (uint16, bool) {
+    for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+        for _, s := range suites {
+            if s.Name == name {
+                return s.ID, true
+            }
+        }
+    }
+    return 0, false
+}
+
+// legacyCipherSuites returns the names of all cipher suites of TLS 1.0 to 1.2 Go implements, insecure ones included
+func legacyCipherSuites() []string {
+    var names []string
+    for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+        for _, s := range suites {
+            for _, v := range s.SupportedVersions {
+                if v != tls.VersionTLS13 {
+                    names = append(names, s.Name)
+                    break
+                }
+            }
+        }
+    }
+    return names
+}
+
+// build returns the tls.Config for a connection to serverName
+func (c *tlsConfig) build(serverName string) (*tls.Config, error) {
+    cfg := &tls.Config{
+        ServerName:         serverName,
+        InsecureSkipVerify: true,
+    }
+    if c.MinVersion != "" {
+        v, ok := tlsVersions[c.MinVersion]
+        if !ok {
+            return nil, fmt.Errorf("unknown min_version %q", c.MinVersion)
+        }
+        cfg.MinVersion = v
+    }
+    if c.MaxVersion != "" {
+        v, ok := tlsVersions[c.MaxVersion]
+        if !ok {
+            return nil, fmt.Errorf("unknown max_version %q", c.MaxVersion)
+        }
+        cfg.MaxVersion = v
+    }
+    if cfg.MaxVersion != 0 && cfg.MinVersion > cfg.MaxVersion {
+        return nil, fmt.Errorf("min_version %s is greater than max_version %s", c.MinVersion, c.MaxVersion)
+    }
+    if c.Renegotiation != "" {
+        r, ok := tlsRenegotiation[c.Renegotiation]
+        if !ok {
+            return nil, fmt.Errorf("unknown renegotiation %q", c.Renegotiation)
+        }
+        cfg.Renegotiation = r
+    }
+    for _, name := range c.CipherSuites {
+        id, ok := cipherSuiteID(name)
+        if !ok {
+            return nil, fmt.Errorf("unknown cipher suite %q", name)
+        }
+        cfg.CipherSuites = append(cfg.CipherSuites, id)
+    }
+    for _, name := range c.CurvePreferences {
+        id, ok := tlsCurves[name]
+        if !ok {
+            return nil, fmt.Errorf("unknown curve %q", name)
+        }
+        cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+    }
+    if c.clientCert != nil {
+        cfg.Certificates = []tls.Certificate{*c.clientCert}
+    }
+    if c.Spiffe != nil && c.Spiffe.source != nil {
+        cfg.GetClientCertificate = c.Spiffe.clientCertificate
+    }
+    return cfg, nil
+}
+
+// rootCAs loads the trust anchors of CAFile and their version, nil means the system roots
+func (c *tlsConfig) rootCAs() (*x509.CertPool, string, error) {
+    switch c.TrustStore {
+    case "", trustStoreSystem, trustStoreMozilla:
+    default:
+        return nil, "", fmt.Errorf("unknown trust_store %q", c.TrustStore)
+    }
+    if c.CAFile != "" && c.TrustStore != "" {
+        return nil, "", fmt.Errorf("ca_file and trust_store are mutually exclusive")
+    }
+    if (c.CAFile != "" || c.TrustStore != "") && c.Spiffe != nil && c.Spiffe.VerifyServer {
+        return nil, "", fmt.Errorf("ca_file and trust_store can't be used with spiffe.verify_server")
+    }
+    if c.CAFile == "" {
+        return nil, "", nil
+    }
+    certs, err := readCertFile(c.CAFile)
+    if err != nil {
+        return nil, "", err
+    }
+    pool := x509.NewCertPool()
+    for _, cert := range certs {
+        pool.AddCert(cert)
+    }
+    return pool, certsVersion(certs), nil
+}
+
+// fallbackVersions returns the maximum versions to try in order, starting with the configured one
+func fallbackVersions(cfg *tls.Config) []uint16 {
+    max := cfg.MaxVersion
+    if max == 0 {
+        max = tls.VersionTLS13
+    }
+    var versions []uint16
+    for v := max; v >= cfg.MinVersion; v-- {
+        versions = append(versions, v)
+    }
+    return versions
+}
+
+// connectError wraps the errors of a probe that never got a connection to the target: failed lookups,
+// unreachable or denied addresses and proxies that didn't connect
+type connectError struct {
+    err error
+}
+
+func (e *connectError) Error() string { return e.err.Error() }
+func (e *connectError) Unwrap() error { return e.err }
+
+// isHandshakeError reports whether err happened after the TCP connection was established,
+// only then a lower protocol version can make a difference
+func isHandshakeError(err error) bool {
+    var connErr *connectError
+    var dnsErr *net.DNSError
+    var opErr *net.OpError
+    switch {
+    case errors.As(err, &connErr), errors.As(err, &dnsErr):
+        return false
+    case errors.As(err, &opErr) && opErr.Op == "dial":
+        return false
+    }
+    return true
+}
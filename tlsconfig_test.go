@@ -0,0 +1,33 @@
+package main
+
+import (
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "net"
+    "syscall"
+    "testing"
+)
+
+func TestIsHandshakeError(t *testing.T) {
+    nxdomain := &net.DNSError{Err: "no such host", Name: "gone.example.com", IsNotFound: true}
+    for _, tc := range []struct {
+        name string
+        err  error
+        want bool
+    }{
+        {"dns error", nxdomain, false},
+        {"wrapped dns error", fmt.Errorf("resolving: %w", nxdomain), false},
+        {"cached dns error", &connectError{fmt.Errorf("%w (cached until tomorrow)", nxdomain)}, false},
+        {"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, false},
+        {"denied by policy", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("address 10.0.0.1 is denied by target policy")}, false},
+        {"proxy refused", &connectError{errors.New("proxy http://proxy:3128 refused CONNECT to example.com:443: 403 Forbidden")}, false},
+        {"alert", &net.OpError{Op: "remote error", Err: errors.New("tls: protocol version not supported")}, true},
+        {"reset", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, true},
+        {"unknown authority", x509.UnknownAuthorityError{}, true},
+    } {
+        if got := isHandshakeError(tc.err); got != tc.want {
+            t.Errorf("%s: isHandshakeError(%v) = %v, want %v", tc.name, tc.err, got, tc.want)
+        }
+    }
+}
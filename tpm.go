@@ -0,0 +1,163 @@
+//go:build !windows
+
+package main
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/rsa"
+    "errors"
+    "fmt"
+    "io"
+    "sync"
+
+    "github.com/google/go-tpm/tpm2"
+    "github.com/google/go-tpm/tpm2/transport"
+    "github.com/google/go-tpm/tpm2/transport/linuxtpm"
+)
+
+// tpmDevice is an open TPM. Commands must not interleave, so they are serialized.
+type tpmDevice struct {
+    mu  sync.Mutex
+    tpm transport.TPM
+}
+
+// tpmDevices holds the open TPMs by path, shared by config reloads since /dev/tpm0 can only be opened once
+var tpmDevices = struct {
+    mu      sync.Mutex
+    devices map[string]*tpmDevice
+}{devices: make(map[string]*tpmDevice)}
+
+// openTPM opens the TPM at path
+func openTPM(path string) (*tpmDevice, error) {
+    tpmDevices.mu.Lock()
+    defer tpmDevices.mu.Unlock()
+    if dev, ok := tpmDevices.devices[path]; ok {
+        return dev, nil
+    }
+    tpm, err := linuxtpm.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    dev := &tpmDevice{tpm: tpm}
+    tpmDevices.devices[path] = dev
+    return dev, nil
+}
+
+// tpmSigner signs with a key that never leaves the TPM
+type tpmSigner struct {
+    dev    *tpmDevice
+    key    tpm2.AuthHandle
+    public crypto.PublicKey
+}
+
+// signer opens the TPM and checks that the key at the handle belongs to the client certificate's public key
+func (k *tpmKey) signer(public crypto.PublicKey) (crypto.Signer, error) {
+    if k.Handle == 0 {
+        return nil, errors.New("handle is required")
+    }
+    device := k.Device
+    if device == "" {
+        device = defaultTPMDevice
+    }
+    dev, err := openTPM(device)
+    if err != nil {
+        return nil, err
+    }
+
+    dev.mu.Lock()
+    rsp, err := tpm2.ReadPublic{ObjectHandle: tpm2.TPMHandle(k.Handle)}.Execute(dev.tpm)
+    dev.mu.Unlock()
+    if err != nil {
+        return nil, fmt.Errorf("reading key 0x%x: %v", k.Handle, err)
+    }
+    area, err := rsp.OutPublic.Contents()
+    if err != nil {
+        return nil, err
+    }
+    tpmPublic, err := tpm2.Pub(*area)
+    if err != nil {
+        return nil, err
+    }
+    if key, ok := public.(interface{ Equal(crypto.PublicKey) bool }); !ok || !key.Equal(tpmPublic) {
+        return nil, fmt.Errorf("key 0x%x doesn't match cert_file", k.Handle)
+    }
+    return &tpmSigner{
+        dev: dev,
+        key: tpm2.AuthHandle{
+            Handle: tpm2.TPMHandle(k.Handle),
+            Name:   rsp.Name,
+            Auth:   tpm2.PasswordAuth([]byte(k.Password)),
+        },
+        public: public,
+    }, nil
+}
+
+// Public returns the key of the client certificate
+func (s *tpmSigner) Public() crypto.PublicKey {
+    return s.public
+}
+
+// tpmHashes maps hash functions to their TPM algorithm IDs
+var tpmHashes = map[crypto.Hash]tpm2.TPMAlgID{
+    crypto.SHA1:   tpm2.TPMAlgSHA1,
+    crypto.SHA256: tpm2.TPMAlgSHA256,
+    crypto.SHA384: tpm2.TPMAlgSHA384,
+    crypto.SHA512: tpm2.TPMAlgSHA512,
+}
+
+// Sign signs the digest in the TPM. TLS requires RSA-PSS salts as long as the hash, some older TPMs use the
+// longest salt the key allows instead, their RSA keys only work up to TLS 1.2 without RSA-PSS.
+func (s *tpmSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+    hash, ok := tpmHashes[opts.HashFunc()]
+    if !ok {
+        return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+    }
+    var alg tpm2.TPMAlgID
+    switch s.public.(type) {
+    case *rsa.PublicKey:
+        alg = tpm2.TPMAlgRSASSA
+        if _, ok := opts.(*rsa.PSSOptions); ok {
+            alg = tpm2.TPMAlgRSAPSS
+        }
+    case *ecdsa.PublicKey:
+        alg = tpm2.TPMAlgECDSA
+    default:
+        return nil, fmt.Errorf("unsupported key type %T", s.public)
+    }
+
+    s.dev.mu.Lock()
+    rsp, err := tpm2.Sign{
+        KeyHandle: s.key,
+        Digest:    tpm2.TPM2BDigest{Buffer: digest},
+        InScheme: tpm2.TPMTSigScheme{
+            Scheme:  alg,
+            Details: tpm2.NewTPMUSigScheme(alg, &tpm2.TPMSSchemeHash{HashAlg: hash}),
+        },
+        Validation: tpm2.TPMTTKHashCheck{Tag: tpm2.TPMSTHashCheck, Hierarchy: tpm2.TPMRHNull},
+    }.Execute(s.dev.tpm)
+    s.dev.mu.Unlock()
+    if err != nil {
+        return nil, err
+    }
+
+    switch alg {
+    case tpm2.TPMAlgRSASSA:
+        sig, err := rsp.Signature.Signature.RSASSA()
+        if err != nil {
+            return nil, err
+        }
+        return sig.Sig.Buffer, nil
+    case tpm2.TPMAlgRSAPSS:
+        sig, err := rsp.Signature.Signature.RSAPSS()
+        if err != nil {
+            return nil, err
+        }
+        return sig.Sig.Buffer, nil
+    }
+    sig, err := rsp.Signature.Signature.ECDSA()
+    if err != nil {
+        return nil, err
+    }
+    return ecdsaSignature(sig.SignatureR.Buffer, sig.SignatureS.Buffer)
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+    "crypto"
+    "errors"
+)
+
+// signer fails, the TPM is only opened through the device file of Unix systems
+func (k *tpmKey) signer(public crypto.PublicKey) (crypto.Signer, error) {
+    return nil, errors.New("TPM keys are not supported on this platform")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+    "sort"
+
+    "github.com/prometheus/client_golang/prometheus"
+    dto "github.com/prometheus/client_model/go"
+    "google.golang.org/protobuf/proto"
+)
+
+// vantagePointLabel names the instance that exported a series when several instances probe the same targets
+// from different regions, so ssl_cert_leaf_fingerprint_info of different vantage points can be compared
+const vantagePointLabel = "vantage_point"
+
+// vantagePoint is the value of the vantage_point label added to every exported series, none if empty
+var vantagePoint string
+
+// vantageGatherer adds the vantage_point label to the series of a gatherer
+type vantageGatherer struct {
+    prometheus.Gatherer
+    name string
+}
+
+func (g vantageGatherer) Gather() ([]*dto.MetricFamily, error) {
+    families, err := g.Gatherer.Gather()
+    for _, family := range families {
+        for _, m := range family.Metric {
+            if hasLabel(m, vantagePointLabel) {
+                continue
+            }
+            m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(vantagePointLabel), Value: proto.String(g.name)})
+            sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+        }
+    }
+    return families, err
+}
+
+// hasLabel reports whether the metric carries the label
+func hasLabel(m *dto.Metric, name string) bool {
+    for _, l := range m.Label {
+        if l.GetName() == name {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/miekg/dns"
+)
+
+// zoneSource is a DNS zone whose A and AAAA names become targets, read from a zone file
+// or transferred from a server that allows AXFR
+type zoneSource struct {
+    Zone   string            `yaml:"zone"` // origin of the zone, required for AXFR
+    File   string            `yaml:"file"`
+    AXFR   string            `yaml:"axfr"` // host[:port] of the server to transfer the zone from
+    Port   int               `yaml:"port"` // port to probe, 443 by default
+    Module string            `yaml:"module"`
+    Labels map[string]string `yaml:"labels"` // added to every discovered target
+}
+
+// validate checks the source and fills in defaults
+func (z *zoneSource) validate() error {
+    if (z.File == "") == (z.AXFR == "") {
+        return fmt.Errorf("exactly one of file and axfr is required")
+    }
+    if z.AXFR != "" && z.Zone == "" {
+        return fmt.Errorf("zone is required for axfr")
+    }
+    if z.Port == 0 {
+        z.Port = 443
+    }
+    return nil
+}
+
+// String describes where the zone is read from
+func (z *zoneSource) String() string {
+    if z.File != "" {
+        return z.File
+    }
+    return z.Zone + " from " + z.AXFR
+}
+
+// zoneTargets returns a target for every name of the zone with an A or AAAA record.
+// Wildcards can't be probed and are skipped.
+func zoneTargets(z zoneSource) ([]target, error) {
+    var (
+        records []dns.RR
+        err     error
+    )
+    if z.File != "" {
+        records, err = readZoneFile(z.File, z.Zone)
+    } else {
+        records, err = transferZone(z.AXFR, z.Zone)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    names := make(map[string]bool)
+    for _, rr := range records {
+        switch rr.(type) {
+        case *dns.A, *dns.AAAA:
+        default:
+            continue
+        }
+        name := strings.TrimSuffix(strings.ToLower(rr.Header().Name), ".")
+        if name != "" && !strings.HasPrefix(name, "*") {
+            names[name] = true
+        }
+    }
+    sorted := make([]string, 0, len(names))
+    for name := range names {
+        sorted = append(sorted, name)
+    }
+    sort.Strings(sorted)
+
+    targets := make([]target, 0, len(sorted))
+    for _, name := range sorted {
+        domain := name
+        if z.Port != 443 {
+            domain = net.JoinHostPort(name, strconv.Itoa(z.Port))
+        }
+        t := target{Domain: domain, Module: z.Module, Labels: make(map[string]string)}
+        for k, v := range z.Labels {
+            t.Labels[k] = v
+        }
+        targets = append(targets, t)
+    }
+    return targets, nil
+}
+
+// readZoneFile parses the records of a zone file, origin applies to relative names without $ORIGIN
+func readZoneFile(path, origin string) ([]dns.RR, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    parser := dns.NewZoneParser(file, dns.Fqdn(origin), path)
+    parser.SetIncludeAllowed(true)
+    var records []dns.RR
+    for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+        records = append(records, rr)
+    }
+    if err := parser.Err(); err != nil {
+        return nil, err
+    }
+    return records, nil
+}
+
+// transferZone fetches all records of a zone with AXFR
+func transferZone(server, zone string) ([]dns.RR, error) {
+    if _, _, err := net.SplitHostPort(server); err != nil {
+        server = net.JoinHostPort(server, "53")
+    }
+    msg := new(dns.Msg)
+    msg.SetAxfr(dns.Fqdn(zone))
+    transfer := &dns.Transfer{DialTimeout: dialTimeout, ReadTimeout: dialTimeout}
+    envelopes, err := transfer.In(msg, server)
+    if err != nil {
+        return nil, err
+    }
+    var records []dns.RR
+    for env := range envelopes {
+        if env.Error != nil {
+            return nil, fmt.Errorf("transfer of %s from %s: %v", zone, server, env.Error)
+        }
+        records = append(records, env.RR...)
+    }
+    return records, nil
+}